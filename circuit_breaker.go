@@ -0,0 +1,253 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// ErrCircuitOpen is returned instead of sending a message to a peer whose circuit breaker is open, see CircuitBreaker.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState is the state of the circuit breaker of a peer, see CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets messages through to the peer.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails every message to the peer without sending it.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe through to the peer, which decides whether the circuit closes or opens again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// peerCircuit is the circuit breaker of a single peer.
+type peerCircuit struct {
+	state CircuitState
+	// the outcomes of the last messages sent while closed, true for failures
+	outcomes []bool
+	next     int
+	failures int
+	// when the circuit last opened
+	openedAt time.Time
+	// set while the probe of a half-open circuit is in flight
+	probing bool
+	// when the outcome of a message to the peer was last recorded
+	last time.Time
+}
+
+// circuitGCThreshold is the number of circuits past which those left idle are
+// pruned whenever another one is added, so that the peers we stop sending to
+// don't accumulate.
+const circuitGCThreshold = 128
+
+// circuitBreaker stops sending through the wrapped MessageSender to the peers
+// too many messages failed to, and lets a probe through once in a while to find
+// out whether they recovered.
+type circuitBreaker struct {
+	pb.MessageSender
+
+	errorRate float64
+	window    int
+	cooldown  time.Duration
+
+	lk       sync.Mutex
+	circuits map[peer.ID]*peerCircuit
+}
+
+func newCircuitBreaker(sender pb.MessageSender, errorRate float64, window int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		MessageSender: sender,
+		errorRate:     errorRate,
+		window:        window,
+		cooldown:      cooldown,
+		circuits:      make(map[peer.ID]*peerCircuit),
+	}
+}
+
+func (b *circuitBreaker) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	probe, err := b.allow(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.MessageSender.SendRequest(ctx, p, pmes)
+	b.done(ctx, p, probe, err)
+	return resp, err
+}
+
+func (b *circuitBreaker) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	probe, err := b.allow(p)
+	if err != nil {
+		return err
+	}
+	err = b.MessageSender.SendMessage(ctx, p, pmes)
+	b.done(ctx, p, probe, err)
+	return err
+}
+
+func (b *circuitBreaker) SendMessageBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) error {
+	probe, err := b.allow(p)
+	if err != nil {
+		return err
+	}
+	err = pb.SendMessageBatch(ctx, b.MessageSender, p, pmess)
+	b.done(ctx, p, probe, err)
+	return err
+}
+
+// allow reports whether a message may be sent to p, and whether it's the probe
+// of a half-open circuit.
+func (b *circuitBreaker) allow(p peer.ID) (probe bool, err error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	c, ok := b.circuits[p]
+	if !ok {
+		return false, nil
+	}
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < b.cooldown {
+			return false, ErrCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		fallthrough
+	case CircuitHalfOpen:
+		if c.probing {
+			return false, ErrCircuitOpen
+		}
+		c.probing = true
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// done records the outcome of a message sent to p.
+func (b *circuitBreaker) done(ctx context.Context, p peer.ID, probe bool, err error) {
+	if err != nil && ctx.Err() != nil {
+		// We gave up on the message, that's not the peer's fault. A probe cut
+		// short needs to be retried though.
+		if probe {
+			b.lk.Lock()
+			if c, ok := b.circuits[p]; ok {
+				c.probing = false
+			}
+			b.lk.Unlock()
+		}
+		return
+	}
+
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	c, ok := b.circuits[p]
+	if probe {
+		if !ok {
+			return
+		}
+		if err == nil {
+			// The peer recovered, start over with a clean record.
+			delete(b.circuits, p)
+			return
+		}
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+		c.last = c.openedAt
+		c.probing = false
+		return
+	}
+
+	if !ok {
+		if err == nil {
+			return
+		}
+		b.gc()
+		c = &peerCircuit{outcomes: make([]bool, 0, b.window)}
+		b.circuits[p] = c
+	}
+	if c.state != CircuitClosed {
+		return
+	}
+	c.last = time.Now()
+	if len(c.outcomes) < b.window {
+		c.outcomes = append(c.outcomes, err != nil)
+	} else {
+		if c.outcomes[c.next] {
+			c.failures--
+		}
+		c.outcomes[c.next] = err != nil
+		c.next = (c.next + 1) % b.window
+	}
+	if err != nil {
+		c.failures++
+	}
+
+	switch {
+	case len(c.outcomes) == b.window && float64(c.failures) >= b.errorRate*float64(b.window):
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+		c.outcomes, c.next, c.failures = c.outcomes[:0], 0, 0
+	case c.failures == 0:
+		// Nothing worth remembering about p.
+		delete(b.circuits, p)
+	}
+}
+
+// gc forgets the circuits of the peers nothing was sent to for twice the
+// cooldown, which then start over with a closed circuit. Open circuits are thus
+// kept for at least a cooldown past the point they'd let a probe through. It
+// must be called with lk held.
+func (b *circuitBreaker) gc() {
+	if len(b.circuits) < circuitGCThreshold {
+		return
+	}
+	now := time.Now()
+	for p, c := range b.circuits {
+		if !c.probing && now.Sub(c.last) >= 2*b.cooldown {
+			delete(b.circuits, p)
+		}
+	}
+}
+
+// state returns the state of the circuit breaker of p.
+func (b *circuitBreaker) state(p peer.ID) CircuitState {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	c, ok := b.circuits[p]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// CircuitState returns the state of the circuit breaker of p. It's always CircuitClosed unless the CircuitBreaker option
+// is set.
+func (dht *IpfsDHT) CircuitState(p peer.ID) CircuitState {
+	if dht.breaker == nil {
+		return CircuitClosed
+	}
+	return dht.breaker.state(p)
+}
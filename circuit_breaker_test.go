@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+var errPeerDown = errors.New("peer down")
+
+// flakySender echoes every request, or fails it while failing is set, and
+// counts the messages that got through to it.
+type flakySender struct {
+	failing int32
+	sent    int32
+}
+
+func (s *flakySender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	atomic.AddInt32(&s.sent, 1)
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return nil, errPeerDown
+	}
+	return pmes, nil
+}
+
+func (s *flakySender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	atomic.AddInt32(&s.sent, 1)
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return errPeerDown
+	}
+	return nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := mocknet.New(ctx).GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &flakySender{failing: 1}
+	const cooldown = 100 * time.Millisecond
+	d, err := New(ctx, h, testPrefix, DisableAutoRefresh(), CircuitBreaker(0.5, 4, cooldown),
+		CustomMessageSender(func(host.Host, []protocol.ID) pb.MessageSender { return sender }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two failures out of the last four messages open the circuit.
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			atomic.StoreInt32(&sender.failing, 0)
+		}
+		if st := d.CircuitState(p); st != CircuitClosed {
+			t.Fatalf("expected the circuit to be closed after %d messages, got %s", i, st)
+		}
+		_ = d.protoMessenger.Ping(ctx, p)
+	}
+	if st := d.CircuitState(p); st != CircuitOpen {
+		t.Fatalf("expected the circuit to be open, got %s", st)
+	}
+
+	// Requests and messages fail fast, without being sent, until the cooldown passes.
+	atomic.StoreInt32(&sender.failing, 1)
+	if err := d.protoMessenger.Ping(ctx, p); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the request to fail fast, got %v", err)
+	}
+	if err := d.protoMessenger.PutProvider(ctx, p, []byte("key"), h); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the message to fail fast, got %v", err)
+	}
+	if n := atomic.LoadInt32(&sender.sent); n != 4 {
+		t.Fatalf("expected nothing to be sent while the circuit is open, got %d messages", n)
+	}
+
+	// A failed probe opens the circuit for another cooldown.
+	time.Sleep(cooldown)
+	if st := d.CircuitState(p); st != CircuitHalfOpen {
+		t.Fatalf("expected the circuit to be half-open, got %s", st)
+	}
+	if err := d.protoMessenger.Ping(ctx, p); !errors.Is(err, errPeerDown) {
+		t.Fatalf("expected the probe to go through and fail, got %v", err)
+	}
+	if err := d.protoMessenger.Ping(ctx, p); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the request after a failed probe to fail fast, got %v", err)
+	}
+
+	// A successful probe closes it.
+	atomic.StoreInt32(&sender.failing, 0)
+	time.Sleep(cooldown)
+	if err := d.protoMessenger.Ping(ctx, p); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if st := d.CircuitState(p); st != CircuitClosed {
+		t.Fatalf("expected the circuit to be closed, got %s", st)
+	}
+	if err := d.protoMessenger.Ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCircuitBreakerForgetsIdlePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const cooldown = 10 * time.Millisecond
+	b := newCircuitBreaker(&flakySender{failing: 1}, 0.5, 4, cooldown)
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+	for i := 0; i < circuitGCThreshold; i++ {
+		p, err := test.RandPeerID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = b.SendMessage(ctx, p, ping)
+	}
+	if n := len(b.circuits); n != circuitGCThreshold {
+		t.Fatalf("expected a circuit per failing peer, got %d", n)
+	}
+
+	// Once idle for long enough, the circuits are dropped as others are added.
+	time.Sleep(2 * cooldown)
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = b.SendMessage(ctx, p, ping)
+	if n := len(b.circuits); n != 1 {
+		t.Fatalf("expected the idle circuits to be forgotten, got %d circuits", n)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"runtime"
 	"sync"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -34,7 +36,9 @@ import (
 	goprocessctx "github.com/jbenet/goprocess/context"
 	"github.com/multiformats/go-base32"
 	ma "github.com/multiformats/go-multiaddr"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 )
 
@@ -43,6 +47,9 @@ var (
 	baseLogger = logger.Desugar()
 
 	rtFreezeTimeout = 1 * time.Minute
+
+	// streamDrainTimeout bounds how long Close waits for pooled streams to be closed gracefully.
+	streamDrainTimeout = 1 * time.Second
 )
 
 const (
@@ -84,6 +91,11 @@ type IpfsDHT struct {
 	datastore ds.Datastore // Local data
 
 	routingTable *kb.RoutingTable // Array of routing tables for differently distanced nodes
+
+	// the DHT protocol each routing table peer supported when it was added
+	rtProtocolsLk     sync.Mutex
+	rtPeerProtocols   map[peer.ID]protocol.ID
+	rtProtocolsCounts map[protocol.ID]int
 	// ProviderManager stores & manages the provider records for this Dht peer.
 	ProviderManager *providers.ProviderManager
 
@@ -99,6 +111,8 @@ type IpfsDHT struct {
 
 	protoMessenger *pb.ProtocolMessenger
 	msgSender      pb.MessageSender
+	requests       *requestTracker
+	breaker        *circuitBreaker // nil unless the CircuitBreaker option is set
 
 	plk sync.Mutex
 
@@ -120,9 +134,20 @@ type IpfsDHT struct {
 	alpha      int // The concurrency parameter per path
 	beta       int // The number of peers closest to a target that must have responded for a query path to terminate
 
+	// the most closest peers returned in response to FIND_NODE, never more than bucketSize
+	maxClosestPeers int
+
+	// when set, queries prefer the peers with the lowest recorded latency, see LatencyAwareRouting
+	latencyAwareRouting bool
+
 	queryPeerFilter        QueryFilterFunc
 	routingTablePeerFilter RouteTableFilterFunc
-	rtPeerDiversityFilter  peerdiversity.PeerIPGroupFilter
+	inboundMessageFilter   InboundMessageFilterFunc
+	addressFilter          AddressFilterFunc
+
+	// metricsLabelTransformer rewrites the value of every metric tag the DHT sets, nil means identity
+	metricsLabelTransformer func(key tag.Key, value string) string
+	rtPeerDiversityFilter   peerdiversity.PeerIPGroupFilter
 
 	autoRefresh bool
 
@@ -133,6 +158,72 @@ type IpfsDHT struct {
 
 	maxRecordAge time.Duration
 
+	// how long an inbound stream may stay idle waiting for the next message
+	inboundReadTimeout time.Duration
+	// how long writing responses to an inbound stream may take, 0 means forever
+	inboundWriteTimeout time.Duration
+	inboundStreams      *inboundStreamLimiter
+	inboundRate         *inboundRateLimiter
+	connectionGater     connmgr.ConnectionGater
+
+	// logs the handling of inbound streams
+	log *zap.Logger
+	// tells this DHT apart from others in the same process, in logs and metrics
+	instanceID      string
+	handlerTimeouts map[pb.Message_MessageType]time.Duration
+	messageHandlers map[pb.Message_MessageType]MessageHandlerFunc
+	disabledTypes   map[pb.Message_MessageType]struct{}
+	maxMessageSize  int
+
+	// the size of the buffer responses are written through, 0 means the default
+	writeBufferSize int
+	// encodes the messages exchanged over DHT streams, nil means protobuf
+	codec pb.MessageCodec
+
+	// how many requests pipelined on a stream are handled at once, 0 or 1 means one after the other
+	handlerWorkers int
+
+	// the totals of the messages sent and received, see MetricsSnapshot
+	traffic trafficCounter
+
+	// lets the handlers of inbound requests run, taking turns between peers, nil means without limit
+	handlerScheduler *fairScheduler
+
+	// the response bytes written but not flushed yet across inbound streams, accessed atomically
+	bufferedResponseBytes int64
+
+	// how many requests read off a stream may await their response being flushed, see MaxOutstandingResponses
+	maxOutstandingResponses int
+
+	// when set, inbound messages whose sequence number skips or repeats are counted, see SequenceNumbers
+	sequenceNumbers bool
+
+	// responses are flagged to slow down when handling took longer than this
+	// or at least this many inbound streams are open, 0 disables either check
+	slowDownHandlingTime time.Duration
+	slowDownStreams      int
+
+	// requests whose handling and response took longer than this are logged as warnings, 0 disables it
+	slowHandlerThreshold time.Duration
+
+	// when set, peers messaging us aren't added to the routing table, see AutoRoutingTableUpdate
+	disableAutoRTUpdate bool
+
+	// when set, requests of some types are only handled with a token, see ResponseTokens
+	responseTokens *responseTokens
+
+	// picks the inbound messages counted in the received messages and bytes views, see MetricsSampling
+	inboundSampler *net.MessageSampler
+
+	// fraction by which periodic maintenance intervals are randomly stretched or shrunk
+	maintenanceJitter float64
+
+	// when set, a span is started for every inbound request handled
+	traceSampler trace.Sampler
+
+	// measures request latencies, only ever replaced by tests
+	clock internal.Clock
+
 	// Allows disabling dht subsystems. These should _only_ be set on
 	// "forked" DHTs (e.g., DHTs with custom protocols and/or private
 	// networks).
@@ -185,13 +276,107 @@ func New(ctx context.Context, h host.Host, options ...Option) (*IpfsDHT, error)
 	dht.autoRefresh = cfg.RoutingTable.AutoRefresh
 
 	dht.maxRecordAge = cfg.MaxRecordAge
+	dht.inboundReadTimeout = cfg.InboundReadTimeout
+	dht.inboundWriteTimeout = cfg.InboundWriteTimeout
+	dht.inboundStreams = newInboundStreamLimiter(cfg.MaxInboundStreams, cfg.MaxInboundStreamsPerPeer)
+	dht.inboundRate = newInboundRateLimiter(cfg.InboundRateLimit, cfg.InboundRateBurst)
+	dht.connectionGater = cfg.ConnectionGater
+	dht.log = baseLogger
+	if cfg.Logger != nil {
+		dht.log = cfg.Logger
+	}
+	dht.log = dht.log.With(zap.String("instance", dht.instanceID))
+	dht.handlerTimeouts = cfg.HandlerTimeouts
+	dht.messageHandlers = cfg.MessageHandlers
+	dht.disabledTypes = cfg.DisabledMessageTypes
+	dht.maxMessageSize = cfg.MaxMessageSize
+	dht.writeBufferSize = cfg.WriteBufferSize
+	dht.handlerWorkers = cfg.HandlerWorkers
+	if cfg.FairScheduling {
+		dht.handlerScheduler = newFairScheduler(runtime.GOMAXPROCS(0))
+	}
+	dht.maxOutstandingResponses = cfg.MaxOutstandingResponses
+	dht.sequenceNumbers = cfg.SequenceNumbers
+	dht.slowDownHandlingTime = cfg.SlowDownHandlingTime
+	dht.slowDownStreams = cfg.SlowDownInboundStreams
+	dht.slowHandlerThreshold = cfg.SlowHandlerThreshold
+	if cfg.MaxClosestPeers > 0 && cfg.MaxClosestPeers < cfg.BucketSize {
+		dht.maxClosestPeers = cfg.MaxClosestPeers
+	}
+	dht.disableAutoRTUpdate = cfg.DisableAutoRTUpdate
+	dht.inboundSampler = net.NewMessageSampler(cfg.MetricsSampling)
+	if len(cfg.ResponseTokenTypes) > 0 {
+		if dht.responseTokens, err = newResponseTokens(cfg.ResponseTokenTypes); err != nil {
+			return nil, err
+		}
+	}
+	dht.codec = cfg.Codec
+	dht.maintenanceJitter = cfg.MaintenanceJitter
+	dht.traceSampler = cfg.TraceSampler
+	dht.clock = internal.RealClock
 	dht.enableProviders = cfg.EnableProviders
 	dht.enableValues = cfg.EnableValues
 	dht.disableFixLowPeers = cfg.DisableFixLowPeers
 
 	dht.Validator = cfg.Validator
-	dht.msgSender = net.NewMessageSenderImpl(h, dht.protocols)
-	dht.protoMessenger, err = pb.NewProtocolMessenger(dht.msgSender, pb.WithValidator(dht.Validator))
+	if cfg.MsgSenderBuilder != nil {
+		dht.msgSender = cfg.MsgSenderBuilder(h, dht.protocols)
+	} else {
+		latencyRecorder, trackLatency := cfg.LatencyRecorder, !cfg.DisableLatencyTracking
+		if cfg.OnLatencySample != nil {
+			// The round trip times are measured for the samples even if they
+			// aren't recorded.
+			o := &latencyObserver{onSample: cfg.OnLatencySample}
+			if trackLatency {
+				o.recorder = latencyRecorder
+				if o.recorder == nil {
+					o.recorder = h.Peerstore()
+				}
+			}
+			latencyRecorder, trackLatency = o, true
+		}
+		dht.msgSender = net.NewMessageSenderImpl(h, dht.protocols,
+			net.WithMaxMessageSize(dht.maxMessageSize),
+			net.WithStreamBackoff(cfg.StreamBackoffBase, cfg.StreamBackoffMax),
+			net.WithDialTimeout(cfg.DialTimeout),
+			net.WithLatencyTracking(trackLatency),
+			net.WithLatencyRecorder(latencyRecorder),
+			net.WithConnectionHints(cfg.PreferFastConnections),
+			net.WithCodec(cfg.Codec),
+			net.WithMetrics(!cfg.DisableOutboundMetrics),
+			net.WithMetricsSampling(cfg.MetricsSampling),
+			net.WithStreamPoolIdleTimeout(cfg.StreamPoolIdleTimeout),
+			net.WithStreamPoolMaxIdlePerPeer(cfg.StreamPoolMaxIdlePerPeer),
+			net.WithConnectionPruning(cfg.ConnectionPruneTimeout),
+			net.WithAdaptiveStreamPool(cfg.StreamPoolMinRate, cfg.StreamPoolRateWindow),
+			net.WithMessageCoalescing(cfg.MessageCoalescingDelay),
+			net.WithTraceSampler(cfg.TraceSampler),
+			net.WithCompression(cfg.EnableCompression),
+			net.WithChecksums(cfg.EnableChecksums),
+			net.WithSequenceNumbers(cfg.SequenceNumbers),
+			net.WithRequestRetries(cfg.RequestRetries),
+			net.WithClock(dht.clock),
+			net.WithLateReplyHandler(cfg.OnLateReply),
+			net.WithOutboundMessageHook(cfg.OutboundMessageHook),
+			net.WithInstanceID(dht.instanceID),
+			net.WithMetricTags(
+				dht.upsertTag(metrics.KeyPeerID, dht.self.Pretty()),
+				dht.upsertTag(metrics.KeyInstanceID, dht.instanceID),
+			),
+		)
+	}
+	var sender pb.MessageSender = &countingSender{MessageSender: &drainingSender{dht.msgSender}, traffic: &dht.traffic}
+	if cfg.CircuitBreakerWindow > 0 {
+		dht.breaker = newCircuitBreaker(sender, cfg.CircuitBreakerErrorRate, cfg.CircuitBreakerWindow, cfg.CircuitBreakerCooldown)
+		sender = dht.breaker
+	}
+	dht.requests = newRequestTracker(sender)
+	sender = dht.requests
+	dht.protoMessenger, err = pb.NewProtocolMessenger(sender,
+		pb.WithValidator(dht.Validator),
+		pb.WithSlowDownHandler(cfg.OnSlowDown),
+		pb.WithMismatchedReplyHandler(dht.recordMismatchedReply),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -274,6 +459,12 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 
 	protocols = []protocol.ID{v1proto}
 	serverProtocols = []protocol.ID{v1proto}
+	if cfg.EnableCompression {
+		serverProtocols = append(serverProtocols, net.CompressedProtocol(v1proto))
+	}
+	if cfg.EnableChecksums {
+		serverProtocols = append(serverProtocols, net.ChecksummedProtocol(v1proto))
+	}
 
 	dht := &IpfsDHT{
 		datastore:              cfg.Datastore,
@@ -288,15 +479,28 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 		bucketSize:             cfg.BucketSize,
 		alpha:                  cfg.Concurrency,
 		beta:                   cfg.Resiliency,
+		maxClosestPeers:        cfg.BucketSize,
+		latencyAwareRouting:    cfg.LatencyAwareRouting,
 		queryPeerFilter:        cfg.QueryPeerFilter,
 		routingTablePeerFilter: cfg.RoutingTable.PeerFilter,
-		rtPeerDiversityFilter:  cfg.RoutingTable.DiversityFilter,
+		inboundMessageFilter:   cfg.InboundMessageFilter,
+		addressFilter:          cfg.AddressFilter,
+
+		metricsLabelTransformer: cfg.MetricsLabelTransformer,
+		rtPeerDiversityFilter:   cfg.RoutingTable.DiversityFilter,
+
+		rtPeerProtocols:   make(map[peer.ID]protocol.ID),
+		rtProtocolsCounts: make(map[protocol.ID]int),
 
 		fixLowPeersChan: make(chan struct{}, 1),
 
 		addPeerToRTChan:   make(chan addPeerRTReq),
 		refreshFinishedCh: make(chan struct{}),
 	}
+	dht.instanceID = cfg.InstanceID
+	if dht.instanceID == "" {
+		dht.instanceID = fmt.Sprintf("%p", dht)
+	}
 
 	var maxLastSuccessfulOutboundThreshold time.Duration
 
@@ -334,7 +538,7 @@ func makeDHT(ctx context.Context, h host.Host, cfg dhtcfg.Config) (*IpfsDHT, err
 	})
 
 	// create a tagged context derived from the original context
-	ctxTags := dht.newContextWithLocalTags(ctx)
+	ctxTags := withInstanceID(dht.newContextWithLocalTags(ctx), dht.instanceID)
 	// the DHT context should be done when the process is closed
 	dht.ctx = goprocessctx.WithProcessClosing(ctxTags, dht.proc)
 
@@ -367,7 +571,8 @@ func makeRtRefreshManager(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutb
 		cfg.RoutingTable.RefreshQueryTimeout,
 		cfg.RoutingTable.RefreshInterval,
 		maxLastSuccessfulOutboundThreshold,
-		dht.refreshFinishedCh)
+		dht.refreshFinishedCh,
+		rtrefresh.RefreshJitter(cfg.MaintenanceJitter))
 
 	return r, err
 }
@@ -393,18 +598,24 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 	}
 
 	cmgr := dht.host.ConnManager()
+	tag := rtTag(dht.protocols[0])
+	changes := newRTChangeNotifier(cfg.OnRoutingTableChanged)
 
 	rt.PeerAdded = func(p peer.ID) {
 		commonPrefixLen := kb.CommonPrefixLen(dht.selfKey, kb.ConvertPeerID(p))
 		if commonPrefixLen < protectedBuckets {
-			cmgr.Protect(p, kbucketTag)
+			cmgr.Protect(p, tag)
 		} else {
-			cmgr.TagPeer(p, kbucketTag, baseConnMgrScore)
+			cmgr.TagPeer(p, tag, baseConnMgrScore)
 		}
+		dht.recordRTPeerProtocol(p)
+		changes.peerAdded(p)
 	}
 	rt.PeerRemoved = func(p peer.ID) {
-		cmgr.Unprotect(p, kbucketTag)
-		cmgr.UntagPeer(p, kbucketTag)
+		cmgr.Unprotect(p, tag)
+		cmgr.UntagPeer(p, tag)
+		dht.forgetRTPeerProtocol(p)
+		changes.peerRemoved(p)
 
 		// try to fix the RT
 		dht.fixRTIfNeeded()
@@ -413,6 +624,60 @@ func makeRoutingTable(dht *IpfsDHT, cfg dhtcfg.Config, maxLastSuccessfulOutbound
 	return rt, err
 }
 
+// rtTag returns the tag the peers in the routing table of a DHT speaking proto are tagged and protected with in the
+// connection manager. DHTs speaking different protocols may share a host, a peer leaving the routing table of one
+// of them must stay tagged for the others.
+func rtTag(proto protocol.ID) string {
+	if proto == ProtocolDHT {
+		return kbucketTag
+	}
+	return kbucketTag + "-" + string(proto)
+}
+
+// recordRTPeerProtocol remembers which of our DHT protocols a peer that was just added to the routing table supports.
+func (dht *IpfsDHT) recordRTPeerProtocol(p peer.ID) {
+	proto, err := dht.peerstore.FirstSupportedProtocol(p, dht.protocolsStrs...)
+	if err != nil || proto == "" {
+		return
+	}
+
+	dht.rtProtocolsLk.Lock()
+	defer dht.rtProtocolsLk.Unlock()
+	if _, ok := dht.rtPeerProtocols[p]; ok {
+		return
+	}
+	dht.rtPeerProtocols[p] = protocol.ID(proto)
+	dht.rtProtocolsCounts[protocol.ID(proto)]++
+	dht.recordRTProtocolCount(protocol.ID(proto))
+}
+
+func (dht *IpfsDHT) forgetRTPeerProtocol(p peer.ID) {
+	dht.rtProtocolsLk.Lock()
+	defer dht.rtProtocolsLk.Unlock()
+	proto, ok := dht.rtPeerProtocols[p]
+	if !ok {
+		return
+	}
+	delete(dht.rtPeerProtocols, p)
+	dht.rtProtocolsCounts[proto]--
+	dht.recordRTProtocolCount(proto)
+}
+
+// recordRTProtocolCount must be called with rtProtocolsLk held.
+func (dht *IpfsDHT) recordRTProtocolCount(proto protocol.ID) {
+	ctx, _ := tag.New(dht.ctx, dht.upsertTag(metrics.KeyProtocol, string(proto)))
+	stats.Record(ctx, metrics.RoutingTablePeers.M(int64(dht.rtProtocolsCounts[proto])))
+}
+
+// DHTProtocolForPeer returns the DHT protocol a routing table peer supported when it was added to the routing table.
+// It returns false if the peer isn't in the routing table.
+func (dht *IpfsDHT) DHTProtocolForPeer(p peer.ID) (protocol.ID, bool) {
+	dht.rtProtocolsLk.Lock()
+	defer dht.rtProtocolsLk.Unlock()
+	proto, ok := dht.rtPeerProtocols[p]
+	return proto, ok
+}
+
 // GetRoutingTableDiversityStats returns the diversity stats for the Routing Table.
 func (dht *IpfsDHT) GetRoutingTableDiversityStats() []peerdiversity.CplDiversityStats {
 	return dht.routingTable.GetDiversityStats()
@@ -441,13 +706,14 @@ func (dht *IpfsDHT) populatePeers(_ goprocess.Process) {
 
 // fixLowPeersRouting manages simultaneous requests to fixLowPeers
 func (dht *IpfsDHT) fixLowPeersRoutine(proc goprocess.Process) {
-	ticker := time.NewTicker(periodicBootstrapInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(internal.Jitter(periodicBootstrapInterval, dht.maintenanceJitter))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-dht.fixLowPeersChan:
-		case <-ticker.C:
+		case <-timer.C:
+			timer.Reset(internal.Jitter(periodicBootstrapInterval, dht.maintenanceJitter))
 		case <-proc.Closing():
 			return
 		}
@@ -751,6 +1017,7 @@ func (dht *IpfsDHT) moveToClientMode() error {
 			if pset[s.Protocol()] {
 				if s.Stat().Direction == network.DirInbound {
 					_ = s.Reset()
+					dht.recordStreamReset("shutdown")
 				}
 			}
 		}
@@ -779,11 +1046,90 @@ func (dht *IpfsDHT) RoutingTable() *kb.RoutingTable {
 	return dht.routingTable
 }
 
-// Close calls Process Close.
+type drainer interface {
+	Drain(ctx context.Context)
+}
+
+// Close gracefully closes the outbound streams the DHT keeps open, then calls Process Close.
 func (dht *IpfsDHT) Close() error {
+	if d, ok := dht.msgSender.(drainer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), streamDrainTimeout)
+		d.Drain(ctx)
+		cancel()
+	}
 	return dht.proc.Close()
 }
 
+type streamKeeper interface {
+	SendRequestKeepStream(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, *net.HeldStream, error)
+}
+
+// sendRequestKeepStream sends req to p, and hands the stream it was sent on to the caller instead of putting it back in
+// the pool, so that follow-up requests to p go over it directly with the returned stream's SendRequest.
+//
+// On success the caller owns the stream: the pool has none to p in the meantime, and only gets it back through Put,
+// which the caller must call exactly once when done with it, even if a follow-up request failed. On error there is no
+// stream to give back. Requests on held streams bypass the DHT's traffic counters, see net.HeldStream.
+func (dht *IpfsDHT) sendRequestKeepStream(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, *net.HeldStream, error) {
+	k, ok := dht.msgSender.(streamKeeper)
+	if !ok {
+		return nil, nil, fmt.Errorf("message sender can't hand out streams")
+	}
+	return k.SendRequestKeepStream(ctx, p, req)
+}
+
+type streamWarmer interface {
+	WarmStreams(ctx context.Context, peers []peer.ID) map[peer.ID]error
+}
+
+// warmStreams opens streams to peers in the background, if the message sender supports it, so that the requests sent
+// to them next don't have to wait for a dial. Peers no stream could be opened to are only logged: their requests open
+// one as usual.
+func (dht *IpfsDHT) warmStreams(ctx context.Context, peers []peer.ID) {
+	w, ok := dht.msgSender.(streamWarmer)
+	if !ok || len(peers) == 0 {
+		return
+	}
+	go func() {
+		for p, err := range w.WarmStreams(ctx, peers) {
+			if c := dht.log.Check(zap.DebugLevel, "failed to warm stream"); c != nil {
+				c.Write(zap.String("peer", p.String()), zap.Error(err))
+			}
+		}
+	}()
+}
+
+type peerCloser interface {
+	ClosePeer(p peer.ID)
+}
+
+// DisconnectPeer immediately resets every DHT stream to and from p, e.g. once p is found to misbehave. Requests in
+// flight to p fail. The connection to p is left open, so p can still be reached over other protocols, and over new
+// DHT streams.
+func (dht *IpfsDHT) DisconnectPeer(p peer.ID) {
+	if c, ok := dht.msgSender.(peerCloser); ok {
+		c.ClosePeer(p)
+	}
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		for _, s := range c.GetStreams() {
+			if s.Stat().Direction == network.DirInbound && dht.servesProtocol(s.Protocol()) {
+				_ = s.Reset()
+				dht.recordStreamReset("disconnect")
+			}
+		}
+	}
+}
+
+// servesProtocol reports whether proto is one of the protocols the DHT answers requests on.
+func (dht *IpfsDHT) servesProtocol(proto protocol.ID) bool {
+	for _, p := range dht.serverProtocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
 func mkDsKey(s string) ds.Key {
 	return ds.NewKey(base32.RawStdEncoding.EncodeToString([]byte(s)))
 }
@@ -808,14 +1154,38 @@ func (dht *IpfsDHT) Ping(ctx context.Context, p peer.ID) error {
 	return dht.protoMessenger.Ping(ctx, p)
 }
 
+// Probe checks that the passed peer is alive and returns the round trip time, without the peer adding us to its
+// routing table as it does for a ping.
+func (dht *IpfsDHT) Probe(ctx context.Context, p peer.ID) (time.Duration, error) {
+	return dht.protoMessenger.Probe(ctx, p)
+}
+
+type instanceIDKey struct{}
+
+func withInstanceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, instanceIDKey{}, id)
+}
+
+// InstanceIDFromContext returns the instance id of the DHT a context was derived from, see InstanceID. It is set in
+// the context passed to every message handler.
+func InstanceIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(instanceIDKey{}).(string)
+	return id, ok
+}
+
+// InstanceID returns the id telling this DHT apart from others in the same process, see the InstanceID option.
+func (dht *IpfsDHT) InstanceID() string {
+	return dht.instanceID
+}
+
 // newContextWithLocalTags returns a new context.Context with the InstanceID and
 // PeerID keys populated. It will also take any extra tags that need adding to
 // the context as tag.Mutators.
 func (dht *IpfsDHT) newContextWithLocalTags(ctx context.Context, extraTags ...tag.Mutator) context.Context {
 	extraTags = append(
 		extraTags,
-		tag.Upsert(metrics.KeyPeerID, dht.self.Pretty()),
-		tag.Upsert(metrics.KeyInstanceID, fmt.Sprintf("%p", dht)),
+		dht.upsertTag(metrics.KeyPeerID, dht.self.Pretty()),
+		dht.upsertTag(metrics.KeyInstanceID, dht.instanceID),
 	)
 	ctx, _ = tag.New(
 		ctx,
@@ -824,6 +1194,14 @@ func (dht *IpfsDHT) newContextWithLocalTags(ctx context.Context, extraTags ...ta
 	return ctx
 }
 
+// upsertTag is like tag.Upsert, but passes the value through the configured metrics label transformer first.
+func (dht *IpfsDHT) upsertTag(key tag.Key, value string) tag.Mutator {
+	if dht.metricsLabelTransformer != nil {
+		value = dht.metricsLabelTransformer(key, value)
+	}
+	return tag.Upsert(key, value)
+}
+
 func (dht *IpfsDHT) maybeAddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
 	// Don't add addresses for self or our connected peers. We have better ones.
 	if p == dht.self || dht.host.Network().Connectedness(p) == network.Connected {
@@ -26,6 +26,13 @@ type QueryFilterFunc = dhtcfg.QueryFilterFunc
 // the local route table.
 type RouteTableFilterFunc = dhtcfg.RouteTableFilterFunc
 
+// InboundMessageFilterFunc is a filter applied to every inbound message before it is dispatched to a handler.
+// Returning an error rejects the message.
+type InboundMessageFilterFunc = dhtcfg.InboundMessageFilterFunc
+
+// AddressFilterFunc is a filter applied to the addresses a peer announces for itself before they are stored.
+type AddressFilterFunc = dhtcfg.AddressFilterFunc
+
 var publicCIDR6 = "2000::/3"
 var public6 *net.IPNet
 
@@ -76,6 +83,19 @@ func PublicQueryFilter(_ interface{}, ai peer.AddrInfo) bool {
 	return hasPublicAddr
 }
 
+// PublicAddressFilter keeps the public addresses, dropping relay addresses as well as private and loopback ones.
+func PublicAddressFilter(_ peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	var public []ma.Multiaddr
+	for _, a := range addrs {
+		if !isRelayAddr(a) && isPublicAddr(a) {
+			public = append(public, a)
+		}
+	}
+	return public
+}
+
+var _ AddressFilterFunc = PublicAddressFilter
+
 type hasHost interface {
 	Host() host.Host
 }
@@ -1,28 +1,336 @@
 package dht
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"io"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/mux"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 
-	"github.com/libp2p/go-msgio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"go.uber.org/zap"
 )
 
-var dhtStreamIdleTimeout = 1 * time.Minute
-
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = net.ErrReadTimeout
 
+// ErrWriteTimeout is an error that occurs when a response isn't written within the timeout period.
+var ErrWriteTimeout = errors.New("timed out writing response")
+
+// ErrHandlerPanic is an error that occurs when the handler of an inbound message panics.
+var ErrHandlerPanic = errors.New("message handler panicked")
+
+// errUnexpectedAck is returned when a requester acknowledges a batch of a
+// streamed response with something other than an acknowledgment.
+var errUnexpectedAck = errors.New("unexpected acknowledgment of streamed response")
+
+// isStreamReset reports whether err (or any error it wraps) signals that the
+// stream was reset, whichever muxer carries it: the muxer transports of libp2p
+// report resets as mux.ErrReset.
+func isStreamReset(err error) bool {
+	return errors.Is(err, mux.ErrReset)
+}
+
+// inboundStreamLimiter bounds the number of inbound streams handled concurrently,
+// both in total and per remote peer. A limit of 0 means unlimited.
+type inboundStreamLimiter struct {
+	maxTotal, maxPerPeer int
+
+	lk      sync.Mutex
+	total   int
+	perPeer map[peer.ID]int
+}
+
+func newInboundStreamLimiter(maxTotal, maxPerPeer int) *inboundStreamLimiter {
+	return &inboundStreamLimiter{
+		maxTotal:   maxTotal,
+		maxPerPeer: maxPerPeer,
+		perPeer:    make(map[peer.ID]int),
+	}
+}
+
+// acquire reserves a slot for a stream from p. It returns false if either limit
+// has been reached.
+func (l *inboundStreamLimiter) acquire(p peer.ID) bool {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerPeer > 0 && l.perPeer[p] >= l.maxPerPeer {
+		return false
+	}
+	l.total++
+	l.perPeer[p]++
+	return true
+}
+
+// count returns the number of streams currently holding a slot.
+func (l *inboundStreamLimiter) count() int {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.total
+}
+
+func (l *inboundStreamLimiter) release(p peer.ID) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	l.total--
+	if n := l.perPeer[p] - 1; n > 0 {
+		l.perPeer[p] = n
+	} else {
+		delete(l.perPeer, p)
+	}
+}
+
+// inboundRateLimiter limits the rate at which messages from each remote peer are
+// handled, using a token bucket per peer.
+type inboundRateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	lk      sync.Mutex
+	buckets map[peer.ID]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiterGCThreshold is the number of buckets above which full ones are
+// pruned, a full bucket is no different from a missing one.
+const rateLimiterGCThreshold = 128
+
+// inboundRateLimitGracePeriod is the longest we delay a message from a peer
+// that exceeds its rate limit. If it would have to wait any longer, the stream
+// is reset instead.
+const inboundRateLimitGracePeriod = 5 * time.Second
+
+// newInboundRateLimiter returns a limiter allowing rate messages per second
+// from every peer, with bursts of up to burst messages. A rate of 0 means
+// unlimited, in which case nil is returned.
+func newInboundRateLimiter(rate float64, burst int) *inboundRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &inboundRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[peer.ID]*tokenBucket),
+	}
+}
+
+// reserve takes a token for a message from p and returns how long to wait
+// before handling it. It returns false, without taking a token, if the wait
+// would exceed maxWait.
+func (l *inboundRateLimiter) reserve(p peer.ID, maxWait time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[p]
+	if !ok {
+		if len(l.buckets) >= rateLimiterGCThreshold {
+			l.gc(now)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[p] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	// Tokens may go negative, messages waiting for a token are queued up behind
+	// each other.
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		if wait > maxWait {
+			return 0, false
+		}
+	}
+	b.tokens--
+	return wait, true
+}
+
+func (l *inboundRateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+func (l *inboundRateLimiter) gc(now time.Time) {
+	for p, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, p)
+		}
+	}
+}
+
+// fairScheduler bounds the number of handlers running at once across all
+// inbound streams. Once every slot is taken, the handlers waiting for one are
+// let in by taking turns between their peers, rather than in the order they
+// arrived, so that a peer with many streams open can't crowd out the others.
+type fairScheduler struct {
+	lk    sync.Mutex
+	free  int
+	queue map[peer.ID][]chan struct{} // handlers waiting for a slot, by peer
+	turns []peer.ID                   // peers with handlers waiting, in turn
+}
+
+// newFairScheduler returns a scheduler running up to slots handlers at once. A
+// number of slots of 0 means unlimited, in which case nil is returned.
+func newFairScheduler(slots int) *fairScheduler {
+	if slots <= 0 {
+		return nil
+	}
+	return &fairScheduler{
+		free:  slots,
+		queue: make(map[peer.ID][]chan struct{}),
+	}
+}
+
+// acquire waits for a slot to run a handler of p in. It returns false, without
+// a slot, if stop is closed first.
+func (s *fairScheduler) acquire(p peer.ID, stop <-chan struct{}) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lk.Lock()
+	if s.free > 0 {
+		s.free--
+		s.lk.Unlock()
+		return true
+	}
+	turn := make(chan struct{})
+	if len(s.queue[p]) == 0 {
+		s.turns = append(s.turns, p)
+	}
+	s.queue[p] = append(s.queue[p], turn)
+	s.lk.Unlock()
+
+	select {
+	case <-turn:
+		return true
+	case <-stop:
+	}
+
+	s.lk.Lock()
+	waiting := s.dequeue(p, turn)
+	s.lk.Unlock()
+	if !waiting {
+		// We were handed the slot in the meantime, pass it on.
+		s.release()
+	}
+	return false
+}
+
+// release frees the slot of a handler, handing it to the next peer in turn.
+func (s *fairScheduler) release() {
+	if s == nil {
+		return
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if len(s.turns) == 0 {
+		s.free++
+		return
+	}
+	p := s.turns[0]
+	s.turns = s.turns[1:]
+	q := s.queue[p]
+	close(q[0])
+	if len(q) > 1 {
+		s.queue[p] = q[1:]
+		s.turns = append(s.turns, p)
+	} else {
+		delete(s.queue, p)
+	}
+}
+
+// dequeue removes turn from the handlers of p waiting for a slot. It returns
+// false if turn isn't waiting anymore.
+func (s *fairScheduler) dequeue(p peer.ID, turn chan struct{}) bool {
+	q := s.queue[p]
+	for i, t := range q {
+		if t != turn {
+			continue
+		}
+		if len(q) > 1 {
+			s.queue[p] = append(q[:i:i], q[i+1:]...)
+			return true
+		}
+		delete(s.queue, p)
+		for j, tp := range s.turns {
+			if tp == p {
+				s.turns = append(s.turns[:j:j], s.turns[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// waiting returns the number of handlers of p waiting for a slot.
+func (s *fairScheduler) waiting(p peer.ID) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return len(s.queue[p])
+}
+
 // handleNewStream implements the network.StreamHandler
 func (dht *IpfsDHT) handleNewStream(s network.Stream) {
+	p := s.Conn().RemotePeer()
+	if g := dht.connectionGater; g != nil && !g.InterceptSecured(s.Conn().Stat().Direction, p, s.Conn()) {
+		stats.Record(dht.ctx, metrics.InboundStreamsGated.M(1))
+		if c := dht.log.Check(zap.DebugLevel, "peer blocked by the connection gater, resetting stream"); c != nil {
+			c.Write(zap.String("from", p.String()))
+		}
+		_ = s.Reset()
+		dht.recordStreamReset("rejected")
+		return
+	}
+	if !dht.inboundStreams.acquire(p) {
+		stats.Record(dht.ctx, metrics.InboundStreamsRejected.M(1))
+		if c := dht.log.Check(zap.DebugLevel, "inbound stream limit reached, resetting stream"); c != nil {
+			c.Write(zap.String("from", p.String()))
+		}
+		_ = s.Reset()
+		dht.recordStreamReset("rejected")
+		return
+	}
+	defer dht.inboundStreams.release(p)
+
 	if dht.handleNewMessage(s) {
 		// If we exited without error, close gracefully.
 		_ = s.Close()
@@ -33,38 +341,368 @@ func (dht *IpfsDHT) handleNewStream(s network.Stream) {
 }
 
 // Returns true on orderly completion of writes (so we can Close the stream).
-func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
+func (dht *IpfsDHT) handleNewMessage(s network.Stream) (orderly bool) {
 	ctx := dht.ctx
-	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
-
 	mPeer := s.Conn().RemotePeer()
 
-	timer := time.AfterFunc(dhtStreamIdleTimeout, func() { _ = s.Reset() })
+	// The stream is reset unless handled in an orderly way, and why is only
+	// known here.
+	var reset resetReason
+	defer func() {
+		if !orderly {
+			dht.recordStreamReset(reset.get())
+		}
+	}()
+
+	// A stream looped back to us, we must not end up in our own routing table.
+	if mPeer == dht.self {
+		stats.Record(ctx, metrics.InboundSelfStreams.M(1))
+		dht.log.Warn("received a stream from ourselves, resetting it", zap.String("peer", mPeer.String()))
+		return reset.set("rejected")
+	}
+
+	compressed := net.IsCompressedProtocol(s.Protocol())
+	checksummed := net.IsChecksummedProtocol(s.Protocol())
+	br := bufio.NewReader(s)
+	r := net.NewMessageReader(ctx, br, dht.maxMessageSize, compressed)
+
+	// Responses are buffered while further requests are already waiting to be
+	// read, so that a burst of pipelined requests is answered with few writes.
+	var w *net.MessageWriter
+	switch {
+	case compressed:
+		w = net.NewCompressedMessageWriterSize(ctx, s, dht.writeBufferSize)
+	case checksummed:
+		w = net.NewChecksummedMessageWriterSize(s, dht.writeBufferSize)
+	default:
+		w = net.NewMessageWriterSize(s, dht.writeBufferSize)
+	}
+	defer w.Release()
+	w.SetCodec(dht.codec)
+	var pending []pb.Message_MessageType
+	var addProviders addProviderDedup
+	// the highest sequence number received on the stream, see SequenceNumbers
+	var lastSeq uint64
+
+	// Responses are flushed before there are more outstanding than allowed,
+	// with several workers reading pauses until they are.
+	window := newResponseWindow(dht.maxOutstandingResponses)
+	defer func() {
+		if window.peak > 0 {
+			stats.Record(ctx, metrics.OutstandingResponses.M(int64(window.peak)))
+		}
+	}()
+	flushAt := maxCoalescedResponses
+	if window.size() < flushAt {
+		flushAt = window.size()
+	}
+
+	// Responses must fit what the peer reads, checksum included. Peers don't
+	// tell their limit, it's assumed to be ours unless we raised ours above
+	// the standard one, which other peers may still use, see MaxMessageSize.
+	maxRespSize := dht.maxMessageSize
+	if maxRespSize > network.MessageSizeMax {
+		maxRespSize = network.MessageSizeMax
+	}
+	if checksummed {
+		maxRespSize -= net.ChecksumOverhead
+	}
+
+	// The read timeout only applies while we're waiting for the next message,
+	// the time spent handling it doesn't count against it.
+	var timedOut int32
+	timer := time.AfterFunc(dht.inboundReadTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		_ = s.Reset()
+	})
+	timer.Stop()
 	defer timer.Stop()
 
+	// Writes are bounded too, a peer that doesn't read its responses must not
+	// be able to block us forever.
+	writeTimer := time.AfterFunc(dht.inboundWriteTimeout, func() { _ = s.Reset() })
+	writeTimer.Stop()
+	defer writeTimer.Stop()
+
+	// Shutting down resets the stream, so that neither a flush to a peer that
+	// doesn't read nor a read from a peer that doesn't write outlives the DHT.
+	handled := make(chan struct{})
+	defer close(handled)
+	go func() {
+		select {
+		case <-ctx.Done():
+			reset.set("shutdown")
+			_ = s.Reset()
+		case <-handled:
+		}
+	}()
+
+	// What's buffered but not flushed counts towards the total across streams,
+	// until the writer is released.
+	var buffered int
+	trackBuffered := func(n int) {
+		if n == buffered {
+			return
+		}
+		total := atomic.AddInt64(&dht.bufferedResponseBytes, int64(n-buffered))
+		buffered = n
+		stats.Record(ctx, metrics.BufferedResponseBytes.M(total))
+	}
+	defer trackBuffered(0)
+
+	writeWithDeadline := func(write func() error) error {
+		defer func() { trackBuffered(w.Buffered()) }()
+		if dht.inboundWriteTimeout <= 0 {
+			return write()
+		}
+		writeTimer.Reset(dht.inboundWriteTimeout)
+		err := write()
+		if !writeTimer.Stop() {
+			// The timer fired, resetting the stream even if the write made it
+			// just in time.
+			stats.Record(ctx, metrics.ResponseWriteTimeouts.M(1))
+			return ErrWriteTimeout
+		}
+		return err
+	}
+
+	flush := func() bool {
+		if err := writeWithDeadline(w.Flush); err != nil {
+			reset.setFor(err, "write-error")
+			dht.recordResponseWriteErrors(ctx, pending, err)
+			if c := dht.log.Check(zap.DebugLevel, "error writing response"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Error(err))
+			}
+			return false
+		}
+		window.release(len(pending))
+		pending = pending[:0]
+		return true
+	}
+
+	// Batches of a streamed response are written out right away, along with
+	// the responses held back, the requester has to see each batch before it
+	// acknowledges it. The stream ends with the streamed response, so there's
+	// no point in making room for more responses.
+	writeBatch := func(batch *pb.Message) error {
+		pending = append(pending, batch.GetType())
+		err := writeWithDeadline(func() error {
+			if err := w.WriteMsg(batch); err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			reset.setFor(err, "write-error")
+			dht.recordResponseWriteErrors(ctx, pending, err)
+			return err
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	readAck := func(req *pb.Message) error {
+		timer.Reset(dht.inboundReadTimeout)
+		msgbytes, err := r.ReadMsg()
+		timer.Stop()
+		if err != nil {
+			r.ReleaseMsg(msgbytes)
+			if atomic.LoadInt32(&timedOut) == 1 {
+				err = ErrReadTimeout
+			}
+			reset.setFor(err, "read-error")
+			return err
+		}
+		var ack pb.Message
+		err = net.UnmarshalMsg(dht.codec, msgbytes, &ack)
+		r.ReleaseMsg(msgbytes)
+		if err == nil && checksummed {
+			err = net.VerifyChecksum(ctx, &ack)
+		}
+		if err == nil && (ack.GetType() != req.GetType() || ack.GetRequestId() != req.GetRequestId()) {
+			err = errUnexpectedAck
+		}
+		reset.setFor(err, "read-error")
+		return err
+	}
+
+	// respond finishes the handling of a request, once its handler returned. It
+	// reports whether the stream is done with, and if so whether in an orderly
+	// way.
+	respond := func(hr *handledRequest) (done, ok bool) {
+		ctx, span, req, startTime, msgLen := hr.ctx, hr.span, hr.req, hr.startTime, hr.msgLen
+		resp, err := hr.resp, hr.err
+		if err != nil {
+			internal.EndMessageSpan(span, dht.clock.Since(startTime), err)
+			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+			if c := dht.log.Check(zap.DebugLevel, "error handling message"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())),
+					zap.Binary("key", req.GetKey()),
+					zap.Int("size", msgLen),
+					zap.Error(err))
+			}
+			reset.set("handler-error")
+			return true, false
+		}
+
+		if c := dht.log.Check(zap.DebugLevel, "handled message"); c != nil {
+			c.Write(zap.String("from", mPeer.String()),
+				zap.Int32("type", int32(req.GetType())),
+				zap.Binary("key", req.GetKey()),
+				zap.Duration("time", dht.clock.Since(startTime)))
+		}
+
+		if resp == nil {
+			internal.EndMessageSpan(span, dht.clock.Since(startTime), nil)
+			if c := dht.log.Check(zap.DebugLevel, "handled one-way message"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())))
+			}
+			stats.Record(ctx, metrics.ReceivedOneWayMessages.M(1))
+			window.release(1)
+			return false, true
+		}
+
+		// send out response msg
+		resp.RequestId = req.GetRequestId()
+		if dht.shouldSlowDown(dht.clock.Since(startTime)) {
+			resp.SlowDown = true
+			stats.Record(ctx, metrics.SlowDownHints.M(1))
+		}
+
+		// The requester asked for the closer peers in batches. Streaming them
+		// ends the stream, as the requester can't tell where they end otherwise.
+		if streamed(req) {
+			err := streamCloserPeers(req, resp, writeBatch, readAck)
+			elapsedTime := dht.clock.Since(startTime)
+			internal.EndMessageSpan(span, elapsedTime, err)
+			if err != nil {
+				stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+				if c := dht.log.Check(zap.DebugLevel, "error streaming response"); c != nil && !isStreamReset(err) {
+					c.Write(zap.String("from", mPeer.String()),
+						zap.Binary("key", req.GetKey()),
+						zap.Error(err))
+				}
+				return true, false
+			}
+			stats.Record(ctx, metrics.InboundRequestLatency.M(float64(elapsedTime)/float64(time.Millisecond)))
+			dht.logSlowHandling(mPeer, req, elapsedTime)
+			return true, true
+		}
+
+		// The peer would refuse a response larger than it reads, so drop the
+		// least relevant peers rather than the whole response.
+		if size := resp.Size(); size > maxRespSize {
+			dropped := resp.TruncatePeers(maxRespSize)
+			stats.Record(ctx, metrics.TruncatedResponses.M(1))
+			if c := dht.log.Check(zap.DebugLevel, "truncated oversized response"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())),
+					zap.Int("size", size),
+					zap.Int("dropped", dropped))
+			}
+		}
+		pending = append(pending, req.GetType())
+		err = writeWithDeadline(func() error {
+			if err := w.WriteMsg(resp); err != nil {
+				return err
+			}
+			if len(pending) < flushAt {
+				return nil
+			}
+			return w.Flush()
+		})
+		if err == nil && len(pending) >= flushAt {
+			window.release(len(pending))
+			pending = pending[:0]
+		}
+		if err != nil {
+			reset.setFor(err, "write-error")
+			internal.EndMessageSpan(span, dht.clock.Since(startTime), err)
+			dht.recordResponseWriteErrors(ctx, pending, err)
+			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+			if c := dht.log.Check(zap.DebugLevel, "error writing response"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())),
+					zap.Binary("key", req.GetKey()),
+					zap.Int("size", resp.Size()),
+					zap.Error(err))
+			}
+			return true, false
+		}
+
+		elapsedTime := dht.clock.Since(startTime)
+		internal.EndMessageSpan(span, elapsedTime, nil)
+
+		if c := dht.log.Check(zap.DebugLevel, "responded to message"); c != nil {
+			c.Write(zap.String("from", mPeer.String()),
+				zap.Int32("type", int32(req.GetType())),
+				zap.Binary("key", req.GetKey()),
+				zap.Duration("time", elapsedTime))
+		}
+
+		latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
+		stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+		dht.logSlowHandling(mPeer, req, elapsedTime)
+		return false, true
+	}
+
+	// With several workers, the handlers of pipelined requests run while the
+	// next ones are read, and responses are written on a goroutine of their own.
+	var handlers *orderedHandlers
+	if dht.handlerWorkers > 1 {
+		handlers = newOrderedHandlers(dht.handlerWorkers)
+		go handlers.write(respond, func() bool { return len(pending) == 0 || flush() }, func() { _ = s.Reset() })
+		defer func() {
+			if !orderly {
+				// Responses still to be written are dropped, as without workers.
+				_ = s.Reset()
+			}
+			orderly = handlers.finish(orderly)
+		}()
+	}
+
 	for {
 		if dht.getMode() != modeServer {
 			logger.Errorf("ignoring incoming dht message while not in server mode")
+			return reset.set("shutdown")
+		}
+
+		// Never block on a read while holding responses back, the peer may be
+		// waiting for them before sending its next request.
+		if handlers == nil && len(pending) > 0 && !hasBufferedMsg(br) && !flush() {
 			return false
 		}
 
 		var req pb.Message
+		timer.Reset(dht.inboundReadTimeout)
 		msgbytes, err := r.ReadMsg()
+		timer.Stop()
 		msgLen := len(msgbytes)
 		if err != nil {
 			r.ReleaseMsg(msgbytes)
 			if err == io.EOF {
+				// The peer is done sending requests. Responses held back were
+				// flushed before reading, those of workers are left to finish.
 				return true
 			}
-			// This string test is necessary because there isn't a single stream reset error
-			// instance	in use.
-			if c := baseLogger.Check(zap.DebugLevel, "error reading message"); c != nil && err.Error() != "stream reset" {
+			if atomic.LoadInt32(&timedOut) == 1 {
+				err = ErrReadTimeout
+			}
+			reset.setFor(err, "read-error")
+			if c := dht.log.Check(zap.DebugLevel, "error reading message"); c != nil && !isStreamReset(err) {
 				c.Write(zap.String("from", mPeer.String()),
+					zap.Int("size", msgLen),
 					zap.Error(err))
 			}
 			if msgLen > 0 {
 				_ = stats.RecordWithTags(ctx,
-					[]tag.Mutator{tag.Upsert(metrics.KeyMessageType, "UNKNOWN")},
+					[]tag.Mutator{
+						dht.upsertTag(metrics.KeyMessageType, "UNKNOWN"),
+						dht.upsertTag(metrics.KeyPeerClass, dht.peerClass(mPeer)),
+					},
 					metrics.ReceivedMessages.M(1),
 					metrics.ReceivedMessageErrors.M(1),
 					metrics.ReceivedBytes.M(int64(msgLen)),
@@ -72,98 +710,851 @@ func (dht *IpfsDHT) handleNewMessage(s network.Stream) bool {
 			}
 			return false
 		}
-		err = req.Unmarshal(msgbytes)
+		err = net.UnmarshalMsg(dht.codec, msgbytes, &req)
 		r.ReleaseMsg(msgbytes)
 		if err != nil {
-			if c := baseLogger.Check(zap.DebugLevel, "error unmarshaling message"); c != nil {
+			if c := dht.log.Check(zap.DebugLevel, "error unmarshaling message"); c != nil {
 				c.Write(zap.String("from", mPeer.String()),
+					zap.Int("size", msgLen),
 					zap.Error(err))
 			}
 			_ = stats.RecordWithTags(ctx,
-				[]tag.Mutator{tag.Upsert(metrics.KeyMessageType, "UNKNOWN")},
+				[]tag.Mutator{
+					dht.upsertTag(metrics.KeyMessageType, "UNKNOWN"),
+					dht.upsertTag(metrics.KeyPeerClass, dht.peerClass(mPeer)),
+				},
 				metrics.ReceivedMessages.M(1),
 				metrics.ReceivedMessageErrors.M(1),
 				metrics.ReceivedBytes.M(int64(msgLen)),
 			)
-			return false
+			return reset.set("read-error")
+		}
+		// A corrupted message could make us act on bogus peers or records.
+		if checksummed {
+			if err := net.VerifyChecksum(ctx, &req); err != nil {
+				if c := dht.log.Check(zap.DebugLevel, "dropping corrupted message"); c != nil {
+					c.Write(zap.String("from", mPeer.String()),
+						zap.Int("size", msgLen),
+						zap.Error(err))
+				}
+				_ = stats.RecordWithTags(ctx,
+					[]tag.Mutator{
+						dht.upsertTag(metrics.KeyMessageType, "UNKNOWN"),
+						dht.upsertTag(metrics.KeyPeerClass, dht.peerClass(mPeer)),
+					},
+					metrics.ReceivedMessages.M(1),
+					metrics.ReceivedMessageErrors.M(1),
+					metrics.ReceivedBytes.M(int64(msgLen)),
+				)
+				continue
+			}
 		}
 
-		timer.Reset(dhtStreamIdleTimeout)
-
-		startTime := time.Now()
+		startTime := dht.clock.Now()
 		ctx, _ := tag.New(ctx,
-			tag.Upsert(metrics.KeyMessageType, req.GetType().String()),
+			dht.upsertTag(metrics.KeyMessageType, req.GetType().String()),
+			dht.upsertTag(metrics.KeyPeerClass, dht.peerClass(mPeer)),
 		)
 
-		stats.Record(ctx,
-			metrics.ReceivedMessages.M(1),
-			metrics.ReceivedBytes.M(int64(msgLen)),
-		)
+		if w := dht.inboundSampler.Weight(req.GetType()); w > 0 {
+			stats.Record(ctx,
+				metrics.ReceivedMessages.M(int64(w)),
+				metrics.ReceivedBytes.M(int64(msgLen)),
+			)
+		}
+		dht.traffic.received(msgLen)
+
+		// Unnumbered messages come from peers that don't number theirs.
+		if seq := req.GetSequence(); dht.sequenceNumbers && seq != 0 {
+			if seq != lastSeq+1 {
+				stats.Record(ctx, metrics.SequenceGaps.M(1))
+				if c := dht.log.Check(zap.DebugLevel, "message out of sequence"); c != nil {
+					c.Write(zap.String("from", mPeer.String()),
+						zap.Int32("type", int32(req.GetType())),
+						zap.Uint64("expected", lastSeq+1),
+						zap.Uint64("got", seq))
+				}
+			}
+			if seq > lastSeq {
+				lastSeq = seq
+			}
+		}
+
+		wait, ok := dht.inboundRate.reserve(mPeer, inboundRateLimitGracePeriod)
+		// Don't hold responses back while the peer is throttled.
+		if handlers == nil && (!ok || wait > 0) && len(pending) > 0 && !flush() {
+			return false
+		}
+		if !ok {
+			stats.Record(ctx, metrics.InboundRateLimited.M(1))
+			if c := dht.log.Check(zap.DebugLevel, "inbound rate limit exceeded, closing stream"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Int32("type", int32(req.GetType())))
+			}
+			// The request is left unanswered, but the stream is closed rather
+			// than reset: a reset could discard the responses flushed above, or
+			// those of workers still to be written, before the peer reads them.
+			return true
+		} else if wait > 0 {
+			stats.Record(ctx, metrics.InboundRateLimited.M(1))
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return reset.set("shutdown")
+			}
+		}
+
+		if dht.inboundMessageFilter != nil {
+			if err := dht.inboundMessageFilter(mPeer, &req); err != nil {
+				stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
+				if c := dht.log.Check(zap.DebugLevel, "inbound message rejected by filter"); c != nil {
+					c.Write(zap.String("from", mPeer.String()),
+						zap.Int32("type", int32(req.GetType())),
+						zap.Binary("key", req.GetKey()),
+						zap.Error(err))
+				}
+				return reset.set("rejected")
+			}
+		}
 
 		handler := dht.handlerForMsgType(req.GetType())
 		if handler == nil {
 			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "can't handle received message"); c != nil {
+			if _, disabled := dht.disabledTypes[req.GetType()]; disabled {
+				stats.Record(ctx, metrics.DisabledTypeHits.M(1))
+			} else {
+				_ = stats.RecordWithTags(ctx,
+					[]tag.Mutator{dht.upsertTag(metrics.KeyMessageTypeValue, unknownTypeValue(req.GetType()))},
+					metrics.UnknownMessageTypes.M(1),
+				)
+			}
+			if c := dht.log.Check(zap.DebugLevel, "can't handle received message"); c != nil {
 				c.Write(zap.String("from", mPeer.String()),
 					zap.Int32("type", int32(req.GetType())))
 			}
-			return false
+			return reset.set("rejected")
+		}
+		if dht.responseTokens != nil && dht.responseTokens.required(req.GetType()) && !streamed(&req) {
+			handler = dht.withResponseToken(handler)
 		}
 
-		// a peer has queried us, let's add it to RT
-		dht.peerFound(dht.ctx, mPeer, true)
+		// Buggy clients announce the same provider record over and over, there's
+		// no point in storing it again.
+		if req.GetType() == pb.Message_ADD_PROVIDER && addProviders.repeated(&req, dht.clock.Now()) {
+			stats.Record(ctx, metrics.CollapsedAddProviders.M(1))
+			if c := dht.log.Check(zap.DebugLevel, "collapsing repeated provider record"); c != nil {
+				c.Write(zap.String("from", mPeer.String()),
+					zap.Binary("key", req.GetKey()))
+			}
+			continue
+		}
+
+		// a peer has queried us, let's add it to RT, unless it only probed
+		// whether we're alive or the RT is managed by someone else
+		if !isProbe(&req) && !dht.disableAutoRTUpdate {
+			dht.peerFound(dht.ctx, mPeer, true)
+		}
 
-		if c := baseLogger.Check(zap.DebugLevel, "handling message"); c != nil {
+		if c := dht.log.Check(zap.DebugLevel, "handling message"); c != nil {
 			c.Write(zap.String("from", mPeer.String()),
 				zap.Int32("type", int32(req.GetType())),
 				zap.Binary("key", req.GetKey()))
 		}
-		resp, err := handler(ctx, mPeer, &req)
-		if err != nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "error handling message"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())),
-					zap.Binary("key", req.GetKey()),
-					zap.Error(err))
+		// Without workers, the responses are flushed before the window is full.
+		stop := ctx.Done()
+		if handlers != nil {
+			stop = handlers.done
+		}
+		if !window.acquire(stop) {
+			return reset.set("shutdown")
+		}
+
+		ctx, span := internal.StartMessageSpan(ctx, dht.traceSampler, "dht.handleMessage", trace.SpanKindServer,
+			mPeer, req.GetType().String(), msgLen)
+		hr := &handledRequest{ctx: ctx, span: span, req: &req, startTime: startTime, msgLen: msgLen}
+		handlerCtx := withObservedAddr(withStreamProtocol(ctx, s.Protocol()), s.Conn().RemoteMultiaddr())
+		if handlers == nil {
+			hr.resp, hr.err = dht.callHandler(handlerCtx, handler, mPeer, &req)
+			if done, ok := respond(hr); done {
+				return ok
 			}
+			continue
+		}
+		if !handlers.dispatch(hr, func() { hr.resp, hr.err = dht.callHandler(handlerCtx, handler, mPeer, &req) }) {
 			return false
 		}
+		// A streamed response ends the stream, and needs its acknowledgments read.
+		if streamed(&req) {
+			return true
+		}
+	}
+}
 
-		if c := baseLogger.Check(zap.DebugLevel, "handled message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
-				zap.Int32("type", int32(req.GetType())),
-				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", time.Since(startTime)))
+// shouldSlowDown reports whether a response to a request that took
+// handlingTime to handle should ask the requester to slow down.
+func (dht *IpfsDHT) shouldSlowDown(handlingTime time.Duration) bool {
+	if dht.slowDownHandlingTime > 0 && handlingTime > dht.slowDownHandlingTime {
+		return true
+	}
+	return dht.slowDownStreams > 0 && dht.inboundStreams.count() >= dht.slowDownStreams
+}
+
+// logSlowHandling warns about a request from p whose handling and response took
+// elapsed, if that's longer than the threshold set with SlowHandlerLog.
+func (dht *IpfsDHT) logSlowHandling(p peer.ID, req *pb.Message, elapsed time.Duration) {
+	if dht.slowHandlerThreshold <= 0 || elapsed <= dht.slowHandlerThreshold {
+		return
+	}
+	if c := dht.log.Check(zap.WarnLevel, "slow message handling"); c != nil {
+		c.Write(zap.String("from", p.String()),
+			zap.Int32("type", int32(req.GetType())),
+			zap.Binary("key", req.GetKey()),
+			zap.Duration("time", elapsed))
+	}
+}
+
+// recordResponseWriteErrors records a failure to write a response for each of
+// the given message types.
+func (dht *IpfsDHT) recordResponseWriteErrors(ctx context.Context, types []pb.Message_MessageType, err error) {
+	class := errorClass(err)
+	for _, typ := range types {
+		_ = stats.RecordWithTags(ctx,
+			[]tag.Mutator{
+				dht.upsertTag(metrics.KeyMessageType, typ.String()),
+				dht.upsertTag(metrics.KeyErrorClass, class),
+			},
+			metrics.ResponseWriteErrors.M(1),
+		)
+	}
+}
+
+// recordMismatchedReply records that p replied to req with a message of another type.
+func (dht *IpfsDHT) recordMismatchedReply(p peer.ID, req, resp *pb.Message) {
+	ctx := dht.newContextWithLocalTags(context.Background(), dht.upsertTag(metrics.KeyMessageType, req.GetType().String()))
+	stats.Record(ctx, metrics.MismatchedReplies.M(1))
+	if c := dht.log.Check(zap.DebugLevel, "mismatched reply"); c != nil {
+		c.Write(zap.String("from", p.String()),
+			zap.Int32("request", int32(req.GetType())),
+			zap.Int32("reply", int32(resp.GetType())))
+	}
+}
+
+// resetReason is why an inbound stream is about to be reset. Only the first
+// reason given counts, as the others are usually its consequences. Responses
+// may be written on a goroutine of their own, so it's safe for concurrent use.
+type resetReason struct {
+	mu     sync.Mutex
+	reason string
+}
+
+// set records reason unless there's one already, and returns false for the
+// convenience of handleNewMessage.
+func (r *resetReason) set(reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reason == "" {
+		r.reason = reason
+	}
+	return false
+}
+
+// setFor records reason for a stream failing with err, unless err means the
+// stream was reset already: either by the peer, or locally, where the reset is
+// counted.
+func (r *resetReason) setFor(err error, reason string) {
+	if err != nil && !isStreamReset(err) {
+		r.set(reason)
+	}
+}
+
+func (r *resetReason) get() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reason
+}
+
+// recordStreamReset counts a DHT stream reset for reason, if there's any.
+func (dht *IpfsDHT) recordStreamReset(reason string) {
+	if reason == "" {
+		return
+	}
+	_ = stats.RecordWithTags(dht.ctx,
+		[]tag.Mutator{dht.upsertTag(metrics.KeyResetReason, reason)},
+		metrics.StreamResets.M(1),
+	)
+}
+
+// isProbe reports whether req is a liveness probe, see ProtocolMessenger.Probe.
+func isProbe(req *pb.Message) bool {
+	return req.GetType() == pb.Message_PING && req.GetProbe()
+}
+
+// streamed reports whether the response to req is streamed in batches, see
+// streamCloserPeers.
+func streamed(req *pb.Message) bool {
+	return req.GetType() == pb.Message_FIND_NODE && req.GetBatchSize() > 0
+}
+
+// handledRequest is a request read from an inbound stream, along with the
+// outcome of its handler once it returned.
+type handledRequest struct {
+	ctx       context.Context
+	span      *trace.Span
+	req       *pb.Message
+	startTime time.Time
+	msgLen    int
+
+	finished chan struct{}
+	resp     *pb.Message
+	err      error
+}
+
+// orderedHandlers runs the handlers of the requests read from an inbound stream
+// concurrently, while their responses are written in the order the requests
+// were read.
+type orderedHandlers struct {
+	// requests whose response is still to be written, in order
+	queue chan *handledRequest
+	// closed once write returned
+	done chan struct{}
+	// whether write returned after writing every response
+	ok bool
+}
+
+// newOrderedHandlers returns an orderedHandlers running up to workers handlers
+// at once.
+func newOrderedHandlers(workers int) *orderedHandlers {
+	return &orderedHandlers{
+		// The writer holds on to one more request while waiting for it.
+		queue: make(chan *handledRequest, workers-1),
+		done:  make(chan struct{}),
+	}
+}
+
+// dispatch runs handle for r on a goroutine of its own once there's room for
+// another request. It returns false if responses aren't written anymore.
+func (h *orderedHandlers) dispatch(r *handledRequest, handle func()) bool {
+	r.finished = make(chan struct{})
+	select {
+	case h.queue <- r:
+	case <-h.done:
+		return false
+	}
+	go func() {
+		defer close(r.finished)
+		handle()
+	}()
+	return true
+}
+
+// write passes the dispatched requests to respond in order, each once its
+// handler returned. Pending responses are flushed whenever write would have to
+// wait. If writing fails, abort is called so that reading stops too.
+func (h *orderedHandlers) write(respond func(*handledRequest) (done, ok bool), flush func() bool, abort func()) {
+	defer close(h.done)
+	h.ok = h.writeAll(respond, flush)
+	if !h.ok {
+		abort()
+	}
+}
+
+func (h *orderedHandlers) writeAll(respond func(*handledRequest) (done, ok bool), flush func() bool) bool {
+	for {
+		var r *handledRequest
+		more := true
+		select {
+		case r, more = <-h.queue:
+		default:
+			if !flush() {
+				return false
+			}
+			r, more = <-h.queue
+		}
+		if !more {
+			return flush()
 		}
 
-		if resp == nil {
-			continue
+		select {
+		case <-r.finished:
+		default:
+			if !flush() {
+				return false
+			}
+			<-r.finished
+		}
+		if done, ok := respond(r); done {
+			return ok
 		}
+	}
+}
 
-		// send out response msg
-		err = net.WriteMsg(s, resp)
-		if err != nil {
-			stats.Record(ctx, metrics.ReceivedMessageErrors.M(1))
-			if c := baseLogger.Check(zap.DebugLevel, "error writing response"); c != nil {
-				c.Write(zap.String("from", mPeer.String()),
-					zap.Int32("type", int32(req.GetType())),
-					zap.Binary("key", req.GetKey()),
-					zap.Error(err))
+// finish is called once no more requests are dispatched. It waits until every
+// response has been written, and reports whether the stream was handled in an
+// orderly way, given whether reading requests ended in an orderly way.
+func (h *orderedHandlers) finish(orderly bool) bool {
+	close(h.queue)
+	<-h.done
+	return orderly && h.ok
+}
+
+// streamCloserPeers answers req with the closer peers of resp in batches of at
+// most req.BatchSize peers, one message each. A batch is only sent once the
+// requester acknowledged the previous one, by sending a message of the same
+// type and request id, so that a requester needing just the first few peers
+// can close the stream instead. The first batch is sent even if there are no
+// closer peers at all.
+func streamCloserPeers(req, resp *pb.Message, write func(*pb.Message) error, readAck func(*pb.Message) error) error {
+	size := int(req.GetBatchSize())
+	peers := resp.CloserPeers
+	for first := true; first || len(peers) > 0; first = false {
+		if !first {
+			if err := readAck(req); err != nil {
+				if err == io.EOF {
+					// The requester has seen enough.
+					return nil
+				}
+				return err
 			}
-			return false
 		}
+		n := size
+		if n > len(peers) {
+			n = len(peers)
+		}
+		batch := *resp
+		batch.CloserPeers = peers[:n:n]
+		peers = peers[n:]
+		if err := write(&batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		elapsedTime := time.Since(startTime)
+// addProviderDedupWindow is how long an ADD_PROVIDER message repeating the one
+// just before it on the same stream is ignored.
+const addProviderDedupWindow = 10 * time.Second
 
-		if c := baseLogger.Check(zap.DebugLevel, "responded to message"); c != nil {
-			c.Write(zap.String("from", mPeer.String()),
+// addProviderDedup recognizes ADD_PROVIDER messages repeating the previous one
+// received on a stream.
+type addProviderDedup struct {
+	last []byte
+	at   time.Time
+}
+
+// repeated reports whether req, received at now, announces the same provider
+// record as the last ADD_PROVIDER message that wasn't collapsed, received within
+// addProviderDedupWindow. Request ids, sequence numbers and checksums are
+// ignored. Repeats don't extend the window, so that a record announced over and
+// over is still stored again once in a while.
+func (d *addProviderDedup) repeated(req *pb.Message, now time.Time) bool {
+	m := *req
+	m.RequestId, m.Sequence, m.Checksum = 0, 0, 0
+	data, err := m.Marshal()
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(data, d.last) && now.Sub(d.at) < addProviderDedupWindow {
+		return true
+	}
+	d.last, d.at = data, now
+	return false
+}
+
+// peerClass buckets p for metrics: "routing_table" if p is in the routing table
+// and "unknown" otherwise.
+func (dht *IpfsDHT) peerClass(p peer.ID) string {
+	if dht.routingTable.Find(p) != "" {
+		return "routing_table"
+	}
+	return "unknown"
+}
+
+// errorClass buckets err for metrics: "cancelled" if a context was cancelled or
+// timed out, "reset" if the stream was reset and "other" otherwise.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "cancelled"
+	case isStreamReset(err):
+		return "reset"
+	default:
+		return "other"
+	}
+}
+
+// maxUnknownTypeValue bounds the message type values told apart in the unknown
+// message types metric, larger ones are all counted as "other".
+const maxUnknownTypeValue = 64
+
+// unknownTypeValue returns the value typ is counted as in the unknown message
+// types metric.
+func unknownTypeValue(typ pb.Message_MessageType) string {
+	if typ < 0 || typ >= maxUnknownTypeValue {
+		return "other"
+	}
+	return strconv.Itoa(int(typ))
+}
+
+// maxCoalescedResponses bounds how many responses are held back before being
+// flushed, so that a long burst of requests doesn't delay the first responses
+// for too long.
+const maxCoalescedResponses = 16
+
+// responseWindow bounds how many requests read off an inbound stream await
+// their response being flushed, see MaxOutstandingResponses. Room is only made
+// on the goroutine reading requests, and freed by the one writing responses.
+type responseWindow struct {
+	slots chan struct{}
+	// the most responses outstanding at once
+	peak int
+}
+
+func newResponseWindow(size int) *responseWindow {
+	return &responseWindow{slots: make(chan struct{}, size)}
+}
+
+func (w *responseWindow) size() int {
+	return cap(w.slots)
+}
+
+// acquire waits for room for the response to another request. It returns false
+// if stop is closed first.
+func (w *responseWindow) acquire(stop <-chan struct{}) bool {
+	select {
+	case w.slots <- struct{}{}:
+	case <-stop:
+		return false
+	}
+	if n := len(w.slots); n > w.peak {
+		w.peak = n
+	}
+	return true
+}
+
+// release frees the room taken by n responses, once flushed.
+func (w *responseWindow) release(n int) {
+	for i := 0; i < n; i++ {
+		<-w.slots
+	}
+}
+
+// hasBufferedMsg reports whether a complete length-prefixed message has already
+// been read into br, so that reading it won't block.
+func hasBufferedMsg(br *bufio.Reader) bool {
+	buf, _ := br.Peek(br.Buffered())
+	length, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return false
+	}
+	return uint64(len(buf)-n) >= length
+}
+
+// callHandler invokes handler once the handler scheduler lets it run, bounding
+// its execution by the timeout configured for the message type, if any. A
+// handler that overruns its timeout is abandoned and context.DeadlineExceeded is
+// returned. A handler that panics is recovered from and ErrHandlerPanic is
+// returned.
+func (dht *IpfsDHT) callHandler(ctx context.Context, handler dhtHandler, p peer.ID, req *pb.Message) (*pb.Message, error) {
+	if !dht.handlerScheduler.acquire(p, ctx.Done()) {
+		return nil, ctx.Err()
+	}
+	defer dht.handlerScheduler.release()
+
+	timeout, ok := dht.handlerTimeouts[req.GetType()]
+	if !ok {
+		return dht.runHandler(ctx, handler, p, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		resp *pb.Message
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := dht.runHandler(ctx, handler, p, req)
+		resCh <- result{resp, err}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runHandler invokes handler, turning a panic into ErrHandlerPanic so that a
+// faulty handler only costs the stream it was invoked for. The time spent in
+// the handler is recorded on its own, apart from writing the response.
+func (dht *IpfsDHT) runHandler(ctx context.Context, handler dhtHandler, p peer.ID, req *pb.Message) (resp *pb.Message, err error) {
+	start := dht.clock.Now()
+	defer func() {
+		elapsed := dht.clock.Since(start)
+		stats.Record(ctx, metrics.HandlerExecution.M(float64(elapsed)/float64(time.Millisecond)))
+		if r := recover(); r != nil {
+			stats.Record(ctx, metrics.HandlerPanics.M(1))
+			dht.log.Error("message handler panicked",
+				zap.String("from", p.String()),
 				zap.Int32("type", int32(req.GetType())),
-				zap.Binary("key", req.GetKey()),
-				zap.Duration("time", elapsedTime))
+				zap.Any("panic", r),
+				zap.ByteString("stack", debug.Stack()))
+			resp, err = nil, ErrHandlerPanic
 		}
+	}()
+	return handler(ctx, p, req)
+}
 
-		latencyMillis := float64(elapsedTime) / float64(time.Millisecond)
-		stats.Record(ctx, metrics.InboundRequestLatency.M(latencyMillis))
+// latencyObserver reports the round trip time of every successful request, as
+// the message sender records it, and passes it on to recorder if it's set.
+type latencyObserver struct {
+	recorder internal.LatencyRecorder
+	onSample func(p peer.ID, rtt time.Duration)
+}
+
+func (o *latencyObserver) RecordLatency(p peer.ID, rtt time.Duration) {
+	if o.recorder != nil {
+		o.recorder.RecordLatency(p, rtt)
+	}
+	go o.onSample(p, rtt)
+}
+
+// handleSender is implemented by message senders able to give up on a single request without cancelling its context.
+type handleSender interface {
+	SendRequestWithHandle(ctx context.Context, p peer.ID, pmes *pb.Message) *net.RequestHandle
+}
+
+type requestSetKey struct{}
+
+// requestSet holds the requests in flight under a context, for them to be given up on at once without resetting their
+// streams: their replies are drained and the streams put back in the pool, see net.RequestHandle.Cancel. Requests
+// added once the set is cancelled are given up on right away.
+type requestSet struct {
+	cancelCtx context.CancelFunc
+
+	lk        sync.Mutex
+	handles   map[*net.RequestHandle]struct{}
+	cancelled bool
+}
+
+// withRequestSet returns a context whose requests are added to the returned set when sent through a drainingSender.
+// The context is done once the set is cancelled.
+func withRequestSet(ctx context.Context) (context.Context, *requestSet) {
+	ctx, cancel := context.WithCancel(ctx)
+	set := &requestSet{cancelCtx: cancel, handles: make(map[*net.RequestHandle]struct{})}
+	return context.WithValue(ctx, requestSetKey{}, set), set
+}
+
+func (s *requestSet) add(h *net.RequestHandle) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.cancelled {
+		h.Cancel()
+		return
+	}
+	s.handles[h] = struct{}{}
+}
+
+func (s *requestSet) remove(h *net.RequestHandle) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	delete(s.handles, h)
+}
+
+func (s *requestSet) isCancelled() bool {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.cancelled
+}
+
+// cancel gives up on the requests in the set, and then cancels the context of the set.
+func (s *requestSet) cancel() {
+	s.lk.Lock()
+	s.cancelled = true
+	for h := range s.handles {
+		h.Cancel()
 	}
+	s.handles = nil
+	s.lk.Unlock()
+	s.cancelCtx()
+}
+
+// drainingSender sends the requests whose context carries a requestSet with a handle, for the set to give up on them,
+// if the wrapped MessageSender supports it.
+type drainingSender struct {
+	pb.MessageSender
+}
+
+func (d *drainingSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	set, ok := ctx.Value(requestSetKey{}).(*requestSet)
+	hs, canCancel := d.MessageSender.(handleSender)
+	if !ok || !canCancel {
+		return d.MessageSender.SendRequest(ctx, p, pmes)
+	}
+	h := hs.SendRequestWithHandle(ctx, p, pmes)
+	set.add(h)
+	defer set.remove(h)
+	resp, err := h.Reply()
+	if err != nil && set.isCancelled() {
+		// Callers tell a request given up on from a failed one by their
+		// context, which the set cancels right after its requests.
+		<-ctx.Done()
+	}
+	return resp, err
+}
+
+func (d *drainingSender) SendMessageBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) error {
+	return pb.SendMessageBatch(ctx, d.MessageSender, p, pmess)
+}
+
+// RequestInfo describes a request sent to a peer that hasn't completed yet.
+type RequestInfo struct {
+	Peer    peer.ID
+	Type    pb.Message_MessageType
+	Elapsed time.Duration
+}
+
+type inFlightRequest struct {
+	p     peer.ID
+	typ   pb.Message_MessageType
+	start time.Time
+}
+
+// requestTracker keeps track of the requests in flight through the wrapped
+// MessageSender.
+type requestTracker struct {
+	pb.MessageSender
+
+	lk       sync.Mutex
+	lastID   uint64
+	inFlight map[uint64]inFlightRequest
+}
+
+func newRequestTracker(sender pb.MessageSender) *requestTracker {
+	return &requestTracker{
+		MessageSender: sender,
+		inFlight:      make(map[uint64]inFlightRequest),
+	}
+}
+
+func (t *requestTracker) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	t.lk.Lock()
+	t.lastID++
+	id := t.lastID
+	t.inFlight[id] = inFlightRequest{p: p, typ: pmes.GetType(), start: time.Now()}
+	t.lk.Unlock()
+
+	defer func() {
+		t.lk.Lock()
+		delete(t.inFlight, id)
+		t.lk.Unlock()
+	}()
+	return t.MessageSender.SendRequest(ctx, p, pmes)
+}
+
+func (t *requestTracker) SendMessageBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) error {
+	return pb.SendMessageBatch(ctx, t.MessageSender, p, pmess)
+}
+
+// requests returns the requests in flight, oldest first.
+func (t *requestTracker) requests() []RequestInfo {
+	t.lk.Lock()
+	now := time.Now()
+	infos := make([]RequestInfo, 0, len(t.inFlight))
+	for _, r := range t.inFlight {
+		infos = append(infos, RequestInfo{Peer: r.p, Type: r.typ, Elapsed: now.Sub(r.start)})
+	}
+	t.lk.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Elapsed > infos[j].Elapsed })
+	return infos
+}
+
+// InFlightRequests returns the requests the DHT sent that haven't been answered, failed or been abandoned yet, oldest
+// first. This is meant for debugging queries that seem to be stuck.
+func (dht *IpfsDHT) InFlightRequests() []RequestInfo {
+	return dht.requests.requests()
+}
+
+// DHTMetrics holds the totals of the messages the DHT sent and received since it was created, see MetricsSnapshot.
+type DHTMetrics struct {
+	// one-way messages sent, and how many of them couldn't be sent
+	SentMessages, SentMessageErrors int64
+	// requests sent, and how many of them failed
+	SentRequests, SentRequestErrors int64
+	// messages read off inbound streams, and their total size in bytes
+	ReceivedMessages, ReceivedBytes int64
+}
+
+// trafficCounter adds up the messages the DHT sends and receives. Related
+// totals are updated together, so that a snapshot never sees half an update.
+type trafficCounter struct {
+	lk sync.Mutex
+	m  DHTMetrics
+}
+
+func (c *trafficCounter) sent(request bool, err error) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if request {
+		c.m.SentRequests++
+		if err != nil {
+			c.m.SentRequestErrors++
+		}
+	} else {
+		c.m.SentMessages++
+		if err != nil {
+			c.m.SentMessageErrors++
+		}
+	}
+}
+
+func (c *trafficCounter) received(size int) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.m.ReceivedMessages++
+	c.m.ReceivedBytes += int64(size)
+}
+
+func (c *trafficCounter) snapshot() DHTMetrics {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.m
+}
+
+// countingSender counts the messages sent through the wrapped MessageSender.
+type countingSender struct {
+	pb.MessageSender
+	traffic *trafficCounter
+}
+
+func (c *countingSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	resp, err := c.MessageSender.SendRequest(ctx, p, pmes)
+	c.traffic.sent(true, err)
+	return resp, err
+}
+
+func (c *countingSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	err := c.MessageSender.SendMessage(ctx, p, pmes)
+	c.traffic.sent(false, err)
+	return err
+}
+
+func (c *countingSender) SendMessageBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) error {
+	err := pb.SendMessageBatch(ctx, c.MessageSender, p, pmess)
+	for range pmess {
+		c.traffic.sent(false, err)
+	}
+	return err
+}
+
+// MetricsSnapshot returns the totals of the messages the DHT sent and received so far, for applications embedding the
+// DHT to report along with their own metrics, whether the DHT's views are registered or not. All totals are read at
+// once, so they're consistent with each other.
+func (dht *IpfsDHT) MetricsSnapshot() DHTMetrics {
+	return dht.traffic.snapshot()
 }
@@ -0,0 +1,387 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// pipeNet carries the streams between DHTs over in-memory pipes, so that the
+// message sender, its stream pool and the handling of inbound streams can be
+// exercised without any network in between. DHTs join it by building their
+// message sender with sender, and by being added.
+type pipeNet struct {
+	mu    sync.Mutex
+	dhts  map[peer.ID]*IpfsDHT
+	conns map[[2]peer.ID]*pipeConn // by local and remote peer
+
+	streams int32 // number of streams opened
+}
+
+func newPipeNet() *pipeNet {
+	return &pipeNet{
+		dhts:  make(map[peer.ID]*IpfsDHT),
+		conns: make(map[[2]peer.ID]*pipeConn),
+	}
+}
+
+// setupPipedDHTs sets up two server DHTs, connected only through a pipeNet.
+func setupPipedDHTs(ctx context.Context, t *testing.T, options ...Option) (*pipeNet, *IpfsDHT, *IpfsDHT) {
+	t.Helper()
+	return setupPipedDHTsWithSender(ctx, t, nil, options...)
+}
+
+// setupPipedDHTsWithSender is setupPipedDHTs with options for the message
+// senders of the DHTs.
+func setupPipedDHTsWithSender(ctx context.Context, t *testing.T, senderOpts []net.Option, options ...Option) (*pipeNet, *IpfsDHT, *IpfsDHT) {
+	t.Helper()
+
+	pn := newPipeNet()
+	mn := mocknet.New(ctx)
+	dhts := make([]*IpfsDHT, 2)
+	for i := range dhts {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := append([]Option{
+			testPrefix,
+			NamespacedValidator("v", blankValidator{}),
+			DisableAutoRefresh(),
+			Mode(ModeServer),
+			CustomMessageSender(pn.sender(senderOpts...)),
+		}, options...)
+		d, err := New(ctx, h, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pn.add(d)
+		dhts[i] = d
+	}
+	return pn, dhts[0], dhts[1]
+}
+
+// sender builds message senders that open their streams on the pipe net, see
+// CustomMessageSender.
+func (pn *pipeNet) sender(opts ...net.Option) func(h host.Host, protos []protocol.ID) pb.MessageSender {
+	return func(h host.Host, protos []protocol.ID) pb.MessageSender {
+		return net.NewMessageSenderImpl(&pipeHost{Host: h, pn: pn}, protos, opts...)
+	}
+}
+
+// add makes d handle the streams opened to it on the pipe net.
+func (pn *pipeNet) add(d *IpfsDHT) {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	pn.dhts[d.self] = d
+}
+
+// conn returns the connection from local to remote, opening it if needed.
+func (pn *pipeNet) conn(local, remote peer.ID, dir network.Direction) *pipeConn {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	c, ok := pn.conns[[2]peer.ID{local, remote}]
+	if !ok {
+		c = &pipeConn{local: local, remote: remote, dir: dir}
+		pn.conns[[2]peer.ID{local, remote}] = c
+	}
+	return c
+}
+
+// connected returns the connection from local to remote, if any.
+func (pn *pipeNet) connected(local, remote peer.ID) *pipeConn {
+	pn.mu.Lock()
+	defer pn.mu.Unlock()
+	return pn.conns[[2]peer.ID{local, remote}]
+}
+
+// newStream opens a stream from local to remote, with the first of protos the
+// remote DHT speaks, and has the remote DHT handle the other end.
+func (pn *pipeNet) newStream(local, remote peer.ID, protos []protocol.ID) (network.Stream, error) {
+	pn.mu.Lock()
+	d, ok := pn.dhts[remote]
+	pn.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no DHT %s on the pipe net", remote)
+	}
+
+	var proto protocol.ID
+	for _, p := range protos {
+		for _, sp := range d.serverProtocols {
+			if p == sp && proto == "" {
+				proto = p
+			}
+		}
+	}
+	if proto == "" {
+		return nil, fmt.Errorf("%s speaks none of %v", remote, protos)
+	}
+
+	out, in := newPipeStreams(pn.conn(local, remote, network.DirOutbound), pn.conn(remote, local, network.DirInbound), proto)
+	atomic.AddInt32(&pn.streams, 1)
+	go d.handleNewStream(in)
+	return out, nil
+}
+
+// openedStreams returns the number of streams opened on the pipe net.
+func (pn *pipeNet) openedStreams() int {
+	return int(atomic.LoadInt32(&pn.streams))
+}
+
+// pipeHost stands in for a DHT's host towards its message sender, opening
+// streams on the pipe net instead of the host's network.
+type pipeHost struct {
+	host.Host
+	pn *pipeNet
+}
+
+func (h *pipeHost) NewStream(ctx context.Context, p peer.ID, protos ...protocol.ID) (network.Stream, error) {
+	return h.pn.newStream(h.ID(), p, protos)
+}
+
+func (h *pipeHost) Network() network.Network {
+	return &pipeNetwork{Network: h.Host.Network(), h: h}
+}
+
+// pipeNetwork reports the connections of the pipe net as the host's.
+type pipeNetwork struct {
+	network.Network
+	h *pipeHost
+}
+
+func (n *pipeNetwork) ConnsToPeer(p peer.ID) []network.Conn {
+	if c := n.h.pn.connected(n.h.ID(), p); c != nil {
+		return []network.Conn{c}
+	}
+	return nil
+}
+
+func (n *pipeNetwork) Connectedness(p peer.ID) network.Connectedness {
+	if n.h.pn.connected(n.h.ID(), p) != nil {
+		return network.Connected
+	}
+	return network.NotConnected
+}
+
+// pipeConn is one side of the connection between two peers on the pipe net.
+// Only what the DHT needs of a connection is implemented.
+type pipeConn struct {
+	network.Conn
+	local, remote peer.ID
+	dir           network.Direction
+
+	mu      sync.Mutex
+	streams []network.Stream
+}
+
+func (c *pipeConn) LocalPeer() peer.ID  { return c.local }
+func (c *pipeConn) RemotePeer() peer.ID { return c.remote }
+func (c *pipeConn) ID() string          { return fmt.Sprintf("%s-%s", c.local, c.remote) }
+func (c *pipeConn) Stat() network.Stat  { return network.Stat{Direction: c.dir} }
+
+// RemoteMultiaddr returns nil, pipes have no address.
+func (c *pipeConn) RemoteMultiaddr() ma.Multiaddr { return nil }
+
+func (c *pipeConn) GetStreams() []network.Stream {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]network.Stream(nil), c.streams...)
+}
+
+func (c *pipeConn) addStream(s network.Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams = append(c.streams, s)
+}
+
+var pipeStreamIDs int64
+
+// newPipeStreams returns the two linked ends of a stream speaking proto, the
+// outbound one on the connection out and the inbound one on the connection in.
+// What's written to one end is read from the other.
+func newPipeStreams(out, in *pipeConn, proto protocol.ID) (network.Stream, network.Stream) {
+	id := strconv.FormatInt(atomic.AddInt64(&pipeStreamIDs, 1), 10)
+	ab, ba := newPipeBuffer(), newPipeBuffer()
+	a := &pipeStream{id: id, r: ba, w: ab, conn: out, proto: proto, dir: network.DirOutbound}
+	b := &pipeStream{id: id, r: ab, w: ba, conn: in, proto: proto, dir: network.DirInbound}
+	out.addStream(a)
+	in.addStream(b)
+	return a, b
+}
+
+// pipeStream is one end of a stream on the pipe net.
+type pipeStream struct {
+	id    string
+	r, w  *pipeBuffer
+	conn  *pipeConn
+	proto protocol.ID
+	dir   network.Direction
+
+	// writes never block, so they only fail once the deadline has passed
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+func (s *pipeStream) Read(p []byte) (int, error) { return s.r.read(p) }
+
+func (s *pipeStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	deadline := s.writeDeadline
+	s.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, pipeTimeoutError{}
+	}
+	return s.w.write(p)
+}
+
+func (s *pipeStream) Close() error {
+	s.w.close()
+	s.r.reset()
+	return nil
+}
+
+func (s *pipeStream) CloseWrite() error {
+	s.w.close()
+	return nil
+}
+
+func (s *pipeStream) CloseRead() error {
+	s.r.reset()
+	return nil
+}
+
+func (s *pipeStream) Reset() error {
+	s.r.reset()
+	s.w.reset()
+	return nil
+}
+
+func (s *pipeStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *pipeStream) SetReadDeadline(t time.Time) error {
+	s.r.setDeadline(t)
+	return nil
+}
+
+func (s *pipeStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeDeadline = t
+	return nil
+}
+
+func (s *pipeStream) ID() string                    { return s.id }
+func (s *pipeStream) Protocol() protocol.ID         { return s.proto }
+func (s *pipeStream) SetProtocol(proto protocol.ID) { s.proto = proto }
+func (s *pipeStream) Stat() network.Stat            { return network.Stat{Direction: s.dir} }
+func (s *pipeStream) Conn() network.Conn            { return s.conn }
+
+// pipeTimeoutError is returned by the reads and writes past a stream's deadline.
+type pipeTimeoutError struct{}
+
+func (pipeTimeoutError) Error() string   { return "i/o deadline reached" }
+func (pipeTimeoutError) Timeout() bool   { return true }
+func (pipeTimeoutError) Temporary() bool { return true }
+
+// pipeBuffer carries one direction of a pipe stream. Writes never block, reads
+// block until there's something to read, the writer closes the buffer, either
+// end resets it, or the reader's deadline passes.
+type pipeBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	closed   bool
+	failed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		switch {
+		case b.failed:
+			return 0, mux.ErrReset
+		case b.buf.Len() > 0:
+			return b.buf.Read(p)
+		case b.closed:
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			return 0, pipeTimeoutError{}
+		}
+		b.cond.Wait()
+	}
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failed:
+		return 0, mux.ErrReset
+	case b.closed:
+		return 0, fmt.Errorf("write on closed stream")
+	}
+	b.cond.Broadcast()
+	return b.buf.Write(p)
+}
+
+func (b *pipeBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *pipeBuffer) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed = true
+	b.buf.Reset()
+	b.cond.Broadcast()
+}
+
+func (b *pipeBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.cond.Broadcast()
+		})
+	}
+	b.cond.Broadcast()
+}
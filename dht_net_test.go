@@ -0,0 +1,3314 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
+
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// openIdleStream opens a DHT stream from h to d and returns a channel that is
+// closed once the remote side resets it.
+func openIdleStream(ctx context.Context, t *testing.T, h host.Host, d *IpfsDHT) <-chan struct{} {
+	t.Helper()
+
+	s, err := h.NewStream(ctx, d.self, d.serverProtocols...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1)
+		_, _ = s.Read(buf)
+	}()
+	return done
+}
+
+func TestInboundReadTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	os := []Option{testPrefix, DisableAutoRefresh(), Mode(ModeServer)}
+	fast, err := New(ctx, hosts[0], append(os, InboundReadTimeout(100*time.Millisecond))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := New(ctx, hosts[1], append(os, InboundReadTimeout(2*time.Second))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	fastDone := openIdleStream(ctx, t, hosts[2], fast)
+	slowDone := openIdleStream(ctx, t, hosts[2], slow)
+
+	select {
+	case <-fastDone:
+	case <-slowDone:
+		t.Fatal("the DHT with the longer timeout reset the stream first")
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle stream to be reset")
+	}
+
+	select {
+	case <-slowDone:
+		t.Fatal("the DHT with the longer timeout reset the stream too early")
+	default:
+	}
+
+	select {
+	case <-slowDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the idle stream to be reset")
+	}
+}
+
+func TestInboundReadTimeoutHandlerReturns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	const timeout = 100 * time.Millisecond
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), InboundReadTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		ok      bool
+		elapsed time.Duration
+	}
+	results := make(chan result, 1)
+	hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+		start := time.Now()
+		ok := d.handleNewMessage(s)
+		_ = s.Reset()
+		results <- result{ok, time.Since(start)}
+	})
+
+	openIdleStream(ctx, t, hosts[1], d)
+
+	select {
+	case res := <-results:
+		if res.ok {
+			t.Fatal("expected the idle stream to be handled as an error")
+		}
+		if res.elapsed < timeout {
+			t.Fatalf("handler returned after %s, before the timeout", res.elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handler to return once the read timed out")
+	}
+}
+
+func TestInboundReadTimeoutExcludesHandling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	const timeout = 100 * time.Millisecond
+	// Handling the request takes longer than the read timeout.
+	slowFilter := func(p peer.ID, req *pb.Message) error {
+		time.Sleep(3 * timeout)
+		return nil
+	}
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer),
+		InboundReadTimeout(timeout), InboundMessageFilter(slowFilter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	if _, err := r.ReadMsg(); err != nil {
+		t.Fatalf("expected a response despite the slow handler, got %v", err)
+	}
+}
+
+func TestResponseEchoesRequestId(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := hosts[1].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	req := pb.NewMessage(pb.Message_FIND_NODE, []byte(hosts[1].ID()), 0)
+	req.RequestId = 42
+	if err := net.WriteMsg(s, req); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp pb.Message
+	if err := resp.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetRequestId() != 42 {
+		t.Fatalf("expected the request id to be echoed, got %d", resp.GetRequestId())
+	}
+}
+
+func TestInboundReadTimeoutValidation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(ctx, mn.Hosts()[0], testPrefix, InboundReadTimeout(0)); err == nil {
+		t.Fatal("expected a non-positive timeout to be rejected")
+	}
+}
+
+// fakeMessageSender answers every request with a canned response instead of
+// talking to the network.
+type fakeMessageSender struct {
+	lk       sync.Mutex
+	requests map[peer.ID]int
+	respond  func(p peer.ID, pmes *pb.Message) (*pb.Message, error)
+}
+
+func (f *fakeMessageSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	f.lk.Lock()
+	if f.requests == nil {
+		f.requests = make(map[peer.ID]int)
+	}
+	f.requests[p]++
+	f.lk.Unlock()
+	return f.respond(p, pmes)
+}
+
+func (f *fakeMessageSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	_, err := f.SendRequest(ctx, p, pmes)
+	return err
+}
+
+func (f *fakeMessageSender) requestCount(p peer.ID) int {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+	return f.requests[p]
+}
+
+func TestCustomMessageSender(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	server, target := hosts[1], hosts[2]
+
+	fake := &fakeMessageSender{
+		respond: func(p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+			resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
+			if p == server.ID() {
+				resp.CloserPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: target.ID(), Addrs: target.Addrs()}})
+			}
+			return resp, nil
+		},
+	}
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer),
+		CustomMessageSender(func(h host.Host, protos []protocol.ID) pb.MessageSender { return fake }))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Advertise the DHT protocol so that the server makes it into the routing table.
+	for _, proto := range d.protocols {
+		server.SetStreamHandler(proto, func(s network.Stream) { _ = s.Reset() })
+	}
+	if _, err := mn.ConnectPeers(hosts[0].ID(), server.ID()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && d.routingTable.Size() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pi, err := d.FindPeer(ctx, target.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.ID != target.ID() {
+		t.Fatalf("expected to find %s, got %s", target.ID(), pi.ID)
+	}
+	if fake.requestCount(server.ID()) == 0 {
+		t.Fatal("expected the query to go through the custom message sender")
+	}
+}
+
+func TestProvideMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two undefined keys, and a key given twice.
+	keys := append([]cid.Cid{cid.Undef}, testCaseCids[:10]...)
+	keys = append(keys, cid.Undef, testCaseCids[2])
+	undefined := []int{0, 11}
+
+	t.Run("stream reuse", func(t *testing.T) {
+		client := setupDHT(ctx, t, false)
+		defer client.Close()
+		servers := make([]*IpfsDHT, 3)
+		streams := make([]int32, len(servers))
+		for i := range servers {
+			server := setupDHT(ctx, t, false)
+			defer server.Close()
+			servers[i] = server
+			n := &streams[i]
+			server.host.SetStreamHandler(server.protocols[0], func(s network.Stream) {
+				if s.Conn().RemotePeer() == client.self {
+					atomic.AddInt32(n, 1)
+				}
+				server.handleNewStream(s)
+			})
+			connect(t, ctx, client, server)
+		}
+
+		err := client.ProvideMany(ctx, keys)
+		var perr ProvideManyError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected a ProvideManyError, got %v", err)
+		}
+		if len(perr) != len(undefined) {
+			t.Fatalf("expected only the undefined keys to fail, got %v", perr)
+		}
+		for i, ke := range perr {
+			if ke.Index != undefined[i] || ke.Key.Defined() {
+				t.Fatalf("expected undefined key %d to be reported, got %v", undefined[i], ke)
+			}
+		}
+
+		for i, server := range servers {
+			// The records are one-way messages, stored once the server read them.
+			for _, c := range testCaseCids[:10] {
+				deadline := time.Now().Add(5 * time.Second)
+				for len(server.ProviderManager.GetProviders(ctx, c.Hash())) == 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if provs := server.ProviderManager.GetProviders(ctx, c.Hash()); len(provs) != 1 || provs[0] != client.self {
+					t.Fatalf("expected %s to have the provider record of %s, got %v", server.self, c, provs)
+				}
+			}
+			// Every record, along with the lookups, went over the one stream
+			// the client opened to the server.
+			if n := atomic.LoadInt32(&streams[i]); n != 1 {
+				t.Fatalf("expected the client to open 1 stream to %s, got %d", server.self, n)
+			}
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		mn, err := mocknet.FullMeshLinked(ctx, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := mn.Hosts()
+		servers := hosts[1:]
+
+		rejected := fmt.Errorf("rejected")
+		fake := &fakeMessageSender{
+			respond: func(p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+				if pmes.GetType() == pb.Message_ADD_PROVIDER {
+					return nil, rejected
+				}
+				return pb.NewMessage(pmes.GetType(), pmes.GetKey(), 0), nil
+			},
+		}
+		d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer),
+			CustomMessageSender(func(h host.Host, protos []protocol.ID) pb.MessageSender { return fake }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		for _, server := range servers {
+			for _, proto := range d.protocols {
+				server.SetStreamHandler(proto, func(s network.Stream) { _ = s.Reset() })
+			}
+			if _, err := mn.ConnectPeers(hosts[0].ID(), server.ID()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 100 && d.routingTable.Size() < len(servers); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Every key is reported once, at its first position.
+		err = d.ProvideMany(ctx, keys)
+		var perr ProvideManyError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected a ProvideManyError, got %v", err)
+		}
+		if len(perr) != len(keys)-1 {
+			t.Fatalf("expected %d keys to fail, got %v", len(keys)-1, perr)
+		}
+		for i, ke := range perr {
+			if ke.Index != i {
+				t.Fatalf("expected key %d to be reported, got %v", i, ke)
+			}
+			if ke.Key.Defined() && !errors.Is(ke, rejected) {
+				t.Fatalf("expected key %d to be rejected, got %v", i, ke.Err)
+			}
+		}
+	})
+}
+
+func TestMaxInboundStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	core, logs := observer.New(zap.DebugLevel)
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)),
+		MaxInboundStreams(3), MaxInboundStreamsPerPeer(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertOpen := func(done <-chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+			t.Fatal("expected the stream to stay open")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	assertReset := func(done <-chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the stream to be reset")
+		}
+	}
+
+	// The per-peer limit kicks in first for a single peer.
+	assertOpen(openIdleStream(ctx, t, hosts[1], d))
+	assertOpen(openIdleStream(ctx, t, hosts[1], d))
+	assertReset(openIdleStream(ctx, t, hosts[1], d))
+
+	// Another peer still gets served until the global limit is reached.
+	assertOpen(openIdleStream(ctx, t, hosts[2], d))
+	assertReset(openIdleStream(ctx, t, hosts[2], d))
+
+	for _, h := range hosts[1:] {
+		entries := logs.FilterMessage("inbound stream limit reached, resetting stream").
+			FilterField(zap.String("from", h.ID().String())).All()
+		if len(entries) != 1 {
+			t.Fatalf("expected the rejected stream of %s to be logged once, got %d entries", h.ID(), len(entries))
+		}
+	}
+}
+
+func TestMismatchedReplyLogged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(pb.Message_GET_VALUE, func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			return pb.NewMessage(pb.Message_PING, nil, 0), nil
+		}, true))
+	core, logs := observer.New(zap.DebugLevel)
+	client := setupDHT(ctx, t, false, Logger(zap.New(core)))
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	if _, _, err := client.protoMessenger.GetValue(ctx, server.self, "key"); !errors.Is(err, pb.ErrMismatchedReply) {
+		t.Fatalf("expected a mismatched reply, got %v", err)
+	}
+	entries := logs.FilterMessage("mismatched reply").
+		FilterField(zap.String("from", server.self.String())).
+		FilterField(zap.Int32("request", int32(pb.Message_GET_VALUE))).
+		FilterField(zap.Int32("reply", int32(pb.Message_PING))).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected the mismatched reply to be logged once, got %d entries", len(entries))
+	}
+}
+
+func TestIsStreamReset(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		reset bool
+	}{
+		{mux.ErrReset, true},
+		{fmt.Errorf("read failed: %w", mux.ErrReset), true},
+		{fmt.Errorf("yamux: remote peer dropped the stream: %w", mux.ErrReset), true},
+		{errors.New("stream reset"), false},
+		{io.ErrUnexpectedEOF, false},
+		{ErrReadTimeout, false},
+		{nil, false},
+	} {
+		if got := isStreamReset(tc.err); got != tc.reset {
+			t.Errorf("isStreamReset(%v) = %t, expected %t", tc.err, got, tc.reset)
+		}
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, HandlerTimeout(pb.Message_GET_VALUE, 50*time.Millisecond))
+
+	cancelled := make(chan struct{})
+	slow := func(ctx context.Context, _ peer.ID, _ *pb.Message) (*pb.Message, error) {
+		select {
+		case <-ctx.Done():
+			close(cancelled)
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil, nil
+		}
+	}
+
+	start := time.Now()
+	_, err := d.callHandler(ctx, slow, "peer", pb.NewMessage(pb.Message_GET_VALUE, []byte("key"), 0))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the handler to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handler ran for %s, past the configured bound", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the handler's context to be cancelled")
+	}
+
+	// Message types without a configured timeout run unbounded.
+	if _, err := d.callHandler(ctx, d.handlePing, "peer", pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInboundMessageFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := func(p peer.ID, req *pb.Message) error {
+		if string(req.GetKey()) == "/v/blocked" {
+			return fmt.Errorf("key not served")
+		}
+		return nil
+	}
+	server := setupDHT(ctx, t, false, InboundMessageFilter(filter))
+	client := setupDHT(ctx, t, true)
+	connectNoSync(t, ctx, client, server)
+
+	if err := client.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/blocked", []byte("value"))); err == nil {
+		t.Fatal("expected the filtered put to fail")
+	}
+	if err := client.protoMessenger.PutValue(ctx, server.self, record.MakePutRecord("/v/allowed", []byte("value"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, err := server.getLocal("/v/blocked"); err != nil || rec != nil {
+		t.Fatalf("expected the filtered record not to be stored, got %v (err: %v)", rec, err)
+	}
+	if rec, err := server.getLocal("/v/allowed"); err != nil || rec == nil {
+		t.Fatalf("expected the record to be stored (err: %v)", err)
+	}
+}
+
+// viewCountForType returns the count aggregated by a registered view for the
+// given message type.
+func viewCountForType(t *testing.T, v *view.View, typ pb.Message_MessageType) int64 {
+	t.Helper()
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyMessageType && tg.Value == typ.String() {
+				switch data := r.Data.(type) {
+				case *view.CountData:
+					total += data.Value
+				case *view.SumData:
+					total += int64(data.Value)
+				case *view.DistributionData:
+					total += data.Count
+				}
+			}
+		}
+	}
+	return total
+}
+
+func TestOneWayMessageMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	views := []*view.View{metrics.ReceivedOneWayMessagesView, metrics.InboundRequestLatencyView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	core, logs := observer.New(zap.DebugLevel)
+	server := setupDHT(ctx, t, false, Logger(zap.New(core)))
+	client := setupDHT(ctx, t, true)
+	connectNoSync(t, ctx, client, server)
+
+	if err := client.protoMessenger.PutProvider(ctx, server.self, testCaseCids[0].Hash(), client.host); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; viewCountForType(t, metrics.ReceivedOneWayMessagesView, pb.Message_ADD_PROVIDER) == 0; i++ {
+		if i > 100 {
+			t.Fatal("expected the one-way message counter to move")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := viewCountForType(t, metrics.InboundRequestLatencyView, pb.Message_ADD_PROVIDER); n != 0 {
+		t.Fatalf("expected no response to be recorded, got %d", n)
+	}
+
+	entries := logs.FilterMessage("handled one-way message").
+		FilterField(zap.String("from", client.self.String())).
+		FilterField(zap.Int32("type", int32(pb.Message_ADD_PROVIDER))).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected the one-way message to be logged once, got %d entries", len(entries))
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, true, MaxMessageSize(8<<20))
+	rec := record.MakePutRecord("/v/large", make([]byte, network.MessageSizeMax+1024))
+
+	defaultServer := setupDHT(ctx, t, false)
+	connectNoSync(t, ctx, client, defaultServer)
+	if err := client.protoMessenger.PutValue(ctx, defaultServer.self, rec); err == nil {
+		t.Fatal("expected a message over the default limit to be rejected")
+	}
+
+	raisedServer := setupDHT(ctx, t, false, MaxMessageSize(8<<20))
+	connectNoSync(t, ctx, client, raisedServer)
+	if err := client.protoMessenger.PutValue(ctx, raisedServer.self, rec); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxMessageSizeClamping(t *testing.T) {
+	for _, tc := range []struct{ in, out int }{
+		{-1, network.MessageSizeMax},
+		{0, network.MessageSizeMax},
+		{1 << 20, 1 << 20},
+		{1 << 40, maxMessageSizeCeiling},
+	} {
+		var cfg dhtcfg.Config
+		if err := MaxMessageSize(tc.in)(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.MaxMessageSize != tc.out {
+			t.Errorf("MaxMessageSize(%d) = %d, expected %d", tc.in, cfg.MaxMessageSize, tc.out)
+		}
+	}
+}
+
+// chanLatencyRecorder passes the samples it records on to a channel, dropping
+// them once it's full.
+type chanLatencyRecorder chan time.Duration
+
+func (r chanLatencyRecorder) RecordLatency(p peer.ID, rtt time.Duration) {
+	select {
+	case r <- rtt:
+	default:
+	}
+}
+
+func TestOnLatencySample(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type sample struct {
+		p   peer.ID
+		rtt time.Duration
+	}
+	for _, tc := range []struct {
+		name     string
+		tracking bool
+	}{
+		{name: "recorded", tracking: true},
+		// The samples are still measured for the callback.
+		{name: "tracking disabled", tracking: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			samples := make(chan sample, 1)
+			recorded := make(chanLatencyRecorder, 1)
+			server := setupDHT(ctx, t, false)
+			client := setupDHT(ctx, t, false,
+				CustomLatencyRecorder(recorded),
+				LatencyTracking(tc.tracking),
+				OnLatencySample(func(p peer.ID, rtt time.Duration) { samples <- sample{p, rtt} }))
+			defer server.Close()
+			defer client.Close()
+			connectNoSync(t, ctx, client, server)
+
+			if err := client.protoMessenger.Ping(ctx, server.self); err != nil {
+				t.Fatal(err)
+			}
+
+			var s sample
+			select {
+			case s = <-samples:
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the latency callback to fire")
+			}
+			if s.p != server.self {
+				t.Fatalf("expected a sample for %s, got %s", server.self, s.p)
+			}
+			if s.rtt <= 0 || s.rtt > time.Second {
+				t.Fatalf("implausible round trip time %s", s.rtt)
+			}
+			select {
+			case rtt := <-recorded:
+				if !tc.tracking {
+					t.Fatalf("expected nothing to be recorded with latency tracking disabled, got %s", rtt)
+				}
+				// The callback sees the sample that was recorded.
+				if rtt != s.rtt {
+					t.Fatalf("expected the sample %s to be the one recorded, got %s", s.rtt, rtt)
+				}
+			default:
+				if tc.tracking {
+					t.Fatal("expected the sample to be recorded")
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsLabelTransformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.ReceivedMessagesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.ReceivedMessagesView)
+
+	const collapsed = "collapsed-peer"
+	server := setupDHT(ctx, t, false, MetricsLabelTransformer(func(key tag.Key, value string) string {
+		if key == metrics.KeyPeerID {
+			return collapsed
+		}
+		return value
+	}))
+	client := setupDHT(ctx, t, true)
+	connectNoSync(t, ctx, client, server)
+
+	if err := client.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(metrics.ReceivedMessagesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key != metrics.KeyPeerID {
+				continue
+			}
+			if tg.Value == server.self.Pretty() {
+				t.Fatalf("expected the server's peer ID to be collapsed, got %q", tg.Value)
+			}
+			found = found || tg.Value == collapsed
+		}
+	}
+	if !found {
+		t.Fatal("expected the collapsed peer ID to be used as a label")
+	}
+}
+
+// countingStream counts the writes made to the underlying stream.
+type countingStream struct {
+	network.Stream
+	writes *int64
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	atomic.AddInt64(s.writes, 1)
+	return s.Stream.Write(p)
+}
+
+func BenchmarkResponseCoalescing(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var writes int64
+	hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+		if d.handleNewMessage(&countingStream{Stream: s, writes: &writes}) {
+			_ = s.Close()
+		} else {
+			_ = s.Reset()
+		}
+	})
+
+	const burst = 16
+	reqs := make([]*pb.Message, burst)
+	for i := range reqs {
+		reqs[i] = pb.NewMessage(pb.Message_PING, nil, 0)
+	}
+
+	run := func(b *testing.B, send func(s network.Stream, r msgio.Reader) error) {
+		atomic.StoreInt64(&writes, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s, err := hosts[1].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := send(s, msgio.NewVarintReaderSize(s, network.MessageSizeMax)); err != nil {
+				b.Fatal(err)
+			}
+			_ = s.Close()
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N*burst), "writes/response")
+	}
+
+	b.Run("pipelined", func(b *testing.B) {
+		run(b, func(s network.Stream, r msgio.Reader) error {
+			if err := net.WriteMsgs(s, reqs); err != nil {
+				return err
+			}
+			for range reqs {
+				if _, err := r.ReadMsg(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+
+	b.Run("lockstep", func(b *testing.B) {
+		run(b, func(s network.Stream, r msgio.Reader) error {
+			for _, req := range reqs {
+				if err := net.WriteMsg(s, req); err != nil {
+					return err
+				}
+				if _, err := r.ReadMsg(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// failingWriteStream fails every write with err.
+type failingWriteStream struct {
+	network.Stream
+	err error
+}
+
+func (s *failingWriteStream) Write([]byte) (int, error) { return 0, s.err }
+
+func TestResponseWriteErrorsMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.ResponseWriteErrorsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.ResponseWriteErrorsView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countFor := func(typ pb.Message_MessageType, class string) int64 {
+		rows, err := view.RetrieveData(metrics.ResponseWriteErrorsView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, r := range rows {
+			var typeMatches, classMatches, self bool
+			for _, tg := range r.Tags {
+				typeMatches = typeMatches || (tg.Key == metrics.KeyMessageType && tg.Value == typ.String())
+				classMatches = classMatches || (tg.Key == metrics.KeyErrorClass && tg.Value == class)
+				self = self || (tg.Key == metrics.KeyPeerID && tg.Value == d.self.Pretty())
+			}
+			if typeMatches && classMatches && self {
+				total += r.Data.(*view.CountData).Value
+			}
+		}
+		return total
+	}
+
+	for _, tc := range []struct {
+		class string
+		err   error
+	}{
+		{"cancelled", context.Canceled},
+		{"reset", mux.ErrReset},
+		{"other", fmt.Errorf("broken pipe")},
+	} {
+		t.Run(tc.class, func(t *testing.T) {
+			handled := make(chan bool, 1)
+			hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+				handled <- d.handleNewMessage(&failingWriteStream{Stream: s, err: tc.err})
+				_ = s.Reset()
+			})
+
+			s, err := hosts[1].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case ok := <-handled:
+				if ok {
+					t.Fatal("expected handling the stream to fail")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the stream to be handled")
+			}
+			if n := countFor(pb.Message_PING, tc.class); n != 1 {
+				t.Fatalf("expected one %s write error for PING, got %d", tc.class, n)
+			}
+		})
+	}
+}
+
+// recordingExporter records every span exported to it.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+// find returns the spans with the given name exchanged with p.
+func (e *recordingExporter) find(name string, p peer.ID) []*trace.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var found []*trace.SpanData
+	for _, s := range e.spans {
+		if s.Name == name && s.Attributes["peer"] == p.Pretty() {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func TestTraceSampler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exporter := &recordingExporter{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), TraceSampler(trace.AlwaysSample()))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh(), TraceSampler(trace.AlwaysSample()))
+	defer a.Close()
+	defer b.Close()
+	connectNoSync(t, ctx, a, b)
+
+	for i := 0; i < 3; i++ {
+		if _, err := a.protoMessenger.GetClosestPeers(ctx, b.self, a.self); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(name string, p peer.ID, kind int) {
+		t.Helper()
+		var spans []*trace.SpanData
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			spans = nil
+			for _, s := range exporter.find(name, p) {
+				if s.Attributes["message_type"] == pb.Message_FIND_NODE.String() {
+					spans = append(spans, s)
+				}
+			}
+			if len(spans) >= 3 {
+				break
+			}
+		}
+		if len(spans) != 3 {
+			t.Fatalf("expected a %s span per request, got %d", name, len(spans))
+		}
+		for _, s := range spans {
+			if s.SpanKind != kind {
+				t.Fatalf("expected %s span of kind %d, got %d", name, kind, s.SpanKind)
+			}
+			if size, _ := s.Attributes["message_size"].(int64); size <= 0 {
+				t.Fatalf("expected %s span to record the message size, got %v", name, s.Attributes["message_size"])
+			}
+			if _, ok := s.Attributes["latency_ms"].(float64); !ok {
+				t.Fatalf("expected %s span to record the latency", name)
+			}
+		}
+	}
+	check("dht.SendRequest", b.self, trace.SpanKindClient)
+	check("dht.handleMessage", a.self, trace.SpanKindServer)
+}
+
+// outboundProtocols returns the protocols of the outbound streams from h to p.
+func outboundProtocols(h host.Host, p peer.ID) []protocol.ID {
+	var protos []protocol.ID
+	for _, c := range h.Network().ConnsToPeer(p) {
+		for _, s := range c.GetStreams() {
+			if s.Stat().Direction == network.DirOutbound {
+				protos = append(protos, s.Protocol())
+			}
+		}
+	}
+	return protos
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), Compression(true))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh(), Compression(true))
+	c := setupDHT(ctx, t, false, DisableAutoRefresh())
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	connectNoSync(t, ctx, a, b)
+	connectNoSync(t, ctx, a, c)
+	connectNoSync(t, ctx, c, b)
+
+	compressed := net.CompressedProtocol(a.protocols[0])
+	for _, tc := range []struct {
+		from, to *IpfsDHT
+		proto    protocol.ID
+	}{
+		{a, b, compressed},
+		{a, c, a.protocols[0]},
+		{c, a, a.protocols[0]},
+		{c, b, a.protocols[0]},
+	} {
+		if err := tc.from.protoMessenger.Ping(ctx, tc.to.self); err != nil {
+			t.Fatal(err)
+		}
+		protos := outboundProtocols(tc.from.host, tc.to.self)
+		if len(protos) != 1 || protos[0] != tc.proto {
+			t.Fatalf("expected a stream speaking %s, got %v", tc.proto, protos)
+		}
+	}
+}
+
+func TestMessageChecksums(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.CorruptMessagesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.CorruptMessagesView)
+
+	a := setupDHT(ctx, t, false, DisableAutoRefresh(), MessageChecksums(true))
+	b := setupDHT(ctx, t, false, DisableAutoRefresh(), MessageChecksums(true))
+	c := setupDHT(ctx, t, false, DisableAutoRefresh())
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	connectNoSync(t, ctx, a, b)
+	connectNoSync(t, ctx, a, c)
+	connectNoSync(t, ctx, c, b)
+
+	checksummed := net.ChecksummedProtocol(a.protocols[0])
+	for _, tc := range []struct {
+		from, to *IpfsDHT
+		proto    protocol.ID
+	}{
+		{a, b, checksummed},
+		{a, c, a.protocols[0]},
+		{c, b, a.protocols[0]},
+	} {
+		if err := tc.from.protoMessenger.Ping(ctx, tc.to.self); err != nil {
+			t.Fatal(err)
+		}
+		protos := outboundProtocols(tc.from.host, tc.to.self)
+		if len(protos) != 1 || protos[0] != tc.proto {
+			t.Fatalf("expected a stream speaking %s, got %v", tc.proto, protos)
+		}
+	}
+
+	// Send a request corrupted in transit, followed by an intact one.
+	s, err := a.host.NewStream(ctx, b.self, checksummed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	encode := func(id uint64) []byte {
+		req := pb.NewMessage(pb.Message_PING, []byte("key"), 0)
+		req.RequestId = id
+		if err := req.SetChecksum(); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	corrupted := encode(1)
+	corrupted[bytes.Index(corrupted, []byte("key"))] ^= 0x01
+	w := msgio.NewVarintWriter(s)
+	for _, buf := range [][]byte{corrupted, encode(2)} {
+		if err := w.WriteMsg(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp pb.Message
+	if err := resp.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetRequestId() != 2 || !resp.VerifyChecksum() {
+		t.Fatalf("expected a checksummed response to the intact request only, got %+v", resp)
+	}
+
+	rows, err := view.RetrieveData(metrics.CorruptMessagesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupt int64
+	for _, r := range rows {
+		corrupt += r.Data.(*view.CountData).Value
+	}
+	if corrupt != 1 {
+		t.Fatalf("expected 1 corrupt message to be counted, got %d", corrupt)
+	}
+}
+
+func TestInboundRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.InboundRateLimitedView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.InboundRateLimitedView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	rateLimited := func(d *IpfsDHT) int64 {
+		rows, err := view.RetrieveData(metrics.InboundRateLimitedView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		for _, r := range rows {
+			for _, tg := range r.Tags {
+				if tg.Key == metrics.KeyPeerID && tg.Value == d.self.Pretty() {
+					total += r.Data.(*view.CountData).Value
+				}
+			}
+		}
+		return total
+	}
+
+	pings := func(n int) []*pb.Message {
+		reqs := make([]*pb.Message, n)
+		for i := range reqs {
+			reqs[i] = pb.NewMessage(pb.Message_PING, nil, 0)
+		}
+		return reqs
+	}
+
+	t.Run("delay", func(t *testing.T) {
+		const rate, burst, n = 20, 2, 6
+		d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), InboundRateLimit(rate, burst))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		s, err := hosts[2].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		start := time.Now()
+		if err := net.WriteMsgs(s, pings(n)); err != nil {
+			t.Fatal(err)
+		}
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for i := 0; i < n; i++ {
+			if _, err := r.ReadMsg(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Every message past the burst waits for a token.
+		if elapsed, min := time.Since(start), (n-burst)*time.Second/rate; elapsed < min*3/4 {
+			t.Fatalf("expected the replies to take at least %s, took %s", min, elapsed)
+		}
+		if got := rateLimited(d); got < 1 || got > n-burst {
+			t.Fatalf("expected between 1 and %d rate limited messages, got %d", n-burst, got)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		// A second token would only be available after 100s, longer than we're
+		// willing to delay the message.
+		d, err := New(ctx, hosts[1], testPrefix, DisableAutoRefresh(), Mode(ModeServer), InboundRateLimit(0.01, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		s, err := hosts[2].NewStream(ctx, hosts[1].ID(), d.protocols[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		if err := net.WriteMsgs(s, pings(2)); err != nil {
+			t.Fatal(err)
+		}
+		// The first ping is answered before the stream is closed, without a
+		// reset that could drop the answer.
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		if _, err := r.ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadMsg(); err != io.EOF {
+			t.Fatalf("expected the stream to be closed, got %v", err)
+		}
+		if got := rateLimited(d); got != 1 {
+			t.Fatalf("expected 1 rate limited message, got %d", got)
+		}
+	})
+}
+
+func TestInFlightRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	// The fake never responds until released.
+	release := make(chan struct{})
+	fake := &fakeMessageSender{
+		respond: func(p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+			<-release
+			return nil, errors.New("no response")
+		},
+	}
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(),
+		CustomMessageSender(func(h host.Host, protos []protocol.ID) pb.MessageSender { return fake }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if reqs := d.InFlightRequests(); len(reqs) != 0 {
+		t.Fatalf("expected no requests in flight, got %v", reqs)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = d.protoMessenger.Ping(ctx, hosts[1].ID())
+	}()
+
+	var reqs []RequestInfo
+	for start := time.Now(); len(reqs) == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		reqs = d.InFlightRequests()
+	}
+	if len(reqs) != 1 {
+		t.Fatalf("expected 1 request in flight, got %v", reqs)
+	}
+	if reqs[0].Peer != hosts[1].ID() || reqs[0].Type != pb.Message_PING || reqs[0].Elapsed <= 0 {
+		t.Fatalf("unexpected request in flight %+v", reqs[0])
+	}
+
+	close(release)
+	<-done
+	if reqs := d.InFlightRequests(); len(reqs) != 0 {
+		t.Fatalf("expected no requests in flight once the request failed, got %v", reqs)
+	}
+}
+
+// blockingGater blocks the given peer, and allows everything else.
+type blockingGater struct {
+	blocked peer.ID
+}
+
+func (g *blockingGater) InterceptPeerDial(p peer.ID) bool                 { return p != g.blocked }
+func (g *blockingGater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool { return p != g.blocked }
+func (g *blockingGater) InterceptAccept(network.ConnMultiaddrs) bool      { return true }
+func (g *blockingGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return p != g.blocked
+}
+func (g *blockingGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+func TestConnectionGater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.InboundStreamsGatedView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.InboundStreamsGatedView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	var handled int32
+	core, logs := observer.New(zap.DebugLevel)
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)),
+		ConnectionGater(&blockingGater{blocked: hosts[1].ID()}),
+		RegisterMessageHandler(pb.Message_PING, func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			atomic.AddInt32(&handled, 1)
+			return req, nil
+		}, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	ping := func(h host.Host) error {
+		s, err := h.NewStream(ctx, d.self, d.protocols[0])
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			return err
+		}
+		_, err = msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg()
+		return err
+	}
+
+	if err := ping(hosts[1]); err == nil {
+		t.Fatal("expected the stream of the blocked peer to be reset")
+	}
+	if n := atomic.LoadInt32(&handled); n != 0 {
+		t.Fatalf("expected no message of the blocked peer to be handled, got %d", n)
+	}
+	rows, err := view.RetrieveData(metrics.InboundStreamsGatedView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gated int64
+	for _, r := range rows {
+		gated += r.Data.(*view.CountData).Value
+	}
+	if gated != 1 {
+		t.Fatalf("expected 1 gated stream, got %d", gated)
+	}
+	entries := logs.FilterMessage("peer blocked by the connection gater, resetting stream").
+		FilterField(zap.String("from", hosts[1].ID().String())).All()
+	if len(entries) != 1 {
+		t.Fatalf("expected the gated stream to be logged once, got %d entries", len(entries))
+	}
+
+	if err := ping(hosts[2]); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("expected the message of the allowed peer to be handled, got %d", n)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	core, logs := observer.New(zap.DebugLevel)
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Without a key the request can't be handled.
+	req := pb.NewMessage(pb.Message_GET_VALUE, nil, 0)
+	if err := net.WriteMsg(s, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err == nil {
+		t.Fatal("expected the stream to be reset")
+	}
+
+	var entries []observer.LoggedEntry
+	for start := time.Now(); len(entries) == 0 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		entries = logs.FilterMessage("error handling message").All()
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 handler error to be logged, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["from"] != hosts[1].ID().String() {
+		t.Fatalf("expected the remote peer to be logged, got %v", fields["from"])
+	}
+	if fields["type"] != int32(pb.Message_GET_VALUE) {
+		t.Fatalf("expected the message type to be logged, got %v", fields["type"])
+	}
+	if fields["size"] != int64(req.Size()) {
+		t.Fatalf("expected the message size to be logged, got %v", fields["size"])
+	}
+	if _, ok := fields["error"]; !ok {
+		t.Fatal("expected the error to be logged")
+	}
+}
+
+func TestInstanceID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	handled := make(chan string, 2)
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		id, _ := InstanceIDFromContext(ctx)
+		handled <- id
+		return req, nil
+	}
+	core, logs := observer.New(zap.DebugLevel)
+	opts := []Option{testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)),
+		RegisterMessageHandler(pb.Message_PING, ping, true)}
+	first, err := New(ctx, hosts[0], opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := New(ctx, hosts[1], append(opts, InstanceID("second"))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if first.InstanceID() == "" || first.InstanceID() == second.InstanceID() || second.InstanceID() != "second" {
+		t.Fatalf("expected distinct instance ids, got %q and %q", first.InstanceID(), second.InstanceID())
+	}
+
+	for _, d := range []*IpfsDHT{first, second} {
+		s, err := hosts[2].NewStream(ctx, d.self, d.protocols[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Close()
+		if id := <-handled; id != d.InstanceID() {
+			t.Fatalf("expected the handler context to carry instance id %q, got %q", d.InstanceID(), id)
+		}
+	}
+
+	instances := make(map[interface{}]int)
+	for _, e := range logs.FilterMessage("handled message").FilterField(zap.String("from", hosts[2].ID().String())).All() {
+		instances[e.ContextMap()["instance"]]++
+	}
+	if len(instances) != 2 || instances[first.InstanceID()] != 1 || instances["second"] != 1 {
+		t.Fatalf("expected one log line carrying each instance id, got %v", instances)
+	}
+}
+
+func TestHalfClosedStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, n := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d requests", n), func(t *testing.T) {
+			s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			reqs := make([]*pb.Message, n)
+			for i := range reqs {
+				reqs[i] = pb.NewMessage(pb.Message_PING, nil, 0)
+			}
+			if err := net.WriteMsgs(s, reqs); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+			for i := 0; i < n; i++ {
+				if _, err := r.ReadMsg(); err != nil {
+					t.Fatalf("expected response %d, got %v", i, err)
+				}
+			}
+			// The DHT closes the stream once it's done.
+			if _, err := r.ReadMsg(); err != io.EOF {
+				t.Fatalf("expected the stream to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+// loopedBackStream reports the given peer as being on the other side of the
+// stream.
+type loopedBackStream struct {
+	network.Stream
+	remote peer.ID
+}
+
+func (s *loopedBackStream) Conn() network.Conn {
+	return &loopedBackConn{Conn: s.Stream.Conn(), remote: s.remote}
+}
+
+type loopedBackConn struct {
+	network.Conn
+	remote peer.ID
+}
+
+func (c *loopedBackConn) RemotePeer() peer.ID { return c.remote }
+
+func TestSelfStreamRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.InboundSelfStreamsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.InboundSelfStreamsView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	var handled int32
+	core, logs := observer.New(zap.WarnLevel)
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)),
+		RegisterMessageHandler(pb.Message_PING, func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			atomic.AddInt32(&handled, 1)
+			return req, nil
+		}, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+		d.handleNewStream(&loopedBackStream{Stream: s, remote: d.self})
+	})
+
+	s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err == nil {
+		t.Fatal("expected a stream from ourselves to be reset")
+	}
+	if n := atomic.LoadInt32(&handled); n != 0 {
+		t.Fatalf("expected no message from ourselves to be handled, got %d", n)
+	}
+	if d.routingTable.Find(d.self) != "" {
+		t.Fatal("expected ourselves not to be in the routing table")
+	}
+	if n := logs.FilterMessage("received a stream from ourselves, resetting it").Len(); n != 1 {
+		t.Fatalf("expected the stream to be logged through the DHT's logger, got %d entries", n)
+	}
+
+	rows, err := view.RetrieveData(metrics.InboundSelfStreamsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var observed int64
+	for _, r := range rows {
+		observed += r.Data.(*view.CountData).Value
+	}
+	if observed != 1 {
+		t.Fatalf("expected 1 self stream to be counted, got %d", observed)
+	}
+}
+
+func TestInboundWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.ResponseWriteTimeoutsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.ResponseWriteTimeoutsView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	const timeout = 100 * time.Millisecond
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), InboundWriteTimeout(timeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	handled := make(chan bool, 1)
+	hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+		handled <- d.handleNewMessage(s)
+		_ = s.Reset()
+	})
+
+	// Keep sending requests without ever reading a response, until writing the
+	// responses blocks.
+	s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Reset()
+	go func() {
+		for {
+			if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case ok := <-handled:
+		if ok {
+			t.Fatal("expected writing to a peer that doesn't read to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected writing to a peer that doesn't read to time out")
+	}
+
+	rows, err := view.RetrieveData(metrics.ResponseWriteTimeoutsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeouts int64
+	for _, r := range rows {
+		timeouts += r.Data.(*view.CountData).Value
+	}
+	if timeouts != 1 {
+		t.Fatalf("expected 1 write timeout to be counted, got %d", timeouts)
+	}
+}
+
+func TestReceivedBytesPeerClass(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.ReceivedBytesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.ReceivedBytesView)
+
+	server := setupDHT(ctx, t, false)
+	// The server adds the known peer to its routing table, but not the
+	// unknown one, which doesn't advertise the DHT protocol.
+	known := setupDHT(ctx, t, false)
+	unknown := setupDHT(ctx, t, true)
+	defer server.Close()
+	defer known.Close()
+	defer unknown.Close()
+	connectNoSync(t, ctx, known, server)
+	wait(t, ctx, server, known)
+	connectNoSync(t, ctx, unknown, server)
+
+	for _, client := range []*IpfsDHT{known, unknown} {
+		if err := client.protoMessenger.Ping(ctx, server.self); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := view.RetrieveData(metrics.ReceivedBytesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes := make(map[string]int64)
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyPeerClass {
+				classes[tg.Value] += r.Data.(*view.DistributionData).Count
+			}
+		}
+	}
+	for _, class := range []string{"routing_table", "unknown"} {
+		if classes[class] == 0 {
+			t.Errorf("expected received bytes to be recorded for %q peers, got %v", class, classes)
+		}
+	}
+}
+
+func TestRepeatedAddProviderCollapsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.CollapsedAddProvidersView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.CollapsedAddProvidersView)
+
+	collapsed := func(t *testing.T) int64 {
+		t.Helper()
+		rows, err := view.RetrieveData(metrics.CollapsedAddProvidersView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int64
+		for _, r := range rows {
+			n += r.Data.(*view.CountData).Value
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		// sends the same announcement twice and then a ping, in order
+		send func(t *testing.T, client, server *IpfsDHT, announce func(id uint64) *pb.Message)
+	}{
+		{
+			// The repeat only differs by its request id.
+			name: "request ids",
+			send: func(t *testing.T, client, server *IpfsDHT, announce func(id uint64) *pb.Message) {
+				s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				for _, mes := range []*pb.Message{announce(1), announce(2), pb.NewMessage(pb.Message_PING, nil, 0)} {
+					if err := net.WriteMsg(s, mes); err != nil {
+						t.Fatal(err)
+					}
+				}
+				// The ping's response tells that both announcements were handled.
+				if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// The repeat also differs by its sequence number, all of them going
+			// over the client's pooled stream.
+			name: "sequence numbers",
+			opts: []Option{SequenceNumbers(true)},
+			send: func(t *testing.T, client, server *IpfsDHT, announce func(id uint64) *pb.Message) {
+				for i := 0; i < 2; i++ {
+					if err := client.msgSender.SendMessage(ctx, server.self, announce(0)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if _, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var server *IpfsDHT
+			stored := make(chan struct{}, 4)
+			store := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+				stored <- struct{}{}
+				return addProviderHandler(server.handleAddProvider)(ctx, p, req)
+			}
+			server = setupDHT(ctx, t, false, append(tc.opts, RegisterMessageHandler(pb.Message_ADD_PROVIDER, store, true))...)
+			client := setupDHT(ctx, t, false, tc.opts...)
+			defer server.Close()
+			defer client.Close()
+			connectNoSync(t, ctx, client, server)
+
+			key := []byte("provided-key")
+			announce := func(id uint64) *pb.Message {
+				mes := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+				mes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{{ID: client.self, Addrs: client.host.Addrs()}})
+				mes.RequestId = id
+				return mes
+			}
+
+			before := collapsed(t)
+			tc.send(t, client, server, announce)
+
+			if n := len(stored); n != 1 {
+				t.Fatalf("expected the provider record to be stored once, got %d", n)
+			}
+			if provs := server.ProviderManager.GetProviders(ctx, key); len(provs) != 1 || provs[0] != client.self {
+				t.Fatalf("expected %s to provide the key, got %v", client.self, provs)
+			}
+			if n := collapsed(t) - before; n != 1 {
+				t.Fatalf("expected one collapsed announcement, got %d", n)
+			}
+		})
+	}
+}
+
+func TestAddProviderDedupWindow(t *testing.T) {
+	announce := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("provided-key"), 0)
+	other := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("other-key"), 0)
+
+	var d addProviderDedup
+	start := time.Now()
+	for _, tc := range []struct {
+		mes      *pb.Message
+		at       time.Duration
+		repeated bool
+	}{
+		{announce, 0, false},
+		{announce, addProviderDedupWindow / 2, true},
+		// The window runs from the record being stored, not from the last
+		// repeat.
+		{announce, addProviderDedupWindow, false},
+		{announce, addProviderDedupWindow + 1, true},
+		{other, addProviderDedupWindow + 2, false},
+		{announce, addProviderDedupWindow + 3, false},
+	} {
+		if got := d.repeated(tc.mes, start.Add(tc.at)); got != tc.repeated {
+			t.Fatalf("expected %q at %s to be repeated: %t, got %t", tc.mes.GetKey(), tc.at, tc.repeated, got)
+		}
+	}
+}
+
+func TestSlowDownHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var slow int32
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return pb.NewMessage(pb.Message_PING, nil, 0), nil
+	}
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(pb.Message_PING, ping, true),
+		SlowDownHint(10*time.Millisecond, 0),
+	)
+	slowedDown := make(chan peer.ID, 1)
+	client := setupDHT(ctx, t, false, OnSlowDown(func(p peer.ID) { slowedDown <- p }))
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	resp, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetSlowDown() {
+		t.Fatal("expected a fast response not to ask to slow down")
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	resp, err = client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetSlowDown() {
+		t.Fatal("expected a slow response to ask to slow down")
+	}
+
+	if err := client.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-slowedDown:
+		if p != server.self {
+			t.Fatalf("expected %s to ask to slow down, got %s", server.self, p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow down hint wasn't reported")
+	}
+}
+
+func TestSlowDownHintInboundStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The stream the request arrives on counts itself.
+	server := setupDHT(ctx, t, false, SlowDownHint(0, 1))
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	resp, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, nil, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.GetSlowDown() {
+		t.Fatal("expected a response to ask to slow down at the stream threshold")
+	}
+}
+
+func TestStreamedFindNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+		}
+	}()
+	server, client := dhts[0], dhts[1]
+	for _, d := range dhts[1:] {
+		connect(t, ctx, server, d)
+	}
+
+	s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	req := pb.NewMessage(pb.Message_FIND_NODE, []byte(client.self), 0)
+	req.RequestId = 7
+	req.BatchSize = 1
+	if err := net.WriteMsg(s, req); err != nil {
+		t.Fatal(err)
+	}
+
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	readBatch := func() {
+		t.Helper()
+		buf, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var batch pb.Message
+		if err := batch.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if batch.GetType() != pb.Message_FIND_NODE || batch.GetRequestId() != 7 || len(batch.CloserPeers) != 1 {
+			t.Fatalf("expected a batch of one closer peer, got %+v", batch)
+		}
+	}
+
+	readBatch()
+	if err := net.WriteMsg(s, &pb.Message{Type: pb.Message_FIND_NODE, RequestId: 7}); err != nil {
+		t.Fatal(err)
+	}
+	readBatch()
+
+	// Stop after two of the three batches.
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := r.ReadMsg(); err != io.EOF {
+		t.Fatalf("expected the server to stop streaming, read %d bytes and %v", len(buf), err)
+	}
+}
+
+func TestStreamedFindNodeSendRequestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+		}
+	}()
+	server, client := dhts[0], dhts[1]
+	for _, d := range dhts[1:] {
+		connect(t, ctx, server, d)
+	}
+
+	type streamer interface {
+		SendRequestStream(ctx context.Context, p peer.ID, pmes *pb.Message) (<-chan *pb.Message, error)
+	}
+	req := pb.NewMessage(pb.Message_FIND_NODE, []byte(client.self), 0)
+	req.BatchSize = 2
+	replies, err := client.msgSender.(streamer).SendRequestStream(ctx, server.self, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var batches, peers int
+	for batch := range replies {
+		batches++
+		peers += len(batch.CloserPeers)
+	}
+	if batches != 2 || peers != 3 {
+		t.Fatalf("expected 3 closer peers in 2 batches, got %d in %d", peers, batches)
+	}
+}
+
+func TestOversizedResponseTruncated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.TruncatedResponsesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.TruncatedResponsesView)
+
+	addrs := make([]ma.Multiaddr, 100)
+	for i := range addrs {
+		addrs[i] = ma.StringCast(fmt.Sprintf("/ip4/1.2.3.%d/tcp/4001", i))
+	}
+	for _, tc := range []struct {
+		name string
+		// the server's MaxMessageSize and the size responses must fit in
+		maxSize, fit int
+		// the closer peers the server answers with, and their addresses each
+		peers, addrs int
+	}{
+		{name: "lowered limit", maxSize: 4096, fit: 4096, peers: 100, addrs: 1},
+		// Peers with the standard limit couldn't read responses fitting the
+		// server's own.
+		{name: "raised limit", maxSize: 2 * network.MessageSizeMax, fit: network.MessageSizeMax, peers: 5000, addrs: 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var closer []peer.AddrInfo
+			for i := 0; i < tc.peers; i++ {
+				closer = append(closer, peer.AddrInfo{ID: test.RandPeerIDFatal(t), Addrs: addrs[:tc.addrs]})
+			}
+			findNode := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+				resp := pb.NewMessage(pb.Message_FIND_NODE, req.GetKey(), 0)
+				resp.CloserPeers = pb.RawPeerInfosToPBPeers(closer)
+				return resp, nil
+			}
+			server := setupDHT(ctx, t, false,
+				RegisterMessageHandler(pb.Message_FIND_NODE, findNode, true),
+				MaxMessageSize(tc.maxSize),
+			)
+			client := setupDHT(ctx, t, false)
+			defer server.Close()
+			defer client.Close()
+			connectNoSync(t, ctx, client, server)
+
+			resp, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Size() > tc.fit {
+				t.Fatalf("expected the response to fit in %d bytes, got %d", tc.fit, resp.Size())
+			}
+			if n := len(resp.CloserPeers); n == 0 || n == len(closer) {
+				t.Fatalf("expected some of the %d closer peers to be dropped, got %d", len(closer), n)
+			}
+			// The most relevant peers are kept, intact.
+			for i, pi := range pb.PBPeersToPeerInfos(resp.CloserPeers) {
+				if pi.ID != closer[i].ID || len(pi.Addrs) != tc.addrs || !pi.Addrs[0].Equal(closer[i].Addrs[0]) {
+					t.Fatalf("expected closer peer %d to be %v, got %v", i, closer[i], pi)
+				}
+			}
+		})
+	}
+
+	rows, err := view.RetrieveData(metrics.TruncatedResponsesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var truncated int64
+	for _, r := range rows {
+		truncated += r.Data.(*view.CountData).Value
+	}
+	if truncated < 2 {
+		t.Fatalf("expected both truncated responses to be counted, got %d", truncated)
+	}
+}
+
+func BenchmarkHandlerWorkers(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+	const burst = 16
+	// Every request costs about as much as an expensive lookup.
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		time.Sleep(250 * time.Microsecond)
+		return pb.NewMessage(req.GetType(), nil, 0), nil
+	}
+	reqs := make([]*pb.Message, burst)
+	for i := range reqs {
+		reqs[i] = pb.NewMessage(experimental, nil, 0)
+		reqs[i].RequestId = uint64(i)
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			mn, err := mocknet.FullMeshConnected(ctx, 2)
+			if err != nil {
+				b.Fatal(err)
+			}
+			hosts := mn.Hosts()
+			d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer),
+				RegisterMessageHandler(experimental, handler, false), HandlerWorkers(workers))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer d.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s, err := hosts[1].NewStream(ctx, hosts[0].ID(), d.protocols[0])
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := net.WriteMsgs(s, reqs); err != nil {
+					b.Fatal(err)
+				}
+				r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+				for range reqs {
+					if _, err := r.ReadMsg(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				_ = s.Close()
+			}
+		})
+	}
+}
+
+func TestHandlerWorkersPreserveOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+	const pipelined = 8
+	var running, maxRunning int32
+	// Earlier requests take longer, so that their handlers finish last.
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(pipelined-req.GetRequestId()) * 5 * time.Millisecond)
+		return pb.NewMessage(req.GetType(), req.GetKey(), 0), nil
+	}
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(experimental, handler, false),
+		HandlerWorkers(4),
+	)
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	reqs := make([]*pb.Message, pipelined)
+	for i := range reqs {
+		reqs[i] = pb.NewMessage(experimental, []byte(fmt.Sprint(i)), 0)
+		reqs[i].RequestId = uint64(i)
+	}
+	if err := net.WriteMsgs(s, reqs); err != nil {
+		t.Fatal(err)
+	}
+
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for i := range reqs {
+		buf, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp pb.Message
+		if err := resp.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetRequestId() != uint64(i) || string(resp.GetKey()) != fmt.Sprint(i) {
+			t.Fatalf("expected the response to request %d, got the one to %d", i, resp.GetRequestId())
+		}
+	}
+	if m := atomic.LoadInt32(&maxRunning); m < 2 || m > 4 {
+		t.Fatalf("expected between 2 and 4 handlers to run at once, got %d", m)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requester := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	defer requester.Close()
+	defer server.Close()
+	connect(t, ctx, requester, server)
+
+	lastUsefulAt := func() time.Time {
+		for _, pi := range server.routingTable.GetPeerInfos() {
+			if pi.Id == requester.self {
+				return pi.LastUsefulAt
+			}
+		}
+		t.Fatal("requester missing from the server's routing table")
+		return time.Time{}
+	}
+	if !lastUsefulAt().IsZero() {
+		t.Fatal("requester already counted as queried")
+	}
+
+	rtt, err := requester.Probe(ctx, server.self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("expected a positive round trip time, got %s", rtt)
+	}
+	if requester.host.Peerstore().LatencyEWMA(server.self) == 0 {
+		t.Fatal("expected the probe's round trip to be recorded")
+	}
+
+	// Give the server the time to update its routing table, as it would have
+	// after a ping.
+	time.Sleep(50 * time.Millisecond)
+	if !lastUsefulAt().IsZero() {
+		t.Fatal("probe counted as a query")
+	}
+
+	if err := requester.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+	for lastUsefulAt().IsZero() {
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestSequenceGaps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.SequenceGapsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.SequenceGapsView)
+	gaps := func() int64 {
+		rows, err := view.RetrieveData(metrics.SequenceGapsView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int64
+		for _, r := range rows {
+			n += r.Data.(*view.CountData).Value
+		}
+		return n
+	}
+
+	var seqs []uint64
+	var mu sync.Mutex
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		mu.Lock()
+		seqs = append(seqs, req.GetSequence())
+		mu.Unlock()
+		return req, nil
+	}
+	server := setupDHT(ctx, t, false, SequenceNumbers(true), RegisterMessageHandler(pb.Message_PING, ping, true))
+	client := setupDHT(ctx, t, false, SequenceNumbers(true))
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	// Messages sent in order don't count as gaps.
+	for i := 0; i < 3; i++ {
+		if err := client.Ping(ctx, server.self); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Fatalf("expected the pings to be numbered 1 to 3, got %v", seqs)
+	}
+	mu.Unlock()
+	if n := gaps(); n != 0 {
+		t.Fatalf("expected no gaps, got %d", n)
+	}
+
+	s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 4 skips 3, and 3 then comes after 4.
+	var reqs []*pb.Message
+	for _, seq := range []uint64{1, 2, 4, 3} {
+		req := pb.NewMessage(pb.Message_PING, nil, 0)
+		req.Sequence = seq
+		reqs = append(reqs, req)
+	}
+	if err := net.WriteMsgs(s, reqs); err != nil {
+		t.Fatal(err)
+	}
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for range reqs {
+		if _, err := r.ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := gaps(); n != 2 {
+		t.Fatalf("expected 2 gaps, got %d", n)
+	}
+}
+
+// thresholdLatencyRecorder passes the samples below a threshold on to a
+// peerstore and drops the others.
+type thresholdLatencyRecorder struct {
+	ps        peerstore.Peerstore
+	threshold time.Duration
+	dropped   int32
+}
+
+func (r *thresholdLatencyRecorder) RecordLatency(p peer.ID, rtt time.Duration) {
+	if rtt > r.threshold {
+		atomic.AddInt32(&r.dropped, 1)
+		return
+	}
+	r.ps.RecordLatency(p, rtt)
+}
+
+func TestCustomLatencyRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const threshold = 100 * time.Millisecond
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		if string(req.GetKey()) == "slow" {
+			time.Sleep(2 * threshold)
+		}
+		return pb.NewMessage(pb.Message_PING, nil, 0), nil
+	}
+	server := setupDHT(ctx, t, false, RegisterMessageHandler(pb.Message_PING, ping, true))
+	h := bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport))
+	recorder := &thresholdLatencyRecorder{ps: h.Peerstore(), threshold: threshold}
+	client, err := New(ctx, h, testPrefix, DisableAutoRefresh(), Mode(ModeServer), CustomLatencyRecorder(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	// The first request also opens the stream.
+	for i := 0; i < 2; i++ {
+		if _, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accepted := h.Peerstore().LatencyEWMA(server.self)
+	dropped := atomic.LoadInt32(&recorder.dropped)
+	if accepted == 0 || accepted > threshold {
+		t.Fatalf("expected a sample below %s to be recorded, got %s", threshold, accepted)
+	}
+
+	if _, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(pb.Message_PING, []byte("slow"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&recorder.dropped) - dropped; n != 1 {
+		t.Fatalf("expected the slow sample to be dropped, %d were", n)
+	}
+	if got := h.Peerstore().LatencyEWMA(server.self); got != accepted {
+		t.Fatalf("expected the peerstore to only see the accepted sample, its estimate moved from %s to %s", accepted, got)
+	}
+}
+
+func TestOutboundMessageHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+	received := make(chan *pb.Message, 3)
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		received <- req
+		return pb.NewMessage(pb.Message_PING, nil, 0), nil
+	}
+	hook := func(p peer.ID, pmes *pb.Message) *pb.Message {
+		switch pmes.GetType() {
+		case pb.Message_PING:
+			pmes.Key = []byte("rewritten")
+			return pmes
+		case experimental:
+			return nil
+		}
+		return pmes
+	}
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(pb.Message_PING, ping, true),
+		RegisterMessageHandler(experimental, ping, false),
+	)
+	client := setupDHT(ctx, t, false, OutboundMessageHook(hook))
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	req := pb.NewMessage(pb.Message_PING, []byte("original"), 0)
+	if _, err := client.msgSender.SendRequest(ctx, server.self, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := string((<-received).GetKey()); got != "rewritten" {
+		t.Fatalf("expected the peer to receive the rewritten message, got key %q", got)
+	}
+	if string(req.GetKey()) != "original" {
+		t.Fatal("expected the caller's message to be left alone")
+	}
+
+	// Dropped messages never reach the peer.
+	dropped := pb.NewMessage(experimental, nil, 0)
+	if _, err := client.msgSender.SendRequest(ctx, server.self, dropped); err != net.ErrMessageDropped {
+		t.Fatalf("expected the request to be dropped, got %v", err)
+	}
+	if err := client.msgSender.SendMessage(ctx, server.self, dropped); err != nil {
+		t.Fatalf("expected the message to be dropped silently, got %v", err)
+	}
+	if _, err := client.msgSender.SendRequest(ctx, server.self, req); err != nil {
+		t.Fatal(err)
+	}
+	if typ := (<-received).GetType(); typ != pb.Message_PING {
+		t.Fatalf("expected only the ping to reach the peer, got a %s message first", typ)
+	}
+}
+
+// stalledWriteStream blocks writes until unstalled.
+type stalledWriteStream struct {
+	network.Stream
+	unstalled <-chan struct{}
+}
+
+func (s *stalledWriteStream) Write(p []byte) (int, error) {
+	<-s.unstalled
+	return s.Stream.Write(p)
+}
+
+func TestMaxOutstandingResponses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.OutstandingResponsesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.OutstandingResponsesView)
+
+	const experimental pb.Message_MessageType = 42
+	const outstanding, pipelined = 4, 20
+	servers := make(map[string]bool)
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			var handled int32
+			handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+				atomic.AddInt32(&handled, 1)
+				return pb.NewMessage(req.GetType(), req.GetKey(), 0), nil
+			}
+			server := setupDHT(ctx, t, false,
+				RegisterMessageHandler(experimental, handler, false),
+				HandlerWorkers(workers),
+				MaxOutstandingResponses(outstanding),
+			)
+			servers[server.self.Pretty()] = true
+			client := setupDHT(ctx, t, false)
+			defer server.Close()
+			defer client.Close()
+			connectNoSync(t, ctx, client, server)
+
+			unstalled := make(chan struct{})
+			server.host.SetStreamHandler(server.protocols[0], func(s network.Stream) {
+				server.handleNewStream(&stalledWriteStream{Stream: s, unstalled: unstalled})
+			})
+
+			s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			reqs := make([]*pb.Message, pipelined)
+			for i := range reqs {
+				reqs[i] = pb.NewMessage(experimental, []byte(fmt.Sprint(i)), 0)
+				reqs[i].RequestId = uint64(i)
+			}
+			if err := net.WriteMsgs(s, reqs); err != nil {
+				t.Fatal(err)
+			}
+
+			// No more requests are read while the responses can't be written.
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&handled) < outstanding && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if n := atomic.LoadInt32(&handled); n != outstanding {
+				t.Fatalf("expected reading to pause after %d requests, %d were handled", outstanding, n)
+			}
+
+			close(unstalled)
+			r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+			for i := range reqs {
+				buf, err := r.ReadMsg()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resp pb.Message
+				if err := resp.Unmarshal(buf); err != nil {
+					t.Fatal(err)
+				}
+				if resp.GetRequestId() != uint64(i) {
+					t.Fatalf("expected the response to request %d, got the one to %d", i, resp.GetRequestId())
+				}
+			}
+		})
+	}
+
+	// Both streams are recorded once they end, along with those the servers
+	// were sent other requests on.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, err := view.RetrieveData(metrics.OutstandingResponsesView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int64
+		var max float64
+		for _, r := range rows {
+			server := false
+			for _, tg := range r.Tags {
+				server = server || (tg.Key == metrics.KeyPeerID && servers[tg.Value])
+			}
+			if !server {
+				continue
+			}
+			d := r.Data.(*view.DistributionData)
+			count += d.Count
+			if d.Max > max {
+				max = d.Max
+			}
+		}
+		if count >= 2 {
+			if max != outstanding {
+				t.Fatalf("expected at most %d responses to be outstanding, got %v", outstanding, max)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the outstanding responses of 2 streams to be recorded, got %d", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipedRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pn, client, server := setupPipedDHTs(ctx, t)
+	defer client.Close()
+	defer server.Close()
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	if err := client.protoMessenger.PutValue(ctx, server.self, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := client.protoMessenger.GetValue(ctx, server.self, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.GetValue(), []byte("world")) {
+		t.Fatalf("expected to get the value back, got %q", got.GetValue())
+	}
+	// Both requests went over the same pooled stream.
+	if n := pn.openedStreams(); n != 1 {
+		t.Fatalf("expected 1 stream to be opened, got %d", n)
+	}
+}
+
+func TestSendRequestKeepStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pn, client, server := setupPipedDHTs(ctx, t)
+	defer client.Close()
+	defer server.Close()
+
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+	reply, hs, err := client.sendRequestKeepStream(ctx, server.self, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.GetType() != pb.Message_PING {
+		t.Fatalf("expected a PING reply, got %s", reply.GetType())
+	}
+	if _, err := hs.SendRequest(ctx, ping); err != nil {
+		t.Fatal(err)
+	}
+	// Both requests went over the held stream, without another dial.
+	if n := pn.openedStreams(); n != 1 {
+		t.Fatalf("expected 1 stream to be opened, got %d", n)
+	}
+
+	// Once put back, the stream serves the pool, and is no longer the caller's.
+	hs.Put()
+	if _, err := hs.SendRequest(ctx, ping); err != net.ErrStreamReleased {
+		t.Fatalf("expected the released stream to refuse requests, got %v", err)
+	}
+	if err := client.protoMessenger.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+	if n := pn.openedStreams(); n != 1 {
+		t.Fatalf("expected the pool to reuse the stream, got %d streams", n)
+	}
+}
+
+func TestRequestSetCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		received <- struct{}{}
+		<-release
+		return pb.NewMessage(req.GetType(), req.GetKey(), 0), nil
+	}
+	late := make(chan *pb.Message, 1)
+	onLateReply := func(p peer.ID, reply *pb.Message) { late <- reply }
+	pn, client, server := setupPipedDHTsWithSender(ctx, t, []net.Option{net.WithLateReplyHandler(onLateReply)},
+		RegisterMessageHandler(experimental, handler, false),
+	)
+	defer client.Close()
+	defer server.Close()
+
+	if err := client.protoMessenger.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+
+	// Giving up on the request through its set drains its reply instead of
+	// resetting the stream.
+	reqCtx, set := withRequestSet(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.requests.SendRequest(reqCtx, server.self, pb.NewMessage(experimental, []byte("key"), 0))
+		errc <- err
+	}()
+	<-received
+	set.cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be given up on, got %v", err)
+	}
+	close(release)
+	select {
+	case reply := <-late:
+		if reply.GetType() != experimental {
+			t.Fatalf("expected the drained reply, got a %s", reply.GetType())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the reply to be drained")
+	}
+
+	// The drained stream went back to the pool.
+	if err := client.protoMessenger.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+	if n := pn.openedStreams(); n != 1 {
+		t.Fatalf("expected the pool to reuse the drained stream, got %d streams", n)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	busy, other := hosts[1].ID(), hosts[2].ID()
+
+	gate := make(chan struct{})
+	var lk sync.Mutex
+	var handled []peer.ID
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), FairScheduling(true),
+		RegisterMessageHandler(pb.Message_PING, func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+			lk.Lock()
+			handled = append(handled, p)
+			lk.Unlock()
+			<-gate
+			return req, nil
+		}, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// A single slot, so that the order handlers run in is deterministic.
+	d.handlerScheduler = newFairScheduler(1)
+
+	ping := func(h host.Host) {
+		s, err := h.NewStream(ctx, d.self, d.protocols[0])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer s.Close()
+		if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err != nil {
+			t.Error(err)
+		}
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The busy peer takes the slot, and has many more requests waiting.
+	const streams = 20
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ping(hosts[1])
+		}()
+	}
+	waitFor("the busy peer's requests to wait", func() bool { return d.handlerScheduler.waiting(busy) == streams-1 })
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ping(hosts[2])
+	}()
+	waitFor("the other peer's request to wait", func() bool { return d.handlerScheduler.waiting(other) == 1 })
+	close(gate)
+	wg.Wait()
+
+	lk.Lock()
+	defer lk.Unlock()
+	if len(handled) != streams+1 {
+		t.Fatalf("expected %d requests to be handled, got %d", streams+1, len(handled))
+	}
+	// The other peer takes its turn after a single more request of the busy one.
+	for i, p := range handled {
+		if p == other {
+			if i > 2 {
+				t.Fatalf("expected the other peer's request to be handled third at the latest, it was handled after %d requests", i)
+			}
+			return
+		}
+	}
+	t.Fatal("expected the other peer's request to be handled")
+}
+
+// stalledUntilResetStream blocks writes until the stream is reset, like a
+// stream to a peer that doesn't read.
+type stalledUntilResetStream struct {
+	network.Stream
+	writing chan struct{}
+	reset   chan struct{}
+	once    sync.Once
+}
+
+func (s *stalledUntilResetStream) Write(p []byte) (int, error) {
+	select {
+	case s.writing <- struct{}{}:
+	default:
+	}
+	<-s.reset
+	return 0, mux.ErrReset
+}
+
+func (s *stalledUntilResetStream) Reset() error {
+	s.once.Do(func() { close(s.reset) })
+	return s.Stream.Reset()
+}
+
+func TestCloseInterruptsStalledFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writing := make(chan struct{}, 1)
+	handled := make(chan struct{})
+	hosts[0].SetStreamHandler(d.protocols[0], func(s network.Stream) {
+		defer close(handled)
+		d.handleNewStream(&stalledUntilResetStream{Stream: s, writing: writing, reset: make(chan struct{})})
+	})
+
+	s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-writing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the response to be written")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- d.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to return while a flush is stalled")
+	}
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stalled flush to be interrupted by Close")
+	}
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := setupDHT(ctx, t, false)
+	server := setupDHT(ctx, t, false)
+	defer client.Close()
+	defer server.Close()
+	connect(t, ctx, client, server)
+
+	before, serverBefore := client.MetricsSnapshot(), server.MetricsSnapshot()
+	if err := client.Ping(ctx, server.self); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.protoMessenger.PutProvider(ctx, server.self, testCaseCids[0].Hash(), client.host); err != nil {
+		t.Fatal(err)
+	}
+
+	after := client.MetricsSnapshot()
+	if n := after.SentRequests - before.SentRequests; n != 1 {
+		t.Fatalf("expected 1 more request to be counted, got %d", n)
+	}
+	if n := after.SentMessages - before.SentMessages; n != 1 {
+		t.Fatalf("expected 1 more message to be counted, got %d", n)
+	}
+	if after.SentRequestErrors != before.SentRequestErrors || after.SentMessageErrors != before.SentMessageErrors {
+		t.Fatalf("expected no errors to be counted, got %+v", after)
+	}
+
+	// The server counts both once it has read them.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		serverAfter := server.MetricsSnapshot()
+		if serverAfter.ReceivedMessages-serverBefore.ReceivedMessages == 2 {
+			if serverAfter.ReceivedBytes <= serverBefore.ReceivedBytes {
+				t.Fatalf("expected the received bytes to be counted, got %+v", serverAfter)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 more received messages to be counted, got %+v", serverAfter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSlowHandlerLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	const threshold = 50 * time.Millisecond
+	ping := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		if string(req.GetKey()) == "slow" {
+			time.Sleep(2 * threshold)
+		}
+		return req, nil
+	}
+	core, logs := observer.New(zap.DebugLevel)
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), Logger(zap.New(core)),
+		SlowHandlerLog(threshold), RegisterMessageHandler(pb.Message_PING, ping, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for _, key := range []string{"fast", "slow", "fast"} {
+		if err := net.WriteMsg(s, pb.NewMessage(pb.Message_PING, []byte(key), 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the slow request is logged, once its response has been written.
+	entries := logs.FilterMessage("slow message handling").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 slow request to be logged, got %d", len(entries))
+	}
+	if entries[0].Level != zap.WarnLevel {
+		t.Fatalf("expected a warning, got %s", entries[0].Level)
+	}
+	fields := entries[0].ContextMap()
+	if fields["from"] != hosts[1].ID().String() {
+		t.Fatalf("expected the remote peer to be logged, got %v", fields["from"])
+	}
+	if fields["type"] != int32(pb.Message_PING) {
+		t.Fatalf("expected the message type to be logged, got %v", fields["type"])
+	}
+	if !bytes.Equal(fields["key"].([]byte), []byte("slow")) {
+		t.Fatalf("expected the slow request to be logged, got %v", fields["key"])
+	}
+}
+
+// jsonCodec encodes messages as JSON, and remembers whether it only decoded JSON.
+type jsonCodec struct {
+	decoded, invalid int32
+}
+
+func (c *jsonCodec) Marshal(mes *pb.Message) ([]byte, error) {
+	return json.Marshal(mes)
+}
+
+func (c *jsonCodec) Unmarshal(data []byte, mes *pb.Message) error {
+	if !json.Valid(data) {
+		atomic.AddInt32(&c.invalid, 1)
+	}
+	atomic.AddInt32(&c.decoded, 1)
+	return json.Unmarshal(data, mes)
+}
+
+func TestMessageCodec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	codec := &jsonCodec{}
+	dhts := make([]*IpfsDHT, 2)
+	for i, h := range hosts {
+		d, err := New(ctx, h, testPrefix, NamespacedValidator("v", blankValidator{}), DisableAutoRefresh(),
+			Mode(ModeServer), MessageCodec(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		dhts[i] = d
+	}
+	client, server := dhts[0], dhts[1]
+
+	rec := record.MakePutRecord("/v/hello", []byte("world"))
+	if err := client.protoMessenger.PutValue(ctx, server.self, rec); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := client.protoMessenger.GetValue(ctx, server.self, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.GetValue(), []byte("world")) {
+		t.Fatalf("expected to get the value back, got %q", got.GetValue())
+	}
+	// Both requests and both replies went over the wire as JSON.
+	if n := atomic.LoadInt32(&codec.decoded); n != 4 {
+		t.Fatalf("expected 4 messages to be decoded, got %d", n)
+	}
+	if n := atomic.LoadInt32(&codec.invalid); n != 0 {
+		t.Fatalf("expected only JSON on the wire, got %d other messages", n)
+	}
+}
+
+func TestUnknownMessageTypeMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.UnknownMessageTypesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.UnknownMessageTypesView)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, typ := range []pb.Message_MessageType{42, 1000} {
+		s, err := hosts[1].NewStream(ctx, d.self, d.protocols[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := net.WriteMsg(s, pb.NewMessage(typ, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Read(make([]byte, 1)); !isStreamReset(err) {
+			t.Fatalf("expected the stream to be reset, got %v", err)
+		}
+	}
+
+	rows, err := view.RetrieveData(metrics.UnknownMessageTypesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int64)
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyMessageTypeValue {
+				counts[tg.Value] += r.Data.(*view.CountData).Value
+			}
+		}
+	}
+	// Large type values are lumped together.
+	if counts["42"] != 1 || counts["other"] != 1 || len(counts) != 2 {
+		t.Fatalf("expected one message of type 42 and one other to be counted, got %v", counts)
+	}
+}
+
+func TestAutoRoutingTableUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	requester := hosts[2]
+
+	var servers []*IpfsDHT
+	for i, enabled := range []bool{true, false} {
+		d, err := New(ctx, hosts[i], testPrefix, DisableAutoRefresh(), disableFixLowPeersRoutine(t), Mode(ModeServer),
+			AutoRoutingTableUpdate(enabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		// Make the requester look like a DHT server, so only the option keeps it out of the routing table. Identify
+		// overwrites the protocols of the requester, so wait for it first.
+		for {
+			protos, err := hosts[i].Peerstore().GetProtocols(requester.ID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(protos) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		hosts[i].Peerstore().AddProtocols(requester.ID(), string(d.protocols[0]))
+		servers = append(servers, d)
+	}
+
+	for _, d := range servers {
+		s, err := requester.NewStream(ctx, d.self, d.protocols[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := net.WriteMsg(s, pb.NewMessage(pb.Message_FIND_NODE, []byte(requester.ID()), 0)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The routing table is updated asynchronously, wait for the server that
+	// still does it before checking the other one didn't.
+	deadline := time.Now().Add(5 * time.Second)
+	for servers[0].routingTable.Find(requester.ID()) == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the requester to be added to the routing table")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if servers[1].routingTable.Find(requester.ID()) != "" {
+		t.Fatal("expected the requester not to be added to the routing table")
+	}
+}
+
+func TestMetricsSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var cfg dhtcfg.Config
+	if err := cfg.Apply(MetricsSampling(pb.Message_FIND_NODE, 0)); err == nil {
+		t.Fatal("expected a sampling rate of 0 to be refused")
+	}
+
+	views := []*view.View{metrics.ReceivedMessagesView, metrics.ReceivedBytesView, metrics.SentRequestsView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	const rate = 4
+	d, err := New(ctx, hosts[0], testPrefix, DisableAutoRefresh(), Mode(ModeServer), InstanceID("sampled-server"),
+		MetricsSampling(pb.Message_FIND_NODE, rate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	sender := net.NewMessageSenderImpl(hosts[1], d.protocols,
+		net.WithMetricsSampling(map[pb.Message_MessageType]int{pb.Message_FIND_NODE: rate}))
+	sendCtx, err := tag.New(ctx, tag.Upsert(metrics.KeyInstanceID, "sampled-client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 in 10 FIND_NODE requests are recorded, each standing for 4 of them,
+	// while every PING is.
+	for i := 0; i < 10; i++ {
+		if _, err := sender.SendRequest(sendCtx, d.self, pb.NewMessage(pb.Message_FIND_NODE, []byte(hosts[1].ID()), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := sender.SendRequest(sendCtx, d.self, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts := func(v *view.View, instance string) map[string]int64 {
+		t.Helper()
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[string]int64)
+		for _, r := range rows {
+			var typ string
+			var ours bool
+			for _, tg := range r.Tags {
+				switch tg.Key {
+				case metrics.KeyMessageType:
+					typ = tg.Value
+				case metrics.KeyInstanceID:
+					ours = tg.Value == instance
+				}
+			}
+			if !ours {
+				continue
+			}
+			switch data := r.Data.(type) {
+			case *view.SumData:
+				counts[typ] += int64(data.Value)
+			case *view.DistributionData:
+				counts[typ] += data.Count
+			}
+		}
+		return counts
+	}
+	for _, tc := range []struct {
+		view     *view.View
+		instance string
+		// the FIND_NODE requests the view counts
+		findNodes int64
+	}{
+		{metrics.ReceivedMessagesView, "sampled-server", 2 * rate},
+		// Only the sampled requests are measured.
+		{metrics.ReceivedBytesView, "sampled-server", 2},
+		{metrics.SentRequestsView, "sampled-client", 2 * rate},
+	} {
+		got := counts(tc.view, tc.instance)
+		if got[pb.Message_FIND_NODE.String()] != tc.findNodes || got[pb.Message_PING.String()] != 3 {
+			t.Fatalf("expected %s to count %d FIND_NODE and 3 PING, got %v", tc.view.Name, tc.findNodes, got)
+		}
+	}
+}
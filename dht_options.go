@@ -5,15 +5,23 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
 
 	ds "github.com/ipfs/go-datastore"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
 )
 
 // ModeOpt describes what mode the dht should operate in
@@ -34,6 +42,9 @@ const (
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
 const DefaultPrefix protocol.ID = "/ipfs"
 
+// maxMessageSizeCeiling is the largest value MaxMessageSize accepts.
+const maxMessageSizeCeiling = 64 << 20
+
 type Option = dhtcfg.Option
 
 // RoutingTableLatencyTolerance sets the maximum acceptable latency for peers
@@ -165,6 +176,21 @@ func BucketSize(bucketSize int) Option {
 	}
 }
 
+// MaxClosestPeersReturned caps the number of closest peers the DHT returns in response to FIND_NODE requests, which
+// makes responses smaller and less suitable for amplification on constrained networks. The cap never exceeds the
+// bucket size.
+//
+// The default value is the bucket size.
+func MaxClosestPeersReturned(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("max closest peers returned must be positive, got %d", n)
+		}
+		c.MaxClosestPeers = n
+		return nil
+	}
+}
+
 // Concurrency configures the number of concurrent requests (alpha in the Kademlia paper) for a given query path.
 //
 // The default value is 10.
@@ -186,6 +212,20 @@ func Resiliency(beta int) Option {
 	}
 }
 
+// LatencyAwareRouting makes queries prefer the peers with the lowest latency recorded in the peerstore. Among twice
+// as many of the closest peers as a query is about to send requests to, the fastest ones are sent a request first,
+// interleaved with the peers whose latency isn't known yet so that they get a chance to be measured. This speeds up
+// lookups on networks whose peers are far apart, at the cost of lookups taking slightly longer paths.
+//
+// Latencies are only known for the peers we've sent requests to, and only if they are recorded to the peerstore, as
+// they are unless CustomLatencyRecorder is set or LatencyTracking is disabled. Defaults to disabled.
+func LatencyAwareRouting(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LatencyAwareRouting = enabled
+		return nil
+	}
+}
+
 // MaxRecordAge specifies the maximum time that any node will hold onto a record ("PutValue record")
 // from the time its received. This does not apply to any other forms of validity that
 // the record may contain.
@@ -199,6 +239,546 @@ func MaxRecordAge(maxAge time.Duration) Option {
 	}
 }
 
+// InboundReadTimeout configures how long an inbound DHT stream may wait for the
+// next message before it is reset. Reads that exceed this bound are reported as
+// ErrReadTimeout.
+//
+// Defaults to 1 minute.
+func InboundReadTimeout(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("inbound read timeout must be positive, got %s", timeout)
+		}
+		c.InboundReadTimeout = timeout
+		return nil
+	}
+}
+
+// InboundWriteTimeout configures how long writing responses to an inbound DHT
+// stream may take before the stream is reset, so that a peer that stops reading
+// can't hold on to the stream forever. Writes that exceed this bound are
+// reported as ErrWriteTimeout.
+//
+// Defaults to 0, which doesn't bound writes.
+func InboundWriteTimeout(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout < 0 {
+			return fmt.Errorf("inbound write timeout must not be negative, got %s", timeout)
+		}
+		c.InboundWriteTimeout = timeout
+		return nil
+	}
+}
+
+// MaxInboundStreams limits the number of inbound DHT streams that are handled concurrently. Streams opened while the
+// limit is reached are reset immediately rather than queued.
+//
+// Defaults to 0 (unlimited).
+func MaxInboundStreams(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("max inbound streams must not be negative, got %d", n)
+		}
+		c.MaxInboundStreams = n
+		return nil
+	}
+}
+
+// MaxInboundStreamsPerPeer limits the number of inbound DHT streams that are handled concurrently for a single remote
+// peer, so that one peer can't starve the others. Streams opened while the limit is reached are reset immediately.
+//
+// Defaults to 0 (unlimited).
+func MaxInboundStreamsPerPeer(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("max inbound streams per peer must not be negative, got %d", n)
+		}
+		c.MaxInboundStreamsPerPeer = n
+		return nil
+	}
+}
+
+// Logger sets the logger the DHT writes its debug logs about the handling of inbound streams and messages to. Every
+// entry carries the instance id of the DHT and the remote peer, and where known the message type, key and size, as
+// structured fields.
+//
+// Defaults to the "dht" logger of go-log.
+func Logger(l *zap.Logger) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Logger = l
+		return nil
+	}
+}
+
+// InstanceID sets the id that tells this DHT apart from others in the same process. It is the "instance" field of the
+// DHT's logs about inbound messages and failed requests, the instance_id label of its metrics, and is carried by the
+// context passed to message handlers, see InstanceIDFromContext.
+//
+// Defaults to the address of the DHT in memory.
+func InstanceID(id string) Option {
+	return func(c *dhtcfg.Config) error {
+		c.InstanceID = id
+		return nil
+	}
+}
+
+// RequestRetries sets how many more times the DHT retries a request on a fresh stream when the one it was sent on
+// fails, e.g. because it was reset. A request is always retried once, so that a pooled stream the peer closed doesn't
+// fail it, and never retried once its context is done.
+//
+// Defaults to 0. Only applies to the default message sender, not to one set with CustomMessageSender.
+func RequestRetries(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("request retries must not be negative, got %d", n)
+		}
+		c.RequestRetries = n
+		return nil
+	}
+}
+
+// ConnectionGater makes the DHT check every inbound stream against the given gater and reset the streams of peers it
+// blocks before reading from them. This catches streams over connections that were established before the gater
+// started blocking the peer. Only InterceptSecured is consulted.
+//
+// Defaults to nil, i.e. no peer is blocked.
+func ConnectionGater(g connmgr.ConnectionGater) Option {
+	return func(c *dhtcfg.Config) error {
+		c.ConnectionGater = g
+		return nil
+	}
+}
+
+// InboundRateLimit limits the rate at which the messages of each remote peer are handled to rps messages per second,
+// allowing bursts of up to burst messages. Messages over the limit are delayed until the peer is within its limit
+// again, unless that would take more than a few seconds, in which case the message is left unanswered and the stream
+// is closed once the responses to the messages before it are written.
+//
+// Defaults to 0 (unlimited).
+func InboundRateLimit(rps float64, burst int) Option {
+	return func(c *dhtcfg.Config) error {
+		if rps < 0 {
+			return fmt.Errorf("inbound rate limit must not be negative, got %v", rps)
+		}
+		if rps > 0 && burst < 1 {
+			return fmt.Errorf("inbound rate limit burst must be at least 1, got %d", burst)
+		}
+		c.InboundRateLimit = rps
+		c.InboundRateBurst = burst
+		return nil
+	}
+}
+
+// HandlerTimeout bounds the time spent handling a single inbound message of the given type. When the bound is exceeded
+// the handler's context is cancelled and the stream is reset. This option can be given multiple times to configure
+// different message types.
+//
+// Defaults to no timeout for every message type.
+func HandlerTimeout(typ pb.Message_MessageType, timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("handler timeout for %s must be positive, got %s", typ, timeout)
+		}
+		if c.HandlerTimeouts == nil {
+			c.HandlerTimeouts = make(map[pb.Message_MessageType]time.Duration)
+		}
+		c.HandlerTimeouts[typ] = timeout
+		return nil
+	}
+}
+
+// DisabledMessageTypes makes the DHT refuse inbound messages of the given types, e.g. to serve FIND_NODE but not
+// GET_PROVIDERS on a constrained private network. Streams carrying a disabled message type are reset, as for message
+// types without a handler, even if a handler was registered for it with RegisterMessageHandler. This option can be
+// given multiple times, the disabled types add up.
+func DisabledMessageTypes(types ...pb.Message_MessageType) Option {
+	return func(c *dhtcfg.Config) error {
+		if c.DisabledMessageTypes == nil {
+			c.DisabledMessageTypes = make(map[pb.Message_MessageType]struct{}, len(types))
+		}
+		for _, typ := range types {
+			c.DisabledMessageTypes[typ] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// ResponseTokens protects peers from reflection and amplification attacks through the DHT by withholding the responses
+// to requests of the given types, e.g. GET_PROVIDERS, until the requester proves it receives what's sent to it. The
+// first request of a requester gets a small response carrying nothing but a token, which it has to echo in a repeated
+// request to get the full response. Tokens are bound to the requester and the address its request came from, and
+// expire after a few minutes. This DHT echoes tokens on its own, but peers that don't support them only ever get the
+// token. Streamed FIND_NODE responses are paced by the requester already and don't need a token. This option can be
+// given multiple times, the types add up.
+//
+// Defaults to no types.
+func ResponseTokens(types ...pb.Message_MessageType) Option {
+	return func(c *dhtcfg.Config) error {
+		if len(types) == 0 {
+			return fmt.Errorf("response tokens need at least one message type")
+		}
+		if c.ResponseTokenTypes == nil {
+			c.ResponseTokenTypes = make(map[pb.Message_MessageType]struct{}, len(types))
+		}
+		for _, typ := range types {
+			c.ResponseTokenTypes[typ] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// RegisterMessageHandler makes the DHT dispatch inbound messages of the given type to handler, e.g. to support an
+// experimental message type. Messages of types without a handler are rejected by resetting the stream. Replacing the
+// handler of one of the message types the DHT handles itself requires passing override. This option can be given
+// multiple times to register handlers for different message types.
+func RegisterMessageHandler(typ pb.Message_MessageType, handler MessageHandlerFunc, override bool) Option {
+	return func(c *dhtcfg.Config) error {
+		if handler == nil {
+			return fmt.Errorf("handler for %s must not be nil", typ)
+		}
+		if _, core := pb.Message_MessageType_name[int32(typ)]; core && !override {
+			return fmt.Errorf("%s is handled by the DHT, pass override to replace its handler", typ)
+		}
+		if c.MessageHandlers == nil {
+			c.MessageHandlers = make(map[pb.Message_MessageType]MessageHandlerFunc)
+		}
+		c.MessageHandlers[typ] = handler
+		return nil
+	}
+}
+
+// MaxMessageSize sets the maximum size of a single DHT message the DHT will read, both for inbound requests and for
+// responses to its own requests. Non-positive values fall back to the default and values above 64MiB are clamped.
+// Peers don't tell what they read, so responses are truncated to fit the smaller of this limit and
+// network.MessageSizeMax, for them to stay readable by peers with the standard limit.
+//
+// Defaults to network.MessageSizeMax.
+//
+// WARNING: do not change this unless you're using a forked DHT (i.e., a private
+// network and/or distinct DHT protocols with the `Protocols` option).
+func MaxMessageSize(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		switch {
+		case n <= 0:
+			n = network.MessageSizeMax
+		case n > maxMessageSizeCeiling:
+			n = maxMessageSizeCeiling
+		}
+		c.MaxMessageSize = n
+		return nil
+	}
+}
+
+// WriteBufferSize sets the size of the buffer responses to inbound requests are written through. A larger buffer
+// means fewer writes for large responses, e.g. long lists of providers, and for bursts of pipelined responses, at the
+// cost of that much memory per inbound stream. Non-positive values fall back to the default.
+//
+// Defaults to 4KiB.
+func WriteBufferSize(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			n = 0
+		}
+		c.WriteBufferSize = n
+		return nil
+	}
+}
+
+// HandlerWorkers sets how many of the requests a peer pipelines on a single stream may be handled at once. With more
+// than one worker, the next requests are read while handlers run, so that a slow handler doesn't hold up the requests
+// behind it. Responses are still written in the order the requests were read.
+//
+// Defaults to 1, handling the requests of a stream one after the other.
+func HandlerWorkers(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("handler workers must not be negative, got %d", n)
+		}
+		c.HandlerWorkers = n
+		return nil
+	}
+}
+
+// FairScheduling sets whether the handlers of inbound requests are scheduled fairly between peers. When enabled, at
+// most GOMAXPROCS handlers run at once across all inbound streams, and once they're all busy, the peers with requests
+// waiting take turns, so that a peer opening many streams can't starve the requests of other peers.
+//
+// Defaults to false, running the handler of every stream as soon as its request is read.
+func FairScheduling(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.FairScheduling = enabled
+		return nil
+	}
+}
+
+// MaxOutstandingResponses bounds how many of the requests a peer pipelines on a single stream may be read before
+// their responses are written out. Once that many responses are outstanding, no further request is read off the
+// stream until they have been flushed, so that a peer sending requests faster than it reads the responses can't make
+// us buffer them without bounds.
+//
+// Defaults to 64.
+func MaxOutstandingResponses(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("max outstanding responses must be positive, got %d", n)
+		}
+		c.MaxOutstandingResponses = n
+		return nil
+	}
+}
+
+// SlowDownHint makes the DHT ask requesters to back off while it is under load, by setting the slowDown flag of its
+// responses. A response is flagged when handling its request took longer than handlingTime, or when at least streams
+// inbound streams are being handled. A zero value disables the respective condition.
+//
+// Defaults to never asking requesters to slow down.
+func SlowDownHint(handlingTime time.Duration, streams int) Option {
+	return func(c *dhtcfg.Config) error {
+		if handlingTime < 0 || streams < 0 {
+			return fmt.Errorf("slow down thresholds must not be negative")
+		}
+		c.SlowDownHandlingTime = handlingTime
+		c.SlowDownInboundStreams = streams
+		return nil
+	}
+}
+
+// SlowHandlerLog makes the DHT log a warning, with the requester and the message type, for every inbound request whose
+// handling and response took longer than threshold. This points out pathologically slow requests without having to
+// go through the handling time metrics.
+//
+// Defaults to 0, which disables the warning.
+func SlowHandlerLog(threshold time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if threshold < 0 {
+			return fmt.Errorf("slow handler threshold must not be negative, got %s", threshold)
+		}
+		c.SlowHandlerThreshold = threshold
+		return nil
+	}
+}
+
+// StreamBackoff configures how long the DHT stops trying to open new streams to a peer after failing to do so. The
+// delay starts at base and doubles with every consecutive failure, up to max, and is reset by the first successful
+// stream. Peers the DHT is connected to are never backed off from, e.g. once they reconnect. A base of 0 disables the
+// backoff.
+//
+// Defaults to 0, the backoff is disabled.
+func StreamBackoff(base, max time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if base < 0 {
+			return fmt.Errorf("stream backoff base must be non-negative, got %s", base)
+		}
+		if max < base {
+			return fmt.Errorf("stream backoff max (%s) must not be smaller than base (%s)", max, base)
+		}
+		c.StreamBackoffBase = base
+		c.StreamBackoffMax = max
+		return nil
+	}
+}
+
+// DialTimeout makes the DHT open the streams it sends messages on in the background, bounded by d rather than by the
+// deadline of the request that needs the stream. A request with a short deadline then doesn't abort a dial that would
+// have succeeded slightly later: the stream is pooled once open, ready for the next request to the peer, rather than
+// dialed again. A dial running out of time counts as failing to reach the peer, see StreamBackoff, and dials still
+// running when the DHT is closed are aborted.
+//
+// Defaults to 0, which opens streams with the deadline of the request. Only applies to the default message sender,
+// not to one set with CustomMessageSender.
+func DialTimeout(d time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if d < 0 {
+			return fmt.Errorf("dial timeout must not be negative, got %s", d)
+		}
+		c.DialTimeout = d
+		return nil
+	}
+}
+
+// CircuitBreaker makes the DHT stop sending to a peer once at least errorRate of the last window requests and messages
+// sent to it failed. Everything sent to the peer then fails right away with ErrCircuitOpen, until cooldown has passed.
+// The next request or message is then let through as a probe, while the others keep failing: if the probe succeeds,
+// the peer gets a clean record, otherwise the circuit stays open for another cooldown. Messages given up on by their
+// context don't count. The record of a peer nothing was sent to for twice the cooldown may be forgotten, giving the
+// peer a clean record too. Use IpfsDHT.CircuitState to find out where a peer stands.
+//
+// Disabled by default.
+func CircuitBreaker(errorRate float64, window int, cooldown time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if errorRate <= 0 || errorRate > 1 {
+			return fmt.Errorf("circuit breaker error rate must be in (0, 1], got %v", errorRate)
+		}
+		if window <= 0 {
+			return fmt.Errorf("circuit breaker window must be positive, got %d", window)
+		}
+		if cooldown <= 0 {
+			return fmt.Errorf("circuit breaker cooldown must be positive, got %s", cooldown)
+		}
+		c.CircuitBreakerErrorRate = errorRate
+		c.CircuitBreakerWindow = window
+		c.CircuitBreakerCooldown = cooldown
+		return nil
+	}
+}
+
+// StreamPoolIdleTimeout sets how long a stream the DHT opened to send requests may go unused before it is closed.
+// A timeout of 0 keeps idle streams open until the peer disconnects.
+//
+// Defaults to 0.
+func StreamPoolIdleTimeout(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout < 0 {
+			return fmt.Errorf("stream pool idle timeout must not be negative, got %s", timeout)
+		}
+		c.StreamPoolIdleTimeout = timeout
+		return nil
+	}
+}
+
+// StreamPoolMaxIdlePerPeer sets how many idle streams the DHT keeps open per peer to send further requests on. Requests
+// to a peer take turns on one stream, but streams handed off to finish a request, e.g. one whose reply is streamed,
+// come back to the pool on top of it. Once a peer has more idle streams than that, the oldest ones are closed. With 0,
+// a new stream is opened for every request.
+//
+// Defaults to 1.
+func StreamPoolMaxIdlePerPeer(n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 0 {
+			return fmt.Errorf("max idle streams per peer must not be negative, got %d", n)
+		}
+		c.StreamPoolMaxIdlePerPeer = n
+		return nil
+	}
+}
+
+// IdleConnectionPruning makes the DHT close its connections to a peer once it has had neither a pooled stream nor a
+// request in flight to the peer for the given timeout, so that peers only ever contacted during queries don't keep file
+// descriptors open until the connection manager trims them. Connections still carrying streams, of any protocol, are
+// left open, as are the connections to peers the connection manager protects or has tags for, which includes the peers
+// in the routing table. Pooled streams only go away with StreamPoolIdleTimeout, StreamPoolMaxIdlePerPeer set to 0 or
+// AdaptiveStreamPool.
+//
+// Defaults to 0, leaving connections to the connection manager. Only applies to the default message sender, not to one
+// set with CustomMessageSender.
+func IdleConnectionPruning(timeout time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if timeout < 0 {
+			return fmt.Errorf("idle connection pruning timeout must not be negative, got %s", timeout)
+		}
+		c.ConnectionPruneTimeout = timeout
+		return nil
+	}
+}
+
+// AdaptiveStreamPool makes the DHT keep streams to a peer open between requests only while it sends the peer at least
+// minRate requests per second, averaged over roughly the given window. Bursts of requests then reuse their streams,
+// while streams to peers that are rarely queried are closed as soon as their request is done instead of lingering. The
+// pooled streams of a peer, at most StreamPoolMaxIdlePerPeer of them, are closed once the rate drops below minRate, or
+// after the idle timeout set with StreamPoolIdleTimeout, whichever comes first.
+//
+// Disabled by default, streams are then kept regardless of the request rate.
+func AdaptiveStreamPool(minRate float64, window time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if minRate <= 0 {
+			return fmt.Errorf("stream pool min request rate must be positive, got %v", minRate)
+		}
+		if window <= 0 {
+			return fmt.Errorf("stream pool rate window must be positive, got %s", window)
+		}
+		c.StreamPoolMinRate = minRate
+		c.StreamPoolRateWindow = window
+		return nil
+	}
+}
+
+// MessageCoalescing makes the DHT hold back every one-way message it sends, such as provider records, for up to the
+// given delay, so that the messages sent to the same peer in the meantime are written together over a single stream
+// instead of each acquiring one. This cuts down on stream churn during reprovide bursts, at the cost of delaying every
+// message. Sending a message still returns once it has been written. Messages still held back when the DHT is closed
+// are dropped, failing with an error.
+//
+// Defaults to 0, i.e. messages are sent right away. Messages are only coalesced by the default message sender, not by one
+// set with CustomMessageSender.
+func MessageCoalescing(delay time.Duration) Option {
+	return func(c *dhtcfg.Config) error {
+		if delay < 0 {
+			return fmt.Errorf("message coalescing delay must not be negative, got %s", delay)
+		}
+		c.MessageCoalescingDelay = delay
+		return nil
+	}
+}
+
+// MaintenanceJitter randomly stretches or shrinks every interval between two runs of the DHT's periodic maintenance,
+// i.e. routing table refreshes and attempts to fill up a sparse routing table, by up to the given fraction. This keeps
+// nodes that started together from sending their maintenance traffic at the same time.
+//
+// Defaults to 0, i.e. no jitter.
+func MaintenanceJitter(fraction float64) Option {
+	return func(c *dhtcfg.Config) error {
+		if fraction < 0 || fraction >= 1 {
+			return fmt.Errorf("maintenance jitter must be in [0, 1), got %v", fraction)
+		}
+		c.MaintenanceJitter = fraction
+		return nil
+	}
+}
+
+// TraceSampler enables tracing of the DHT's requests with OpenCensus. A span is started with the given sampler for
+// every request sent to and handled for a peer, annotated with the peer, the message type and size, and the latency.
+// Sampled spans are exported to the exporters registered with go.opencensus.io/trace. Spans for requests sent are only
+// created by the default message sender, not by one set with CustomMessageSender.
+//
+// Defaults to nil, i.e. no spans are created.
+func TraceSampler(sampler trace.Sampler) Option {
+	return func(c *dhtcfg.Config) error {
+		c.TraceSampler = sampler
+		return nil
+	}
+}
+
+// Compression enables gzip compression of the DHT's messages, which mostly pays off for large responses such as
+// provider records with many addresses. Compressed messages are exchanged over a variant of the DHT protocol, so they
+// are only sent to and accepted from peers that enabled compression too, and other peers are still spoken to
+// uncompressed.
+//
+// Defaults to false. Compression only applies to requests sent by the default message sender, not by one set with
+// CustomMessageSender.
+func Compression(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.EnableCompression = enabled
+		return nil
+	}
+}
+
+// MessageChecksums makes the DHT add a CRC32 checksum to its messages and check the checksum of the messages it
+// receives, dropping those that were corrupted in transit. Checksummed messages are exchanged over a variant of the DHT
+// protocol, so they are only sent to and accepted from peers that enabled checksums too. Compressed messages are
+// always checksummed, so compression is preferred with peers supporting both.
+//
+// Defaults to false. Checksums only apply to requests sent by the default message sender, not by one set with
+// CustomMessageSender.
+func MessageChecksums(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.EnableChecksums = enabled
+		return nil
+	}
+}
+
+// SequenceNumbers is a debugging aid for suspected message loss or reordering. It makes the DHT number the messages
+// it sends on each stream, and count and log the inbound messages whose number doesn't follow the previous one on
+// their stream, see metrics.SequenceGaps. Messages are only numbered by the default message sender, and they can only
+// be checked by peers that enabled sequence numbers too.
+//
+// Defaults to false.
+func SequenceNumbers(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.SequenceNumbers = enabled
+		return nil
+	}
+}
+
 // DisableAutoRefresh completely disables 'auto-refresh' on the DHT routing
 // table. This means that we will neither refresh the routing table periodically
 // nor when the routing table size goes below the minimum threshold.
@@ -209,6 +789,19 @@ func DisableAutoRefresh() Option {
 	}
 }
 
+// AutoRoutingTableUpdate sets whether the DHT tries to add every peer that sends it a request to the routing table.
+// Disabling it saves checking the protocols of the requester in the peerstore for every inbound message, which is
+// useful when the routing table is managed externally. Peers are still added as they're connected to or found by
+// queries.
+//
+// Defaults to enabled.
+func AutoRoutingTableUpdate(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DisableAutoRTUpdate = !enabled
+		return nil
+	}
+}
+
 // DisableProviders disables storing and retrieving provider records.
 //
 // Defaults to enabled.
@@ -265,6 +858,26 @@ func RoutingTableFilter(filter RouteTableFilterFunc) Option {
 	}
 }
 
+// InboundMessageFilter sets a function that approves which inbound messages may be handled. It runs before any
+// handler, so it can be used to enforce policies such as namespace allow-lists. When the filter rejects a message, the
+// message is dropped and the stream it arrived on is reset.
+func InboundMessageFilter(filter InboundMessageFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.InboundMessageFilter = filter
+		return nil
+	}
+}
+
+// AddressFilter sets a function that filters the addresses peers announce for themselves in ADD_PROVIDER messages,
+// e.g. PublicAddressFilter to keep private addresses out of a public DHT. Only the addresses it returns are stored,
+// and a provider left without any address isn't stored at all.
+func AddressFilter(filter AddressFilterFunc) Option {
+	return func(c *dhtcfg.Config) error {
+		c.AddressFilter = filter
+		return nil
+	}
+}
+
 // BootstrapPeers configures the bootstrapping nodes that we will connect to to seed
 // and refresh our Routing Table if it becomes empty.
 func BootstrapPeers(bootstrappers ...peer.AddrInfo) Option {
@@ -284,6 +897,177 @@ func RoutingTablePeerDiversityFilter(pg peerdiversity.PeerIPGroupFilter) Option
 	}
 }
 
+// CustomMessageSender configures the pb.MessageSender implementation used by the DHT to send requests and
+// messages to other peers. The builder is invoked with the host and the protocols the DHT queries with.
+//
+// Defaults to a stream-reusing sender speaking the DHT wire protocol. This is mostly useful for testing query logic
+// against canned responses.
+func CustomMessageSender(messageSenderBuilder func(h host.Host, protos []protocol.ID) pb.MessageSender) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MsgSenderBuilder = messageSenderBuilder
+		return nil
+	}
+}
+
+// OnLatencySample registers a callback invoked with the round trip time of every successful request the DHT sends,
+// e.g. for custom routing decisions. It gets the very sample recorded in the peerstore, or with CustomLatencyRecorder,
+// and is invoked even if LatencyTracking is disabled. The callback is invoked on its own goroutine, so it never blocks
+// the request.
+//
+// Samples are only reported by the default message sender, not by one set with CustomMessageSender.
+func OnLatencySample(f func(p peer.ID, rtt time.Duration)) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnLatencySample = f
+		return nil
+	}
+}
+
+// OnLateReply registers a callback invoked with replies that arrive after the request they answer was given up on
+// because its context was done or the query it was sent for terminated, e.g. to cache the records of slow peers
+// opportunistically. Replies arriving in time are never passed to the callback. The callback is invoked on its own
+// goroutine.
+//
+// Late replies are only reported by the default message sender, not by one set with CustomMessageSender.
+func OnLateReply(f func(p peer.ID, reply *pb.Message)) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnLateReply = f
+		return nil
+	}
+}
+
+// OnRoutingTableChanged registers a callback invoked whenever peers enter or leave the routing table, including peers
+// evicted to make room for others, e.g. to mirror the routing table for monitoring. Changes are reported one at a time,
+// in the order they happened, on a goroutine of their own.
+func OnRoutingTableChanged(f func(added, removed []peer.ID)) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnRoutingTableChanged = f
+		return nil
+	}
+}
+
+// OnSlowDown registers a callback invoked with every peer whose response to a request asked the DHT to slow down, see
+// SlowDownHint. The callback is invoked on its own goroutine.
+func OnSlowDown(f func(p peer.ID)) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OnSlowDown = f
+		return nil
+	}
+}
+
+// OutboundMessageHook registers a function every message the DHT sends is passed to before it is written, e.g. for
+// fault injection in tests or to add extensions to messages. The message is sent as returned by f. If f returns nil, the
+// message is dropped: a dropped request fails with an error, and a dropped one-way message is silently discarded. f gets
+// a shallow copy of the message, which it may modify, but it must not modify the slices the copy shares with the
+// original, e.g. the closer peers, in place.
+//
+// Messages are only passed to f by the default message sender, not by one set with CustomMessageSender.
+func OutboundMessageHook(f func(p peer.ID, pmes *pb.Message) *pb.Message) Option {
+	return func(c *dhtcfg.Config) error {
+		c.OutboundMessageHook = f
+		return nil
+	}
+}
+
+// LatencyRecorder records the round trip times of the requests the DHT sends, see CustomLatencyRecorder.
+type LatencyRecorder = internal.LatencyRecorder
+
+// CustomLatencyRecorder makes the DHT record the round trip times of its requests with r instead of the peerstore, e.g.
+// to smooth or filter samples before passing them on to the peerstore. r is invoked on the goroutine sending the
+// request, so it should return quickly. Nothing is recorded if latency tracking is disabled, see LatencyTracking.
+//
+// Defaults to the host's peerstore. Latencies are only recorded by the default message sender, not by one set with
+// CustomMessageSender.
+func CustomLatencyRecorder(r LatencyRecorder) Option {
+	return func(c *dhtcfg.Config) error {
+		c.LatencyRecorder = r
+		return nil
+	}
+}
+
+// LatencyTracking sets whether the round trip time of every request the DHT sends is recorded in the peerstore.
+// Deployments that never consult the peerstore's latency metrics can disable it to save a little work per request.
+//
+// Defaults to true.
+func LatencyTracking(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DisableLatencyTracking = !enabled
+		return nil
+	}
+}
+
+// MessageCodec sets how the messages exchanged over DHT streams are encoded within their length-prefixed frames, e.g.
+// to fuzz the DHT or to debug its traffic as JSON. Only peers using the same codec understand each other, so anything
+// but the default protobuf codec is meant for tests and controlled deployments. The sending side only applies it with
+// the default message sender, not with one set with CustomMessageSender.
+//
+// Defaults to pb.ProtobufCodec.
+func MessageCodec(codec pb.MessageCodec) Option {
+	return func(c *dhtcfg.Config) error {
+		c.Codec = codec
+		return nil
+	}
+}
+
+// PreferFastConnections sets whether the DHT opens its streams to a peer it's connected to more than once, e.g. a
+// multihomed one, on the connection its requests were answered the fastest on. Connections no request went over yet
+// are only used when the host picks them. Falls back to the connection the host picks whenever the preferred one can't
+// open a stream.
+//
+// Defaults to false. Only applies to the default message sender, not to one set with CustomMessageSender.
+func PreferFastConnections(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.PreferFastConnections = enabled
+		return nil
+	}
+}
+
+// OutboundMetrics sets whether the outcome, size and latency of every message the DHT sends is recorded. Disabling them
+// saves tagging and recording several measurements per message, which matters for very high rates of messages, at the
+// cost of the DHT's traffic no longer showing up in the sent messages, requests, bytes, latency and stream pool views.
+//
+// Defaults to true. Only applies to the default message sender, not to one set with CustomMessageSender.
+func OutboundMetrics(enabled bool) Option {
+	return func(c *dhtcfg.Config) error {
+		c.DisableOutboundMetrics = !enabled
+		return nil
+	}
+}
+
+// MetricsSampling makes the DHT record only 1 in every n messages of type typ in the views of the messages and bytes it
+// sends and receives, e.g. to sample chatty FIND_NODE traffic while still counting every GET_VALUE. At very high rates,
+// this saves handing the measurements of most messages to the views. A sampled message is counted with a weight of n,
+// so the message count views keep counting every message on average, while the byte distributions are built from the
+// sampled messages alone. Messages are still tagged with their type, as the other views need it. Failed messages are
+// always counted. This option can be given multiple times to sample several message types, and n may be 1 to count
+// every message of a type again.
+//
+// Defaults to counting every message. Outbound messages are only sampled by the default message sender, not by one
+// set with CustomMessageSender.
+func MetricsSampling(typ pb.Message_MessageType, n int) Option {
+	return func(c *dhtcfg.Config) error {
+		if n < 1 {
+			return fmt.Errorf("metrics sampling rate must be positive, got %d", n)
+		}
+		if c.MetricsSampling == nil {
+			c.MetricsSampling = make(map[pb.Message_MessageType]int)
+		}
+		c.MetricsSampling[typ] = n
+		return nil
+	}
+}
+
+// MetricsLabelTransformer sets a function that rewrites the value of every metric tag the DHT sets, e.g. to collapse
+// peer IDs into a handful of buckets and keep the cardinality of exported metrics down. Note that it is also applied to
+// tags that are used to tell DHT instances apart.
+//
+// Defaults to leaving all values unchanged.
+func MetricsLabelTransformer(transform func(key tag.Key, value string) string) Option {
+	return func(c *dhtcfg.Config) error {
+		c.MetricsLabelTransformer = transform
+		return nil
+	}
+}
+
 // disableFixLowPeersRoutine disables the "fixLowPeers" routine in the DHT.
 // This is ONLY for tests.
 func disableFixLowPeersRoutine(t *testing.T) Option {
@@ -13,13 +13,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/event"
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	"github.com/libp2p/go-libp2p-core/routing"
 
 	test "github.com/libp2p/go-libp2p-kad-dht/internal/testing"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	record "github.com/libp2p/go-libp2p-record"
@@ -35,6 +39,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
 )
 
 var testCaseCids []cid.Cid
@@ -467,6 +472,91 @@ func TestSearchValue(t *testing.T) {
 	}
 }
 
+// quorumSender answers GET_VALUE requests sent to the fast peers with a record.
+// Requests to any other peer block until they are cancelled.
+type quorumSender struct {
+	fast        map[peer.ID]bool
+	slowStarted sync.WaitGroup
+	allSlow     chan struct{}
+	cancelled   chan peer.ID
+}
+
+func (s *quorumSender) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	if pmes.GetType() != pb.Message_GET_VALUE {
+		return pmes, nil
+	}
+	if !s.fast[p] {
+		s.slowStarted.Done()
+		<-ctx.Done()
+		s.cancelled <- p
+		return nil, ctx.Err()
+	}
+
+	// Reply once every slow request is in flight, so that reaching the quorum
+	// has requests left to cancel.
+	select {
+	case <-s.allSlow:
+	case <-time.After(time.Second):
+	}
+	resp := pb.NewMessage(pb.Message_GET_VALUE, pmes.GetKey(), 0)
+	resp.Record = record.MakePutRecord(string(pmes.GetKey()), []byte("world"))
+	return resp, nil
+}
+
+func (s *quorumSender) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	return nil
+}
+
+func TestGetValueQuorumCancelsOutstandingRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const nFast, nSlow = 3, 4
+	sender := &quorumSender{
+		fast:      make(map[peer.ID]bool),
+		allSlow:   make(chan struct{}),
+		cancelled: make(chan peer.ID, nSlow),
+	}
+	sender.slowStarted.Add(nSlow)
+	go func() {
+		sender.slowStarted.Wait()
+		close(sender.allSlow)
+	}()
+	d := setupDHT(ctx, t, false, CustomMessageSender(func(host.Host, []protocol.ID) pb.MessageSender {
+		return sender
+	}))
+	defer d.Close()
+
+	peers := setupDHTS(t, ctx, nFast+nSlow)
+	for i, p := range peers {
+		defer p.Close()
+		if i < nFast {
+			sender.fast[p.self] = true
+		}
+	}
+	for _, p := range peers {
+		connectNoSync(t, ctx, d, p)
+		wait(t, ctx, d, p)
+	}
+
+	ctxT, cancelT := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelT()
+	val, err := d.GetValue(ctxT, "/v/hello", Quorum(nFast-1))
+	require.NoError(t, err)
+	require.Equal(t, "world", string(val))
+
+	// Every request still waiting for a slow peer must have been cancelled
+	// once the quorum was reached, rather than when the lookup timed out.
+	for i := 0; i < nSlow; i++ {
+		select {
+		case p := <-sender.cancelled:
+			require.False(t, sender.fast[p])
+		case <-ctxT.Done():
+			t.Fatal("requests outstanding after reaching the quorum weren't cancelled")
+		}
+	}
+}
+
 func TestGetValues(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1363,6 +1453,29 @@ func TestClientModeConnect(t *testing.T) {
 	}
 }
 
+func TestClientModeRefusesInboundStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, true)
+	connectNoSync(t, ctx, server, client)
+
+	// The client doesn't advertise any DHT protocol...
+	protos, err := server.peerstore.SupportsProtocols(client.self, server.protocolsStrs...)
+	require.NoError(t, err)
+	require.Empty(t, protos)
+
+	// ...and won't negotiate one either.
+	s, err := server.host.NewStream(ctx, client.self, server.protocols...)
+	if err == nil {
+		// Protocol negotiation may be deferred until the stream is used.
+		_, err = s.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+	require.Empty(t, server.routingTable.Find(client.self))
+}
+
 func TestClientModeFindPeer(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -1946,6 +2059,42 @@ func TestRoutingFilter(t *testing.T) {
 	}
 }
 
+func TestOnRoutingTableChanged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type change struct{ added, removed []peer.ID }
+	changes := make(chan change, 10)
+	a := setupDHT(ctx, t, false, OnRoutingTableChanged(func(added, removed []peer.ID) {
+		changes <- change{added, removed}
+	}))
+	b := setupDHT(ctx, t, false)
+	defer a.Close()
+	defer b.Close()
+
+	next := func() change {
+		t.Helper()
+		select {
+		case c := <-changes:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("routing table change not reported")
+			return change{}
+		}
+	}
+
+	connectNoSync(t, ctx, a, b)
+	wait(t, ctx, a, b)
+	c := next()
+	require.Equal(t, []peer.ID{b.self}, c.added)
+	require.Empty(t, c.removed)
+
+	a.routingTable.RemovePeer(b.self)
+	c = next()
+	require.Empty(t, c.added)
+	require.Equal(t, []peer.ID{b.self}, c.removed)
+}
+
 func TestBootStrapWhenRTIsEmpty(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -2115,3 +2264,163 @@ func TestPreconnectedNodes(t *testing.T) {
 		t.Fatal("could not find peer")
 	}
 }
+
+func TestDHTProtocolForPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.RoutingTablePeersView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.RoutingTablePeersView)
+
+	d := setupDHT(ctx, t, false)
+	// A secondary protocol we also query with, after the primary one.
+	secondary := protocol.ID("/secondary" + kad1)
+	d.protocols = append(d.protocols, secondary)
+	d.protocolsStrs = protocol.ConvertToStrings(d.protocols)
+
+	peers := []*IpfsDHT{setupDHT(ctx, t, false), setupDHT(ctx, t, false)}
+	for _, p := range peers {
+		connect(t, ctx, d, p)
+	}
+
+	for _, p := range peers {
+		proto, ok := d.DHTProtocolForPeer(p.self)
+		require.True(t, ok)
+		require.Equal(t, d.protocols[0], proto)
+	}
+
+	rtPeersGauge := func(proto protocol.ID) int64 {
+		rows, err := view.RetrieveData(metrics.RoutingTablePeersView.Name)
+		require.NoError(t, err)
+		for _, r := range rows {
+			var self, tagged bool
+			for _, tg := range r.Tags {
+				self = self || (tg.Key == metrics.KeyPeerID && tg.Value == d.self.Pretty())
+				tagged = tagged || (tg.Key == metrics.KeyProtocol && tg.Value == string(proto))
+			}
+			if self && tagged {
+				return int64(r.Data.(*view.LastValueData).Value)
+			}
+		}
+		return -1
+	}
+	require.EqualValues(t, 2, rtPeersGauge(d.protocols[0]))
+	require.EqualValues(t, -1, rtPeersGauge(secondary))
+
+	// A peer only speaking the secondary protocol is recorded with it, and
+	// counted apart from the peers speaking the primary one.
+	legacy := setupDHT(ctx, t, false, V1ProtocolOverride(secondary))
+	defer legacy.Close()
+	require.NoError(t, d.peerstore.AddProtocols(legacy.self, string(secondary)))
+	added, err := d.routingTable.TryAddPeer(legacy.self, true, false)
+	require.NoError(t, err)
+	require.True(t, added)
+
+	proto, ok := d.DHTProtocolForPeer(legacy.self)
+	require.True(t, ok)
+	require.Equal(t, secondary, proto)
+	require.EqualValues(t, 1, rtPeersGauge(secondary))
+	require.EqualValues(t, 2, rtPeersGauge(d.protocols[0]))
+
+	d.routingTable.RemovePeer(peers[0].self)
+	_, ok = d.DHTProtocolForPeer(peers[0].self)
+	require.False(t, ok)
+	require.EqualValues(t, 1, rtPeersGauge(d.protocols[0]))
+
+	d.routingTable.RemovePeer(legacy.self)
+	_, ok = d.DHTProtocolForPeer(legacy.self)
+	require.False(t, ok)
+	require.EqualValues(t, 0, rtPeersGauge(secondary))
+}
+
+// connMgrHost is a host with a connection manager of our choice.
+type connMgrHost struct {
+	host.Host
+	cm connmgr.ConnManager
+}
+
+func (h *connMgrHost) ConnManager() connmgr.ConnManager { return h.cm }
+
+// taggingConnManager keeps track of the tags peers are tagged or protected with.
+type taggingConnManager struct {
+	connmgr.NullConnMgr
+
+	lk   sync.Mutex
+	tags map[peer.ID]map[string]bool
+}
+
+func (cm *taggingConnManager) set(p peer.ID, tag string, tagged bool) {
+	cm.lk.Lock()
+	defer cm.lk.Unlock()
+	if cm.tags[p] == nil {
+		cm.tags[p] = make(map[string]bool)
+	}
+	cm.tags[p][tag] = tagged
+}
+
+func (cm *taggingConnManager) tagged(p peer.ID, tag string) bool {
+	cm.lk.Lock()
+	defer cm.lk.Unlock()
+	return cm.tags[p][tag]
+}
+
+func (cm *taggingConnManager) TagPeer(p peer.ID, tag string, _ int) { cm.set(p, tag, true) }
+func (cm *taggingConnManager) UntagPeer(p peer.ID, tag string)      { cm.set(p, tag, false) }
+func (cm *taggingConnManager) Protect(p peer.ID, tag string)        { cm.set(p, tag, true) }
+func (cm *taggingConnManager) Unprotect(p peer.ID, tag string) bool {
+	cm.set(p, tag, false)
+	return false
+}
+
+func TestProtocolPrefixesSharingHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &taggingConnManager{tags: make(map[peer.ID]map[string]bool)}
+	serverHost := &connMgrHost{Host: bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)), cm: cm}
+	clientHost := bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport))
+
+	const key = "/v/tenant"
+	servers := make(map[string]*IpfsDHT)
+	clients := make(map[string]*IpfsDHT)
+	for _, tenant := range []string{"a", "b"} {
+		opts := []Option{
+			ProtocolPrefix(protocol.ID("/tenant-" + tenant)),
+			NamespacedValidator("v", blankValidator{}),
+			DisableAutoRefresh(),
+			Mode(ModeServer),
+		}
+		server, err := New(ctx, serverHost, opts...)
+		require.NoError(t, err)
+		defer server.Close()
+		client, err := New(ctx, clientHost, opts...)
+		require.NoError(t, err)
+		defer client.Close()
+
+		rec := record.MakePutRecord(key, []byte(tenant))
+		rec.TimeReceived = u.FormatRFC3339(time.Now())
+		require.NoError(t, server.putLocal(key, rec))
+		servers[tenant], clients[tenant] = server, client
+	}
+	for tenant := range servers {
+		connect(t, ctx, clients[tenant], servers[tenant])
+	}
+
+	// Every client gets its answer from the DHT of its own tenant.
+	for tenant, client := range clients {
+		rec, _, err := client.protoMessenger.GetValue(ctx, serverHost.ID(), key)
+		require.NoError(t, err)
+		require.Equal(t, tenant, string(rec.GetValue()))
+	}
+
+	// Every DHT tags the client in its routing table on its own.
+	tagA, tagB := rtTag(servers["a"].protocols[0]), rtTag(servers["b"].protocols[0])
+	require.NotEqual(t, tagA, tagB)
+	require.True(t, cm.tagged(clientHost.ID(), tagA))
+	require.True(t, cm.tagged(clientHost.ID(), tagB))
+	servers["a"].routingTable.RemovePeer(clientHost.ID())
+	require.False(t, cm.tagged(clientHost.ID(), tagA))
+	require.True(t, cm.tagged(clientHost.ID(), tagB))
+}
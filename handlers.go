@@ -5,25 +5,85 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 
 	"github.com/gogo/protobuf/proto"
 	ds "github.com/ipfs/go-datastore"
 	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 	"github.com/multiformats/go-base32"
+	ma "github.com/multiformats/go-multiaddr"
 )
 
 // dhthandler specifies the signature of functions that handle DHT messages.
 type dhtHandler func(context.Context, peer.ID, *pb.Message) (*pb.Message, error)
 
+// MessageHandlerFunc handles an inbound message of a given type from peer p. It returns the response to send back,
+// or nil if the message isn't answered. Returning an error resets the stream.
+type MessageHandlerFunc = dhtcfg.MessageHandlerFunc
+
+type streamProtocolKey struct{}
+
+// withStreamProtocol returns a copy of ctx carrying the protocol negotiated on the stream a message was received on.
+func withStreamProtocol(ctx context.Context, proto protocol.ID) context.Context {
+	return context.WithValue(ctx, streamProtocolKey{}, proto)
+}
+
+// StreamProtocol returns the protocol negotiated on the stream the message being handled was received on, so that
+// handlers can tell protocol versions apart. The protocol is set in the context passed to every handler, including
+// those registered with RegisterMessageHandler. It is reported as negotiated, e.g. with a suffix for compressed
+// streams.
+func StreamProtocol(ctx context.Context) (protocol.ID, bool) {
+	proto, ok := ctx.Value(streamProtocolKey{}).(protocol.ID)
+	return proto, ok
+}
+
+type observedAddrKey struct{}
+
+// withObservedAddr returns a copy of ctx carrying the address the connection a message was received on comes from.
+func withObservedAddr(ctx context.Context, addr ma.Multiaddr) context.Context {
+	return context.WithValue(ctx, observedAddrKey{}, addr)
+}
+
+// ObservedAddr returns the remote address of the connection the message being handled was received on, as we observe
+// it rather than as the requester claims it, e.g. for handlers of ADD_PROVIDER or FIND_NODE to check the addresses in a
+// message against it when the requester may be behind a NAT. The address is set in the context passed to every handler,
+// including those registered with RegisterMessageHandler.
+func ObservedAddr(ctx context.Context) (ma.Multiaddr, bool) {
+	addr, ok := ctx.Value(observedAddrKey{}).(ma.Multiaddr)
+	return addr, ok && addr != nil
+}
+
+// Redirect returns a response to req from p that carries no record or providers, only the peers we know of that are
+// closer to its key, for the requester to continue its query with. Handlers registered with RegisterMessageHandler can
+// return it to point requesters elsewhere, for any message type, e.g. rather than serving a value themselves.
+func (dht *IpfsDHT) Redirect(p peer.ID, req *pb.Message) *pb.Message {
+	resp := pb.NewMessage(req.GetType(), req.GetKey(), req.GetClusterLevel())
+	if closer := dht.betterPeersToQuery(req, p, dht.bucketSize); len(closer) > 0 {
+		// TODO: pstore.PeerInfos should move to core (=> peerstore.AddrInfos).
+		infos := pstore.PeerInfos(dht.peerstore, closer)
+		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
+	}
+	return resp
+}
+
 func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
+	if _, disabled := dht.disabledTypes[t]; disabled {
+		return nil
+	}
+	if h, ok := dht.messageHandlers[t]; ok {
+		return dhtHandler(h)
+	}
+
 	switch t {
 	case pb.Message_FIND_NODE:
 		return dht.handleFindPeer
@@ -43,15 +103,61 @@ func (dht *IpfsDHT) handlerForMsgType(t pb.Message_MessageType) dhtHandler {
 	if dht.enableProviders {
 		switch t {
 		case pb.Message_ADD_PROVIDER:
-			return dht.handleAddProvider
+			return addProviderHandler(dht.handleAddProvider)
 		case pb.Message_GET_PROVIDERS:
-			return dht.handleGetProviders
+			return getProvidersHandler(dht.handleGetProviders)
 		}
 	}
 
 	return nil
 }
 
+// RegisteredMessageTypes returns the types of the inbound messages the DHT handles, in ascending order. These are the
+// built-in types that aren't disabled with DisabledMessageTypes, along with those registered with
+// RegisterMessageHandler. Messages of other types are dropped.
+func (dht *IpfsDHT) RegisteredMessageTypes() []pb.Message_MessageType {
+	var types []pb.Message_MessageType
+	for t := range pb.Message_MessageType_name {
+		if _, custom := dht.messageHandlers[pb.Message_MessageType(t)]; custom {
+			// added with the other registered handlers below
+			continue
+		}
+		if dht.handlerForMsgType(pb.Message_MessageType(t)) != nil {
+			types = append(types, pb.Message_MessageType(t))
+		}
+	}
+	for t := range dht.messageHandlers {
+		if dht.handlerForMsgType(t) != nil {
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// getProvidersHandler adapts a handler of GET_PROVIDERS requests to a dhtHandler, passing it the typed view of the
+// request. Invalid requests are refused before reaching the handler.
+func getProvidersHandler(h func(context.Context, peer.ID, *pb.GetProvidersRequest) (*pb.Message, error)) dhtHandler {
+	return func(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		req, err := pmes.AsGetProviders()
+		if err != nil {
+			return nil, err
+		}
+		return h(ctx, p, req)
+	}
+}
+
+// addProviderHandler is like getProvidersHandler, for ADD_PROVIDER requests.
+func addProviderHandler(h func(context.Context, peer.ID, *pb.AddProviderRequest) (*pb.Message, error)) dhtHandler {
+	return func(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		req, err := pmes.AsAddProvider()
+		if err != nil {
+			return nil, err
+		}
+		return h(ctx, p, req)
+	}
+}
+
 func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, err error) {
 	// first, is there even a key?
 	k := pmes.GetKey()
@@ -266,7 +372,7 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 	if targetPid == dht.self {
 		closest = []peer.ID{dht.self}
 	} else {
-		closest = dht.betterPeersToQuery(pmes, from, dht.bucketSize)
+		closest = dht.betterPeersToQuery(pmes, from, dht.maxClosestPeers)
 
 		// Never tell a peer about itself.
 		if targetPid != from {
@@ -284,6 +390,10 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 				}
 			}
 			if !found {
+				if len(closest) >= dht.maxClosestPeers && dht.maxClosestPeers < dht.bucketSize {
+					// Make room for the target within the cap, in place of the farthest peer.
+					closest = closest[:len(closest)-1]
+				}
 				closest = append(closest, targetPid)
 			}
 		}
@@ -307,15 +417,9 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, from peer.ID, pmes *pb.M
 	return resp, nil
 }
 
-func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
-	key := pmes.GetKey()
-	if len(key) > 80 {
-		return nil, fmt.Errorf("handleGetProviders key size too large")
-	} else if len(key) == 0 {
-		return nil, fmt.Errorf("handleGetProviders key is empty")
-	}
-
-	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
+func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, req *pb.GetProvidersRequest) (_ *pb.Message, _err error) {
+	key, pmes := req.Key, req.Message()
+	resp := pb.NewMessage(pmes.GetType(), key, pmes.GetClusterLevel())
 
 	// setup providers
 	providers := dht.ProviderManager.GetProviders(ctx, key)
@@ -337,19 +441,12 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	return resp, nil
 }
 
-func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.Message) (_ *pb.Message, _err error) {
-	key := pmes.GetKey()
-	if len(key) > 80 {
-		return nil, fmt.Errorf("handleAddProvider key size too large")
-	} else if len(key) == 0 {
-		return nil, fmt.Errorf("handleAddProvider key is empty")
-	}
-
+func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, req *pb.AddProviderRequest) (_ *pb.Message, _err error) {
+	key := req.Key
 	logger.Debugf("adding provider", "from", p, "key", internal.LoggableProviderRecordBytes(key))
 
 	// add provider should use the address given in the message
-	pinfos := pb.PBPeersToPeerInfos(pmes.GetProviderPeers())
-	for _, pi := range pinfos {
+	for _, pi := range req.Providers {
 		if pi.ID != p {
 			// we should ignore this provider record! not from originator.
 			// (we should sign them and check signature later...)
@@ -357,6 +454,9 @@ func (dht *IpfsDHT) handleAddProvider(ctx context.Context, p peer.ID, pmes *pb.M
 			continue
 		}
 
+		if dht.addressFilter != nil {
+			pi.Addrs = dht.addressFilter(pi.ID, pi.Addrs)
+		}
 		if len(pi.Addrs) < 1 {
 			logger.Debugw("no valid addresses for provider", "from", p)
 			continue
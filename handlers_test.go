@@ -3,18 +3,30 @@ package dht
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
 	proto "github.com/gogo/protobuf/proto"
+	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	record "github.com/libp2p/go-libp2p-record"
 	recpb "github.com/libp2p/go-libp2p-record/pb"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multihash"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestCleanRecordSigned(t *testing.T) {
@@ -138,3 +150,530 @@ func BenchmarkHandleFindPeer(b *testing.B) {
 	}
 
 }
+
+func TestMaxClosestPeersReturned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var cfg dhtcfg.Config
+	if err := cfg.Apply(MaxClosestPeersReturned(0)); err == nil {
+		t.Fatal("expected a cap of 0 to be refused")
+	}
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const known = 10
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected int
+	}{
+		{"default", nil, known + 1},
+		{"capped", []Option{MaxClosestPeersReturned(3)}, 3},
+		{"above bucket size", []Option{BucketSize(known), MaxClosestPeersReturned(2 * known)}, known + 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := setupDHT(ctx, t, false, tc.opts...)
+			defer d.Close()
+
+			for i := 0; i < known; i++ {
+				p := test.RandPeerIDFatal(t)
+				d.peerstore.AddAddr(p, addr, time.Hour)
+				if _, err := d.routingTable.TryAddPeer(p, true, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			requester, target := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+			d.peerstore.AddAddr(target, addr, time.Hour)
+
+			resp, err := d.handleFindPeer(ctx, requester, pb.NewMessage(pb.Message_FIND_NODE, []byte(target), 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.CloserPeers) != tc.expected {
+				t.Fatalf("expected %d closer peers, got %d", tc.expected, len(resp.CloserPeers))
+			}
+			// The target is returned within the cap.
+			found := false
+			for _, pi := range resp.CloserPeers {
+				found = found || peer.ID(pi.Id) == target
+			}
+			if !found {
+				t.Fatal("expected the target to be returned")
+			}
+		})
+	}
+}
+
+func TestRegisteredMessageTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+	noop := func(context.Context, peer.ID, *pb.Message) (*pb.Message, error) { return nil, nil }
+
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected []pb.Message_MessageType
+	}{{
+		name: "default",
+		expected: []pb.Message_MessageType{
+			pb.Message_PUT_VALUE, pb.Message_GET_VALUE, pb.Message_ADD_PROVIDER,
+			pb.Message_GET_PROVIDERS, pb.Message_FIND_NODE, pb.Message_PING,
+		},
+	}, {
+		name: "disabled",
+		opts: []Option{DisabledMessageTypes(pb.Message_GET_PROVIDERS, pb.Message_PING)},
+		expected: []pb.Message_MessageType{
+			pb.Message_PUT_VALUE, pb.Message_GET_VALUE, pb.Message_ADD_PROVIDER, pb.Message_FIND_NODE,
+		},
+	}, {
+		name: "registered",
+		opts: []Option{
+			RegisterMessageHandler(experimental, noop, false),
+			RegisterMessageHandler(pb.Message_PING, noop, true),
+			DisableValues(),
+		},
+		expected: []pb.Message_MessageType{
+			pb.Message_ADD_PROVIDER, pb.Message_GET_PROVIDERS, pb.Message_FIND_NODE, pb.Message_PING, experimental,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := setupDHT(ctx, t, false, tc.opts...)
+			defer d.Close()
+
+			got := d.RegisteredMessageTypes()
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, got)
+			}
+			for _, typ := range got {
+				if d.handlerForMsgType(typ) == nil {
+					t.Fatalf("%s is reported but has no handler", typ)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterMessageHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const experimental pb.Message_MessageType = 42
+
+	var cfg dhtcfg.Config
+	if err := cfg.Apply(RegisterMessageHandler(pb.Message_PING, nil, true)); err == nil {
+		t.Fatal("expected a nil handler to be refused")
+	}
+	noop := func(context.Context, peer.ID, *pb.Message) (*pb.Message, error) { return nil, nil }
+	if err := cfg.Apply(RegisterMessageHandler(pb.Message_PING, noop, false)); err == nil {
+		t.Fatal("expected overriding a core handler without override to be refused")
+	}
+
+	called := make(chan pb.Message_MessageType, 2)
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		called <- req.GetType()
+		return pb.NewMessage(req.GetType(), req.GetKey(), 0), nil
+	}
+
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(experimental, handler, false),
+		RegisterMessageHandler(pb.Message_PING, handler, true),
+	)
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	for _, typ := range []pb.Message_MessageType{experimental, pb.Message_PING} {
+		resp, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(typ, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetType() != typ || string(resp.GetKey()) != "key" {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		select {
+		case got := <-called:
+			if got != typ {
+				t.Fatalf("expected the handler to be invoked for %s, got %s", typ, got)
+			}
+		default:
+			t.Fatalf("expected the handler to be invoked for %s", typ)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var redirector *IpfsDHT
+	redirect := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		return redirector.Redirect(p, req), nil
+	}
+	redirector = setupDHT(ctx, t, false, RegisterMessageHandler(pb.Message_GET_VALUE, redirect, true))
+	holder := setupDHT(ctx, t, false)
+	client := setupDHT(ctx, t, false)
+	defer redirector.Close()
+	defer holder.Close()
+	defer client.Close()
+
+	// The client only knows the redirector, which only knows the holder.
+	connect(t, ctx, redirector, holder)
+	connect(t, ctx, client, redirector)
+
+	const key = "/v/redirected"
+	rec := record.MakePutRecord(key, []byte("value"))
+	rec.TimeReceived = u.FormatRFC3339(time.Now())
+	for _, d := range []*IpfsDHT{redirector, holder} {
+		if err := d.putLocal(key, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The redirector doesn't serve its value, just the peers closer to it.
+	got, closer, err := client.protoMessenger.GetValue(ctx, redirector.self, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatalf("expected no record from the redirector, got %v", got)
+	}
+	if len(closer) != 1 || closer[0].ID != holder.self || len(closer[0].Addrs) == 0 {
+		t.Fatalf("expected to be redirected to the holder, got %v", closer)
+	}
+
+	ctxT, cancelT := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelT()
+	val, err := client.GetValue(ctxT, key, Quorum(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value" {
+		t.Fatalf("expected to get the value from the holder, got %q", val)
+	}
+}
+
+func TestTypedRequestHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got *pb.GetProvidersRequest
+	handler := getProvidersHandler(func(_ context.Context, _ peer.ID, req *pb.GetProvidersRequest) (*pb.Message, error) {
+		got = req
+		return nil, nil
+	})
+	p := test.RandPeerIDFatal(t)
+
+	mes := pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0)
+	if _, err := handler(ctx, p, mes); err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || string(got.Key) != "key" || got.Message() != mes {
+		t.Fatalf("expected the handler to get the typed view of the request, got %+v", got)
+	}
+
+	got = nil
+	for _, mes := range []*pb.Message{
+		pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0),
+		pb.NewMessage(pb.Message_GET_PROVIDERS, nil, 0),
+	} {
+		if _, err := handler(ctx, p, mes); err == nil {
+			t.Fatalf("expected %s with key %q to be refused", mes.GetType(), mes.GetKey())
+		}
+		if got != nil {
+			t.Fatal("expected the handler not to be invoked for an invalid request")
+		}
+	}
+	if _, err := pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0).AsGetProviders(); !errors.Is(err, pb.ErrWrongMessageType) {
+		t.Fatalf("expected %v, got %v", pb.ErrWrongMessageType, err)
+	}
+}
+
+func TestStreamProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seen := make(chan protocol.ID, 1)
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		proto, ok := StreamProtocol(ctx)
+		if !ok {
+			t.Error("expected the stream protocol to be set")
+		}
+		seen <- proto
+		return req, nil
+	}
+
+	// The server speaks both the plain and the compressed protocol, each client
+	// only one of them.
+	server := setupDHT(ctx, t, false, Compression(true), RegisterMessageHandler(pb.Message_PING, handler, true))
+	compressing := setupDHT(ctx, t, false, Compression(true))
+	plain := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer compressing.Close()
+	defer plain.Close()
+	connectNoSync(t, ctx, compressing, server)
+	connectNoSync(t, ctx, plain, server)
+
+	for _, tc := range []struct {
+		client *IpfsDHT
+		proto  protocol.ID
+	}{
+		{compressing, net.CompressedProtocol(server.protocols[0])},
+		{plain, server.protocols[0]},
+	} {
+		if err := tc.client.protoMessenger.Ping(ctx, server.self); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-seen; got != tc.proto {
+			t.Fatalf("expected the handler to see %s, got %s", tc.proto, got)
+		}
+	}
+}
+
+func TestObservedAddr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seen := make(chan ma.Multiaddr, 1)
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		addr, ok := ObservedAddr(ctx)
+		if !ok {
+			t.Error("expected the observed address to be set")
+		}
+		seen <- addr
+		return pb.NewMessage(req.GetType(), req.GetKey(), req.GetClusterLevel()), nil
+	}
+
+	server := setupDHT(ctx, t, false, RegisterMessageHandler(pb.Message_FIND_NODE, handler, true))
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	if _, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self); err != nil {
+		t.Fatal(err)
+	}
+	addr := <-seen
+	conns := server.host.Network().ConnsToPeer(client.self)
+	if len(conns) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(conns))
+	}
+	if !addr.Equal(conns[0].RemoteMultiaddr()) {
+		t.Fatalf("expected the handler to see %s, got %s", conns[0].RemoteMultiaddr(), addr)
+	}
+}
+
+func TestDisabledMessageTypes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.DisabledTypeHitsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.DisabledTypeHitsView)
+
+	called := make(chan struct{}, 1)
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		called <- struct{}{}
+		return req, nil
+	}
+	server := setupDHT(ctx, t, false,
+		RegisterMessageHandler(pb.Message_GET_PROVIDERS, handler, true),
+		DisabledMessageTypes(pb.Message_GET_PROVIDERS),
+	)
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	if _, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self); err != nil {
+		t.Fatalf("expected FIND_NODE to be served, got %v", err)
+	}
+
+	key, err := multihash.Sum([]byte("key"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.protoMessenger.GetProviders(ctx, server.self, key); err == nil {
+		t.Fatal("expected GET_PROVIDERS to be refused")
+	}
+	select {
+	case <-called:
+		t.Fatal("handler of a disabled message type was invoked")
+	default:
+	}
+
+	rows, err := view.RetrieveData(metrics.DisabledTypeHitsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits int64
+	for _, r := range rows {
+		hits += r.Data.(*view.CountData).Value
+	}
+	if hits == 0 {
+		t.Fatal("expected the refused message to be counted")
+	}
+}
+
+func TestHandlerPanicRecovered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.HandlerPanicsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.HandlerPanicsView)
+	panics := func() int64 {
+		rows, err := view.RetrieveData(metrics.HandlerPanicsView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int64
+		for _, r := range rows {
+			n += r.Data.(*view.CountData).Value
+		}
+		return n
+	}
+
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		panic("broken handler")
+	}
+	// Handlers bounded by a timeout run on a goroutine of their own.
+	for _, opts := range [][]Option{
+		{RegisterMessageHandler(pb.Message_PING, handler, true)},
+		{RegisterMessageHandler(pb.Message_PING, handler, true), HandlerTimeout(pb.Message_PING, time.Minute)},
+	} {
+		core, logs := observer.New(zap.ErrorLevel)
+		server := setupDHT(ctx, t, false, append(opts, Logger(zap.New(core)))...)
+		client := setupDHT(ctx, t, false)
+		connectNoSync(t, ctx, client, server)
+
+		before := panics()
+		if err := client.protoMessenger.Ping(ctx, server.self); err == nil {
+			t.Fatal("expected the ping to fail")
+		}
+		if n := panics() - before; n == 0 {
+			t.Fatal("expected the panic to be counted")
+		}
+		entries := logs.FilterMessage("message handler panicked").
+			FilterField(zap.String("from", client.self.String())).All()
+		if len(entries) == 0 || entries[0].ContextMap()["panic"] != "broken handler" {
+			t.Fatalf("expected the panic to be logged, got %v", entries)
+		}
+
+		// The server keeps serving other requests.
+		if _, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self); err != nil {
+			t.Fatalf("expected FIND_NODE to be served after a handler panicked, got %v", err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, AddressFilter(PublicAddressFilter))
+	defer d.Close()
+
+	announce := func(p peer.ID, key []byte, addrs ...string) {
+		t.Helper()
+		pi := peer.AddrInfo{ID: p}
+		for _, a := range addrs {
+			pi.Addrs = append(pi.Addrs, ma.StringCast(a))
+		}
+		mes := pb.NewMessage(pb.Message_ADD_PROVIDER, key, 0)
+		mes.ProviderPeers = pb.RawPeerInfosToPBPeers([]peer.AddrInfo{pi})
+		if _, err := addProviderHandler(d.handleAddProvider)(ctx, p, mes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	public := test.RandPeerIDFatal(t)
+	announce(public, []byte("public"),
+		"/ip4/8.8.8.8/tcp/4001",
+		"/ip4/127.0.0.1/tcp/4001",
+		"/ip4/192.168.1.2/tcp/4001",
+		"/ip6/2001:4860:4860::8888/udp/4001/quic",
+		"/ip6/::1/tcp/4001",
+	)
+	addrs := d.peerstore.Addrs(public)
+	if len(addrs) != 2 {
+		t.Fatalf("expected the 2 public addresses to be stored, got %v", addrs)
+	}
+	for _, a := range addrs {
+		if s := a.String(); s != "/ip4/8.8.8.8/tcp/4001" && s != "/ip6/2001:4860:4860::8888/udp/4001/quic" {
+			t.Fatalf("unexpected address stored: %s", s)
+		}
+	}
+	if provs := d.ProviderManager.GetProviders(ctx, []byte("public")); len(provs) != 1 || provs[0] != public {
+		t.Fatalf("expected %s to provide the key, got %v", public, provs)
+	}
+
+	private := test.RandPeerIDFatal(t)
+	announce(private, []byte("private"), "/ip4/10.0.0.1/tcp/4001", "/ip4/127.0.0.1/tcp/4001")
+	if addrs := d.peerstore.Addrs(private); len(addrs) != 0 {
+		t.Fatalf("expected no private address to be stored, got %v", addrs)
+	}
+	if provs := d.ProviderManager.GetProviders(ctx, []byte("private")); len(provs) != 0 {
+		t.Fatalf("expected a provider without public addresses not to be stored, got %v", provs)
+	}
+}
+
+func TestHandlerExecutionMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.HandlerExecutionView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.HandlerExecutionView)
+
+	const experimental pb.Message_MessageType = 42
+	const delay = 50 * time.Millisecond
+	handler := func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error) {
+		time.Sleep(delay)
+		return pb.NewMessage(req.GetType(), nil, 0), nil
+	}
+	server := setupDHT(ctx, t, false, RegisterMessageHandler(experimental, handler, false))
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	if _, err := client.msgSender.SendRequest(ctx, server.self, pb.NewMessage(experimental, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(metrics.HandlerExecutionView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, r := range rows {
+		var typ string
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyMessageType {
+				typ = tg.Value
+			}
+		}
+		if typ != experimental.String() {
+			continue
+		}
+		found = true
+		d := r.Data.(*view.DistributionData)
+		if d.Count != 1 || d.Min < float64(delay/time.Millisecond) || d.Max > float64(time.Second/time.Millisecond) {
+			t.Fatalf("expected one execution of about %s, got %d between %.2fms and %.2fms", delay, d.Count, d.Min, d.Max)
+		}
+	}
+	if !found {
+		t.Fatal("expected the handler execution to be recorded")
+	}
+}
@@ -0,0 +1,18 @@
+package internal
+
+import "time"
+
+// Clock tells the time. It is used wherever latencies are measured so that
+// tests can substitute a clock they control.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+// RealClock is the Clock backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                  { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration { return time.Since(t) }
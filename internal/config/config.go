@@ -1,18 +1,27 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/ipfs/go-ipns"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	"github.com/libp2p/go-libp2p-kad-dht/providers"
 	"github.com/libp2p/go-libp2p-kbucket/peerdiversity"
 	record "github.com/libp2p/go-libp2p-record"
+	ma "github.com/multiformats/go-multiaddr"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
 )
 
 // DefaultPrefix is the application specific prefix attached to all DHT protocols by default.
@@ -30,22 +39,91 @@ type QueryFilterFunc func(dht interface{}, ai peer.AddrInfo) bool
 // the local route table.
 type RouteTableFilterFunc func(dht interface{}, p peer.ID) bool
 
+// InboundMessageFilterFunc is a filter applied to every inbound message before it is dispatched to a handler.
+// Returning an error rejects the message.
+type InboundMessageFilterFunc func(p peer.ID, req *pb.Message) error
+
+// AddressFilterFunc filters the addresses peer p announced for itself, returning those that may be stored.
+type AddressFilterFunc func(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr
+
+// MessageHandlerFunc handles an inbound message of a given type from peer p. It returns the response to send back,
+// or nil if the message isn't answered. Returning an error resets the stream.
+type MessageHandlerFunc func(ctx context.Context, p peer.ID, req *pb.Message) (*pb.Message, error)
+
 // Config is a structure containing all the options that can be used when constructing a DHT.
 type Config struct {
-	Datastore          ds.Batching
-	Validator          record.Validator
-	ValidatorChanged   bool // if true implies that the validator has been changed and that Defaults should not be used
-	Mode               ModeOpt
-	ProtocolPrefix     protocol.ID
-	V1ProtocolOverride protocol.ID
-	BucketSize         int
-	Concurrency        int
-	Resiliency         int
-	MaxRecordAge       time.Duration
-	EnableProviders    bool
-	EnableValues       bool
-	ProvidersOptions   []providers.Option
-	QueryPeerFilter    QueryFilterFunc
+	Datastore           ds.Batching
+	Validator           record.Validator
+	ValidatorChanged    bool // if true implies that the validator has been changed and that Defaults should not be used
+	Mode                ModeOpt
+	ProtocolPrefix      protocol.ID
+	V1ProtocolOverride  protocol.ID
+	BucketSize          int
+	MaxClosestPeers     int
+	Concurrency         int
+	Resiliency          int
+	MaxRecordAge        time.Duration
+	EnableProviders     bool
+	EnableValues        bool
+	ProvidersOptions    []providers.Option
+	QueryPeerFilter     QueryFilterFunc
+	InboundReadTimeout  time.Duration
+	InboundWriteTimeout time.Duration
+	MsgSenderBuilder    func(h host.Host, protos []protocol.ID) pb.MessageSender
+
+	MaxInboundStreams        int
+	MaxInboundStreamsPerPeer int
+	HandlerTimeouts          map[pb.Message_MessageType]time.Duration
+	DisabledMessageTypes     map[pb.Message_MessageType]struct{}
+	ResponseTokenTypes       map[pb.Message_MessageType]struct{}
+	InboundMessageFilter     InboundMessageFilterFunc
+	AddressFilter            AddressFilterFunc
+	MaxMessageSize           int
+	StreamBackoffBase        time.Duration
+	StreamBackoffMax         time.Duration
+	CircuitBreakerErrorRate  float64
+	CircuitBreakerWindow     int
+	CircuitBreakerCooldown   time.Duration
+	OnLatencySample          func(p peer.ID, rtt time.Duration)
+	OnLateReply              func(p peer.ID, reply *pb.Message)
+	OnRoutingTableChanged    func(added, removed []peer.ID)
+	OnSlowDown               func(p peer.ID)
+	OutboundMessageHook      func(p peer.ID, pmes *pb.Message) *pb.Message
+	MetricsLabelTransformer  func(key tag.Key, value string) string
+	LatencyRecorder          internal.LatencyRecorder
+	DisableLatencyTracking   bool
+	DisableAutoRTUpdate      bool
+	PreferFastConnections    bool
+	DisableOutboundMetrics   bool
+	MetricsSampling          map[pb.Message_MessageType]int
+	WriteBufferSize          int
+	Codec                    pb.MessageCodec
+	HandlerWorkers           int
+	FairScheduling           bool
+	LatencyAwareRouting      bool
+	MaxOutstandingResponses  int
+	SlowDownHandlingTime     time.Duration
+	SlowDownInboundStreams   int
+	SlowHandlerThreshold     time.Duration
+	StreamPoolIdleTimeout    time.Duration
+	StreamPoolMaxIdlePerPeer int
+	ConnectionPruneTimeout   time.Duration
+	DialTimeout              time.Duration
+	StreamPoolMinRate        float64
+	StreamPoolRateWindow     time.Duration
+	MessageCoalescingDelay   time.Duration
+	MaintenanceJitter        float64
+	TraceSampler             trace.Sampler
+	EnableCompression        bool
+	EnableChecksums          bool
+	SequenceNumbers          bool
+	InboundRateLimit         float64
+	InboundRateBurst         int
+	MessageHandlers          map[pb.Message_MessageType]MessageHandlerFunc
+	ConnectionGater          connmgr.ConnectionGater
+	RequestRetries           int
+	Logger                   *zap.Logger
+	InstanceID               string
 
 	RoutingTable struct {
 		RefreshQueryTimeout time.Duration
@@ -108,6 +186,10 @@ var Defaults = func(o *Config) error {
 	o.EnableProviders = true
 	o.EnableValues = true
 	o.QueryPeerFilter = EmptyQueryFilter
+	o.InboundReadTimeout = time.Minute
+	o.MaxMessageSize = network.MessageSizeMax
+	o.StreamPoolMaxIdlePerPeer = 1
+	o.MaxOutstandingResponses = 64
 
 	o.RoutingTable.LatencyTolerance = time.Minute
 	o.RoutingTable.RefreshQueryTimeout = 1 * time.Minute
@@ -19,6 +19,17 @@ func (m CtxMutex) Lock(ctx context.Context) error {
 	}
 }
 
+// TryLock acquires the mutex if it's free, without blocking, and reports
+// whether it did.
+func (m CtxMutex) TryLock() bool {
+	select {
+	case m <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
 func (m CtxMutex) Unlock() {
 	select {
 	case <-m:
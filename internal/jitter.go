@@ -0,0 +1,16 @@
+package internal
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jitter returns d scaled by a random factor in [1-fraction, 1+fraction], so
+// that periodic work started by many nodes at once spreads out over time.
+// A fraction of 0 returns d unchanged.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+	const (
+		d        = time.Minute
+		fraction = 0.2
+	)
+	min, max := time.Duration(float64(d)*(1-fraction)), time.Duration(float64(d)*(1+fraction))
+
+	seen := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		j := Jitter(d, fraction)
+		if j < min || j > max {
+			t.Fatalf("jittered interval %s outside of [%s, %s]", j, min, max)
+		}
+		seen[j] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Fatal("expected the jittered intervals to differ")
+	}
+
+	if j := Jitter(d, 0); j != d {
+		t.Fatalf("expected no jitter, got %s", j)
+	}
+}
@@ -0,0 +1,13 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// LatencyRecorder records the round trip times measured with peers. The
+// peerstore is one, and the default wherever latencies are recorded.
+type LatencyRecorder interface {
+	RecordLatency(p peer.ID, rtt time.Duration)
+}
@@ -0,0 +1,73 @@
+package net
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+)
+
+// requestRate is an exponentially weighted moving average of the number of
+// requests per second sent to a peer, decaying with the given time constant.
+type requestRate struct {
+	value float64
+	at    time.Time
+}
+
+// add counts a request sent at now.
+func (r *requestRate) add(now time.Time, window time.Duration) {
+	r.value = r.get(now, window) + 1/window.Seconds()
+	r.at = now
+}
+
+// get returns the rate at now.
+func (r *requestRate) get(now time.Time, window time.Duration) float64 {
+	if r.at.IsZero() {
+		return 0
+	}
+	return r.value * math.Exp(-now.Sub(r.at).Seconds()/window.Seconds())
+}
+
+// timeBelow returns how long from now it takes for the rate to drop below min
+// if no further requests are sent, 0 if it already is below.
+func (r *requestRate) timeBelow(now time.Time, window time.Duration, min float64) time.Duration {
+	v := r.get(now, window)
+	if v <= min {
+		return 0
+	}
+	return time.Duration(float64(window) * math.Log(v/min))
+}
+
+func (m *messageSenderImpl) adaptive() bool {
+	return m.adaptiveMinRate > 0
+}
+
+// trackRequest counts a request sent to the peer and decides whether its
+// stream is worth keeping, see WithAdaptiveStreamPool. ms.lk must be held.
+func (ms *peerMessageSender) trackRequest(ctx context.Context) {
+	if !ms.m.adaptive() {
+		return
+	}
+	now := ms.m.clock.Now()
+	ms.rate.add(now, ms.m.adaptiveWindow)
+	ms.metricsCtx = metricsContext(ctx)
+	ms.setRetain(ms.rate.get(now, ms.m.adaptiveWindow) >= ms.m.adaptiveMinRate)
+}
+
+// setRetain sets whether the stream is to be kept open between requests,
+// keeping track of the pool's target size. ms.lk must be held.
+func (ms *peerMessageSender) setRetain(retain bool) {
+	if retain == ms.retain {
+		return
+	}
+	ms.retain = retain
+	delta := int64(-1)
+	if retain {
+		delta = 1
+	}
+	stats.Record(ms.metricsCtx, metrics.StreamPoolTargetSize.M(atomic.AddInt64(&ms.m.poolTarget, delta)))
+}
@@ -0,0 +1,59 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	"go.opencensus.io/stats"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// checksumProtocolSuffix is appended to a DHT protocol ID to get the ID of its
+// checksummed variant. Every message exchanged over the checksummed variant
+// carries the CRC32 of its content, see pb.Message.SetChecksum. Compressed
+// protocols don't need a checksummed variant, gzip already checks the CRC32 of
+// every message.
+const checksumProtocolSuffix = "/crc32"
+
+// ChecksumOverhead is the number of bytes a checksum adds to the encoding of a
+// message.
+const ChecksumOverhead = 5
+
+// ErrChecksumMismatch is an error that occurs when the checksum of a message doesn't match its content.
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+// ChecksummedProtocol returns the ID of the checksummed variant of proto.
+func ChecksummedProtocol(proto protocol.ID) protocol.ID {
+	return proto + checksumProtocolSuffix
+}
+
+// IsChecksummedProtocol reports whether messages exchanged over proto carry a
+// checksum.
+func IsChecksummedProtocol(proto protocol.ID) bool {
+	return strings.HasSuffix(string(proto), checksumProtocolSuffix)
+}
+
+// withChecksum returns a copy of mes carrying its checksum. The caller's
+// message isn't modified as it may be sent to several peers at once.
+func withChecksum(mes *pb.Message) (*pb.Message, error) {
+	c := *mes
+	if err := c.SetChecksum(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// VerifyChecksum checks the checksum of a message received over a checksummed
+// protocol, counting the message as corrupt if it doesn't match.
+func VerifyChecksum(ctx context.Context, mes *pb.Message) error {
+	if mes.VerifyChecksum() {
+		return nil
+	}
+	stats.Record(ctx, metrics.CorruptMessages.M(1))
+	return ErrChecksumMismatch
+}
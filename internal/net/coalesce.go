@@ -0,0 +1,112 @@
+package net
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// coalescedMessage is a one-way message waiting to be sent along with others,
+// and the tagged context its metrics are recorded in.
+type coalescedMessage struct {
+	ctx  context.Context
+	pmes *pb.Message
+}
+
+// messageBatch collects the one-way messages sent to a peer until it is
+// flushed, see WithMessageCoalescing.
+type messageBatch struct {
+	msgs  []coalescedMessage
+	timer *time.Timer
+	done  chan struct{}
+	err   error
+}
+
+// coalesce queues pmes for p with the other messages sent to p within the
+// coalescing delay, and waits until they have been written or ctx is done.
+// Once queued, a message is sent even if ctx is done, unless the sender is
+// drained first.
+func (m *messageSenderImpl) coalesce(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	m.batchLk.Lock()
+	if m.ctx.Err() != nil {
+		m.batchLk.Unlock()
+		return ErrSenderClosed
+	}
+	b, ok := m.batches[p]
+	if !ok {
+		b = &messageBatch{done: make(chan struct{})}
+		m.batches[p] = b
+		b.timer = time.AfterFunc(m.coalesceDelay, func() { m.flushBatch(p, b) })
+	}
+	b.msgs = append(b.msgs, coalescedMessage{ctx: ctx, pmes: pmes})
+	m.batchLk.Unlock()
+
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushBatch writes the messages of b to p over a single stream.
+func (m *messageSenderImpl) flushBatch(p peer.ID, b *messageBatch) {
+	m.batchLk.Lock()
+	delete(m.batches, p)
+	m.batchLk.Unlock()
+
+	// The batch outlives the contexts of the messages queued in it.
+	ctx, cancel := context.WithTimeout(metricsContext(b.msgs[0].ctx), dhtReadMessageTimeout)
+	defer cancel()
+
+	pmess := make([]*pb.Message, len(b.msgs))
+	for i, cm := range b.msgs {
+		pmess[i] = cm.pmes
+	}
+	acquireStart := m.clock.Now()
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err == nil {
+		err = ms.SendMessages(ctx, pmess, acquireStart)
+	}
+	if err != nil {
+		m.log.Debugw("message batch failed", "error", err, "to", p, "messages", len(pmess))
+	}
+	m.finishBatch(b, err)
+}
+
+// failBatches fails the batches still waiting for the coalescing delay to pass,
+// once the sender is drained. Those being flushed already are left to finish.
+func (m *messageSenderImpl) failBatches() {
+	m.batchLk.Lock()
+	defer m.batchLk.Unlock()
+	for p, b := range m.batches {
+		if !b.timer.Stop() {
+			continue
+		}
+		delete(m.batches, p)
+		m.finishBatch(b, ErrSenderClosed)
+	}
+}
+
+// finishBatch records the outcome of the messages of b, and hands err to those
+// waiting for them.
+func (m *messageSenderImpl) finishBatch(b *messageBatch, err error) {
+	m.recordBatch(b.msgs, err)
+	b.err = err
+	close(b.done)
+}
+
+// recordBatch records the outcome of messages sent together.
+func (m *messageSenderImpl) recordBatch(msgs []coalescedMessage, err error) {
+	for _, cm := range msgs {
+		if err != nil {
+			m.record(cm.ctx, metrics.SentMessages.M(1), metrics.SentMessageErrors.M(1))
+		} else {
+			m.recordSent(cm.ctx, metrics.SentMessages, cm.pmes)
+		}
+	}
+}
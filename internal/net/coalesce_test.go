@@ -0,0 +1,128 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-msgio"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+func TestMessageCoalescing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const messages = 3
+	for _, tc := range []struct {
+		delay   time.Duration
+		streams int32
+	}{
+		{delay: 0, streams: messages},
+		{delay: 50 * time.Millisecond, streams: 1},
+	} {
+		t.Run(fmt.Sprintf("delay=%s", tc.delay), func(t *testing.T) {
+			mn, err := mocknet.FullMeshConnected(ctx, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, remote := mn.Hosts()[0], mn.Hosts()[1]
+			proto := protocol.ID("/test/kad/1.0.0")
+			var streams int32
+			received := make(chan *pb.Message, messages)
+			remote.SetStreamHandler(proto, func(s network.Stream) {
+				defer s.Close()
+				atomic.AddInt32(&streams, 1)
+				r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+				for {
+					buf, err := r.ReadMsg()
+					if err != nil {
+						return
+					}
+					mes := new(pb.Message)
+					if err := mes.Unmarshal(buf); err != nil {
+						return
+					}
+					received <- mes
+				}
+			})
+			// Without pooling, every message not coalesced with others gets a
+			// stream of its own.
+			ms := NewMessageSenderImpl(h, []protocol.ID{proto},
+				WithStreamPoolMaxIdlePerPeer(0),
+				WithMessageCoalescing(tc.delay),
+			)
+
+			var wg sync.WaitGroup
+			for i := 0; i < messages; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					mes := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte(fmt.Sprint(i)), 0)
+					if err := ms.SendMessage(ctx, remote.ID(), mes); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			for i := 0; i < messages; i++ {
+				select {
+				case <-received:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("expected %d messages, got %d", messages, i)
+				}
+			}
+			if n := atomic.LoadInt32(&streams); n != tc.streams {
+				t.Fatalf("expected the messages to be sent over %d streams, got %d", tc.streams, n)
+			}
+		})
+	}
+}
+
+func TestMessageCoalescingDrained(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithMessageCoalescing(time.Minute)).(*messageSenderImpl)
+
+	mes := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("key"), 0)
+	errc := make(chan error, 1)
+	go func() { errc <- ms.SendMessage(ctx, remote.ID(), mes) }()
+	for i := 0; ; i++ {
+		ms.batchLk.Lock()
+		queued := len(ms.batches)
+		ms.batchLk.Unlock()
+		if queued > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("expected the message to be queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Draining the sender fails the queued message rather than leaving it to
+	// the timer.
+	ms.Drain(ctx)
+	select {
+	case err := <-errc:
+		if err != ErrSenderClosed {
+			t.Fatalf("expected the queued message to fail, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued message to fail once drained")
+	}
+	if err := ms.SendMessage(ctx, remote.ID(), mes); err != ErrSenderClosed {
+		t.Fatalf("expected messages sent once drained to fail, got %v", err)
+	}
+}
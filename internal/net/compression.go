@@ -0,0 +1,172 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-msgio"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// compressedProtocolSuffix is appended to a DHT protocol ID to get the ID of
+// its compressed variant. Messages exchanged over the compressed variant are
+// delimited like the uncompressed ones, but each of them is gzip compressed.
+const compressedProtocolSuffix = "/gzip"
+
+// CompressedProtocol returns the ID of the compressed variant of proto.
+func CompressedProtocol(proto protocol.ID) protocol.ID {
+	return proto + compressedProtocolSuffix
+}
+
+// IsCompressedProtocol reports whether messages exchanged over proto are
+// compressed.
+func IsCompressedProtocol(proto protocol.ID) bool {
+	return strings.HasSuffix(string(proto), compressedProtocolSuffix)
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+var gzipReaderPool sync.Pool
+
+// compressMsg returns the gzip compressed encoding of mes, encoded with codec
+// or as protobuf if codec is nil.
+func compressMsg(codec pb.MessageCodec, mes *pb.Message) ([]byte, error) {
+	data, err := marshalMsg(codec, mes)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	zw.Reset(&buf)
+	_, err = zw.Write(data)
+	if err == nil {
+		err = zw.Close()
+	}
+	zw.Reset(nil)
+	gzipWriterPool.Put(zw)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns data decompressed, failing if it decompresses to more
+// than maxSize bytes.
+func decompress(data []byte, maxSize int) ([]byte, error) {
+	var err error
+	zr, _ := gzipReaderPool.Get().(*gzip.Reader)
+	if zr == nil {
+		zr, err = gzip.NewReader(bytes.NewReader(data))
+	} else {
+		err = zr.Reset(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReaderPool.Put(zr)
+
+	out, err := ioutil.ReadAll(io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, msgio.ErrMsgTooLarge
+	}
+	return out, nil
+}
+
+// writeCompressedMsg writes mes compressed and delimited to w and returns the
+// compressed size.
+func writeCompressedMsg(w *bufio.Writer, codec pb.MessageCodec, mes *pb.Message) (int, error) {
+	data, err := compressMsg(codec, mes)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeDelimited(w, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// writeDelimited writes data to w, prefixed with its length.
+func writeDelimited(w *bufio.Writer, data []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// recordCompression records the size of a message before and after compression.
+func recordCompression(ctx context.Context, uncompressed, compressed int) {
+	stats.Record(ctx,
+		metrics.UncompressedBytes.M(int64(uncompressed)),
+		metrics.CompressedBytes.M(int64(compressed)),
+	)
+}
+
+// metricsContext returns a context carrying only the metric tags of ctx, for
+// recording metrics after ctx is done.
+func metricsContext(ctx context.Context) context.Context {
+	return tag.NewContext(context.Background(), tag.FromContext(ctx))
+}
+
+// compressedReader reads compressed, delimited messages and decompresses them.
+type compressedReader struct {
+	msgio.ReadCloser
+	ctx     context.Context
+	maxSize int
+}
+
+// NewMessageReader returns a reader for the delimited messages read from r,
+// decompressing them if compressed is set. No message larger than maxSize is
+// read, whether compressed or not. Only the metric tags of ctx are used.
+//
+// r is read through a buffer, so that the messages a peer pipelines are mostly
+// decoded out of a single read, instead of reading every length prefix byte
+// by byte. If r already is a large enough *bufio.Reader, it is used as is.
+func NewMessageReader(ctx context.Context, r io.Reader, maxSize int, compressed bool) msgio.ReadCloser {
+	vr := msgio.NewVarintReaderSize(bufio.NewReader(r), maxSize)
+	if !compressed {
+		return vr
+	}
+	return &compressedReader{ReadCloser: vr, ctx: metricsContext(ctx), maxSize: maxSize}
+}
+
+func (r *compressedReader) ReadMsg() ([]byte, error) {
+	data, err := r.ReadCloser.ReadMsg()
+	if err != nil {
+		return data, err
+	}
+	defer r.ReadCloser.ReleaseMsg(data)
+
+	out, err := decompress(data, r.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	recordCompression(r.ctx, len(out), len(data))
+	return out, nil
+}
+
+// ReleaseMsg does nothing, decompressed messages aren't pooled.
+func (r *compressedReader) ReleaseMsg([]byte) {}
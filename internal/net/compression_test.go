@@ -0,0 +1,201 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// providersResponse returns a GET_PROVIDERS response listing n providers.
+func providersResponse(t testing.TB, n int) *pb.Message {
+	t.Helper()
+
+	mes := pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0)
+	infos := make([]peer.AddrInfo, n)
+	for i := range infos {
+		id, err := test.RandPeerID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/10.0.%d.%d/tcp/4001", i/256, i%256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos[i] = peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{addr}}
+	}
+	mes.ProviderPeers = pb.RawPeerInfosToPBPeers(infos)
+	return mes
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	mess := []*pb.Message{
+		providersResponse(t, 100),
+		pb.NewMessage(pb.Message_PING, nil, 0),
+		providersResponse(t, 3),
+	}
+
+	var buf bytes.Buffer
+	w := NewCompressedMessageWriter(ctx, &buf)
+	for _, mes := range mess {
+		if err := w.WriteMsg(mes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.Release()
+
+	var uncompressed bytes.Buffer
+	if err := WriteMsgs(&uncompressed, mess); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= uncompressed.Len() {
+		t.Fatalf("expected compression to save space, got %d bytes compressed and %d uncompressed", buf.Len(), uncompressed.Len())
+	}
+
+	r := NewMessageReader(ctx, &buf, 1<<20, true)
+	for i, want := range mess {
+		data, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := new(pb.Message)
+		err = got.Unmarshal(data)
+		r.ReleaseMsg(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantBytes, err := want.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotBytes, err := got.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotBytes, wantBytes) {
+			t.Fatalf("message %d didn't decode identically", i)
+		}
+	}
+}
+
+func TestCompressionMaxMessageSize(t *testing.T) {
+	ctx := context.Background()
+	mes := providersResponse(t, 100)
+
+	var buf bytes.Buffer
+	w := NewCompressedMessageWriter(ctx, &buf)
+	if err := w.WriteMsg(mes); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.Release()
+
+	// The compressed message fits, but it decompresses to more than allowed.
+	r := NewMessageReader(ctx, &buf, mes.Size()-1, true)
+	if _, err := r.ReadMsg(); err != msgio.ErrMsgTooLarge {
+		t.Fatalf("expected ErrMsgTooLarge, got %v", err)
+	}
+}
+
+// chunkReader returns at most n bytes per read, counting its reads.
+type chunkReader struct {
+	r     io.Reader
+	n     int
+	reads int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	r.reads++
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	return r.r.Read(p)
+}
+
+func TestMessageReaderPartialFrames(t *testing.T) {
+	ctx := context.Background()
+	mess := []*pb.Message{
+		pb.NewMessage(pb.Message_PING, nil, 0),
+		providersResponse(t, 100),
+		pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0),
+		providersResponse(t, 3),
+	}
+	var encoded bytes.Buffer
+	if err := WriteMsgs(&encoded, mess); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames straddle both the chunks and the read buffer.
+	for _, chunk := range []int{1, 7, 4093, 1 << 16} {
+		r := NewMessageReader(ctx, &chunkReader{r: bytes.NewReader(encoded.Bytes()), n: chunk}, network.MessageSizeMax, false)
+		for i, want := range mess {
+			buf, err := r.ReadMsg()
+			if err != nil {
+				t.Fatalf("chunks of %d bytes: reading message %d: %s", chunk, i, err)
+			}
+			wantBuf, err := want.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			equal := bytes.Equal(buf, wantBuf)
+			r.ReleaseMsg(buf)
+			if !equal {
+				t.Fatalf("chunks of %d bytes: message %d doesn't round trip", chunk, i)
+			}
+		}
+		if _, err := r.ReadMsg(); err != io.EOF {
+			t.Fatalf("chunks of %d bytes: expected EOF, got %v", chunk, err)
+		}
+	}
+}
+
+func BenchmarkMessageReader(b *testing.B) {
+	ctx := context.Background()
+	mess := make([]*pb.Message, 64)
+	for i := range mess {
+		mess[i] = pb.NewMessage(pb.Message_FIND_NODE, []byte(fmt.Sprintf("key-%d", i)), 0)
+	}
+	var encoded bytes.Buffer
+	if err := WriteMsgs(&encoded, mess); err != nil {
+		b.Fatal(err)
+	}
+
+	run := func(b *testing.B, newReader func(io.Reader) msgio.ReadCloser) {
+		var reads int
+		for i := 0; i < b.N; i++ {
+			cr := &chunkReader{r: bytes.NewReader(encoded.Bytes()), n: 1 << 16}
+			r := newReader(cr)
+			for range mess {
+				buf, err := r.ReadMsg()
+				if err != nil {
+					b.Fatal(err)
+				}
+				r.ReleaseMsg(buf)
+			}
+			reads += cr.reads
+		}
+		b.ReportMetric(float64(reads)/float64(b.N*len(mess)), "reads/msg")
+	}
+
+	b.Run("unbuffered", func(b *testing.B) {
+		run(b, func(r io.Reader) msgio.ReadCloser { return msgio.NewVarintReaderSize(r, network.MessageSizeMax) })
+	})
+	b.Run("buffered", func(b *testing.B) {
+		run(b, func(r io.Reader) msgio.ReadCloser { return NewMessageReader(ctx, r, network.MessageSizeMax, false) })
+	})
+}
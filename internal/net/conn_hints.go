@@ -0,0 +1,128 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// connRTTSmoothing weighs every new round trip time measured on a connection
+// into its average, like the peerstore does for peers.
+const connRTTSmoothing = 0.1
+
+// connRTTs keeps the round trip times measured on each connection to a peer, so
+// that streams can be opened on the fastest one, see WithConnectionHints.
+type connRTTs struct {
+	mu   sync.Mutex
+	rtts map[peer.ID]map[network.Conn]time.Duration
+}
+
+// record weighs rtt into the average round trip time of c.
+func (r *connRTTs) record(c network.Conn, rtt time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rtts == nil {
+		r.rtts = make(map[peer.ID]map[network.Conn]time.Duration)
+	}
+	p := c.RemotePeer()
+	conns, ok := r.rtts[p]
+	if !ok {
+		conns = make(map[network.Conn]time.Duration)
+		r.rtts[p] = conns
+	}
+	if prev, ok := conns[c]; ok {
+		rtt = time.Duration((1-connRTTSmoothing)*float64(prev) + connRTTSmoothing*float64(rtt))
+	}
+	conns[c] = rtt
+}
+
+// forget drops the round trip times measured on the connections to p.
+func (r *connRTTs) forget(p peer.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.rtts, p)
+}
+
+// fastest returns the connection of conns, all to p, to open a stream on, or
+// nil for the host to pick one. That's a connection not measured yet if some
+// others were, for it to get measured too: the host keeps picking the same one
+// otherwise. Once they were all measured, that's the one with the lowest
+// average round trip time, if there are at least two. Connections that were
+// closed since are forgotten.
+func (r *connRTTs) fastest(p peer.ID, conns []network.Conn) network.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	measured, ok := r.rtts[p]
+	if !ok {
+		return nil
+	}
+
+	open := make(map[network.Conn]time.Duration, len(measured))
+	var best, unmeasured network.Conn
+	for _, c := range conns {
+		rtt, ok := measured[c]
+		if !ok {
+			if unmeasured == nil {
+				unmeasured = c
+			}
+			continue
+		}
+		open[c] = rtt
+		if best == nil || rtt < open[best] {
+			best = c
+		}
+	}
+	if len(open) == 0 {
+		delete(r.rtts, p)
+		return nil
+	}
+	r.rtts[p] = open
+	if unmeasured != nil {
+		return unmeasured
+	}
+	if len(open) < 2 {
+		return nil
+	}
+	return best
+}
+
+// openStream opens a stream to p with one of our protocols. With connection
+// hints enabled, it's opened on the connection we measured the lowest round
+// trip time on, if p is connected to us more than once, or on one we didn't
+// measure yet, see connRTTs.fastest. Otherwise, or if the connection fails to
+// open a stream, the host picks the connection.
+func (m *messageSenderImpl) openStream(ctx context.Context, p peer.ID) (network.Stream, error) {
+	if m.connHints {
+		if c := m.connRTTs.fastest(p, m.host.Network().ConnsToPeer(p)); c != nil {
+			s, err := c.NewStream(ctx)
+			if err == nil {
+				return m.selectProtocol(ctx, s)
+			}
+			m.log.Debugw("failed to open stream on the fastest connection", "error", err, "to", p)
+		}
+	}
+	return m.host.NewStream(ctx, p, m.protocols...)
+}
+
+// selectProtocol negotiates the first of our protocols the remote end of s
+// speaks, as the host does for the streams it opens.
+func (m *messageSenderImpl) selectProtocol(ctx context.Context, s network.Stream) (network.Stream, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+		defer func() { _ = s.SetDeadline(time.Time{}) }()
+	}
+	proto, err := msmux.SelectOneOf(protocol.ConvertToStrings(m.protocols), s)
+	if err != nil {
+		_ = s.Reset()
+		return nil, err
+	}
+	s.SetProtocol(protocol.ID(proto))
+	_ = m.host.Peerstore().AddProtocols(s.Conn().RemotePeer(), proto)
+	return s, nil
+}
@@ -0,0 +1,190 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// ErrStreamReleased is returned by the requests sent on a HeldStream after it
+// was put back or failed.
+var ErrStreamReleased = fmt.Errorf("held stream has been released")
+
+// HeldStream is a stream to a peer taken out of the pool by
+// SendRequestKeepStream, for a caller to send a series of requests on without
+// going through the pool for each of them.
+//
+// The caller owns the stream until it calls Put, and must call Put exactly once
+// it's done with it, even if a request failed: the pool has no stream to the
+// peer in the meantime, so that other requests to it open their own stream, and
+// only gets one back through Put. Requests on a held stream are sent one at a
+// time. A request that fails resets the stream, after which every request fails
+// with ErrStreamReleased and Put has nothing left to return.
+type HeldStream struct {
+	lk   sync.Mutex
+	ms   *peerMessageSender // carries the stream, detached from the pool
+	pool *peerMessageSender // the pooled sender of the peer, which gets the stream back
+}
+
+// SendRequestKeepStream sends a request like SendRequest, but keeps the stream
+// out of the pool once the reply is in and returns it to the caller, who owns it
+// from then on. The first request is retried on a new stream like SendRequest
+// does. See HeldStream for the contract.
+func (m *messageSenderImpl) SendRequestKeepStream(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, *HeldStream, error) {
+	acquireStart := m.clock.Now()
+	// The hook runs before a stream is taken out of the pool, for a dropped
+	// request not to cost the pool its stream.
+	if pmes = m.rewrite(p, pmes); pmes == nil {
+		return nil, nil, ErrMessageDropped
+	}
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	retries := 0
+	for {
+		hs, err := ms.hold(ctx, acquireStart, retries == 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		// A failed request resets the held stream, so nothing is left to
+		// give back to the pool.
+		reply, err := hs.send(ctx, pmes)
+		if err == nil {
+			return reply, hs, nil
+		}
+		if !ms.mayRetry(ctx, retries) {
+			return nil, nil, err
+		}
+		m.log.Debugw("error sending request on held stream", "error", err, "retrying", true)
+		retries++
+		acquireStart = m.clock.Now()
+	}
+}
+
+// hold takes the stream out of the pool, dialing a new one if needed, and
+// returns it as a HeldStream.
+func (ms *peerMessageSender) hold(ctx context.Context, acquireStart time.Time, track bool) (*HeldStream, error) {
+	if err := ms.lk.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.unlock()
+	if track {
+		ms.trackRequest(ctx)
+	}
+	if err := ms.prep(ctx); err != nil {
+		return nil, err
+	}
+	ms.recordStreamUse(ctx, acquireStart)
+
+	hs := &HeldStream{
+		ms: &peerMessageSender{
+			s:           ms.s,
+			r:           ms.r,
+			p:           ms.p,
+			m:           ms.m,
+			compressed:  ms.compressed,
+			checksummed: ms.checksummed,
+			seq:         ms.seq,
+		},
+		pool: ms,
+	}
+	ms.s = nil
+	return hs, nil
+}
+
+// Peer returns the peer the stream is to.
+func (hs *HeldStream) Peer() peer.ID {
+	return hs.ms.p
+}
+
+// SendRequest sends a request on the held stream and waits for its reply.
+func (hs *HeldStream) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+
+	if hs.ms.s == nil {
+		return nil, ErrStreamReleased
+	}
+	if pmes = hs.ms.m.rewrite(hs.ms.p, pmes); pmes == nil {
+		return nil, ErrMessageDropped
+	}
+	return hs.send(ctx, pmes)
+}
+
+// send sends pmes, which already went through the outbound hook, on the held
+// stream. The stream is reset if the request fails.
+func (hs *HeldStream) send(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+	ms, m := hs.ms, hs.ms.m
+	ctx = m.tagMessageType(ctx, pmes)
+	pmes = m.stampRequest(pmes)
+
+	start := m.clock.Now()
+	reply, err := hs.roundTrip(ctx, pmes)
+	if err != nil {
+		m.resetStream(ctx, ms.s, "request-error")
+		ms.s = nil
+		m.record(ctx,
+			metrics.SentRequests.M(1),
+			metrics.SentRequestErrors.M(1),
+		)
+		m.log.Debugw("request on held stream failed", "error", err, "to", ms.p)
+		return nil, err
+	}
+
+	latency := m.clock.Since(start)
+	m.recordSent(ctx, metrics.SentRequests, pmes,
+		metrics.OutboundRequestLatency.M(float64(latency)/float64(time.Millisecond)),
+	)
+	if m.trackLatency {
+		m.latencyRecorder.RecordLatency(ms.p, latency)
+	}
+	return reply, nil
+}
+
+func (hs *HeldStream) roundTrip(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+	ms := hs.ms
+	if err := ms.writeMsg(ctx, pmes); err != nil {
+		return nil, err
+	}
+	written := ms.m.clock.Now()
+	mes := new(pb.Message)
+	if err := ms.ctxReadMsg(ctx, mes); err != nil {
+		return nil, err
+	}
+	if id := mes.GetRequestId(); id != 0 && id != pmes.GetRequestId() {
+		return nil, ErrUnexpectedReply
+	}
+	wait := ms.m.clock.Since(written)
+	ms.m.record(ctx, metrics.ReplyWait.M(float64(wait)/float64(time.Millisecond)))
+	if ms.m.connHints {
+		ms.m.connRTTs.record(ms.s.Conn(), wait)
+	}
+	return mes, nil
+}
+
+// Put gives the stream back to the pool, which then treats it like a stream
+// just done with a request. The stream is closed instead if the pool got
+// another stream to the peer in the meantime and keeps no more idle streams,
+// see WithStreamPoolMaxIdlePerPeer, or the peer's sender is gone.
+// Requests sent on the held stream after Put fail with ErrStreamReleased.
+func (hs *HeldStream) Put() {
+	hs.lk.Lock()
+	defer hs.lk.Unlock()
+
+	if hs.ms.s == nil {
+		return
+	}
+	ds := hs.ms.handOff()
+	hs.ms.s = nil
+	if !hs.pool.restore(ds) {
+		_ = ds.s.Close()
+	}
+}
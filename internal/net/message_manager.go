@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/libp2p/go-libp2p-core/host"
@@ -19,6 +20,8 @@ import (
 
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
 
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	"github.com/libp2p/go-libp2p-kad-dht/metrics"
@@ -27,9 +30,22 @@ import (
 
 var dhtReadMessageTimeout = 10 * time.Second
 
+// lateReplyTimeout bounds how long a reply to a request whose context is done
+// is still waited for, before its stream is reset.
+var lateReplyTimeout = 10 * time.Second
+
 // ErrReadTimeout is an error that occurs when no message is read within the timeout period.
 var ErrReadTimeout = fmt.Errorf("timed out reading response")
 
+// ErrUnexpectedReply is an error that occurs when a reply doesn't correspond to the request it was matched with.
+var ErrUnexpectedReply = fmt.Errorf("reply does not match request")
+
+// ErrMessageDropped is returned when a request is dropped by the outbound message hook instead of being sent.
+var ErrMessageDropped = fmt.Errorf("message dropped by outbound message hook")
+
+// ErrSenderClosed is returned for coalesced messages still waiting to be sent when the sender is drained.
+var ErrSenderClosed = fmt.Errorf("message sender has been closed")
+
 var logger = logging.Logger("dht")
 
 // messageSenderImpl is responsible for sending requests and messages to peers efficiently, including reuse of streams.
@@ -39,16 +55,393 @@ type messageSenderImpl struct {
 	smlk      sync.Mutex
 	strmap    map[peer.ID]*peerMessageSender
 	protocols []protocol.ID
+
+	maxMessageSize int
+
+	// when set, the round trip time of every request is recorded with latencyRecorder
+	trackLatency    bool
+	latencyRecorder internal.LatencyRecorder
+
+	// when set, the outcome, size and latency of every message sent is recorded
+	metrics bool
+	// picks the messages sent successfully that are counted, nil counts them all
+	sampler *MessageSampler
+	// carries the tags of the metrics that aren't about a request, see
+	// WithMetricTags
+	tagsCtx context.Context
+	tags    []tag.Mutator
+
+	// encodes messages, nil means protobuf
+	codec pb.MessageCodec
+
+	// when set, streams are opened on the connection with the lowest round trip
+	// time measured on it, see connRTTs
+	connHints bool
+	connRTTs  connRTTs
+
+	// the id of the last request sent, see stampRequest
+	lastRequestID uint64
+
+	// how long a pooled stream may stay unused before it is closed, 0 means forever
+	idleTimeout time.Duration
+	// the number of idle streams kept per peer, the oldest ones are closed first
+	maxIdlePerPeer int
+	// how long the connections to a peer may stay without any stream once its
+	// pooled stream is gone before they're closed, 0 means they're left alone
+	connPruneTimeout time.Duration
+
+	// when adaptiveMinRate is set, streams are only kept for peers sent at least
+	// that many requests per second, averaged over adaptiveWindow
+	adaptiveMinRate float64
+	adaptiveWindow  time.Duration
+	// the number of peers whose stream is kept, accessed atomically
+	poolTarget int64
+
+	// backoff for peers we repeatedly failed to open a stream to
+	backoffLk   sync.Mutex
+	backoff     map[peer.ID]*streamBackoff
+	backoffBase time.Duration
+	backoffMax  time.Duration
+
+	// when set, streams are opened in the background, bounded by this timeout
+	// rather than by the context of the request, see WithDialTimeout
+	dialTimeout time.Duration
+	// the context of the dials made in the background, cancelled by Drain
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// when set, a span is started for every request sent
+	traceSampler trace.Sampler
+
+	// when set, messages are compressed for peers supporting it
+	compress bool
+
+	// when set, messages carry a checksum for peers supporting it
+	checksums bool
+
+	// when set, messages are numbered in the order they're sent on their stream
+	sequenceNumbers bool
+
+	// the number of times a failed request is retried on a fresh stream, on top
+	// of the retry every request gets
+	requestRetries int
+
+	// measures request latencies
+	clock internal.Clock
+
+	// when set, invoked with replies that arrive after their request was given up on
+	onLateReply func(peer.ID, *pb.Message)
+
+	// when set, rewrites or drops every message before it is sent
+	outboundHook func(peer.ID, *pb.Message) *pb.Message
+
+	// one-way messages to a peer are held back this long to be written along
+	// with the next ones, 0 means they're written right away
+	coalesceDelay time.Duration
+	batchLk       sync.Mutex
+	batches       map[peer.ID]*messageBatch
+
+	// logs failed requests, tagged with the instance id of the DHT if known
+	log *zap.SugaredLogger
+}
+
+// streamBackoff tracks consecutive failures to open a stream to a peer.
+type streamBackoff struct {
+	failures int
+	until    time.Time
+	err      error
+}
+
+// Option configures a message sender created with NewMessageSenderImpl.
+type Option func(*messageSenderImpl)
+
+// WithMaxMessageSize sets the maximum size of a response the message sender will read.
+// Defaults to network.MessageSizeMax.
+func WithMaxMessageSize(n int) Option {
+	return func(m *messageSenderImpl) {
+		m.maxMessageSize = n
+	}
+}
+
+// WithLatencyTracking sets whether the round trip time of every request is
+// recorded in the peerstore. Defaults to true.
+func WithLatencyTracking(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.trackLatency = enabled
+	}
+}
+
+// WithLatencyRecorder sets what the round trip time of every request is
+// recorded with, if latency tracking is enabled. Defaults to the peerstore of
+// the host, as does a nil r.
+func WithLatencyRecorder(r internal.LatencyRecorder) Option {
+	return func(m *messageSenderImpl) {
+		m.latencyRecorder = r
+	}
+}
+
+// WithConnectionHints sets whether the round trip time of requests is measured
+// per connection, and new streams to a peer connected more than once are opened
+// on the connection measured the fastest, once every connection was measured.
+// Defaults to false, letting the host pick the connection.
+func WithConnectionHints(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.connHints = enabled
+	}
+}
+
+// WithCodec sets the codec messages are encoded with. Defaults to protobuf.
+func WithCodec(c pb.MessageCodec) Option {
+	return func(m *messageSenderImpl) {
+		m.codec = c
+	}
+}
+
+// WithMetrics sets whether the outcome, size and latency of every message sent
+// is recorded, along with how its stream was acquired. Defaults to true.
+//
+// Disabling metrics saves tagging and recording several measurements for every
+// message, which adds up when sending messages at a very high rate, but leaves
+// the sender's traffic invisible to the DHT's views. Compression, checksum and
+// adaptive stream pool metrics are still recorded when those are enabled.
+func WithMetrics(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.metrics = enabled
+	}
+}
+
+// WithMetricsSampling makes the sender record only 1 in every rates[t] messages
+// of type t it sends successfully in the sent messages, requests and bytes
+// views, each counted for the messages left out, see MessageSampler. Failed
+// messages are always counted. Defaults to counting every message.
+func WithMetricsSampling(rates map[pb.Message_MessageType]int) Option {
+	return func(m *messageSenderImpl) {
+		m.sampler = NewMessageSampler(rates)
+	}
+}
+
+// WithStreamPoolIdleTimeout sets how long a pooled stream may go unused before
+// it is closed. A timeout of 0, the default, keeps idle streams open.
+func WithStreamPoolIdleTimeout(d time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.idleTimeout = d
+	}
+}
+
+// WithStreamPoolMaxIdlePerPeer sets how many idle streams are kept per peer.
+// Requests to a peer take turns on a single stream, but streams handed off to
+// finish a request, e.g. a held or streamed one, come back to the pool on top
+// of it. Once a peer has more than n idle streams, the oldest ones are closed.
+// Defaults to 1. With 0, streams are closed as soon as a request is done.
+func WithStreamPoolMaxIdlePerPeer(n int) Option {
+	return func(m *messageSenderImpl) {
+		m.maxIdlePerPeer = n
+	}
+}
+
+// WithConnectionPruning sets how long the connections to a peer are kept once
+// there's neither a pooled stream nor a request in flight to it. They're then
+// closed, unless they carry other streams or the connection manager protects or
+// tags the peer, so that peers kept by others, e.g. those in the routing table,
+// aren't disconnected. Defaults to 0, leaving connections to the connection
+// manager.
+func WithConnectionPruning(timeout time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.connPruneTimeout = timeout
+	}
+}
+
+// WithAdaptiveStreamPool makes the pool keep a peer's stream open between
+// requests only while the peer is sent at least minRate requests per second.
+// The rate is an exponentially weighted moving average decaying with the time
+// constant window, so a burst of requests gets its streams pooled while streams
+// to rarely queried peers are closed as soon as their request is done. A pooled
+// stream is closed once the rate drops below minRate, or once the idle timeout
+// expires if that happens first. No more streams than allowed by
+// WithStreamPoolMaxIdlePerPeer are kept. A minRate of 0, the default, keeps
+// streams regardless of the request rate.
+func WithAdaptiveStreamPool(minRate float64, window time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.adaptiveMinRate = minRate
+		m.adaptiveWindow = window
+	}
+}
+
+// WithStreamBackoff sets how long we stop trying to open streams to a peer after
+// failing to do so. The delay starts at base and doubles with every consecutive
+// failure, up to max. A peer we're connected to is never backed off from, as the
+// connection shows it's reachable again. A base of 0, the default, disables the
+// backoff.
+func WithStreamBackoff(base, max time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.backoffBase = base
+		m.backoffMax = max
+	}
+}
+
+// WithDialTimeout makes the sender open streams in the background, bounded by d
+// rather than by the context of the request that needs the stream. A request
+// that gives up while the stream is being opened doesn't abort it: the stream
+// is pooled once open, and the next request to the peer uses it instead of
+// dialing again. A dial running out of time counts towards the peer's backoff,
+// see WithStreamBackoff, and dials still running when the sender is drained are
+// aborted. A timeout of 0, the default, opens streams with the context of the
+// request.
+func WithDialTimeout(d time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.dialTimeout = d
+	}
+}
+
+// WithTraceSampler enables tracing of requests: a span is started with the
+// given sampler for every request sent. Tracing is disabled by default.
+func WithTraceSampler(sampler trace.Sampler) Option {
+	return func(m *messageSenderImpl) {
+		m.traceSampler = sampler
+	}
+}
+
+// WithCompression sets whether messages are compressed when the peer supports it.
+// When enabled, the compressed variants of the protocols are negotiated first.
+// Defaults to false.
+func WithCompression(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.compress = enabled
+	}
+}
+
+// WithChecksums sets whether messages carry a checksum when the peer supports
+// it. When enabled, the checksummed variants of the protocols are negotiated
+// before the plain ones, but after the compressed ones, as compressed messages
+// are already checksummed. Defaults to false.
+func WithChecksums(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.checksums = enabled
+	}
+}
+
+// WithSequenceNumbers sets whether the messages sent on a stream are numbered,
+// starting at 1 on every new stream, so that the receiver can spot lost or
+// reordered messages. This is a debugging aid. Defaults to false.
+func WithSequenceNumbers(enabled bool) Option {
+	return func(m *messageSenderImpl) {
+		m.sequenceNumbers = enabled
+	}
+}
+
+// WithRequestRetries sets how many more times a request is retried on a fresh
+// stream when writing it or reading the reply fails. Every request is retried
+// once regardless, so that a stream closed by the peer while it sat in the pool
+// doesn't fail the request. Requests are never retried once their context is
+// done. Defaults to 0.
+func WithRequestRetries(n int) Option {
+	return func(m *messageSenderImpl) {
+		m.requestRetries = n
+	}
 }
 
-func NewMessageSenderImpl(h host.Host, protos []protocol.ID) pb.MessageSender {
-	return &messageSenderImpl{
-		host:      h,
-		strmap:    make(map[peer.ID]*peerMessageSender),
-		protocols: protos,
+// WithLateReplyHandler sets a callback invoked with the reply to a request whose
+// context was done before the reply arrived. Instead of being reset right away,
+// the stream of such a request is then kept open for the reply for up to the
+// usual read timeout. The replies to requests cancelled through their
+// RequestHandle are passed to f as well. Replies arriving in time are never
+// passed to f. Only SendRequest reports late replies.
+func WithLateReplyHandler(f func(p peer.ID, reply *pb.Message)) Option {
+	return func(m *messageSenderImpl) {
+		m.onLateReply = f
 	}
 }
 
+// WithMessageCoalescing sets how long a one-way message is held back, waiting
+// for further ones to the same peer, so that bursts of messages such as the
+// provider records of a reprovide are written together over a single stream.
+// SendMessage returns once the message was written. Messages still held back
+// when the sender is drained fail with ErrSenderClosed. Defaults to 0, sending
+// every message right away.
+func WithMessageCoalescing(delay time.Duration) Option {
+	return func(m *messageSenderImpl) {
+		m.coalesceDelay = delay
+	}
+}
+
+// WithOutboundMessageHook sets a function every message is passed to before it
+// is sent to peer p, e.g. for fault injection. The message is sent as returned
+// by f, or dropped if f returns nil: dropped requests fail with
+// ErrMessageDropped, while dropped one-way messages are silently discarded.
+// Dropped messages aren't counted as sent.
+//
+// f gets a shallow copy of the message, which it may modify, but the slices it
+// shares with the caller's message must be replaced rather than modified.
+func WithOutboundMessageHook(f func(p peer.ID, pmes *pb.Message) *pb.Message) Option {
+	return func(m *messageSenderImpl) {
+		m.outboundHook = f
+	}
+}
+
+// WithMetricTags sets the tags of the metrics about the sender as a whole, such
+// as the size of its stream pool, rather than about a request. Those are
+// recorded without the tags of the requests' contexts. Defaults to no tags.
+func WithMetricTags(tags ...tag.Mutator) Option {
+	return func(m *messageSenderImpl) {
+		m.tags = tags
+	}
+}
+
+// WithInstanceID tags the debug logs of the sender with the instance id of the
+// DHT it sends for, telling apart the logs of several DHTs in one process.
+func WithInstanceID(id string) Option {
+	return func(m *messageSenderImpl) {
+		m.log = logger.With("instance", id)
+	}
+}
+
+// WithClock sets the clock request latencies are measured with. Defaults to
+// internal.RealClock.
+func WithClock(c internal.Clock) Option {
+	return func(m *messageSenderImpl) {
+		m.clock = c
+	}
+}
+
+func NewMessageSenderImpl(h host.Host, protos []protocol.ID, opts ...Option) pb.MessageSender {
+	m := &messageSenderImpl{
+		host:           h,
+		strmap:         make(map[peer.ID]*peerMessageSender),
+		protocols:      protos,
+		maxMessageSize: network.MessageSizeMax,
+		trackLatency:   true,
+		metrics:        true,
+		maxIdlePerPeer: 1,
+		backoff:        make(map[peer.ID]*streamBackoff),
+		batches:        make(map[peer.ID]*messageBatch),
+		clock:          internal.RealClock,
+		log:            &logger.SugaredLogger,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.tagsCtx, _ = tag.New(context.Background(), m.tags...)
+	if m.latencyRecorder == nil {
+		m.latencyRecorder = h.Peerstore()
+	}
+	if m.compress || m.checksums {
+		m.protocols = make([]protocol.ID, 0, 3*len(protos))
+		if m.compress {
+			for _, p := range protos {
+				m.protocols = append(m.protocols, CompressedProtocol(p))
+			}
+		}
+		if m.checksums {
+			for _, p := range protos {
+				m.protocols = append(m.protocols, ChecksummedProtocol(p))
+			}
+		}
+		m.protocols = append(m.protocols, protos...)
+	}
+	return m
+}
+
 func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
 	m.smlk.Lock()
 	defer m.smlk.Unlock()
@@ -57,6 +450,8 @@ func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
 		return
 	}
 	delete(m.strmap, p)
+	m.recordPoolSize()
+	m.connRTTs.forget(p)
 
 	// Do this asynchronously as ms.lk can block for a while.
 	go func() {
@@ -68,72 +463,360 @@ func (m *messageSenderImpl) OnDisconnect(ctx context.Context, p peer.ID) {
 	}()
 }
 
+// ClosePeer resets every DHT stream we opened to p, whether pooled or busy with
+// a request, and removes p's sender from the pool. Requests in flight fail
+// instead of being retried on a new stream, later ones open a new stream.
+func (m *messageSenderImpl) ClosePeer(p peer.ID) {
+	m.smlk.Lock()
+	ms, ok := m.strmap[p]
+	if ok {
+		delete(m.strmap, p)
+		m.recordPoolSize()
+	}
+	m.smlk.Unlock()
+
+	if ok {
+		atomic.StoreInt32(&ms.closed, 1)
+		// ms.lk may be held by a request until its stream is reset below.
+		go func() {
+			if err := ms.lk.Lock(context.Background()); err != nil {
+				return
+			}
+			defer ms.lk.Unlock()
+			ms.invalidate()
+		}()
+	}
+
+	// Streams handed off to read late replies or the rest of a streamed reply
+	// aren't tracked by the sender anymore, so go through the connections. Their
+	// readers count the reset, once their read fails.
+	for _, c := range m.host.Network().ConnsToPeer(p) {
+		for _, s := range c.GetStreams() {
+			if s.Stat().Direction == network.DirOutbound && m.speaks(s.Protocol()) {
+				_ = s.Reset()
+			}
+		}
+	}
+}
+
+// speaks reports whether proto is one of the protocols the sender opens
+// streams with.
+func (m *messageSenderImpl) speaks(proto protocol.ID) bool {
+	for _, p := range m.protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain removes every pooled stream and closes it gracefully, so that peers
+// observe an orderly EOF rather than a reset. Every message is flushed as soon as
+// it is written, so there are no buffered writes left to send at this point.
+//
+// Streams still busy with a request when ctx expires are reset once they become
+// free.
+func (m *messageSenderImpl) Drain(ctx context.Context) {
+	m.cancel()
+	m.failBatches()
+
+	m.smlk.Lock()
+	senders := make([]*peerMessageSender, 0, len(m.strmap))
+	for p, ms := range m.strmap {
+		senders = append(senders, ms)
+		delete(m.strmap, p)
+	}
+	m.recordPoolSize()
+	m.smlk.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ms := range senders {
+		wg.Add(1)
+		go func(ms *peerMessageSender) {
+			defer wg.Done()
+			if err := ms.lk.Lock(ctx); err != nil {
+				// Fall back on resetting the stream once the in-flight request is done.
+				go func() {
+					_ = ms.lk.Lock(context.Background())
+					defer ms.lk.Unlock()
+					ms.invalidate()
+				}()
+				return
+			}
+			defer ms.lk.Unlock()
+			ms.closeGracefully()
+		}(ms)
+	}
+	wg.Wait()
+}
+
 // SendRequest sends out a request, but also makes sure to
 // measure the RTT for latency measurements.
 func (m *messageSenderImpl) SendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
-	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	if pmes = m.rewrite(p, pmes); pmes == nil {
+		return nil, ErrMessageDropped
+	}
+	ctx = m.tagMessageType(ctx, pmes)
+	ctx, span := internal.StartMessageSpan(ctx, m.traceSampler, "dht.SendRequest", trace.SpanKindClient,
+		p, pmes.GetType().String(), pmes.Size())
 
+	acquireStart := m.clock.Now()
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
-		stats.Record(ctx,
+		m.record(ctx,
 			metrics.SentRequests.M(1),
 			metrics.SentRequestErrors.M(1),
 		)
-		logger.Debugw("request failed to open message sender", "error", err, "to", p)
+		internal.EndMessageSpan(span, 0, err)
+		m.log.Debugw("request failed to open message sender", "error", err, "to", p)
 		return nil, err
 	}
 
-	start := time.Now()
+	start := m.clock.Now()
 
-	rpmes, err := ms.SendRequest(ctx, pmes)
+	rpmes, err := ms.SendRequest(ctx, pmes, acquireStart)
 	if err != nil {
-		stats.Record(ctx,
+		m.record(ctx,
 			metrics.SentRequests.M(1),
 			metrics.SentRequestErrors.M(1),
 		)
-		logger.Debugw("request failed", "error", err, "to", p)
+		internal.EndMessageSpan(span, m.clock.Since(start), err)
+		m.log.Debugw("request failed", "error", err, "to", p)
 		return nil, err
 	}
 
-	stats.Record(ctx,
-		metrics.SentRequests.M(1),
-		metrics.SentBytes.M(int64(pmes.Size())),
-		metrics.OutboundRequestLatency.M(float64(time.Since(start))/float64(time.Millisecond)),
+	latency := m.clock.Since(start)
+	internal.EndMessageSpan(span, latency, nil)
+	m.recordSent(ctx, metrics.SentRequests, pmes,
+		metrics.OutboundRequestLatency.M(float64(latency)/float64(time.Millisecond)),
 	)
-	m.host.Peerstore().RecordLatency(p, time.Since(start))
+	if m.trackLatency {
+		m.latencyRecorder.RecordLatency(p, latency)
+	}
 	return rpmes, nil
 }
 
 // SendMessage sends out a message
 func (m *messageSenderImpl) SendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
-	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	if pmes = m.rewrite(p, pmes); pmes == nil {
+		return nil
+	}
+	ctx = m.tagMessageType(ctx, pmes)
+	if m.coalesceDelay > 0 {
+		return m.coalesce(ctx, p, pmes)
+	}
 
+	acquireStart := m.clock.Now()
 	ms, err := m.messageSenderForPeer(ctx, p)
 	if err != nil {
-		stats.Record(ctx,
+		m.record(ctx,
 			metrics.SentMessages.M(1),
 			metrics.SentMessageErrors.M(1),
 		)
-		logger.Debugw("message failed to open message sender", "error", err, "to", p)
+		m.log.Debugw("message failed to open message sender", "error", err, "to", p)
 		return err
 	}
 
-	if err := ms.SendMessage(ctx, pmes); err != nil {
-		stats.Record(ctx,
+	if err := ms.SendMessage(ctx, pmes, acquireStart); err != nil {
+		m.record(ctx,
 			metrics.SentMessages.M(1),
 			metrics.SentMessageErrors.M(1),
 		)
-		logger.Debugw("message failed", "error", err, "to", p)
+		m.log.Debugw("message failed", "error", err, "to", p)
 		return err
 	}
 
-	stats.Record(ctx,
-		metrics.SentMessages.M(1),
-		metrics.SentBytes.M(int64(pmes.Size())),
-	)
+	m.recordSent(ctx, metrics.SentMessages, pmes)
 	return nil
 }
 
+// SendMessageBatch sends several one-way messages to a peer at once, over a
+// single stream, without holding them back for coalescing. Messages dropped by
+// the outbound hook are left out. Either all of the messages are sent or none
+// of them is.
+func (m *messageSenderImpl) SendMessageBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) error {
+	msgs := make([]coalescedMessage, 0, len(pmess))
+	sent := make([]*pb.Message, 0, len(pmess))
+	for _, pmes := range pmess {
+		if pmes = m.rewrite(p, pmes); pmes != nil {
+			msgs = append(msgs, coalescedMessage{ctx: m.tagMessageType(ctx, pmes), pmes: pmes})
+			sent = append(sent, pmes)
+		}
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+
+	acquireStart := m.clock.Now()
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err == nil {
+		err = ms.SendMessages(ctx, sent, acquireStart)
+	}
+	if err != nil {
+		m.log.Debugw("message batch failed", "error", err, "to", p, "messages", len(sent))
+	}
+	m.recordBatch(msgs, err)
+	return err
+}
+
+// SendRequestBatch pipelines several requests to a peer over a single stream and
+// waits for all of their responses, which are returned in the order of the
+// requests. Replies are matched to requests by request id, or by order if the
+// peer doesn't echo request ids, so every request must be of a type the peer
+// answers (e.g. not ADD_PROVIDER).
+//
+// If a reply can't be matched or the peer stops replying part way through, the
+// replies received so far are returned along with an error.
+func (m *messageSenderImpl) SendRequestBatch(ctx context.Context, p peer.ID, pmess []*pb.Message) ([]*pb.Message, error) {
+	if m.outboundHook != nil {
+		rewritten := make([]*pb.Message, len(pmess))
+		for i, pmes := range pmess {
+			if rewritten[i] = m.rewrite(p, pmes); rewritten[i] == nil {
+				return nil, ErrMessageDropped
+			}
+		}
+		pmess = rewritten
+	}
+	recordErrors := func() {
+		for _, pmes := range pmess {
+			m.record(m.tagMessageType(ctx, pmes),
+				metrics.SentRequests.M(1),
+				metrics.SentRequestErrors.M(1),
+			)
+		}
+	}
+
+	acquireStart := m.clock.Now()
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err != nil {
+		recordErrors()
+		m.log.Debugw("request batch failed to open message sender", "error", err, "to", p)
+		return nil, err
+	}
+
+	start := m.clock.Now()
+
+	replies, err := ms.SendRequestBatch(ctx, pmess, acquireStart)
+	if err != nil {
+		recordErrors()
+		m.log.Debugw("request batch failed", "error", err, "to", p, "replies", len(replies), "requests", len(pmess))
+		return replies, err
+	}
+
+	latency := m.clock.Since(start)
+	for _, pmes := range pmess {
+		m.recordSent(m.tagMessageType(ctx, pmes), metrics.SentRequests, pmes,
+			metrics.OutboundRequestLatency.M(float64(latency)/float64(time.Millisecond)),
+		)
+	}
+	if m.trackLatency {
+		m.latencyRecorder.RecordLatency(p, latency)
+	}
+	return replies, nil
+}
+
+// SendRequestStream sends a request to a peer that answers it with several
+// messages, and returns a channel yielding each of them until the peer closes
+// the stream. The channel is closed once the reply is exhausted or fails. The
+// reply is read off a stream of its own, taken out of the pool once the request
+// is written, so that other requests to the peer don't wait for the reply to
+// end. The next message is read while the caller handles the previous one. If ctx is cancelled, the channel is
+// closed instead of delivering further messages, past one it may hold already,
+// and the rest of the reply is drained in the background.
+//
+// If pmes has a batch size, every message is acknowledged once it has been
+// delivered, as the peer waits for that before sending the next one. Once ctx
+// is cancelled the stream is closed for writing instead, telling the peer to
+// stop, and only what it has sent already is drained.
+func (m *messageSenderImpl) SendRequestStream(ctx context.Context, p peer.ID, pmes *pb.Message) (<-chan *pb.Message, error) {
+	if pmes = m.rewrite(p, pmes); pmes == nil {
+		return nil, ErrMessageDropped
+	}
+	ctx = m.tagMessageType(ctx, pmes)
+
+	acquireStart := m.clock.Now()
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err != nil {
+		m.record(ctx,
+			metrics.SentRequests.M(1),
+			metrics.SentRequestErrors.M(1),
+		)
+		m.log.Debugw("request stream failed to open message sender", "error", err, "to", p)
+		return nil, err
+	}
+
+	replies, err := ms.SendRequestStream(ctx, pmes, acquireStart)
+	if err != nil {
+		m.record(ctx,
+			metrics.SentRequests.M(1),
+			metrics.SentRequestErrors.M(1),
+		)
+		m.log.Debugw("request stream failed", "error", err, "to", p)
+		return nil, err
+	}
+
+	m.recordSent(ctx, metrics.SentRequests, pmes)
+	return replies, nil
+}
+
+// rewrite returns pmes as rewritten by the outbound message hook, nil if it is
+// to be dropped, see WithOutboundMessageHook.
+func (m *messageSenderImpl) rewrite(p peer.ID, pmes *pb.Message) *pb.Message {
+	if m.outboundHook == nil {
+		return pmes
+	}
+	mes := *pmes
+	return m.outboundHook(p, &mes)
+}
+
+// tagMessageType returns ctx tagged with the type of pmes, unless metrics are
+// disabled.
+func (m *messageSenderImpl) tagMessageType(ctx context.Context, pmes *pb.Message) context.Context {
+	if !m.metrics {
+		return ctx
+	}
+	ctx, _ = tag.New(ctx, metrics.UpsertMessageType(pmes))
+	return ctx
+}
+
+// record records measurements, unless metrics are disabled.
+func (m *messageSenderImpl) record(ctx context.Context, ms ...stats.Measurement) {
+	if m.metrics {
+		stats.Record(ctx, ms...)
+	}
+}
+
+// recordPoolSize records the number of peers in the stream pool. m.smlk must be
+// held.
+func (m *messageSenderImpl) recordPoolSize() {
+	m.record(m.tagsCtx, metrics.StreamPoolSize.M(int64(len(m.strmap))))
+}
+
+// recordSent records ms along with pmes having been sent successfully, counted
+// with counter and in the sent bytes unless it's left out by sampling.
+func (m *messageSenderImpl) recordSent(ctx context.Context, counter *stats.Int64Measure, pmes *pb.Message, ms ...stats.Measurement) {
+	if !m.metrics {
+		return
+	}
+	if w := m.sampler.Weight(pmes.GetType()); w > 0 {
+		ms = append(ms, counter.M(int64(w)), metrics.SentBytes.M(int64(pmes.Size())))
+	}
+	if len(ms) > 0 {
+		stats.Record(ctx, ms...)
+	}
+}
+
+// resetStream resets s and counts the reset for reason.
+func (m *messageSenderImpl) resetStream(ctx context.Context, s network.Stream, reason string) {
+	_ = s.Reset()
+	if m.metrics {
+		_ = stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(metrics.KeyResetReason, reason)},
+			metrics.StreamResets.M(1),
+		)
+	}
+}
+
 func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID) (*peerMessageSender, error) {
 	m.smlk.Lock()
 	ms, ok := m.strmap[p]
@@ -143,6 +826,7 @@ func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID)
 	}
 	ms = &peerMessageSender{p: p, m: m, lk: internal.NewCtxMutex()}
 	m.strmap[p] = ms
+	m.recordPoolSize()
 	m.smlk.Unlock()
 
 	if err := ms.prepOrInvalidate(ctx); err != nil {
@@ -158,24 +842,312 @@ func (m *messageSenderImpl) messageSenderForPeer(ctx context.Context, p peer.ID)
 			// Not changed, remove the now invalid stream from the
 			// map.
 			delete(m.strmap, p)
+			m.recordPoolSize()
+		}
+		// Invalid but not in map. Must have been removed by a disconnect.
+		return nil, err
+	}
+	// All ready to go.
+	return ms, nil
+}
+
+// warmStreamsConcurrency bounds how many streams WarmStreams opens at once.
+const warmStreamsConcurrency = 8
+
+// WarmStreams opens a stream to each of peers that has none pooled, so that the
+// requests sent to them next don't have to wait for a dial. Streams are opened
+// concurrently, and pooled like the streams of any other request, so they are
+// subject to the same idle timeout. The errors of the peers no stream could be
+// opened to are returned, keyed by peer.
+func (m *messageSenderImpl) WarmStreams(ctx context.Context, peers []peer.ID) map[peer.ID]error {
+	var (
+		mu   sync.Mutex
+		errs = make(map[peer.ID]error)
+		wg   sync.WaitGroup
+	)
+	sem := make(chan struct{}, warmStreamsConcurrency)
+	for _, p := range peers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p peer.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := m.warmStream(ctx, p); err != nil {
+				mu.Lock()
+				errs[p] = err
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (m *messageSenderImpl) warmStream(ctx context.Context, p peer.ID) error {
+	ms, err := m.messageSenderForPeer(ctx, p)
+	if err != nil {
+		return err
+	}
+	if err := ms.lk.Lock(ctx); err != nil {
+		return err
+	}
+	defer ms.unlock()
+	// A pooled stream may have been closed since, e.g. because it sat idle.
+	if err := ms.prep(ctx); err != nil {
+		return err
+	}
+	// Requests sent on the stream no longer wait for it to be opened.
+	ms.fresh = false
+	return nil
+}
+
+// stampRequest returns a copy of pmes carrying a new, non-zero request id, so
+// that the reply can be told apart from replies to other requests. The caller's
+// message isn't modified as it may be sent to several peers at once.
+func (m *messageSenderImpl) stampRequest(pmes *pb.Message) *pb.Message {
+	req := *pmes
+	req.RequestId = atomic.AddUint64(&m.lastRequestID, 1)
+	return &req
+}
+
+// newStream opens a new stream to p, unless we recently failed to connect to
+// it, in which case the last error is returned without dialing. Our protocols
+// are offered in order of preference, so the stream falls back to the next one
+// if p doesn't speak the preferred one, e.g. while a new protocol version is
+// rolled out.
+//
+// Streams are only opened by the sender of p, with its lock held, so there's at
+// most one dial to p in flight: concurrent requests to a peer we're not
+// connected to yet wait for the stream the first one opens, and then reuse it.
+func (m *messageSenderImpl) newStream(ctx context.Context, p peer.ID) (network.Stream, error) {
+	return m.newStreamWithin(ctx, p, 0)
+}
+
+// newStreamWithin is like newStream, with the stream opened within timeout if
+// set. Unlike ctx being done, running out of time counts as failing to reach
+// the peer.
+func (m *messageSenderImpl) newStreamWithin(ctx context.Context, p peer.ID, timeout time.Duration) (network.Stream, error) {
+	dialCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if m.backoffBase <= 0 {
+		return m.openStream(dialCtx, p)
+	}
+
+	m.backoffLk.Lock()
+	if b, ok := m.backoff[p]; ok && time.Now().Before(b.until) &&
+		m.host.Network().Connectedness(p) != network.Connected {
+		m.backoffLk.Unlock()
+		return nil, b.err
+	}
+	m.backoffLk.Unlock()
+
+	s, err := m.openStream(dialCtx, p)
+
+	m.backoffLk.Lock()
+	defer m.backoffLk.Unlock()
+	if err == nil {
+		delete(m.backoff, p)
+		return s, nil
+	}
+	if ctx.Err() != nil || m.host.Network().Connectedness(p) == network.Connected {
+		// Either the caller gave up, or we could reach the peer and it just
+		// doesn't speak our protocols (yet), e.g. a client switching to server mode.
+		return nil, err
+	}
+
+	b, ok := m.backoff[p]
+	if !ok {
+		m.gcBackoff()
+		b = &streamBackoff{}
+		m.backoff[p] = b
+	}
+	b.failures++
+	b.err = err
+	delay := m.backoffBase << (b.failures - 1)
+	if delay <= 0 || delay > m.backoffMax {
+		delay = m.backoffMax
+	}
+	b.until = time.Now().Add(delay)
+	return nil, err
+}
+
+// backoffGCThreshold is the number of backoff entries above which expired ones
+// are pruned, so that peers we never try again don't accumulate.
+const backoffGCThreshold = 128
+
+// gcBackoff must be called with backoffLk held.
+func (m *messageSenderImpl) gcBackoff() {
+	if len(m.backoff) < backoffGCThreshold {
+		return
+	}
+	now := time.Now()
+	for p, b := range m.backoff {
+		if now.After(b.until.Add(m.backoffMax)) {
+			delete(m.backoff, p)
+		}
+	}
+}
+
+// peerMessageSender is responsible for sending requests and messages to a particular peer
+type peerMessageSender struct {
+	s  network.Stream
+	r  msgio.ReadCloser
+	lk internal.CtxMutex
+	p  peer.ID
+	m  *messageSenderImpl
+
+	invalid   bool
+	singleMes int
+	// set by ClosePeer, which can't wait for lk, accessed atomically
+	closed int32
+
+	// compressed is set when messages on the current stream are compressed.
+	compressed bool
+	// checksummed is set when messages on the current stream carry a checksum.
+	checksummed bool
+	// seq is the sequence number of the last message written to the current
+	// stream, see WithSequenceNumbers.
+	seq uint64
+
+	// fresh is set when the current stream was opened and hasn't been used yet.
+	fresh bool
+
+	// the idle streams kept on top of the current one, oldest first, see
+	// WithStreamPoolMaxIdlePerPeer
+	spare []drainedStream
+
+	// the stream being opened in the background, see WithDialTimeout
+	dialing *pendingDial
+
+	// closes the stream once it has been idle for too long
+	idleTimer *time.Timer
+	// closes the connections to the peer once they have been unused for too
+	// long, see WithConnectionPruning
+	pruneTimer *time.Timer
+
+	// the request rate towards the peer and whether that's high enough for its
+	// stream to be kept, see WithAdaptiveStreamPool
+	rate       requestRate
+	retain     bool
+	metricsCtx context.Context
+}
+
+// unlock releases the sender after a request, closing the stream or scheduling
+// it to be closed if it sits idle for too long.
+func (ms *peerMessageSender) unlock() {
+	defer ms.lk.Unlock()
+
+	if ms.s == nil && len(ms.spare) == 0 {
+		ms.schedulePrune()
+		return
+	}
+	if ms.m.maxIdlePerPeer <= 0 || (ms.m.adaptive() && !ms.retain) {
+		ms.closeStream()
+		ms.schedulePrune()
+		return
+	}
+	d := ms.m.idleTimeout
+	if ms.m.adaptive() {
+		below := ms.rate.timeBelow(ms.m.clock.Now(), ms.m.adaptiveWindow, ms.m.adaptiveMinRate)
+		if below <= 0 {
+			ms.setRetain(false)
+			ms.closeStream()
+			ms.schedulePrune()
+			return
+		}
+		if d <= 0 || below < d {
+			d = below
+		}
+	}
+	if d > 0 {
+		if ms.idleTimer == nil {
+			ms.idleTimer = time.AfterFunc(d, ms.closeIdle)
+		} else {
+			ms.idleTimer.Reset(d)
+		}
+	}
+}
+
+// closeIdle closes the stream after the idle timeout, or once the request rate
+// dropped too low for the stream to be kept. If the sender is busy the stream
+// isn't idle, and the timer is rearmed once the request is done.
+func (ms *peerMessageSender) closeIdle() {
+	if !ms.lk.TryLock() {
+		return
+	}
+	defer ms.lk.Unlock()
+	ms.setRetain(false)
+	ms.closeStream()
+	ms.schedulePrune()
+}
+
+// schedulePrune arms the timer closing the connections to the peer, now that
+// the sender has no stream left, see WithConnectionPruning.
+func (ms *peerMessageSender) schedulePrune() {
+	d := ms.m.connPruneTimeout
+	if d <= 0 || ms.invalid {
+		return
+	}
+	if ms.pruneTimer == nil {
+		ms.pruneTimer = time.AfterFunc(d, ms.pruneConns)
+	} else {
+		ms.pruneTimer.Reset(d)
+	}
+}
+
+// pruneConns closes the connections to the peer once the prune timeout passed
+// without a request. If the sender is busy the timer is rearmed once the
+// request is done.
+func (ms *peerMessageSender) pruneConns() {
+	if !ms.lk.TryLock() {
+		return
+	}
+	defer ms.lk.Unlock()
+	if ms.s != nil || len(ms.spare) > 0 || ms.invalid {
+		return
+	}
+
+	h := ms.m.host
+	cm := h.ConnManager()
+	if cm.IsProtected(ms.p, "") {
+		return
+	}
+	if info := cm.GetTagInfo(ms.p); info != nil && len(info.Tags) > 0 {
+		return
+	}
+	// Streams handed off to read late replies or the rest of a streamed reply,
+	// inbound requests and other protocols all keep the connections in use.
+	for _, c := range h.Network().ConnsToPeer(ms.p) {
+		if len(c.GetStreams()) > 0 {
+			return
 		}
-		// Invalid but not in map. Must have been removed by a disconnect.
-		return nil, err
 	}
-	// All ready to go.
-	return ms, nil
+	if err := h.Network().ClosePeer(ms.p); err != nil {
+		ms.m.log.Debugw("failed to prune connections", "error", err, "to", ms.p)
+	}
 }
 
-// peerMessageSender is responsible for sending requests and messages to a particular peer
-type peerMessageSender struct {
-	s  network.Stream
-	r  msgio.ReadCloser
-	lk internal.CtxMutex
-	p  peer.ID
-	m  *messageSenderImpl
-
-	invalid   bool
-	singleMes int
+// closeStream gracefully closes the current stream and the spare ones, if any.
+// Unlike closeGracefully, the sender remains usable and opens a new stream on
+// the next request.
+func (ms *peerMessageSender) closeStream() {
+	for _, ds := range ms.spare {
+		if err := ds.s.Close(); err != nil {
+			ms.m.resetStream(context.Background(), ds.s, "shutdown")
+		}
+	}
+	ms.spare = nil
+	if ms.s == nil {
+		return
+	}
+	if err := ms.s.Close(); err != nil {
+		ms.m.resetStream(context.Background(), ms.s, "shutdown")
+	}
+	ms.s = nil
 }
 
 // invalidate is called before this peerMessageSender is removed from the strmap.
@@ -183,12 +1155,37 @@ type peerMessageSender struct {
 // forgotten (leaving the stream open).
 func (ms *peerMessageSender) invalidate() {
 	ms.invalid = true
+	ms.setRetain(false)
+	if ms.idleTimer != nil {
+		ms.idleTimer.Stop()
+	}
+	if ms.pruneTimer != nil {
+		ms.pruneTimer.Stop()
+	}
+	for _, ds := range ms.spare {
+		ms.m.resetStream(context.Background(), ds.s, "shutdown")
+	}
+	ms.spare = nil
 	if ms.s != nil {
-		_ = ms.s.Reset()
+		ms.m.resetStream(context.Background(), ms.s, "shutdown")
 		ms.s = nil
 	}
 }
 
+// closeGracefully is like invalidate, but closes the stream instead of
+// resetting it.
+func (ms *peerMessageSender) closeGracefully() {
+	ms.invalid = true
+	ms.setRetain(false)
+	if ms.idleTimer != nil {
+		ms.idleTimer.Stop()
+	}
+	if ms.pruneTimer != nil {
+		ms.pruneTimer.Stop()
+	}
+	ms.closeStream()
+}
+
 func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
 	if err := ms.lk.Lock(ctx); err != nil {
 		return err
@@ -196,6 +1193,11 @@ func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
 	defer ms.lk.Unlock()
 
 	if err := ms.prep(ctx); err != nil {
+		if ms.dialing != nil {
+			// The caller gave up on a dial that goes on, and needs the sender
+			// to pool its stream. The caller runs into ctx being done next.
+			return nil
+		}
 		ms.invalidate()
 		return err
 	}
@@ -203,25 +1205,131 @@ func (ms *peerMessageSender) prepOrInvalidate(ctx context.Context) error {
 }
 
 func (ms *peerMessageSender) prep(ctx context.Context) error {
-	if ms.invalid {
+	if ms.invalid || atomic.LoadInt32(&ms.closed) == 1 {
 		return fmt.Errorf("message sender has been invalidated")
 	}
-	if ms.s != nil {
-		return nil
+	for ms.s != nil || ms.takeSpare() {
+		if ms.connAlive() {
+			return nil
+		}
+		// Don't waste a round trip on a stream that's bound to fail.
+		ms.m.record(ctx, metrics.StreamPoolStale.M(1))
+		ms.m.resetStream(ctx, ms.s, "stale")
+		ms.s = nil
 	}
 
 	// We only want to speak to peers using our primary protocols. We do not want to query any peer that only speaks
 	// one of the secondary "server" protocols that we happen to support (e.g. older nodes that we can respond to for
 	// backwards compatibility reasons).
-	nstr, err := ms.m.host.NewStream(ctx, ms.p, ms.m.protocols...)
+	nstr, err := ms.dial(ctx)
 	if err != nil {
 		return err
 	}
+	ms.install(ctx, nstr)
+	return nil
+}
+
+// install makes nstr the current stream.
+func (ms *peerMessageSender) install(ctx context.Context, nstr network.Stream) {
+	if ms.m.metrics {
+		_ = stats.RecordWithTags(ctx,
+			[]tag.Mutator{tag.Upsert(metrics.KeyProtocol, string(nstr.Protocol()))},
+			metrics.OutboundStreams.M(1),
+		)
+	}
 
-	ms.r = msgio.NewVarintReaderSize(nstr, network.MessageSizeMax)
+	ms.compressed = IsCompressedProtocol(nstr.Protocol())
+	ms.checksummed = IsChecksummedProtocol(nstr.Protocol())
+	ms.seq = 0
+	ms.r = NewMessageReader(ctx, nstr, ms.m.maxMessageSize, ms.compressed)
 	ms.s = nstr
+	ms.fresh = true
+}
 
-	return nil
+// pendingDial is a stream being opened in the background.
+type pendingDial struct {
+	done chan struct{}
+	s    network.Stream
+	err  error
+}
+
+// dial opens a new stream to the peer. With a dial timeout, the stream is
+// opened in the background, and if ctx is done first, the stream is pooled once
+// open, or handed to the next request waiting for it. Like prep, it must be
+// called with the sender locked.
+func (ms *peerMessageSender) dial(ctx context.Context) (network.Stream, error) {
+	if ms.m.dialTimeout <= 0 {
+		return ms.m.newStream(ctx, ms.p)
+	}
+	d := ms.dialing
+	if d == nil {
+		d = &pendingDial{done: make(chan struct{})}
+		ms.dialing = d
+		go ms.dialInBackground(tag.NewContext(ms.m.ctx, tag.FromContext(ctx)), d)
+	}
+	select {
+	case <-d.done:
+		ms.dialing = nil
+		return d.s, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dialInBackground opens the stream of d, and pools it unless a request took
+// it in the meantime. ctx is only done once the sender is drained.
+func (ms *peerMessageSender) dialInBackground(ctx context.Context, d *pendingDial) {
+	d.s, d.err = ms.m.newStreamWithin(ctx, ms.p, ms.m.dialTimeout)
+	close(d.done)
+
+	if err := ms.lk.Lock(context.Background()); err != nil {
+		return
+	}
+	defer ms.unlock()
+	if ms.dialing != d {
+		return
+	}
+	ms.dialing = nil
+	if d.err != nil {
+		return
+	}
+	if ms.invalid || atomic.LoadInt32(&ms.closed) == 1 || ms.s != nil {
+		_ = d.s.Close()
+		return
+	}
+	ms.install(ctx, d.s)
+}
+
+// connAlive reports whether the connection the current stream was opened on is
+// still open. The whole peer going away is handled by OnDisconnect, but we may
+// lose one of several connections to it.
+func (ms *peerMessageSender) connAlive() bool {
+	c := ms.s.Conn()
+	for _, oc := range ms.m.host.Network().ConnsToPeer(ms.p) {
+		if oc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// recordStreamUse records whether the stream about to be written to was reused
+// or has just been opened, and how long it took to get it since acquireStart.
+func (ms *peerMessageSender) recordStreamUse(ctx context.Context, acquireStart time.Time) {
+	source, use := "pooled", metrics.StreamPoolHits.M(1)
+	if ms.fresh {
+		ms.fresh = false
+		source, use = "dialed", metrics.StreamPoolMisses.M(1)
+	}
+	if !ms.m.metrics {
+		return
+	}
+	latency := float64(ms.m.clock.Since(acquireStart)) / float64(time.Millisecond)
+	_ = stats.RecordWithTags(ctx,
+		[]tag.Mutator{tag.Upsert(metrics.KeyStreamSource, source)},
+		use,
+		metrics.StreamAcquireLatency.M(latency),
+	)
 }
 
 // streamReuseTries is the number of times we will try to reuse a stream to a
@@ -229,32 +1337,45 @@ func (ms *peerMessageSender) prep(ctx context.Context) error {
 // behaviour.
 const streamReuseTries = 3
 
-func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message) error {
+func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message, acquireStart time.Time) error {
+	return ms.SendMessages(ctx, []*pb.Message{pmes}, acquireStart)
+}
+
+// SendMessages writes several one-way messages to the stream at once.
+func (ms *peerMessageSender) SendMessages(ctx context.Context, pmess []*pb.Message, acquireStart time.Time) error {
 	if err := ms.lk.Lock(ctx); err != nil {
 		return err
 	}
-	defer ms.lk.Unlock()
+	defer ms.unlock()
+	ms.trackRequest(ctx)
 
 	retry := false
 	for {
 		if err := ms.prep(ctx); err != nil {
 			return err
 		}
+		ms.recordStreamUse(ctx, acquireStart)
 
-		if err := ms.writeMsg(pmes); err != nil {
-			_ = ms.s.Reset()
+		var err error
+		if len(pmess) == 1 {
+			err = ms.writeMsg(ctx, pmess[0])
+		} else {
+			err = ms.writeMsgs(ctx, pmess)
+		}
+		if err != nil {
+			ms.m.resetStream(ctx, ms.s, "send-error")
 			ms.s = nil
 
 			if retry {
-				logger.Debugw("error writing message", "error", err)
+				ms.m.log.Debugw("error writing message", "error", err)
 				return err
 			}
-			logger.Debugw("error writing message", "error", err, "retrying", true)
+			ms.m.log.Debugw("error writing message", "error", err, "retrying", true)
 			retry = true
+			acquireStart = ms.m.clock.Now()
 			continue
 		}
 
-		var err error
 		if ms.singleMes > streamReuseTries {
 			err = ms.s.Close()
 			ms.s = nil
@@ -266,50 +1387,80 @@ func (ms *peerMessageSender) SendMessage(ctx context.Context, pmes *pb.Message)
 	}
 }
 
-func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb.Message, error) {
+func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message, acquireStart time.Time) (*pb.Message, error) {
 	if err := ms.lk.Lock(ctx); err != nil {
 		return nil, err
 	}
-	defer ms.lk.Unlock()
+	defer ms.unlock()
+	ms.trackRequest(ctx)
 
-	retry := false
+	pmes = ms.m.stampRequest(pmes)
+
+	retries := 0
 	for {
 		if err := ms.prep(ctx); err != nil {
 			return nil, err
 		}
+		ms.recordStreamUse(ctx, acquireStart)
 
-		if err := ms.writeMsg(pmes); err != nil {
-			_ = ms.s.Reset()
+		if err := ms.writeMsg(ctx, pmes); err != nil {
+			ms.m.resetStream(ctx, ms.s, "request-error")
 			ms.s = nil
 
-			if retry {
-				logger.Debugw("error writing message", "error", err)
+			if !ms.mayRetry(ctx, retries) {
+				ms.m.log.Debugw("error writing message", "error", err)
 				return nil, err
 			}
-			logger.Debugw("error writing message", "error", err, "retrying", true)
-			retry = true
+			ms.m.log.Debugw("error writing message", "error", err, "retrying", true)
+			retries++
+			acquireStart = ms.m.clock.Now()
 			continue
 		}
+		// Unlike the request latency, the wait for the reply leaves out the
+		// time spent getting a stream and writing to it.
+		written := ms.m.clock.Now()
 
 		mes := new(pb.Message)
-		if err := ms.ctxReadMsg(ctx, mes); err != nil {
-			_ = ms.s.Reset()
+		errc := ms.readMsgAsync(ctx, mes)
+		if err := ms.awaitMsg(ctx, errc); err != nil {
+			switch {
+			case ctx.Err() != nil && cancelledByHandle(ctx):
+				go ms.drain(ms.handOff(), errc, mes, pmes.GetRequestId())
+			case ctx.Err() != nil && ms.m.onLateReply != nil:
+				go ms.awaitLateReply(ms.s, errc, mes)
+			default:
+				ms.m.resetStream(ctx, ms.s, "request-error")
+			}
 			ms.s = nil
 
-			if retry {
-				logger.Debugw("error reading message", "error", err)
+			if !ms.mayRetry(ctx, retries) {
+				ms.m.log.Debugw("error reading message", "error", err)
 				return nil, err
 			}
-			logger.Debugw("error reading message", "error", err, "retrying", true)
-			retry = true
+			ms.m.log.Debugw("error reading message", "error", err, "retrying", true)
+			retries++
+			acquireStart = ms.m.clock.Now()
 			continue
 		}
+		if id := mes.GetRequestId(); id != 0 && id != pmes.GetRequestId() {
+			// Peers that don't know about request ids reply with a zero id,
+			// anything else must be the reply to this very request.
+			ms.m.resetStream(ctx, ms.s, "request-error")
+			ms.s = nil
+			ms.m.log.Debugw("reply to another request", "expected", pmes.GetRequestId(), "got", id)
+			return nil, ErrUnexpectedReply
+		}
+		wait := ms.m.clock.Since(written)
+		ms.m.record(ctx, metrics.ReplyWait.M(float64(wait)/float64(time.Millisecond)))
+		if ms.m.connHints {
+			ms.m.connRTTs.record(ms.s.Conn(), wait)
+		}
 
 		var err error
 		if ms.singleMes > streamReuseTries {
 			err = ms.s.Close()
 			ms.s = nil
-		} else if retry {
+		} else if retries > 0 {
 			ms.singleMes++
 		}
 
@@ -317,13 +1468,267 @@ func (ms *peerMessageSender) SendRequest(ctx context.Context, pmes *pb.Message)
 	}
 }
 
-func (ms *peerMessageSender) writeMsg(pmes *pb.Message) error {
-	return WriteMsg(ms.s, pmes)
+// mayRetry reports whether a request that failed after the given number of
+// retries should be retried on a fresh stream.
+func (ms *peerMessageSender) mayRetry(ctx context.Context, retries int) bool {
+	return ctx.Err() == nil && retries <= ms.m.requestRetries
+}
+
+func (ms *peerMessageSender) SendRequestBatch(ctx context.Context, pmess []*pb.Message, acquireStart time.Time) ([]*pb.Message, error) {
+	if err := ms.lk.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer ms.unlock()
+	ms.trackRequest(ctx)
+
+	if err := ms.prep(ctx); err != nil {
+		return nil, err
+	}
+	ms.recordStreamUse(ctx, acquireStart)
+
+	reqs := make([]*pb.Message, len(pmess))
+	byID := make(map[uint64]int, len(pmess))
+	for i, pmes := range pmess {
+		reqs[i] = ms.m.stampRequest(pmes)
+		byID[reqs[i].GetRequestId()] = i
+	}
+
+	// Requests aren't retried here: a failed write may have already delivered
+	// some of them to the peer.
+	if err := ms.writeMsgs(ctx, reqs); err != nil {
+		ms.m.resetStream(ctx, ms.s, "request-error")
+		ms.s = nil
+		ms.m.log.Debugw("error writing message batch", "error", err)
+		return nil, err
+	}
+
+	// Replies carrying a request id are matched by id, replies from peers that
+	// don't support request ids are matched by order.
+	replies := make([]*pb.Message, len(reqs))
+	received := func() []*pb.Message {
+		out := make([]*pb.Message, 0, len(replies))
+		for _, r := range replies {
+			if r != nil {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	next := 0
+	for range reqs {
+		mes := new(pb.Message)
+		if err := ms.ctxReadMsg(ctx, mes); err != nil {
+			ms.m.resetStream(ctx, ms.s, "request-error")
+			ms.s = nil
+			ms.m.log.Debugw("error reading message batch", "error", err)
+			return received(), err
+		}
+
+		i, ok := 0, true
+		if id := mes.GetRequestId(); id != 0 {
+			i, ok = byID[id]
+		} else {
+			// The first request that is still unanswered.
+			for next < len(replies) && replies[next] != nil {
+				next++
+			}
+			i = next
+		}
+		if !ok || i >= len(reqs) || replies[i] != nil || mes.GetType() != reqs[i].GetType() {
+			// Everything after this reply is likely misaligned as well.
+			ms.m.resetStream(ctx, ms.s, "request-error")
+			ms.s = nil
+			ms.m.log.Debugw("unexpected reply in message batch", "type", mes.GetType(), "id", mes.GetRequestId())
+			return received(), ErrUnexpectedReply
+		}
+		replies[i] = mes
+	}
+
+	return replies, nil
+}
+
+func (ms *peerMessageSender) SendRequestStream(ctx context.Context, pmes *pb.Message, acquireStart time.Time) (<-chan *pb.Message, error) {
+	if err := ms.lk.Lock(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := ms.prep(ctx); err != nil {
+		ms.lk.Unlock()
+		return nil, err
+	}
+	ms.recordStreamUse(ctx, acquireStart)
+
+	// Not retried: the peer may already be streaming its reply.
+	if err := ms.writeMsg(ctx, pmes); err != nil {
+		ms.m.resetStream(ctx, ms.s, "request-error")
+		ms.s = nil
+		ms.lk.Unlock()
+		ms.m.log.Debugw("error writing message", "error", err)
+		return nil, err
+	}
+
+	// The peer ends its reply by closing the stream, so the stream can't be
+	// pooled again, even once the reply ended cleanly. The sender is released
+	// right away, and the next request to the peer opens a new stream.
+	s, r, compressed, checksummed := ms.s, ms.r, ms.compressed, ms.checksummed
+	ms.s = nil
+	ms.unlock()
+	acked := pmes.GetBatchSize() > 0
+
+	// The next message is read while the caller handles the previous one,
+	// instead of handing each one off synchronously. Acknowledged messages
+	// aren't buffered, acknowledging one means the caller got it.
+	var out chan *pb.Message
+	if acked {
+		out = make(chan *pb.Message)
+	} else {
+		out = make(chan *pb.Message, 1)
+	}
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(out)
+		}
+	}
+
+	go func() {
+		defer release()
+
+		// Reset the stream if the peer stalls between two messages, the read
+		// failing then counts the reset.
+		t := time.AfterFunc(dhtReadMessageTimeout, func() { _ = s.Reset() })
+		defer t.Stop()
+
+		for {
+			buf, err := r.ReadMsg()
+			if err != nil {
+				if err == io.EOF {
+					_ = s.Close()
+				} else {
+					ms.m.resetStream(ctx, s, "read-error")
+					ms.m.log.Debugw("error reading message stream", "error", err)
+				}
+				return
+			}
+			t.Reset(dhtReadMessageTimeout)
+
+			if released {
+				// The caller is gone, keep draining so that the peer sees an
+				// orderly close.
+				r.ReleaseMsg(buf)
+				continue
+			}
+
+			mes := new(pb.Message)
+			err = UnmarshalMsg(ms.m.codec, buf, mes)
+			r.ReleaseMsg(buf)
+			if err == nil && checksummed {
+				err = VerifyChecksum(ctx, mes)
+			}
+			if err != nil {
+				ms.m.resetStream(ctx, s, "read-error")
+				ms.m.log.Debugw("error unmarshaling message stream", "error", err)
+				return
+			}
+
+			// With room in the buffer, sending would win over a cancelled ctx
+			// half of the time.
+			delivered := false
+			if ctx.Err() == nil {
+				select {
+				case out <- mes:
+					delivered = true
+				case <-ctx.Done():
+				}
+			}
+			if !delivered {
+				// Drain the rest of the reply in the background.
+				release()
+				if acked {
+					_ = s.CloseWrite()
+				}
+				continue
+			}
+			if !acked {
+				continue
+			}
+			ack := &pb.Message{Type: pmes.GetType(), RequestId: pmes.GetRequestId()}
+			if err := writeMsgsTo(ctx, s, ms.m.codec, compressed, checksummed, []*pb.Message{ack}); err != nil {
+				// The peer may have closed the stream after its last message.
+				ms.m.log.Debugw("error acknowledging message stream", "error", err)
+				acked = false
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (ms *peerMessageSender) writeMsg(ctx context.Context, pmes *pb.Message) error {
+	if !ms.compressed && !ms.checksummed && ms.m.codec == nil {
+		return WriteMsg(ms.s, ms.number(pmes))
+	}
+	return ms.writeMsgs(ctx, []*pb.Message{pmes})
+}
+
+func (ms *peerMessageSender) writeMsgs(ctx context.Context, pmess []*pb.Message) error {
+	if ms.m.sequenceNumbers {
+		numbered := make([]*pb.Message, len(pmess))
+		for i, pmes := range pmess {
+			numbered[i] = ms.number(pmes)
+		}
+		pmess = numbered
+	}
+	return writeMsgsTo(ctx, ms.s, ms.m.codec, ms.compressed, ms.checksummed, pmess)
+}
+
+// number returns a copy of pmes carrying the next sequence number of the
+// stream, or pmes itself if messages aren't numbered. The caller's message
+// isn't modified as it may be sent to several peers at once.
+func (ms *peerMessageSender) number(pmes *pb.Message) *pb.Message {
+	if !ms.m.sequenceNumbers {
+		return pmes
+	}
+	ms.seq++
+	mes := *pmes
+	mes.Sequence = ms.seq
+	return &mes
+}
+
+// writeMsgsTo writes pmess to s, encoded with codec, or as protobuf if codec is
+// nil, and compressed or checksummed as negotiated.
+func writeMsgsTo(ctx context.Context, s io.Writer, codec pb.MessageCodec, compressed, checksummed bool, pmess []*pb.Message) error {
+	var w *MessageWriter
+	switch {
+	case compressed:
+		w = NewCompressedMessageWriter(ctx, s)
+	case checksummed:
+		w = NewChecksummedMessageWriter(s)
+	case codec != nil:
+		w = NewMessageWriter(s)
+	default:
+		return WriteMsgs(s, pmess)
+	}
+	defer w.Release()
+	w.SetCodec(codec)
+	for _, pmes := range pmess {
+		if err := w.WriteMsg(pmes); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
 }
 
 func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) error {
+	return ms.awaitMsg(ctx, ms.readMsgAsync(ctx, mes))
+}
+
+// readMsgAsync reads the next message off the current stream into mes in the
+// background. The returned channel yields the outcome once the read is done.
+func (ms *peerMessageSender) readMsgAsync(ctx context.Context, mes *pb.Message) <-chan error {
 	errc := make(chan error, 1)
-	go func(r msgio.ReadCloser) {
+	go func(r msgio.ReadCloser, checksummed bool) {
 		defer close(errc)
 		bytes, err := r.ReadMsg()
 		defer r.ReleaseMsg(bytes)
@@ -331,9 +1736,20 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 			errc <- err
 			return
 		}
-		errc <- mes.Unmarshal(bytes)
-	}(ms.r)
+		if err := UnmarshalMsg(ms.m.codec, bytes, mes); err != nil {
+			errc <- err
+			return
+		}
+		if checksummed {
+			errc <- VerifyChecksum(metricsContext(ctx), mes)
+		}
+	}(ms.r, ms.checksummed)
+	return errc
+}
 
+// awaitMsg waits for a read started with readMsgAsync, giving up when ctx is
+// done or the read times out.
+func (ms *peerMessageSender) awaitMsg(ctx context.Context, errc <-chan error) error {
 	t := time.NewTimer(dhtReadMessageTimeout)
 	defer t.Stop()
 
@@ -347,6 +1763,25 @@ func (ms *peerMessageSender) ctxReadMsg(ctx context.Context, mes *pb.Message) er
 	}
 }
 
+// awaitLateReply keeps waiting for a read abandoned because its request's
+// context was done, and passes the reply to the late reply handler if it
+// arrives within lateReplyTimeout. The stream is reset either way, it is no
+// longer pooled, and resetting it also ends a read that is still blocked.
+func (ms *peerMessageSender) awaitLateReply(s network.Stream, errc <-chan error, mes *pb.Message) {
+	defer ms.m.resetStream(context.Background(), s, "request-error")
+
+	t := time.NewTimer(lateReplyTimeout)
+	defer t.Stop()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			ms.m.onLateReply(ms.p, mes)
+		}
+	case <-t.C:
+	}
+}
+
 // The Protobuf writer performs multiple small writes when writing a message.
 // We need to buffer those writes, to make sure that we're not sending a new
 // packet for every single write.
@@ -355,16 +1790,60 @@ type bufferedDelimitedWriter struct {
 	protoio.WriteCloser
 }
 
+// defaultWriteBufferSize is the size of the buffer messages are written through
+// unless another size is asked for, that of the writers in writerPool.
+const defaultWriteBufferSize = 4096
+
 var writerPool = sync.Pool{
 	New: func() interface{} {
-		w := bufio.NewWriter(nil)
-		return &bufferedDelimitedWriter{
-			Writer:      w,
-			WriteCloser: protoio.NewDelimitedWriter(w),
-		}
+		return newBufferedDelimitedWriter(defaultWriteBufferSize)
 	},
 }
 
+// sizedWriterPools holds a pool of writers for every other buffer size asked
+// for, keyed by size. Only a handful of sizes are ever configured.
+var sizedWriterPools sync.Map
+
+// writerPoolFor returns the pool of writers with buffers of the given size.
+func writerPoolFor(size int) *sync.Pool {
+	if size <= 0 || size == defaultWriteBufferSize {
+		return &writerPool
+	}
+	if pool, ok := sizedWriterPools.Load(size); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := sizedWriterPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			return newBufferedDelimitedWriter(size)
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+func newBufferedDelimitedWriter(size int) *bufferedDelimitedWriter {
+	w := bufio.NewWriterSize(nil, size)
+	return &bufferedDelimitedWriter{
+		Writer:      w,
+		WriteCloser: protoio.NewDelimitedWriter(w),
+	}
+}
+
+// marshalMsg encodes mes with codec, or as protobuf if codec is nil.
+func marshalMsg(codec pb.MessageCodec, mes *pb.Message) ([]byte, error) {
+	if codec == nil {
+		return mes.Marshal()
+	}
+	return codec.Marshal(mes)
+}
+
+// UnmarshalMsg decodes data into mes with codec, or as protobuf if codec is nil.
+func UnmarshalMsg(codec pb.MessageCodec, data []byte, mes *pb.Message) error {
+	if codec == nil {
+		return mes.Unmarshal(data)
+	}
+	return codec.Unmarshal(data, mes)
+}
+
 func WriteMsg(w io.Writer, mes *pb.Message) error {
 	bw := writerPool.Get().(*bufferedDelimitedWriter)
 	bw.Reset(w)
@@ -377,6 +1856,135 @@ func WriteMsg(w io.Writer, mes *pb.Message) error {
 	return err
 }
 
+// WriteMsgs writes several messages to w, flushing them together.
+func WriteMsgs(w io.Writer, mess []*pb.Message) error {
+	bw := writerPool.Get().(*bufferedDelimitedWriter)
+	bw.Reset(w)
+	var err error
+	for _, mes := range mess {
+		if err = bw.WriteMsg(mes); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	bw.Reset(nil)
+	writerPool.Put(bw)
+	return err
+}
+
+// MessageWriter writes delimited messages to an underlying writer, buffering
+// them until Flush is called. This lets several messages go out in a single
+// write.
+type MessageWriter struct {
+	bw *bufferedDelimitedWriter
+
+	// set for writers compressing messages, see NewCompressedMessageWriter
+	compressed bool
+	ctx        context.Context
+
+	// set for writers adding checksums, see NewChecksummedMessageWriter
+	checksummed bool
+
+	// encodes messages, nil means protobuf
+	codec pb.MessageCodec
+}
+
+// NewMessageWriter returns a MessageWriter writing to w. Release must be called
+// once the writer is no longer used.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return NewMessageWriterSize(w, defaultWriteBufferSize)
+}
+
+// NewMessageWriterSize is like NewMessageWriter, but buffers up to size bytes
+// before writing to w. A larger buffer means fewer writes for large messages or
+// many coalesced ones. Non-positive sizes fall back to the default of 4KiB.
+func NewMessageWriterSize(w io.Writer, size int) *MessageWriter {
+	bw := writerPoolFor(size).Get().(*bufferedDelimitedWriter)
+	bw.Reset(w)
+	return &MessageWriter{bw: bw}
+}
+
+// NewCompressedMessageWriter is like NewMessageWriter, but compresses every
+// message. Only the metric tags of ctx are used.
+func NewCompressedMessageWriter(ctx context.Context, w io.Writer) *MessageWriter {
+	return NewCompressedMessageWriterSize(ctx, w, defaultWriteBufferSize)
+}
+
+// NewCompressedMessageWriterSize is like NewCompressedMessageWriter, with the
+// buffer size of NewMessageWriterSize.
+func NewCompressedMessageWriterSize(ctx context.Context, w io.Writer, size int) *MessageWriter {
+	mw := NewMessageWriterSize(w, size)
+	mw.compressed = true
+	mw.ctx = metricsContext(ctx)
+	return mw
+}
+
+// NewChecksummedMessageWriter is like NewMessageWriter, but writes every message
+// along with its checksum.
+func NewChecksummedMessageWriter(w io.Writer) *MessageWriter {
+	return NewChecksummedMessageWriterSize(w, defaultWriteBufferSize)
+}
+
+// NewChecksummedMessageWriterSize is like NewChecksummedMessageWriter, with the
+// buffer size of NewMessageWriterSize.
+func NewChecksummedMessageWriterSize(w io.Writer, size int) *MessageWriter {
+	mw := NewMessageWriterSize(w, size)
+	mw.checksummed = true
+	return mw
+}
+
+// SetCodec makes w encode messages with c. A nil codec means protobuf, the
+// default.
+func (w *MessageWriter) SetCodec(c pb.MessageCodec) {
+	w.codec = c
+}
+
+// WriteMsg buffers mes. The buffer is only written out early if it fills up.
+func (w *MessageWriter) WriteMsg(mes *pb.Message) error {
+	if w.checksummed {
+		var err error
+		if mes, err = withChecksum(mes); err != nil {
+			return err
+		}
+	}
+	if !w.compressed {
+		if w.codec == nil {
+			return w.bw.WriteMsg(mes)
+		}
+		data, err := w.codec.Marshal(mes)
+		if err != nil {
+			return err
+		}
+		return writeDelimited(w.bw.Writer, data)
+	}
+	n, err := writeCompressedMsg(w.bw.Writer, w.codec, mes)
+	if err != nil {
+		return err
+	}
+	recordCompression(w.ctx, mes.Size(), n)
+	return nil
+}
+
+// Flush writes out all buffered messages.
+func (w *MessageWriter) Flush() error {
+	return w.bw.Flush()
+}
+
+// Buffered returns the number of bytes written but not flushed yet.
+func (w *MessageWriter) Buffered() int {
+	return w.bw.Buffered()
+}
+
+// Release discards anything that hasn't been flushed and returns the buffer to
+// the pool.
+func (w *MessageWriter) Release() {
+	w.bw.Reset(nil)
+	writerPoolFor(w.bw.Size()).Put(w.bw)
+	w.bw = nil
+}
+
 func (w *bufferedDelimitedWriter) Flush() error {
 	return w.Writer.Flush()
 }
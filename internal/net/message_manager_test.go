@@ -2,13 +2,32 @@ package net
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/protocol"
 
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/libp2p/go-msgio"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 )
 
 func TestInvalidMessageSenderTracking(t *testing.T) {
@@ -34,3 +53,2169 @@ func TestInvalidMessageSenderTracking(t *testing.T) {
 		t.Fatal("should have no message senders in map")
 	}
 }
+
+// setupResponder connects two mock hosts and makes the second one read
+// batchSize requests off each inbound stream before answering them with the
+// replies produced by respond.
+func setupResponder(ctx context.Context, t testing.TB, proto protocol.ID, batchSize int, respond func([]*pb.Message) []*pb.Message) (host.Host, host.Host) {
+	t.Helper()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		var reqs []*pb.Message
+		for len(reqs) < batchSize {
+			buf, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			req := new(pb.Message)
+			if err := req.Unmarshal(buf); err != nil {
+				return
+			}
+			r.ReleaseMsg(buf)
+			reqs = append(reqs, req)
+		}
+		_ = WriteMsgs(s, respond(reqs))
+	})
+	return hosts[0], hosts[1]
+}
+
+func TestSendRequestBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	reqs := []*pb.Message{
+		pb.NewMessage(pb.Message_GET_VALUE, []byte("a"), 0),
+		pb.NewMessage(pb.Message_FIND_NODE, []byte("b"), 0),
+		pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("c"), 0),
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, len(reqs), func(reqs []*pb.Message) []*pb.Message { return reqs })
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestBatch(ctx, remote.ID(), reqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(replies) != len(reqs) {
+			t.Fatalf("expected %d replies, got %d", len(reqs), len(replies))
+		}
+		for i, r := range replies {
+			if string(r.GetKey()) != string(reqs[i].GetKey()) {
+				t.Fatalf("reply %d: expected key %q, got %q", i, reqs[i].GetKey(), r.GetKey())
+			}
+		}
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, len(reqs), func(reqs []*pb.Message) []*pb.Message {
+			return []*pb.Message{reqs[2], reqs[0], reqs[1]}
+		})
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestBatch(ctx, remote.ID(), reqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, r := range replies {
+			if string(r.GetKey()) != string(reqs[i].GetKey()) {
+				t.Fatalf("reply %d: expected key %q, got %q", i, reqs[i].GetKey(), r.GetKey())
+			}
+		}
+	})
+
+	t.Run("out of order without request ids", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, len(reqs), func(reqs []*pb.Message) []*pb.Message {
+			for _, r := range reqs {
+				r.RequestId = 0
+			}
+			return []*pb.Message{reqs[0], reqs[2], reqs[1]}
+		})
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestBatch(ctx, remote.ID(), reqs)
+		if err != ErrUnexpectedReply {
+			t.Fatalf("expected ErrUnexpectedReply, got %v", err)
+		}
+		if len(replies) != 1 {
+			t.Fatalf("expected the first reply to be kept, got %d replies", len(replies))
+		}
+	})
+
+	t.Run("dropped reply", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, len(reqs), func(reqs []*pb.Message) []*pb.Message { return reqs[:2] })
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestBatch(ctx, remote.ID(), reqs)
+		if err == nil {
+			t.Fatal("expected the batch to fail")
+		}
+		if len(replies) != 2 {
+			t.Fatalf("expected 2 replies before the failure, got %d", len(replies))
+		}
+	})
+}
+
+func TestSendMessageBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	msgs := []*pb.Message{
+		pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("a"), 0),
+		pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("b"), 0),
+		pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("c"), 0),
+	}
+	// The responder reads every message off a single stream.
+	received := make(chan []*pb.Message, 1)
+	h, remote := setupResponder(ctx, t, proto, len(msgs), func(reqs []*pb.Message) []*pb.Message {
+		received <- reqs
+		return nil
+	})
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+	if err := ms.SendMessageBatch(ctx, remote.ID(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case reqs := <-received:
+		for i, r := range reqs {
+			if string(r.GetKey()) != string(msgs[i].GetKey()) {
+				t.Fatalf("message %d: expected key %q, got %q", i, msgs[i].GetKey(), r.GetKey())
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the messages to arrive on a single stream")
+	}
+}
+
+// viewCount returns the total count aggregated by a registered view.
+func viewCount(t *testing.T, v *view.View) int64 {
+	t.Helper()
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, r := range rows {
+		switch data := r.Data.(type) {
+		case *view.CountData:
+			total += data.Value
+		case *view.SumData:
+			total += int64(data.Value)
+		}
+	}
+	return total
+}
+
+// setupEchoResponder connects two mock hosts and makes the second one answer
+// every request with the request itself, keeping streams open.
+func setupEchoResponder(ctx context.Context, t *testing.T, proto protocol.ID) (host.Host, host.Host) {
+	t.Helper()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		_ = echoStream(s)
+	})
+	return hosts[0], hosts[1]
+}
+
+// echoStream answers every request read off s with the request itself, until
+// reading fails. It returns the read error, io.EOF if s was closed by the other
+// side.
+func echoStream(s network.Stream) error {
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	for {
+		buf, err := r.ReadMsg()
+		if err != nil {
+			return err
+		}
+		req := new(pb.Message)
+		err = req.Unmarshal(buf)
+		r.ReleaseMsg(buf)
+		if err != nil {
+			return err
+		}
+		if err := WriteMsg(s, req); err != nil {
+			return err
+		}
+	}
+}
+
+func TestStreamPoolMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	views := []*view.View{metrics.StreamPoolHitsView, metrics.StreamPoolMissesView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto})
+
+	req := pb.NewMessage(pb.Message_PING, nil, 0)
+	if _, err := ms.SendRequest(ctx, remote.ID(), req); err != nil {
+		t.Fatal(err)
+	}
+	if hits, misses := viewCount(t, metrics.StreamPoolHitsView), viewCount(t, metrics.StreamPoolMissesView); hits != 0 || misses != 1 {
+		t.Fatalf("expected a cold request to miss, got %d hits and %d misses", hits, misses)
+	}
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), req); err != nil {
+		t.Fatal(err)
+	}
+	if hits, misses := viewCount(t, metrics.StreamPoolHitsView), viewCount(t, metrics.StreamPoolMissesView); hits != 1 || misses != 1 {
+		t.Fatalf("expected a warm request to hit, got %d hits and %d misses", hits, misses)
+	}
+}
+
+func TestStreamPoolSizeTags(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The pool size is about the sender, so it doesn't get the tags of the
+	// request that made the pool grow.
+	v := &view.View{
+		Name:        "test/stream_pool_size",
+		Measure:     metrics.StreamPoolSize,
+		TagKeys:     []tag.Key{metrics.KeyMessageType, metrics.KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	if err := view.Register(v); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(v)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithMetricTags(tag.Upsert(metrics.KeyInstanceID, "sender")))
+
+	reqCtx, err := tag.New(ctx, tag.Upsert(metrics.KeyInstanceID, "request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.SendRequest(reqCtx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected a single pool size, got %d rows", len(rows))
+	}
+	if tags := rows[0].Tags; len(tags) != 1 || tags[0].Key != metrics.KeyInstanceID || tags[0].Value != "sender" {
+		t.Fatalf("expected the pool size to only carry the sender's tags, got %v", tags)
+	}
+	if size := rows[0].Data.(*view.LastValueData).Value; size != 1 {
+		t.Fatalf("expected a pool size of 1, got %v", size)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	readErr := make(chan error, 1)
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			buf, err := r.ReadMsg()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			r.ReleaseMsg(buf)
+		}
+	})
+
+	ms := NewMessageSenderImpl(hosts[0], []protocol.ID{proto}).(*messageSenderImpl)
+	if err := ms.SendMessage(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("key"), 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, time.Second)
+	defer drainCancel()
+	ms.Drain(drainCtx)
+
+	select {
+	case err := <-readErr:
+		if err != io.EOF {
+			t.Fatalf("expected the remote to observe io.EOF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the pooled stream to be closed")
+	}
+
+	ms.smlk.Lock()
+	defer ms.smlk.Unlock()
+	if len(ms.strmap) != 0 {
+		t.Fatal("expected the pool to be empty after draining")
+	}
+}
+
+// failingHost fails to open any stream while fail is set, counting the attempts.
+type failingHost struct {
+	host.Host
+	dials int32
+	fail  int32
+	// how long opening a stream takes
+	delay time.Duration
+}
+
+var errDialFailed = errors.New("dial failed")
+
+func (h *failingHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	atomic.AddInt32(&h.dials, 1)
+	if atomic.LoadInt32(&h.fail) != 0 {
+		return nil, errDialFailed
+	}
+	if h.delay > 0 {
+		t := time.NewTimer(h.delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return h.Host.NewStream(ctx, p, pids...)
+}
+
+func TestStreamBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	h := &failingHost{Host: hosts[0], fail: 1}
+
+	const base = 50 * time.Millisecond
+	ms := NewMessageSenderImpl(h, []protocol.ID{"/test/kad/1.0.0"}, WithStreamBackoff(base, time.Minute))
+	send := func() error {
+		return ms.SendMessage(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_PING, nil, 0))
+	}
+
+	if err := send(); !errors.Is(err, errDialFailed) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+	// Let the first backoff expire so the next attempt dials again.
+	time.Sleep(2 * base)
+	if err := send(); !errors.Is(err, errDialFailed) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+	if n := atomic.LoadInt32(&h.dials); n != 2 {
+		t.Fatalf("expected 2 dials, got %d", n)
+	}
+
+	start := time.Now()
+	if err := send(); !errors.Is(err, errDialFailed) {
+		t.Fatalf("expected the cached error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&h.dials); n != 2 {
+		t.Fatalf("expected no dial while backing off, got %d dials", n)
+	}
+	if elapsed := time.Since(start); elapsed > base {
+		t.Fatalf("expected an immediate return while backing off, took %s", elapsed)
+	}
+}
+
+func TestConcurrentRequestsShareDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		_ = echoStream(s)
+	})
+	h := &failingHost{Host: hosts[0]}
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto})
+
+	const requests = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ms.SendRequest(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_PING, nil, 0))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&h.dials); n != 1 {
+		t.Fatalf("expected the requests to share a single dial, got %d", n)
+	}
+	if n := len(hosts[0].Network().ConnsToPeer(hosts[1].ID())); n != 1 {
+		t.Fatalf("expected a single connection, got %d", n)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	const delay = 100 * time.Millisecond
+	for _, tc := range []struct {
+		name   string
+		opts   []Option
+		pooled bool
+	}{
+		{"request deadline", nil, false},
+		{"dial timeout", []Option{WithDialTimeout(time.Minute)}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requester, responder := setupEchoResponder(ctx, t, proto)
+			h := &failingHost{Host: requester, delay: delay}
+			m := NewMessageSenderImpl(h, []protocol.ID{proto}, tc.opts...).(*messageSenderImpl)
+
+			reqCtx, reqCancel := context.WithTimeout(ctx, delay/10)
+			defer reqCancel()
+			if _, err := m.SendRequest(reqCtx, responder.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("expected the request to time out, got %v", err)
+			}
+
+			// The stream lands in the pool once open, even though its request gave up.
+			time.Sleep(2 * delay)
+			if s := pooledStream(t, m, responder.ID()); (s != nil) != tc.pooled {
+				t.Fatalf("expected the stream to be pooled: %t, got %v", tc.pooled, s)
+			}
+
+			if _, err := m.SendRequest(ctx, responder.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+				t.Fatal(err)
+			}
+			dials := int32(2)
+			if tc.pooled {
+				dials = 1
+			}
+			if n := atomic.LoadInt32(&h.dials); n != dials {
+				t.Fatalf("expected %d dials, got %d", dials, n)
+			}
+		})
+	}
+}
+
+func TestBackgroundDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+
+	t.Run("backoff", func(t *testing.T) {
+		mn, err := mocknet.FullMeshLinked(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := mn.Hosts()
+		h := &failingHost{Host: hosts[0], delay: time.Minute}
+		m := NewMessageSenderImpl(h, []protocol.ID{proto},
+			WithDialTimeout(20*time.Millisecond), WithStreamBackoff(time.Minute, time.Minute))
+
+		// Running out of time counts as failing to reach the peer.
+		if err := m.SendMessage(ctx, hosts[1].ID(), ping); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the dial to time out, got %v", err)
+		}
+		if err := m.SendMessage(ctx, hosts[1].ID(), ping); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the cached error, got %v", err)
+		}
+		if n := atomic.LoadInt32(&h.dials); n != 1 {
+			t.Fatalf("expected no dial while backing off, got %d dials", n)
+		}
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		requester, responder := setupEchoResponder(ctx, t, proto)
+		h := &failingHost{Host: requester, delay: time.Minute}
+		m := NewMessageSenderImpl(h, []protocol.ID{proto}, WithDialTimeout(time.Minute)).(*messageSenderImpl)
+
+		reqCtx, reqCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer reqCancel()
+		if err := m.SendMessage(reqCtx, responder.ID(), ping); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the request to time out, got %v", err)
+		}
+		m.smlk.Lock()
+		ms := m.strmap[responder.ID()]
+		m.smlk.Unlock()
+		if !ms.lk.TryLock() {
+			t.Fatal("expected the message sender to be idle")
+		}
+		d := ms.dialing
+		ms.lk.Unlock()
+		if d == nil {
+			t.Fatal("expected the dial to go on in the background")
+		}
+
+		// Draining the sender aborts the dial.
+		m.Drain(ctx)
+		select {
+		case <-d.done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the dial to be aborted")
+		}
+		if !errors.Is(d.err, context.Canceled) {
+			t.Fatalf("expected the dial to be cancelled, got %v", d.err)
+		}
+	})
+}
+
+func TestStreamBackoffResetsOnSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) { _ = s.Reset() })
+	h := &failingHost{Host: hosts[0], fail: 1}
+
+	m := NewMessageSenderImpl(h, []protocol.ID{proto}, WithStreamBackoff(10*time.Millisecond, time.Minute)).(*messageSenderImpl)
+
+	if _, err := m.newStream(ctx, hosts[1].ID()); err == nil {
+		t.Fatal("expected opening a stream to fail")
+	}
+	atomic.StoreInt32(&h.fail, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	s, err := m.newStream(ctx, hosts[1].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Reset()
+
+	m.backoffLk.Lock()
+	defer m.backoffLk.Unlock()
+	if _, ok := m.backoff[hosts[1].ID()]; ok {
+		t.Fatal("expected the backoff to be reset after a successful stream")
+	}
+}
+
+func TestStreamBackoffSkippedOnceConnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	hosts[1].SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		_ = echoStream(s)
+	})
+	h := &failingHost{Host: hosts[0], fail: 1}
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithStreamBackoff(time.Minute, time.Minute))
+
+	if _, err := ms.SendRequest(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_PING, nil, 0)); !errors.Is(err, errDialFailed) {
+		t.Fatalf("expected the dial to fail, got %v", err)
+	}
+
+	// The peer comes back: the backoff no longer applies once we're connected.
+	atomic.StoreInt32(&h.fail, 0)
+	if _, err := mn.ConnectPeers(hosts[0].ID(), hosts[1].ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.SendRequest(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatalf("expected the request to reach the reconnected peer, got %v", err)
+	}
+	if n := atomic.LoadInt32(&h.dials); n != 2 {
+		t.Fatalf("expected 2 dials, got %d", n)
+	}
+}
+
+func TestStreamBackoffDisabledByDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshLinked(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	h := &failingHost{Host: hosts[0], fail: 1}
+	ms := NewMessageSenderImpl(h, []protocol.ID{"/test/kad/1.0.0"})
+
+	for i := 0; i < 2; i++ {
+		if err := ms.SendMessage(ctx, hosts[1].ID(), pb.NewMessage(pb.Message_PING, nil, 0)); !errors.Is(err, errDialFailed) {
+			t.Fatalf("expected the dial to fail, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&h.dials); n != 2 {
+		t.Fatalf("expected every attempt to dial, got %d dials", n)
+	}
+}
+
+func TestSendRequestStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	frames := func(reqs []*pb.Message) []*pb.Message {
+		var out []*pb.Message
+		for _, k := range []string{"a", "b", "c"} {
+			out = append(out, pb.NewMessage(reqs[0].GetType(), []byte(k), 0))
+		}
+		return out
+	}
+
+	t.Run("exhausted", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, 1, frames)
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestStream(ctx, remote.ID(), pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for r := range replies {
+			keys = append(keys, string(r.GetKey()))
+		}
+		if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "c" {
+			t.Fatalf("expected the three frames in order, got %v", keys)
+		}
+
+		// The sender is free again and opens a new stream for the next request.
+		replies, err = ms.SendRequestStream(ctx, remote.ID(), pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range replies {
+			n++
+		}
+		if n != 3 {
+			t.Fatalf("expected 3 frames on the second request, got %d", n)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, 1, frames)
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		replies, err := ms.SendRequestStream(ctx, remote.ID(), pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The reply isn't read yet, which doesn't hold up other requests.
+		reqCtx, reqCancel := context.WithTimeout(ctx, time.Second)
+		defer reqCancel()
+		if _, err := ms.SendRequest(reqCtx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range replies {
+			n++
+		}
+		if n != 3 {
+			t.Fatalf("expected 3 frames, got %d", n)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		h, remote := setupResponder(ctx, t, proto, 1, frames)
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		replies, err := ms.SendRequestStream(reqCtx, remote.ID(), pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := <-replies; string(r.GetKey()) != "a" {
+			t.Fatalf("expected the first frame, got %q", r.GetKey())
+		}
+		reqCancel()
+
+		done := make(chan struct{})
+		go func() {
+			for range replies {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the reply channel to be closed after cancellation")
+		}
+
+		// The remaining frames are drained in the background and the sender is
+		// usable again.
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("acknowledged", func(t *testing.T) {
+		mn, err := mocknet.FullMeshConnected(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, remote := mn.Hosts()[0], mn.Hosts()[1]
+
+		// Sends frames for as long as they are acknowledged.
+		acked := make(chan int, 1)
+		remote.SetStreamHandler(proto, func(s network.Stream) {
+			defer s.Close()
+			r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+			if _, err := r.ReadMsg(); err != nil {
+				return
+			}
+			for n := 0; ; n++ {
+				if err := WriteMsg(s, pb.NewMessage(pb.Message_FIND_NODE, nil, 0)); err != nil {
+					return
+				}
+				buf, err := r.ReadMsg()
+				if err != nil {
+					if err == io.EOF {
+						acked <- n
+					}
+					return
+				}
+				var ack pb.Message
+				if err := ack.Unmarshal(buf); err != nil || ack.GetType() != pb.Message_FIND_NODE || ack.GetRequestId() != 3 {
+					return
+				}
+			}
+		})
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+		req := pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0)
+		req.RequestId = 3
+		req.BatchSize = 1
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		replies, err := ms.SendRequestStream(reqCtx, remote.ID(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-replies
+		<-replies
+		reqCancel()
+
+		select {
+		case n := <-acked:
+			if n != 2 {
+				t.Fatalf("expected 2 acknowledgments, got %d", n)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the stream to be closed for writing after cancellation")
+		}
+		for range replies {
+		}
+	})
+}
+
+func BenchmarkSendRequestStream(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const frames = 64
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupResponder(ctx, b, proto, 1, func(reqs []*pb.Message) []*pb.Message {
+		out := make([]*pb.Message, frames)
+		for i := range out {
+			out[i] = pb.NewMessage(reqs[0].GetType(), []byte("key"), 0)
+		}
+		return out
+	})
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithMetrics(false)).(*messageSenderImpl)
+	req := pb.NewMessage(pb.Message_GET_PROVIDERS, []byte("key"), 0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		replies, err := ms.SendRequestStream(ctx, remote.ID(), req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n := 0
+		for range replies {
+			n++
+		}
+		if n != frames {
+			b.Fatalf("expected %d frames, got %d", frames, n)
+		}
+	}
+}
+
+// latencyCountingPeerstore counts calls to RecordLatency.
+type latencyCountingPeerstore struct {
+	peerstore.Peerstore
+	recorded int32
+}
+
+func (ps *latencyCountingPeerstore) RecordLatency(p peer.ID, d time.Duration) {
+	atomic.AddInt32(&ps.recorded, 1)
+	ps.Peerstore.RecordLatency(p, d)
+}
+
+type peerstoreHost struct {
+	host.Host
+	ps peerstore.Peerstore
+}
+
+func (h *peerstoreHost) Peerstore() peerstore.Peerstore { return h.ps }
+
+func TestLatencyTracking(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	for _, enabled := range []bool{true, false} {
+		h, remote := setupEchoResponder(ctx, t, proto)
+		ps := &latencyCountingPeerstore{Peerstore: h.Peerstore()}
+		ms := NewMessageSenderImpl(&peerstoreHost{Host: h, ps: ps}, []protocol.ID{proto}, WithLatencyTracking(enabled))
+
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		recorded := atomic.LoadInt32(&ps.recorded)
+		if enabled && recorded == 0 {
+			t.Fatal("expected the latency to be recorded")
+		}
+		if !enabled && recorded != 0 {
+			t.Fatalf("expected no latency to be recorded, got %d samples", recorded)
+		}
+	}
+}
+
+func TestSendRequestMatchesRequestId(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	for _, tc := range []struct {
+		name    string
+		replyID func(reqID uint64) uint64
+		err     error
+	}{
+		{"echoed", func(id uint64) uint64 { return id }, nil},
+		{"not supported", func(uint64) uint64 { return 0 }, nil},
+		{"mismatched", func(id uint64) uint64 { return id + 1 }, ErrUnexpectedReply},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, remote := setupResponder(ctx, t, proto, 1, func(reqs []*pb.Message) []*pb.Message {
+				if reqs[0].GetRequestId() == 0 {
+					t.Error("expected the request to carry an id")
+				}
+				reqs[0].RequestId = tc.replyID(reqs[0].GetRequestId())
+				return reqs
+			})
+			ms := NewMessageSenderImpl(h, []protocol.ID{proto})
+
+			req := pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0)
+			if _, err := ms.SendRequest(ctx, remote.ID(), req); err != tc.err {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if req.GetRequestId() != 0 {
+				t.Fatal("expected the caller's message to be left untouched")
+			}
+		})
+	}
+}
+
+// pooledStream returns the stream currently pooled for p, if any.
+func pooledStream(t *testing.T, m *messageSenderImpl, p peer.ID) network.Stream {
+	t.Helper()
+
+	m.smlk.Lock()
+	ms, ok := m.strmap[p]
+	m.smlk.Unlock()
+	if !ok {
+		return nil
+	}
+	if !ms.lk.TryLock() {
+		t.Fatal("expected the message sender to be idle")
+	}
+	defer ms.lk.Unlock()
+	return ms.s
+}
+
+func TestStreamPoolIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithStreamPoolIdleTimeout(50*time.Millisecond)).(*messageSenderImpl)
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if pooledStream(t, ms, remote.ID()) == nil {
+		t.Fatal("expected the stream to be pooled")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if pooledStream(t, ms, remote.ID()) != nil {
+		t.Fatal("expected the idle stream to be closed")
+	}
+
+	// The sender opens a new stream on the next request.
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamPoolMaxIdlePerPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+
+	var opened, closed int32
+	remote.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		atomic.AddInt32(&opened, 1)
+		if echoStream(s) == io.EOF {
+			atomic.AddInt32(&closed, 1)
+		}
+	})
+
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithStreamPoolMaxIdlePerPeer(0)).(*messageSenderImpl)
+	const requests = 3
+	for i := 0; i < requests; i++ {
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if pooledStream(t, ms, remote.ID()) != nil {
+			t.Fatal("expected no stream to be kept idle")
+		}
+	}
+
+	for i := 0; atomic.LoadInt32(&closed) < requests; i++ {
+		if i > 100 {
+			t.Fatalf("expected all %d streams to be closed, %d were", requests, atomic.LoadInt32(&closed))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&opened); n != requests {
+		t.Fatalf("expected a stream per request, got %d", n)
+	}
+}
+
+func TestStreamPoolEvictsOldestIdleStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+
+	// Streams are numbered in the order they're opened.
+	var opened int32
+	closed := make(chan int32, 3)
+	remote.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		n := atomic.AddInt32(&opened, 1)
+		if echoStream(s) == io.EOF {
+			closed <- n
+		}
+	})
+
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithStreamPoolMaxIdlePerPeer(2)).(*messageSenderImpl)
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+	var held []*HeldStream
+	for i := 0; i < 3; i++ {
+		_, hs, err := ms.SendRequestKeepStream(ctx, remote.ID(), ping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, hs)
+	}
+	for _, hs := range held {
+		hs.Put()
+	}
+
+	select {
+	case n := <-closed:
+		if n != 1 {
+			t.Fatalf("expected the oldest stream to be closed, got stream %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a stream to be closed")
+	}
+
+	// The 2 streams left serve further requests.
+	for i := 0; i < 2; i++ {
+		_, hs, err := ms.SendRequestKeepStream(ctx, remote.ID(), ping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer hs.Put()
+	}
+	if n := atomic.LoadInt32(&opened); n != 3 {
+		t.Fatalf("expected the idle streams to be reused, got %d streams", n)
+	}
+	select {
+	case n := <-closed:
+		t.Fatalf("expected a single stream to be closed, stream %d was too", n)
+	default:
+	}
+}
+
+// protectingConnManager protects every peer.
+type protectingConnManager struct {
+	connmgr.NullConnMgr
+}
+
+func (protectingConnManager) IsProtected(peer.ID, string) bool { return true }
+
+type protectingHost struct {
+	host.Host
+}
+
+func (h *protectingHost) ConnManager() connmgr.ConnManager { return protectingConnManager{} }
+
+func TestConnectionPruning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	const timeout = 50 * time.Millisecond
+
+	// The connection is left alone while the connection manager protects the peer.
+	ms := NewMessageSenderImpl(&protectingHost{Host: h}, []protocol.ID{proto},
+		WithStreamPoolMaxIdlePerPeer(0), WithConnectionPruning(timeout))
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * timeout)
+	if h.Network().Connectedness(remote.ID()) != network.Connected {
+		t.Fatal("expected the connection to a protected peer to be kept")
+	}
+
+	ms = NewMessageSenderImpl(h, []protocol.ID{proto},
+		WithStreamPoolIdleTimeout(timeout), WithConnectionPruning(timeout))
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if h.Network().Connectedness(remote.ID()) != network.Connected {
+		t.Fatal("expected the connection to be kept while its stream is pooled")
+	}
+
+	// Once the pooled stream is closed, the connection goes after the prune timeout.
+	for i := 0; h.Network().Connectedness(remote.ID()) == network.Connected; i++ {
+		if i > 100 {
+			t.Fatal("expected the idle connection to be closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The sender dials again on the next request.
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamPoolDiscardsStaleStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.StreamPoolStaleView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.StreamPoolStaleView)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+	req := pb.NewMessage(pb.Message_PING, nil, 0)
+	if _, err := ms.SendRequest(ctx, remote.ID(), req); err != nil {
+		t.Fatal(err)
+	}
+	stale := pooledStream(t, ms, remote.ID())
+	if stale == nil {
+		t.Fatal("expected the stream to be pooled")
+	}
+	if err := stale.Conn().Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), req); err != nil {
+		t.Fatal(err)
+	}
+	if n := viewCount(t, metrics.StreamPoolStaleView); n != 1 {
+		t.Fatalf("expected 1 stale stream to be discarded, got %d", n)
+	}
+	if s := pooledStream(t, ms, remote.ID()); s == nil || s == stale {
+		t.Fatal("expected a fresh stream to be pooled")
+	}
+}
+
+func TestStreamResetMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.StreamResetsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.StreamResetsView)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+
+	mes := pb.NewMessage(pb.Message_ADD_PROVIDER, nil, 0)
+	if err := ms.SendMessage(ctx, remote.ID(), mes); err != nil {
+		t.Fatal(err)
+	}
+	// Sending on the pooled stream fails once it's closed for writing, and the
+	// message is sent again on a new stream.
+	s := pooledStream(t, ms, remote.ID())
+	if s == nil {
+		t.Fatal("expected the stream to be pooled")
+	}
+	if err := s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.SendMessage(ctx, remote.ID(), mes); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(metrics.StreamResetsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets := make(map[string]int64)
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyResetReason {
+				resets[tg.Value] += r.Data.(*view.CountData).Value
+			}
+		}
+	}
+	if resets["send-error"] != 1 || len(resets) != 1 {
+		t.Fatalf("expected a single reset for a send error, got %v", resets)
+	}
+}
+
+func TestRequestRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	for _, tc := range []struct {
+		name     string
+		failures int
+		retries  int
+		ok       bool
+	}{
+		{"fails once", 1, 0, true},
+		{"fails twice", 2, 0, false},
+		{"fails twice with a retry", 2, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, remote := setupEchoResponder(ctx, t, proto)
+
+			// Reset the first streams after reading the request.
+			var opened int32
+			remote.SetStreamHandler(proto, func(s network.Stream) {
+				if int(atomic.AddInt32(&opened, 1)) <= tc.failures {
+					_, _ = msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg()
+					_ = s.Reset()
+					return
+				}
+				defer s.Close()
+				_ = echoStream(s)
+			})
+
+			ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithRequestRetries(tc.retries))
+			_, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0))
+			if tc.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected the request to fail")
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		h, remote := setupEchoResponder(ctx, t, proto)
+
+		// Never reply.
+		var opened int32
+		remote.SetStreamHandler(proto, func(s network.Stream) {
+			atomic.AddInt32(&opened, 1)
+			_, _ = io.Copy(ioutil.Discard, s)
+		})
+
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithRequestRetries(2))
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != context.DeadlineExceeded {
+			t.Fatalf("expected the request to time out, got %v", err)
+		}
+		if n := atomic.LoadInt32(&opened); n != 1 {
+			t.Fatalf("expected the request not to be retried, got %d streams", n)
+		}
+	})
+}
+
+func TestStreamAcquireLatencyMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.StreamAcquireLatencyView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.StreamAcquireLatencyView)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto})
+
+	req := pb.NewMessage(pb.Message_PING, nil, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := ms.SendRequest(ctx, remote.ID(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.SendMessage(ctx, remote.ID(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(metrics.StreamAcquireLatencyView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make(map[string]int64)
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyStreamSource {
+				samples[tg.Value] += r.Data.(*view.DistributionData).Count
+			}
+		}
+	}
+	if samples["dialed"] != 1 || samples["pooled"] != 2 {
+		t.Fatalf("expected 1 dialed and 2 pooled samples, got %v", samples)
+	}
+}
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const rtt = 42 * time.Millisecond
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupResponder(ctx, t, proto, 1, func(reqs []*pb.Message) []*pb.Message {
+		clock.Advance(rtt)
+		return reqs
+	})
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithClock(clock))
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Peerstore().LatencyEWMA(remote.ID()); got != rtt {
+		t.Fatalf("expected a recorded latency of %s, got %s", rtt, got)
+	}
+}
+
+func TestReplyWaitMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.ReplyWaitView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.ReplyWaitView)
+
+	const delay = 42 * time.Millisecond
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupResponder(ctx, t, proto, 1, func(reqs []*pb.Message) []*pb.Message {
+		clock.Advance(delay)
+		return reqs
+	})
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithClock(clock))
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(metrics.ReplyWaitView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected a single row, got %d", len(rows))
+	}
+	var typ string
+	for _, tg := range rows[0].Tags {
+		if tg.Key == metrics.KeyMessageType {
+			typ = tg.Value
+		}
+	}
+	if typ != pb.Message_PING.String() {
+		t.Fatalf("expected the sample to be tagged with the PING type, got %q", typ)
+	}
+	d := rows[0].Data.(*view.DistributionData)
+	if d.Count != 1 || d.Mean != float64(delay)/float64(time.Millisecond) {
+		t.Fatalf("expected one wait of %s, got %d with a mean of %fms", delay, d.Count, d.Mean)
+	}
+}
+
+func TestWarmStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := mn.Hosts()
+	proto := protocol.ID("/test/kad/1.0.0")
+	for _, h := range hosts[1:3] {
+		h.SetStreamHandler(proto, func(s network.Stream) {
+			defer s.Close()
+			_ = echoStream(s)
+		})
+	}
+	// hosts[3] doesn't speak the protocol, so no stream can be opened to it.
+	ms := NewMessageSenderImpl(hosts[0], []protocol.ID{proto}).(*messageSenderImpl)
+
+	errs := ms.WarmStreams(ctx, []peer.ID{hosts[1].ID(), hosts[2].ID(), hosts[3].ID()})
+	if len(errs) != 1 || errs[hosts[3].ID()] == nil {
+		t.Fatalf("expected warming only the stream to %s to fail, got %v", hosts[3].ID(), errs)
+	}
+	for _, h := range hosts[1:3] {
+		if pooledStream(t, ms, h.ID()) == nil {
+			t.Fatalf("expected a stream to %s to be pooled", h.ID())
+		}
+	}
+	if _, ok := ms.strmap[hosts[3].ID()]; ok {
+		t.Fatal("expected no sender to be pooled for the failing peer")
+	}
+
+	// Requests use the warmed streams.
+	if err := view.Register(metrics.StreamPoolHitsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.StreamPoolHitsView)
+	for _, h := range hosts[1:3] {
+		if _, err := ms.SendRequest(ctx, h.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hits := viewCount(t, metrics.StreamPoolHitsView); hits != 2 {
+		t.Fatalf("expected both requests to reuse a warmed stream, got %d hits", hits)
+	}
+}
+
+func TestLateReplyHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupResponder(ctx, t, proto, 1, func(reqs []*pb.Message) []*pb.Message {
+		if reqs[0].GetType() == pb.Message_FIND_NODE {
+			<-release
+		}
+		return reqs
+	})
+	late := make(chan *pb.Message, 1)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithLateReplyHandler(func(p peer.ID, reply *pb.Message) {
+		if p != remote.ID() {
+			t.Errorf("expected a late reply from %s, got one from %s", remote.ID(), p)
+		}
+		late <- reply
+	}))
+
+	// Replies arriving in time aren't late.
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ms.SendRequest(reqCtx, remote.ID(), pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	reqCancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+	select {
+	case reply := <-late:
+		t.Fatalf("unexpected late reply %v before the peer replied", reply)
+	default:
+	}
+
+	close(release)
+	select {
+	case reply := <-late:
+		if reply.GetType() != pb.Message_FIND_NODE || string(reply.GetKey()) != "key" {
+			t.Fatalf("unexpected late reply %v", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the late reply to be reported")
+	}
+}
+
+func TestLateReplyTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer func(d time.Duration) { lateReplyTimeout = d }(lateReplyTimeout)
+	lateReplyTimeout = 200 * time.Millisecond
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, remote := mn.Hosts()[0], mn.Hosts()[1]
+	proto := protocol.ID("/test/kad/1.0.0")
+
+	// The peer reads the request and then neither replies nor closes the
+	// stream, until the stream is reset.
+	reset := make(chan struct{})
+	remote.SetStreamHandler(proto, func(s network.Stream) {
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		if _, err := r.ReadMsg(); err != nil {
+			return
+		}
+		if _, err := r.ReadMsg(); err != nil {
+			close(reset)
+		}
+	})
+
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithLateReplyHandler(func(p peer.ID, reply *pb.Message) {
+		t.Errorf("unexpected late reply %v", reply)
+	}))
+
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ms.SendRequest(reqCtx, remote.ID(), pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	reqCancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be cancelled, got %v", err)
+	}
+	cancelled := time.Now()
+
+	select {
+	case <-reset:
+		if elapsed := time.Since(cancelled); elapsed < lateReplyTimeout/2 {
+			t.Fatalf("stream reset after %s, before the late reply timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stream to be reset once the late reply timeout passed")
+	}
+}
+
+func TestRequestHandleCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defer func(d time.Duration) { lateReplyTimeout = d }(lateReplyTimeout)
+	lateReplyTimeout = 200 * time.Millisecond
+
+	// setup echoes requests on a stream kept open, holding back the replies to
+	// FIND_NODE requests until release is closed. The returned channel yields
+	// the read error the stream handler ended with.
+	setup := func(t *testing.T, received chan<- struct{}, release <-chan struct{}) (*messageSenderImpl, peer.ID, <-chan error) {
+		mn, err := mocknet.FullMeshConnected(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, remote := mn.Hosts()[0], mn.Hosts()[1]
+		proto := protocol.ID("/test/kad/1.0.0")
+		ended := make(chan error, 1)
+		remote.SetStreamHandler(proto, func(s network.Stream) {
+			defer s.Close()
+			r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+			for {
+				buf, err := r.ReadMsg()
+				if err != nil {
+					ended <- err
+					return
+				}
+				req := new(pb.Message)
+				if err := req.Unmarshal(buf); err != nil {
+					ended <- err
+					return
+				}
+				if req.GetType() == pb.Message_FIND_NODE {
+					received <- struct{}{}
+					<-release
+				}
+				if err := WriteMsg(s, req); err != nil {
+					ended <- err
+					return
+				}
+			}
+		})
+		return NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl), remote.ID(), ended
+	}
+	ping := func(t *testing.T, ms *messageSenderImpl, p peer.ID) {
+		if _, err := ms.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancelFindNode := func(t *testing.T, ms *messageSenderImpl, p peer.ID, received <-chan struct{}) {
+		h := ms.SendRequestWithHandle(ctx, p, pb.NewMessage(pb.Message_FIND_NODE, []byte("key"), 0))
+		<-received
+		h.Cancel()
+		if _, err := h.Reply(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the request to be cancelled, got %v", err)
+		}
+	}
+
+	t.Run("drained", func(t *testing.T) {
+		received, release := make(chan struct{}, 1), make(chan struct{})
+		ms, p, _ := setup(t, received, release)
+		ping(t, ms, p)
+		s := pooledStream(t, ms, p)
+		if s == nil {
+			t.Fatal("expected a pooled stream")
+		}
+
+		late := make(chan *pb.Message, 1)
+		ms.onLateReply = func(p peer.ID, reply *pb.Message) { late <- reply }
+		cancelFindNode(t, ms, p, received)
+		close(release)
+		deadline := time.Now().Add(5 * time.Second)
+		for pooledStream(t, ms, p) != s {
+			if time.Now().After(deadline) {
+				t.Fatal("expected the stream to be returned to the pool once the reply was drained")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		select {
+		case reply := <-late:
+			if reply.GetType() != pb.Message_FIND_NODE {
+				t.Fatalf("expected the drained reply to be passed on, got a %s", reply.GetType())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the drained reply to be passed to the late reply handler")
+		}
+
+		// The next request gets the stream, but not the discarded reply.
+		ping(t, ms, p)
+		if pooledStream(t, ms, p) != s {
+			t.Fatal("expected the drained stream to be reused")
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		received, release := make(chan struct{}, 1), make(chan struct{})
+		defer close(release)
+		ms, p, ended := setup(t, received, release)
+		ping(t, ms, p)
+
+		cancelFindNode(t, ms, p, received)
+		cancelled := time.Now()
+		// The handler only reads again once released.
+		time.AfterFunc(2*lateReplyTimeout, func() { release <- struct{}{} })
+		select {
+		case err := <-ended:
+			if elapsed := time.Since(cancelled); elapsed < lateReplyTimeout {
+				t.Fatalf("stream ended after %s, before the late reply timeout", elapsed)
+			}
+			if err == nil || err == io.EOF {
+				t.Fatalf("expected the stream to be reset, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the stream to be reset once the late reply timeout passed")
+		}
+		if pooledStream(t, ms, p) != nil {
+			t.Fatal("expected no stream to be pooled")
+		}
+	})
+}
+
+func TestAdaptiveStreamPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.StreamPoolTargetSizeView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.StreamPoolTargetSizeView)
+	targetSize := func() float64 {
+		rows, err := view.RetrieveData(metrics.StreamPoolTargetSizeView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) == 0 {
+			return 0
+		}
+		return rows[0].Data.(*view.LastValueData).Value
+	}
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	// Every request adds 10 requests per second to the rate.
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithAdaptiveStreamPool(20, 100*time.Millisecond)).(*messageSenderImpl)
+	ping := func() {
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ping()
+	if pooledStream(t, ms, remote.ID()) != nil {
+		t.Fatal("expected the stream of a single request not to be kept")
+	}
+
+	for i := 0; i < 10; i++ {
+		ping()
+	}
+	if pooledStream(t, ms, remote.ID()) == nil {
+		t.Fatal("expected the stream to be kept during a burst")
+	}
+	if size := targetSize(); size != 1 {
+		t.Fatalf("expected a target size of 1 during a burst, got %v", size)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if pooledStream(t, ms, remote.ID()) != nil {
+		t.Fatal("expected the stream to be closed once idle")
+	}
+	if size := targetSize(); size != 0 {
+		t.Fatalf("expected a target size of 0 once idle, got %v", size)
+	}
+}
+
+func TestWithMetricsDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	views := []*view.View{
+		metrics.SentMessagesView,
+		metrics.SentRequestsView,
+		metrics.StreamPoolHitsView,
+		metrics.StreamPoolMissesView,
+	}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, proto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithMetrics(false))
+
+	for i := 0; i < 3; i++ {
+		if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The responder echoes messages too, so no request may follow this one.
+	if err := ms.SendMessage(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range views {
+		if n := viewCount(t, v); n != 0 {
+			t.Errorf("expected nothing to be recorded in %s, got %d", v.Name, n)
+		}
+	}
+}
+
+func BenchmarkSendMessageMetrics(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.DefaultViews...); err != nil {
+		b.Fatal(err)
+	}
+	defer view.Unregister(metrics.DefaultViews...)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h, remote := mn.Hosts()[0], mn.Hosts()[1]
+	proto := protocol.ID("/test/kad/1.0.0")
+	remote.SetStreamHandler(proto, func(s network.Stream) {
+		defer s.Close()
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		for {
+			msg, err := r.ReadMsg()
+			if err != nil {
+				return
+			}
+			r.ReleaseMsg(msg)
+		}
+	})
+
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("metrics=%t", enabled), func(b *testing.B) {
+			ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithMetrics(enabled))
+			mes := pb.NewMessage(pb.Message_ADD_PROVIDER, []byte("key"), 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ms.SendMessage(ctx, remote.ID(), mes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// writeCounter counts the writes made to it.
+type writeCounter struct {
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func TestMessageWriterSize(t *testing.T) {
+	// A burst of coalesced multi-KB responses, each larger than the default
+	// buffer but fitting a larger one together.
+	resps := make([]*pb.Message, 3)
+	total := 0
+	for i := range resps {
+		resps[i] = providersResponse(t, 100)
+		total += resps[i].Size()
+	}
+	if resps[0].Size() <= defaultWriteBufferSize {
+		t.Fatalf("response of %d bytes fits the default buffer", resps[0].Size())
+	}
+
+	for _, tc := range []struct {
+		size, want int
+	}{
+		{0, defaultWriteBufferSize},
+		{64 << 10, 64 << 10},
+	} {
+		var out writeCounter
+		w := NewMessageWriterSize(&out, tc.size)
+		if got := w.bw.Size(); got != tc.want {
+			t.Errorf("asked for a buffer of %d bytes, got %d", tc.size, got)
+		}
+		for _, resp := range resps {
+			if err := w.WriteMsg(resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		w.Release()
+
+		// Only a buffer larger than all responses writes them out at once.
+		if fits := tc.want > total; fits != (out.writes == 1) {
+			t.Errorf("a %d bytes buffer wrote %d bytes of responses in %d writes", tc.want, total, out.writes)
+		}
+	}
+}
+
+func TestMessageWriterBuffered(t *testing.T) {
+	var out writeCounter
+	w := NewMessageWriter(&out)
+	defer w.Release()
+
+	want := 0
+	for i := 0; i < 3; i++ {
+		mes := pb.NewMessage(pb.Message_PING, []byte(fmt.Sprintf("key-%d", i)), 0)
+		if err := w.WriteMsg(mes); err != nil {
+			t.Fatal(err)
+		}
+		want += binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(mes.Size())) + mes.Size()
+		if got := w.Buffered(); got != want {
+			t.Fatalf("expected %d bytes to be buffered, got %d", want, got)
+		}
+	}
+	if out.writes != 0 {
+		t.Fatalf("expected nothing to be written before flushing, got %d writes", out.writes)
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Buffered(); got != 0 {
+		t.Fatalf("expected nothing to be buffered once flushed, got %d bytes", got)
+	}
+}
+
+func BenchmarkMessageWriterSize(b *testing.B) {
+	resps := make([]*pb.Message, 8)
+	for i := range resps {
+		resps[i] = providersResponse(b, 100)
+	}
+
+	for _, size := range []int{defaultWriteBufferSize, 64 << 10} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var out writeCounter
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := NewMessageWriterSize(&out, size)
+				for _, resp := range resps {
+					if err := w.WriteMsg(resp); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Flush(); err != nil {
+					b.Fatal(err)
+				}
+				w.Release()
+			}
+			b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestClosePeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, remote := mn.Hosts()[0], mn.Hosts()[1]
+	proto := protocol.ID("/test/kad/1.0.0")
+
+	// The peer reads requests but never replies, until its streams are reset.
+	requests := make(chan struct{}, 2)
+	resets := make(chan struct{}, 2)
+	remote.SetStreamHandler(proto, func(s network.Stream) {
+		r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+		if _, err := r.ReadMsg(); err != nil {
+			return
+		}
+		requests <- struct{}{}
+		if _, err := r.ReadMsg(); err != nil {
+			resets <- struct{}{}
+		}
+	})
+	ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithLateReplyHandler(func(peer.ID, *pb.Message) {
+		t.Error("unexpected late reply")
+	}))
+
+	// The first request is given up on and its stream kept open for a late
+	// reply, the second one is in flight on a new stream.
+	reqCtx, reqCancel := context.WithCancel(ctx)
+	go func() {
+		<-requests
+		reqCancel()
+	}()
+	if _, err := ms.SendRequest(reqCtx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the first request to be cancelled, got %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0))
+		errc <- err
+	}()
+	<-requests
+
+	ms.(*messageSenderImpl).ClosePeer(remote.ID())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-resets:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected both streams to be reset, %d were", i)
+		}
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("expected the request in flight to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request in flight still waiting after its peer was closed")
+	}
+}
+
+func TestProtocolFallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := view.Register(metrics.OutboundStreamsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.OutboundStreamsView)
+
+	// The peer only speaks the older of our protocols.
+	newProto, oldProto := protocol.ID("/test/kad/2.0.0"), protocol.ID("/test/kad/1.0.0")
+	h, remote := setupEchoResponder(ctx, t, oldProto)
+	ms := NewMessageSenderImpl(h, []protocol.ID{newProto, oldProto})
+
+	if _, err := ms.SendRequest(ctx, remote.ID(), pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	pms := ms.(*messageSenderImpl).strmap[remote.ID()]
+	if got := pms.s.Protocol(); got != oldProto {
+		t.Fatalf("expected the stream to fall back to %s, got %s", oldProto, got)
+	}
+
+	rows, err := view.RetrieveData(metrics.OutboundStreamsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := make(map[string]int64)
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if tg.Key == metrics.KeyProtocol {
+				streams[tg.Value] += r.Data.(*view.CountData).Value
+			}
+		}
+	}
+	if streams[string(oldProto)] != 1 || streams[string(newProto)] != 0 {
+		t.Fatalf("expected one stream to be recorded on %s, got %v", oldProto, streams)
+	}
+}
+
+// multiConnHost exposes two connections to every peer, both carried by the one
+// connection mocknet keeps per peer, and counts the streams opened on each.
+type multiConnHost struct {
+	host.Host
+	lk    sync.Mutex
+	conns map[peer.ID][]network.Conn
+}
+
+func (h *multiConnHost) Network() network.Network {
+	return &multiConnNetwork{Network: h.Host.Network(), h: h}
+}
+
+type multiConnNetwork struct {
+	network.Network
+	h *multiConnHost
+}
+
+func (n *multiConnNetwork) ConnsToPeer(p peer.ID) []network.Conn {
+	n.h.lk.Lock()
+	defer n.h.lk.Unlock()
+	if _, ok := n.h.conns[p]; !ok {
+		for _, c := range n.Network.ConnsToPeer(p) {
+			n.h.conns[p] = append(n.h.conns[p], &countingConn{Conn: c}, &countingConn{Conn: c})
+		}
+	}
+	return n.h.conns[p]
+}
+
+type countingConn struct {
+	network.Conn
+	streams int32
+}
+
+func (c *countingConn) NewStream(ctx context.Context) (network.Stream, error) {
+	s, err := c.Conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&c.streams, 1)
+	return &connStream{Stream: s, conn: c}, nil
+}
+
+// connStream reports the connection it was opened on.
+type connStream struct {
+	network.Stream
+	conn network.Conn
+}
+
+func (s *connStream) Conn() network.Conn { return s.conn }
+
+func TestConnectionHints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const proto = "/test/kad/1.0.0"
+	h0, h1 := setupEchoResponder(ctx, t, proto)
+	p := h1.ID()
+	h := &multiConnHost{Host: h0, conns: make(map[peer.ID][]network.Conn)}
+	conns := h.Network().ConnsToPeer(p)
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(conns))
+	}
+
+	// Whichever connection was measured the fastest gets the stream.
+	for fast := range conns {
+		slow := 1 - fast
+		m := NewMessageSenderImpl(h, []protocol.ID{proto}, WithConnectionHints(true)).(*messageSenderImpl)
+		m.connRTTs.record(conns[fast], time.Millisecond)
+		m.connRTTs.record(conns[slow], 100*time.Millisecond)
+
+		before := atomic.LoadInt32(&conns[slow].(*countingConn).streams)
+		if _, err := m.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, []byte("hello"), 0)); err != nil {
+			t.Fatal(err)
+		}
+		s := pooledStream(t, m, p)
+		if s.Conn() != conns[fast] {
+			t.Fatalf("expected the stream on the faster connection %d", fast)
+		}
+		if n := atomic.LoadInt32(&conns[slow].(*countingConn).streams); n != before {
+			t.Fatalf("expected no stream on the slower connection %d", slow)
+		}
+		if s.Protocol() != proto {
+			t.Fatalf("expected the stream to speak %s, got %s", proto, s.Protocol())
+		}
+		m.connRTTs.mu.Lock()
+		rtt := m.connRTTs.rtts[p][conns[fast]]
+		m.connRTTs.mu.Unlock()
+		if rtt == time.Millisecond {
+			t.Fatal("expected the request to be measured on the faster connection")
+		}
+	}
+
+	// A connection not measured yet is probed before settling on the one
+	// measured first, which may not be the fastest.
+	m := NewMessageSenderImpl(h, []protocol.ID{proto}, WithConnectionHints(true)).(*messageSenderImpl)
+	m.connRTTs.record(conns[0], time.Hour)
+	if _, err := m.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if pooledStream(t, m, p).Conn() != conns[1] {
+		t.Fatal("expected the stream on the connection not measured yet")
+	}
+	if c := m.connRTTs.fastest(p, conns); c != conns[1] {
+		t.Fatal("expected the probed connection to be measured the fastest")
+	}
+
+	// Without measurements, the host picks the connection.
+	m = NewMessageSenderImpl(h, []protocol.ID{proto}, WithConnectionHints(true)).(*messageSenderImpl)
+	if _, err := m.SendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pooledStream(t, m, p).(*connStream); ok {
+		t.Fatal("expected the host to open the stream before any connection was measured")
+	}
+}
+
+func TestSendRequestKeepStreamFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proto := protocol.ID("/test/kad/1.0.0")
+	ping := pb.NewMessage(pb.Message_PING, nil, 0)
+
+	t.Run("dropped", func(t *testing.T) {
+		h, remote := setupEchoResponder(ctx, t, proto)
+
+		var drop int32
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}, WithOutboundMessageHook(func(p peer.ID, pmes *pb.Message) *pb.Message {
+			if atomic.LoadInt32(&drop) == 1 {
+				return nil
+			}
+			return pmes
+		})).(*messageSenderImpl)
+		if _, err := ms.SendRequest(ctx, remote.ID(), ping); err != nil {
+			t.Fatal(err)
+		}
+		pooled := pooledStream(t, ms, remote.ID())
+
+		// A dropped request leaves the pooled stream where it was.
+		atomic.StoreInt32(&drop, 1)
+		if _, _, err := ms.SendRequestKeepStream(ctx, remote.ID(), ping); err != ErrMessageDropped {
+			t.Fatalf("expected the request to be dropped, got %v", err)
+		}
+		if s := pooledStream(t, ms, remote.ID()); s == nil || s != pooled {
+			t.Fatal("expected the stream to stay pooled")
+		}
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		h, remote := setupEchoResponder(ctx, t, proto)
+
+		// Reset the first stream after reading the request.
+		var opened int32
+		remote.SetStreamHandler(proto, func(s network.Stream) {
+			if atomic.AddInt32(&opened, 1) == 1 {
+				_, _ = msgio.NewVarintReaderSize(s, network.MessageSizeMax).ReadMsg()
+				_ = s.Reset()
+				return
+			}
+			defer s.Close()
+			_ = echoStream(s)
+		})
+
+		ms := NewMessageSenderImpl(h, []protocol.ID{proto}).(*messageSenderImpl)
+		_, hs, err := ms.SendRequestKeepStream(ctx, remote.ID(), ping)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer hs.Put()
+		if n := atomic.LoadInt32(&opened); n != 2 {
+			t.Fatalf("expected the request to be retried on a new stream, got %d streams", n)
+		}
+		if _, err := hs.SendRequest(ctx, ping); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package net
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-msgio"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// RequestHandle is a request sent with SendRequestWithHandle. It can be
+// cancelled on its own, without cancelling the context it was sent with.
+type RequestHandle struct {
+	cancel    context.CancelFunc
+	cancelled int32
+
+	done  chan struct{}
+	reply *pb.Message
+	err   error
+}
+
+type requestHandleKey struct{}
+
+// SendRequestWithHandle sends out a request like SendRequest, but doesn't wait
+// for the reply. The returned handle waits for the reply, or cancels just this
+// request.
+func (m *messageSenderImpl) SendRequestWithHandle(ctx context.Context, p peer.ID, pmes *pb.Message) *RequestHandle {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &RequestHandle{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer cancel()
+		h.reply, h.err = m.SendRequest(context.WithValue(ctx, requestHandleKey{}, h), p, pmes)
+		close(h.done)
+	}()
+	return h
+}
+
+// Cancel gives up on the request, which then fails with context.Canceled.
+//
+// Unlike cancelling the request's context, which resets its stream, Cancel
+// drains the stream: the reply is still read, for up to lateReplyTimeout, and
+// passed to the late reply handler if there is one, and the stream is then put
+// back in the pool for the next request. Cancelling a request that is done has
+// no effect.
+func (h *RequestHandle) Cancel() {
+	atomic.StoreInt32(&h.cancelled, 1)
+	h.cancel()
+}
+
+// Done returns a channel that is closed once the request is done, whether it
+// succeeded, failed or was cancelled.
+func (h *RequestHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Reply waits for the request to be done and returns its outcome.
+func (h *RequestHandle) Reply() (*pb.Message, error) {
+	<-h.done
+	return h.reply, h.err
+}
+
+// cancelledByHandle reports whether ctx is done because the handle of the
+// request it was sent with was cancelled.
+func cancelledByHandle(ctx context.Context) bool {
+	h, ok := ctx.Value(requestHandleKey{}).(*RequestHandle)
+	return ok && atomic.LoadInt32(&h.cancelled) == 1
+}
+
+// drainedStream is the state of a stream handed off to drain the reply to a
+// cancelled request, which it gets back if returned to the pool.
+type drainedStream struct {
+	s                       network.Stream
+	r                       msgio.ReadCloser
+	compressed, checksummed bool
+	seq                     uint64
+}
+
+func (ms *peerMessageSender) handOff() drainedStream {
+	return drainedStream{s: ms.s, r: ms.r, compressed: ms.compressed, checksummed: ms.checksummed, seq: ms.seq}
+}
+
+// drain waits for the reply to request id, which was cancelled through its
+// handle, puts the stream back in the pool once it arrives and passes the
+// reply to the late reply handler if there is one. The stream is
+// closed if the pool has no room left for it, and reset if the reply
+// doesn't arrive within lateReplyTimeout.
+func (ms *peerMessageSender) drain(ds drainedStream, errc <-chan error, mes *pb.Message, id uint64) {
+	t := time.NewTimer(lateReplyTimeout)
+	defer t.Stop()
+
+	select {
+	case err := <-errc:
+		if err == nil && (mes.GetRequestId() == 0 || mes.GetRequestId() == id) {
+			if !ms.restore(ds) {
+				_ = ds.s.Close()
+			}
+			if ms.m.onLateReply != nil {
+				ms.m.onLateReply(ms.p, mes)
+			}
+			return
+		}
+	case <-t.C:
+	}
+	ms.m.resetStream(context.Background(), ds.s, "request-error")
+}
+
+// restore puts a drained stream back in the pool, unless the sender has
+// another stream by now and no room for a spare one, or was invalidated. It
+// reports whether it did.
+func (ms *peerMessageSender) restore(ds drainedStream) bool {
+	_ = ms.lk.Lock(context.Background())
+	if ms.invalid || atomic.LoadInt32(&ms.closed) == 1 || (ms.s != nil && ms.m.maxIdlePerPeer <= 1) {
+		ms.lk.Unlock()
+		return false
+	}
+	if ms.s != nil {
+		ms.pushSpare()
+	}
+	ms.s, ms.r = ds.s, ds.r
+	ms.compressed, ms.checksummed, ms.seq = ds.compressed, ds.checksummed, ds.seq
+	ms.unlock()
+	return true
+}
+
+// pushSpare moves the current stream to the spare ones, closing the oldest
+// idle stream if the peer is left with more than allowed by
+// WithStreamPoolMaxIdlePerPeer once it gets a new current stream.
+func (ms *peerMessageSender) pushSpare() {
+	ms.spare = append(ms.spare, ms.handOff())
+	ms.s = nil
+	if 1+len(ms.spare) > ms.m.maxIdlePerPeer {
+		oldest := ms.spare[0]
+		ms.spare[0] = drainedStream{}
+		ms.spare = ms.spare[1:]
+		if err := oldest.s.Close(); err != nil {
+			ms.m.resetStream(context.Background(), oldest.s, "shutdown")
+		}
+	}
+}
+
+// takeSpare makes the most recently pooled spare stream the current one, and
+// reports whether there was one.
+func (ms *peerMessageSender) takeSpare() bool {
+	n := len(ms.spare)
+	if n == 0 {
+		return false
+	}
+	ds := ms.spare[n-1]
+	ms.spare[n-1] = drainedStream{}
+	ms.spare = ms.spare[:n-1]
+	ms.s, ms.r = ds.s, ds.r
+	ms.compressed, ms.checksummed, ms.seq = ds.compressed, ds.checksummed, ds.seq
+	ms.fresh = false
+	return true
+}
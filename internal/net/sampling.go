@@ -0,0 +1,54 @@
+package net
+
+import (
+	"sync/atomic"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+// MessageSampler picks the messages recorded in the per message metrics, e.g.
+// to record only 1 in every 100 FIND_NODE messages while still counting every
+// GET_VALUE. A recorded message stands for all the messages of its type since
+// the previous one: it's counted with their number as its weight, so the
+// message count views keep counting every message on average, while the byte
+// distributions are built from the recorded messages alone. It's safe for
+// concurrent use, and a nil sampler records every message.
+type MessageSampler struct {
+	rates map[pb.Message_MessageType]uint64
+	seen  map[pb.Message_MessageType]*uint64
+}
+
+// NewMessageSampler returns a sampler recording 1 in every rates[t] messages of
+// type t. Types with a rate of 1 or less, or no rate, are always recorded.
+func NewMessageSampler(rates map[pb.Message_MessageType]int) *MessageSampler {
+	s := &MessageSampler{
+		rates: make(map[pb.Message_MessageType]uint64, len(rates)),
+		seen:  make(map[pb.Message_MessageType]*uint64, len(rates)),
+	}
+	for typ, n := range rates {
+		if n > 1 {
+			s.rates[typ] = uint64(n)
+			s.seen[typ] = new(uint64)
+		}
+	}
+	if len(s.rates) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Weight returns how many messages the next message of type typ stands for in
+// the metrics, 0 if it isn't recorded.
+func (s *MessageSampler) Weight(typ pb.Message_MessageType) int {
+	if s == nil {
+		return 1
+	}
+	n, ok := s.rates[typ]
+	if !ok {
+		return 1
+	}
+	if atomic.AddUint64(s.seen[typ], 1)%n != 0 {
+		return 0
+	}
+	return int(n)
+}
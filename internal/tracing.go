@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/trace"
+)
+
+// StartMessageSpan starts a span for a message of the given type and size,
+// exchanged with p, using the given sampler. Without a sampler no span is
+// started and ctx is returned unchanged along with a nil span, which is safe to
+// pass to EndMessageSpan.
+func StartMessageSpan(ctx context.Context, sampler trace.Sampler, name string, kind int, p peer.ID, msgType string, size int) (context.Context, *trace.Span) {
+	if sampler == nil {
+		return ctx, nil
+	}
+	ctx, span := trace.StartSpan(ctx, name, trace.WithSampler(sampler), trace.WithSpanKind(kind))
+	span.AddAttributes(
+		trace.StringAttribute("peer", p.Pretty()),
+		trace.StringAttribute("message_type", msgType),
+		trace.Int64Attribute("message_size", int64(size)),
+	)
+	return ctx, span
+}
+
+// EndMessageSpan records the outcome of a span started with StartMessageSpan
+// and ends it.
+func EndMessageSpan(span *trace.Span, latency time.Duration, err error) {
+	if span == nil {
+		return
+	}
+	span.AddAttributes(trace.Float64Attribute("latency_ms", float64(latency)/float64(time.Millisecond)))
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
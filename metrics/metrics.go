@@ -19,6 +19,21 @@ var (
 	// KeyInstanceID identifies a dht instance by the pointer address.
 	// Useful for differentiating between different dhts that have the same peer id.
 	KeyInstanceID, _ = tag.NewKey("instance_id")
+	// KeyProtocol identifies the DHT protocol a peer speaks.
+	KeyProtocol, _ = tag.NewKey("protocol")
+	// KeyErrorClass classifies an error as "cancelled", "reset" or "other".
+	KeyErrorClass, _ = tag.NewKey("error_class")
+	// KeyStreamSource tells whether an outbound stream was "pooled" or "dialed".
+	KeyStreamSource, _ = tag.NewKey("stream_source")
+	// KeyPeerClass tells whether a peer is in the "routing_table" or "unknown".
+	KeyPeerClass, _ = tag.NewKey("peer_class")
+	// KeyResetReason tells why a stream was reset, e.g. "read-error" or
+	// "shutdown".
+	KeyResetReason, _ = tag.NewKey("reset_reason")
+	// KeyMessageTypeValue is the numeric value of a message type we don't
+	// know of, or "other" for large values, so that peers can't blow up the
+	// number of tag values.
+	KeyMessageTypeValue, _ = tag.NewKey("message_type_value")
 )
 
 // UpsertMessageType is a convenience upserts the message type
@@ -32,21 +47,56 @@ var (
 	ReceivedMessages       = stats.Int64("libp2p.io/dht/kad/received_messages", "Total number of messages received per RPC", stats.UnitDimensionless)
 	ReceivedMessageErrors  = stats.Int64("libp2p.io/dht/kad/received_message_errors", "Total number of errors for messages received per RPC", stats.UnitDimensionless)
 	ReceivedBytes          = stats.Int64("libp2p.io/dht/kad/received_bytes", "Total received bytes per RPC", stats.UnitBytes)
+	ReceivedOneWayMessages = stats.Int64("libp2p.io/dht/kad/received_oneway_messages", "Total number of received messages that were not answered with a response per RPC", stats.UnitDimensionless)
 	InboundRequestLatency  = stats.Float64("libp2p.io/dht/kad/inbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
 	OutboundRequestLatency = stats.Float64("libp2p.io/dht/kad/outbound_request_latency", "Latency per RPC", stats.UnitMilliseconds)
+	ReplyWait              = stats.Float64("libp2p.io/dht/kad/reply_wait", "Time spent waiting for the reply to an outbound request once it was written, per RPC", stats.UnitMilliseconds)
+	HandlerExecution       = stats.Float64("libp2p.io/dht/kad/handler_execution", "Time spent in the handler of an inbound request, without writing the response, per RPC", stats.UnitMilliseconds)
 	SentMessages           = stats.Int64("libp2p.io/dht/kad/sent_messages", "Total number of messages sent per RPC", stats.UnitDimensionless)
 	SentMessageErrors      = stats.Int64("libp2p.io/dht/kad/sent_message_errors", "Total number of errors for messages sent per RPC", stats.UnitDimensionless)
 	SentRequests           = stats.Int64("libp2p.io/dht/kad/sent_requests", "Total number of requests sent per RPC", stats.UnitDimensionless)
 	SentRequestErrors      = stats.Int64("libp2p.io/dht/kad/sent_request_errors", "Total number of errors for requests sent per RPC", stats.UnitDimensionless)
 	SentBytes              = stats.Int64("libp2p.io/dht/kad/sent_bytes", "Total sent bytes per RPC", stats.UnitBytes)
+	InboundStreamsRejected = stats.Int64("libp2p.io/dht/kad/inbound_streams_rejected", "Total number of inbound streams rejected because of the stream limits", stats.UnitDimensionless)
+	InboundStreamsGated    = stats.Int64("libp2p.io/dht/kad/inbound_streams_gated", "Total number of inbound streams reset because the connection gater blocks the peer", stats.UnitDimensionless)
+	InboundSelfStreams     = stats.Int64("libp2p.io/dht/kad/inbound_self_streams", "Total number of inbound streams reset because they came from the local peer", stats.UnitDimensionless)
+	CollapsedAddProviders  = stats.Int64("libp2p.io/dht/kad/collapsed_add_providers", "Total number of ADD_PROVIDER messages ignored because they repeat the previous one on their stream", stats.UnitDimensionless)
+	HandlerPanics          = stats.Int64("libp2p.io/dht/kad/handler_panics", "Total number of inbound messages whose handler panicked per RPC", stats.UnitDimensionless)
+	UnknownMessageTypes    = stats.Int64("libp2p.io/dht/kad/unknown_message_types", "Total number of inbound messages refused because there is no handler for their type, per numeric type value", stats.UnitDimensionless)
+	DisabledTypeHits       = stats.Int64("libp2p.io/dht/kad/disabled_type_hits", "Total number of inbound messages refused because their type is disabled per RPC", stats.UnitDimensionless)
+	TruncatedResponses     = stats.Int64("libp2p.io/dht/kad/truncated_responses", "Total number of responses stripped of peers to fit the maximum message size per RPC", stats.UnitDimensionless)
+	SlowDownHints          = stats.Int64("libp2p.io/dht/kad/slow_down_hints", "Total number of responses asking the requester to slow down per RPC", stats.UnitDimensionless)
+	SequenceGaps           = stats.Int64("libp2p.io/dht/kad/sequence_gaps", "Total number of inbound messages whose sequence number doesn't follow the previous one on their stream per RPC", stats.UnitDimensionless)
+	StreamPoolHits         = stats.Int64("libp2p.io/dht/kad/stream_pool_hits", "Total number of outbound messages sent on a reused stream", stats.UnitDimensionless)
+	StreamPoolMisses       = stats.Int64("libp2p.io/dht/kad/stream_pool_misses", "Total number of outbound messages that required opening a new stream", stats.UnitDimensionless)
+	StreamPoolStale        = stats.Int64("libp2p.io/dht/kad/stream_pool_stale", "Total number of pooled streams discarded because their connection was closed", stats.UnitDimensionless)
+	StreamAcquireLatency   = stats.Float64("libp2p.io/dht/kad/stream_acquire_latency", "Time spent getting a stream to send an outbound message on, from the pool or by dialing", stats.UnitMilliseconds)
+	StreamPoolSize         = stats.Int64("libp2p.io/dht/kad/stream_pool_size", "Number of peers with a pooled outbound stream", stats.UnitDimensionless)
+	StreamPoolTargetSize   = stats.Int64("libp2p.io/dht/kad/stream_pool_target_size", "Number of peers sent enough requests for the adaptive stream pool to keep their stream open", stats.UnitDimensionless)
+	OutboundStreams        = stats.Int64("libp2p.io/dht/kad/outbound_streams", "Total number of outbound streams opened per negotiated DHT protocol", stats.UnitDimensionless)
+	RoutingTablePeers      = stats.Int64("libp2p.io/dht/kad/routing_table_peers", "Number of peers in the routing table per DHT protocol", stats.UnitDimensionless)
+	ResponseWriteErrors    = stats.Int64("libp2p.io/dht/kad/response_write_errors", "Total number of responses that could not be written per RPC", stats.UnitDimensionless)
+	ResponseWriteTimeouts  = stats.Int64("libp2p.io/dht/kad/response_write_timeouts", "Total number of inbound streams reset because writing responses took too long", stats.UnitDimensionless)
+	CompressedBytes        = stats.Int64("libp2p.io/dht/kad/compressed_bytes", "Total size of the compressed messages sent and received, after compression", stats.UnitBytes)
+	UncompressedBytes      = stats.Int64("libp2p.io/dht/kad/uncompressed_bytes", "Total size of the compressed messages sent and received, before compression", stats.UnitBytes)
+	InboundRateLimited     = stats.Int64("libp2p.io/dht/kad/inbound_rate_limited", "Total number of received messages delayed or dropped because of the inbound rate limit per RPC", stats.UnitDimensionless)
+	CorruptMessages        = stats.Int64("libp2p.io/dht/kad/corrupt_messages", "Total number of received messages dropped because their checksum didn't match", stats.UnitDimensionless)
+	OutstandingResponses   = stats.Int64("libp2p.io/dht/kad/outstanding_responses", "Highest number of responses outstanding at once on an inbound stream, recorded once per stream", stats.UnitDimensionless)
+	PrunedProviderRecords  = stats.Int64("libp2p.io/dht/kad/pruned_provider_records", "Total number of expired provider records pruned on demand", stats.UnitDimensionless)
+	StreamResets           = stats.Int64("libp2p.io/dht/kad/stream_resets", "Total number of DHT streams reset locally per reason", stats.UnitDimensionless)
+	BufferedResponseBytes  = stats.Int64("libp2p.io/dht/kad/buffered_response_bytes", "Number of response bytes written but not flushed yet across inbound streams", stats.UnitBytes)
+	MismatchedReplies      = stats.Int64("libp2p.io/dht/kad/mismatched_replies", "Total number of replies of another type than their request per RPC", stats.UnitDimensionless)
+	TokenChallenges        = stats.Int64("libp2p.io/dht/kad/token_challenges", "Total number of responses withheld because the request lacked a valid token per RPC", stats.UnitDimensionless)
 )
 
 // Views
 var (
+	// The message counts are summed, for a sampled message to be recorded once
+	// with the number of messages it stands for.
 	ReceivedMessagesView = &view.View{
 		Measure:     ReceivedMessages,
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
-		Aggregation: view.Count(),
+		Aggregation: view.Sum(),
 	}
 	ReceivedMessageErrorsView = &view.View{
 		Measure:     ReceivedMessageErrors,
@@ -55,9 +105,14 @@ var (
 	}
 	ReceivedBytesView = &view.View{
 		Measure:     ReceivedBytes,
-		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerClass, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	}
+	ReceivedOneWayMessagesView = &view.View{
+		Measure:     ReceivedOneWayMessages,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
 	InboundRequestLatencyView = &view.View{
 		Measure:     InboundRequestLatency,
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
@@ -68,10 +123,20 @@ var (
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultMillisecondsDistribution,
 	}
+	ReplyWaitView = &view.View{
+		Measure:     ReplyWait,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	HandlerExecutionView = &view.View{
+		Measure:     HandlerExecution,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
 	SentMessagesView = &view.View{
 		Measure:     SentMessages,
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
-		Aggregation: view.Count(),
+		Aggregation: view.Sum(),
 	}
 	SentMessageErrorsView = &view.View{
 		Measure:     SentMessageErrors,
@@ -81,7 +146,7 @@ var (
 	SentRequestsView = &view.View{
 		Measure:     SentRequests,
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
-		Aggregation: view.Count(),
+		Aggregation: view.Sum(),
 	}
 	SentRequestErrorsView = &view.View{
 		Measure:     SentRequestErrors,
@@ -93,6 +158,156 @@ var (
 		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
 		Aggregation: defaultBytesDistribution,
 	}
+	InboundStreamsRejectedView = &view.View{
+		Measure:     InboundStreamsRejected,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	InboundStreamsGatedView = &view.View{
+		Measure:     InboundStreamsGated,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	InboundSelfStreamsView = &view.View{
+		Measure:     InboundSelfStreams,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	CollapsedAddProvidersView = &view.View{
+		Measure:     CollapsedAddProviders,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	HandlerPanicsView = &view.View{
+		Measure:     HandlerPanics,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	UnknownMessageTypesView = &view.View{
+		Measure:     UnknownMessageTypes,
+		TagKeys:     []tag.Key{KeyMessageTypeValue, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	DisabledTypeHitsView = &view.View{
+		Measure:     DisabledTypeHits,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	TruncatedResponsesView = &view.View{
+		Measure:     TruncatedResponses,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	SlowDownHintsView = &view.View{
+		Measure:     SlowDownHints,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	SequenceGapsView = &view.View{
+		Measure:     SequenceGaps,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	StreamPoolHitsView = &view.View{
+		Measure:     StreamPoolHits,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	StreamPoolMissesView = &view.View{
+		Measure:     StreamPoolMisses,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	StreamPoolStaleView = &view.View{
+		Measure:     StreamPoolStale,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	StreamAcquireLatencyView = &view.View{
+		Measure:     StreamAcquireLatency,
+		TagKeys:     []tag.Key{KeyStreamSource, KeyPeerID, KeyInstanceID},
+		Aggregation: defaultMillisecondsDistribution,
+	}
+	StreamPoolSizeView = &view.View{
+		Measure:     StreamPoolSize,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	StreamPoolTargetSizeView = &view.View{
+		Measure:     StreamPoolTargetSize,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	OutboundStreamsView = &view.View{
+		Measure:     OutboundStreams,
+		TagKeys:     []tag.Key{KeyProtocol, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	RoutingTablePeersView = &view.View{
+		Measure:     RoutingTablePeers,
+		TagKeys:     []tag.Key{KeyProtocol, KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	ResponseWriteErrorsView = &view.View{
+		Measure:     ResponseWriteErrors,
+		TagKeys:     []tag.Key{KeyMessageType, KeyErrorClass, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	ResponseWriteTimeoutsView = &view.View{
+		Measure:     ResponseWriteTimeouts,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	CompressedBytesView = &view.View{
+		Measure:     CompressedBytes,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Sum(),
+	}
+	UncompressedBytesView = &view.View{
+		Measure:     UncompressedBytes,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Sum(),
+	}
+	InboundRateLimitedView = &view.View{
+		Measure:     InboundRateLimited,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	CorruptMessagesView = &view.View{
+		Measure:     CorruptMessages,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	OutstandingResponsesView = &view.View{
+		Measure:     OutstandingResponses,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Distribution(1, 2, 4, 8, 16, 32, 64, 128, 256, 512),
+	}
+	PrunedProviderRecordsView = &view.View{
+		Measure:     PrunedProviderRecords,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.Sum(),
+	}
+	StreamResetsView = &view.View{
+		Measure:     StreamResets,
+		TagKeys:     []tag.Key{KeyResetReason, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	BufferedResponseBytesView = &view.View{
+		Measure:     BufferedResponseBytes,
+		TagKeys:     []tag.Key{KeyPeerID, KeyInstanceID},
+		Aggregation: view.LastValue(),
+	}
+	MismatchedRepliesView = &view.View{
+		Measure:     MismatchedReplies,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
+	TokenChallengesView = &view.View{
+		Measure:     TokenChallenges,
+		TagKeys:     []tag.Key{KeyMessageType, KeyPeerID, KeyInstanceID},
+		Aggregation: view.Count(),
+	}
 )
 
 // DefaultViews with all views in it.
@@ -100,11 +315,44 @@ var DefaultViews = []*view.View{
 	ReceivedMessagesView,
 	ReceivedMessageErrorsView,
 	ReceivedBytesView,
+	ReceivedOneWayMessagesView,
 	InboundRequestLatencyView,
 	OutboundRequestLatencyView,
+	ReplyWaitView,
+	HandlerExecutionView,
 	SentMessagesView,
 	SentMessageErrorsView,
 	SentRequestsView,
 	SentRequestErrorsView,
 	SentBytesView,
+	InboundStreamsRejectedView,
+	InboundStreamsGatedView,
+	InboundSelfStreamsView,
+	CollapsedAddProvidersView,
+	HandlerPanicsView,
+	UnknownMessageTypesView,
+	DisabledTypeHitsView,
+	TruncatedResponsesView,
+	SlowDownHintsView,
+	SequenceGapsView,
+	StreamPoolHitsView,
+	StreamPoolMissesView,
+	StreamPoolStaleView,
+	StreamAcquireLatencyView,
+	StreamPoolSizeView,
+	StreamPoolTargetSizeView,
+	OutboundStreamsView,
+	RoutingTablePeersView,
+	ResponseWriteErrorsView,
+	ResponseWriteTimeoutsView,
+	CompressedBytesView,
+	UncompressedBytesView,
+	InboundRateLimitedView,
+	CorruptMessagesView,
+	OutstandingResponsesView,
+	PrunedProviderRecordsView,
+	StreamResetsView,
+	BufferedResponseBytesView,
+	MismatchedRepliesView,
+	TokenChallengesView,
 }
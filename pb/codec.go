@@ -0,0 +1,22 @@
+package dht_pb
+
+// MessageCodec encodes the messages exchanged over DHT streams, e.g. to feed a fuzzer or to debug the traffic as JSON.
+// Every message travels in a frame of its own, prefixed with its length, so a codec only decides how a message is laid
+// out within its frame. Both ends of a stream must use the same codec.
+type MessageCodec interface {
+	// Marshal returns the encoding of mes, written out as the payload of a frame.
+	Marshal(mes *Message) ([]byte, error)
+	// Unmarshal decodes the payload of a frame read off a stream into mes, which is empty.
+	Unmarshal(data []byte, mes *Message) error
+}
+
+// ProtobufCodec is the MessageCodec the DHT uses unless told otherwise, encoding messages as protobuf.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(mes *Message) ([]byte, error) {
+	return mes.Marshal()
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, mes *Message) error {
+	return mes.Unmarshal(data)
+}
@@ -4,6 +4,7 @@
 package dht_pb
 
 import (
+	encoding_binary "encoding/binary"
 	fmt "fmt"
 	_ "github.com/gogo/protobuf/gogoproto"
 	proto "github.com/gogo/protobuf/proto"
@@ -114,10 +115,31 @@ type Message struct {
 	CloserPeers []Message_Peer `protobuf:"bytes,8,rep,name=closerPeers,proto3" json:"closerPeers"`
 	// Used to return Providers
 	// GET_VALUE, ADD_PROVIDER, GET_PROVIDERS
-	ProviderPeers        []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
-	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
-	XXX_unrecognized     []byte         `json:"-"`
-	XXX_sizecache        int32          `json:"-"`
+	ProviderPeers []Message_Peer `protobuf:"bytes,9,rep,name=providerPeers,proto3" json:"providerPeers"`
+	// Used to match a response to its request. Responders echo the id of the
+	// request they're answering. A zero id means replies are matched by order.
+	RequestId uint64 `protobuf:"varint,11,opt,name=requestId,proto3" json:"requestId,omitempty"`
+	// CRC32 (IEEE) of the message encoded without its checksum. Only set on
+	// streams whose protocol was negotiated with checksums.
+	Checksum uint32 `protobuf:"fixed32,12,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	// Set in responses by peers under load, asking the requester to back off
+	// before sending further requests.
+	SlowDown bool `protobuf:"varint,13,opt,name=slowDown,proto3" json:"slowDown,omitempty"`
+	// Set in FIND_NODE requests to have the closer peers streamed in messages
+	// of at most this many peers, see the DHT's handling of FIND_NODE.
+	BatchSize uint32 `protobuf:"varint,14,opt,name=batchSize,proto3" json:"batchSize,omitempty"`
+	// Set in PING requests that only check the requester's liveness, which
+	// the handling peer then doesn't count as a query for its routing table.
+	Probe bool `protobuf:"varint,15,opt,name=probe,proto3" json:"probe,omitempty"`
+	// Position of the message among those sent on its stream, starting at 1,
+	// for spotting lost or reordered messages. Only set when debugging.
+	Sequence uint64 `protobuf:"varint,16,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// Set in responses withheld until the requester proves it receives what's
+	// sent to it, see the DHT's response tokens. Echoed in the repeated request.
+	Token                []byte   `protobuf:"bytes,17,opt,name=token,proto3" json:"token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *Message) Reset()         { *m = Message{} }
@@ -195,6 +217,55 @@ func (m *Message) GetProviderPeers() []Message_Peer {
 	return nil
 }
 
+func (m *Message) GetRequestId() uint64 {
+	if m != nil {
+		return m.RequestId
+	}
+	return 0
+}
+
+func (m *Message) GetChecksum() uint32 {
+	if m != nil {
+		return m.Checksum
+	}
+	return 0
+}
+
+func (m *Message) GetSlowDown() bool {
+	if m != nil {
+		return m.SlowDown
+	}
+	return false
+}
+
+func (m *Message) GetBatchSize() uint32 {
+	if m != nil {
+		return m.BatchSize
+	}
+	return 0
+}
+
+func (m *Message) GetProbe() bool {
+	if m != nil {
+		return m.Probe
+	}
+	return false
+}
+
+func (m *Message) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *Message) GetToken() []byte {
+	if m != nil {
+		return m.Token
+	}
+	return nil
+}
+
 type Message_Peer struct {
 	// ID of a given peer.
 	Id byteString `protobuf:"bytes,1,opt,name=id,proto3,customtype=byteString" json:"id"`
@@ -264,37 +335,43 @@ func init() {
 func init() { proto.RegisterFile("dht.proto", fileDescriptor_616a434b24c97ff4) }
 
 var fileDescriptor_616a434b24c97ff4 = []byte{
-	// 469 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x92, 0xb1, 0x6f, 0x9b, 0x40,
-	0x18, 0xc5, 0x73, 0x80, 0xdd, 0xf8, 0x03, 0x3b, 0xe4, 0x94, 0x01, 0xb9, 0x92, 0x83, 0x3c, 0xd1,
-	0xc1, 0x20, 0xd1, 0xb5, 0xaa, 0x6a, 0x03, 0x8d, 0x2c, 0xa5, 0xd8, 0xba, 0x38, 0xe9, 0x68, 0x19,
-	0xb8, 0x12, 0x54, 0xd7, 0x87, 0x00, 0xa7, 0xf2, 0xd6, 0x3f, 0x2f, 0x63, 0xe7, 0x0e, 0x51, 0xe5,
-	0xa9, 0x7f, 0x46, 0xc5, 0x11, 0x5a, 0xec, 0x25, 0x13, 0xef, 0x7d, 0xf7, 0x7e, 0xe2, 0xdd, 0xa7,
-	0x83, 0x4e, 0x74, 0x5f, 0x98, 0x69, 0xc6, 0x0a, 0x86, 0xdb, 0x5c, 0x06, 0x7d, 0x3b, 0x4e, 0x8a,
-	0xfb, 0x6d, 0x60, 0x86, 0xec, 0x9b, 0xb5, 0x4e, 0x82, 0xd4, 0x4e, 0xad, 0x98, 0x8d, 0x2a, 0x35,
-	0xca, 0x68, 0xc8, 0xb2, 0xc8, 0x4a, 0x03, 0xab, 0x52, 0x15, 0xdb, 0x1f, 0x35, 0x98, 0x98, 0xc5,
-	0xcc, 0xe2, 0xe3, 0x60, 0xfb, 0x85, 0x3b, 0x6e, 0xb8, 0xaa, 0xe2, 0xc3, 0x3f, 0x12, 0xbc, 0xfa,
-	0x44, 0xf3, 0x7c, 0x15, 0x53, 0x6c, 0x81, 0x54, 0xec, 0x52, 0xaa, 0x21, 0x1d, 0x19, 0x3d, 0xfb,
-	0xb5, 0x59, 0xb5, 0x30, 0x9f, 0x8f, 0xeb, 0xef, 0x62, 0x97, 0x52, 0xc2, 0x83, 0xd8, 0x80, 0xb3,
-	0x70, 0xbd, 0xcd, 0x0b, 0x9a, 0x5d, 0xd3, 0x07, 0xba, 0x26, 0xab, 0xef, 0x1a, 0xe8, 0xc8, 0x68,
-	0x91, 0xe3, 0x31, 0x56, 0x41, 0xfc, 0x4a, 0x77, 0x9a, 0xa0, 0x23, 0x43, 0x21, 0xa5, 0xc4, 0x6f,
-	0xa0, 0x5d, 0xf5, 0xd6, 0x44, 0x1d, 0x19, 0xb2, 0x7d, 0x6e, 0xd6, 0xd7, 0x08, 0x4c, 0xc2, 0x15,
-	0x79, 0x0e, 0xe0, 0x77, 0x20, 0x87, 0x6b, 0x96, 0xd3, 0x6c, 0x4e, 0x69, 0x96, 0x6b, 0xa7, 0xba,
-	0x68, 0xc8, 0xf6, 0xc5, 0x71, 0xbd, 0xf2, 0x70, 0x22, 0x3d, 0x3e, 0x5d, 0x9e, 0x90, 0x66, 0x1c,
-	0x7f, 0x80, 0x6e, 0x9a, 0xb1, 0x87, 0x24, 0xaa, 0xf9, 0xce, 0x8b, 0xfc, 0x21, 0xd0, 0xff, 0x81,
-	0x40, 0x2a, 0x15, 0x1e, 0x82, 0x90, 0x44, 0x7c, 0x3d, 0xca, 0x04, 0x97, 0xc9, 0x5f, 0x4f, 0x97,
-	0x10, 0xec, 0x0a, 0x7a, 0x53, 0x64, 0xc9, 0x26, 0x26, 0x42, 0x12, 0xe1, 0x0b, 0x68, 0xad, 0xa2,
-	0x28, 0xcb, 0x35, 0x41, 0x17, 0x0d, 0x85, 0x54, 0x06, 0xbf, 0x07, 0x08, 0xd9, 0x66, 0x43, 0xc3,
-	0x22, 0x61, 0x1b, 0x7e, 0xe3, 0x9e, 0x3d, 0x38, 0x6e, 0xe0, 0xfc, 0x4b, 0xf0, 0x1d, 0x37, 0x88,
-	0x61, 0x02, 0x72, 0x63, 0xfd, 0xb8, 0x0b, 0x9d, 0xf9, 0xed, 0x62, 0x79, 0x37, 0xbe, 0xbe, 0xf5,
-	0xd4, 0x93, 0xd2, 0x5e, 0x79, 0xb5, 0x45, 0x58, 0x05, 0x65, 0xec, 0xba, 0xcb, 0x39, 0x99, 0xdd,
-	0x4d, 0x5d, 0x8f, 0xa8, 0x02, 0x3e, 0x87, 0x6e, 0x19, 0xa8, 0x27, 0x37, 0xaa, 0x58, 0x32, 0x1f,
-	0xa7, 0xbe, 0xbb, 0xf4, 0x67, 0xae, 0xa7, 0x4a, 0xf8, 0x14, 0xa4, 0xf9, 0xd4, 0xbf, 0x52, 0x5b,
-	0xc3, 0xcf, 0xd0, 0x3b, 0x2c, 0x52, 0xd2, 0xfe, 0x6c, 0xb1, 0x74, 0x66, 0xbe, 0xef, 0x39, 0x0b,
-	0xcf, 0xad, 0xfe, 0xf8, 0xdf, 0x22, 0x7c, 0x06, 0xb2, 0x33, 0xf6, 0xeb, 0x84, 0x2a, 0x60, 0x0c,
-	0x3d, 0x67, 0xec, 0x37, 0x28, 0x55, 0x9c, 0x28, 0x8f, 0xfb, 0x01, 0xfa, 0xb9, 0x1f, 0xa0, 0xdf,
-	0xfb, 0x01, 0x0a, 0xda, 0xfc, 0xfd, 0xbd, 0xfd, 0x1b, 0x00, 0x00, 0xff, 0xff, 0x8d, 0x1a, 0xa1,
-	0xbe, 0xf7, 0x02, 0x00, 0x00,
+	// 568 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x93, 0x41, 0x6f, 0xda, 0x30,
+	0x14, 0xc7, 0x6b, 0xa0, 0x14, 0x5e, 0x80, 0xa6, 0x56, 0x0f, 0x16, 0x9b, 0x68, 0xc4, 0x29, 0x3b,
+	0x34, 0x91, 0xb2, 0xeb, 0x34, 0x8d, 0x92, 0xac, 0x42, 0xea, 0x02, 0x72, 0x69, 0x77, 0x44, 0x24,
+	0xf1, 0x42, 0x54, 0x1a, 0x67, 0x49, 0x68, 0xc5, 0x4e, 0xfb, 0x30, 0xfb, 0x30, 0x3d, 0xee, 0xbc,
+	0x43, 0x35, 0xf5, 0x93, 0x4c, 0x76, 0x1a, 0x4a, 0xb9, 0xec, 0x94, 0xf7, 0x7f, 0xfe, 0xff, 0x9e,
+	0xdf, 0xb3, 0x1d, 0x68, 0x06, 0x8b, 0xdc, 0x48, 0x52, 0x9e, 0x73, 0x5c, 0x97, 0xa1, 0xd7, 0xb5,
+	0xc2, 0x28, 0x5f, 0xac, 0x3c, 0xc3, 0xe7, 0xb7, 0xe6, 0x32, 0xf2, 0x12, 0x2b, 0x31, 0x43, 0x7e,
+	0x5a, 0x44, 0xa7, 0x29, 0xf3, 0x79, 0x1a, 0x98, 0x89, 0x67, 0x16, 0x51, 0xc1, 0x76, 0x4f, 0xb7,
+	0x98, 0x90, 0x87, 0xdc, 0x94, 0x69, 0x6f, 0xf5, 0x4d, 0x2a, 0x29, 0x64, 0x54, 0xd8, 0xfb, 0xbf,
+	0xea, 0x70, 0xf0, 0x85, 0x65, 0xd9, 0x3c, 0x64, 0xd8, 0x84, 0x5a, 0xbe, 0x4e, 0x18, 0x41, 0x1a,
+	0xd2, 0x3b, 0xd6, 0x1b, 0xa3, 0xe8, 0xc2, 0x78, 0x5e, 0x2e, 0xbf, 0xd3, 0x75, 0xc2, 0xa8, 0x34,
+	0x62, 0x1d, 0x0e, 0xfd, 0xe5, 0x2a, 0xcb, 0x59, 0x7a, 0xc1, 0xee, 0xd8, 0x92, 0xce, 0xef, 0x09,
+	0x68, 0x48, 0xdf, 0xa7, 0xbb, 0x69, 0xac, 0x42, 0xf5, 0x86, 0xad, 0x49, 0x45, 0x43, 0x7a, 0x8b,
+	0x8a, 0x10, 0xbf, 0x83, 0x7a, 0xd1, 0x37, 0xa9, 0x6a, 0x48, 0x57, 0xac, 0x23, 0xa3, 0x1c, 0xc3,
+	0x33, 0xa8, 0x8c, 0xe8, 0xb3, 0x01, 0x7f, 0x00, 0xc5, 0x5f, 0xf2, 0x8c, 0xa5, 0x13, 0xc6, 0xd2,
+	0x8c, 0x34, 0xb4, 0xaa, 0xae, 0x58, 0xc7, 0xbb, 0xed, 0x89, 0xc5, 0xb3, 0xda, 0xc3, 0xe3, 0xc9,
+	0x1e, 0xdd, 0xb6, 0xe3, 0x4f, 0xd0, 0x4e, 0x52, 0x7e, 0x17, 0x05, 0x25, 0xdf, 0xfc, 0x2f, 0xff,
+	0x1a, 0xc0, 0x6f, 0xa1, 0x99, 0xb2, 0xef, 0x2b, 0x96, 0xe5, 0xa3, 0x80, 0x28, 0x1a, 0xd2, 0x6b,
+	0xf4, 0x25, 0x81, 0xbb, 0xd0, 0xf0, 0x17, 0xcc, 0xbf, 0xc9, 0x56, 0xb7, 0xa4, 0xa5, 0x21, 0xfd,
+	0x80, 0x6e, 0xb4, 0x58, 0xcb, 0x96, 0xfc, 0xde, 0xe6, 0xf7, 0x31, 0x69, 0x6b, 0x48, 0x6f, 0xd0,
+	0x8d, 0x16, 0x55, 0xbd, 0x79, 0xee, 0x2f, 0x2e, 0xa3, 0x1f, 0x8c, 0x74, 0x34, 0xa4, 0xb7, 0xe9,
+	0x4b, 0x02, 0x1f, 0xc3, 0x7e, 0x92, 0x72, 0x8f, 0x91, 0x43, 0x89, 0x15, 0x42, 0xd6, 0x13, 0x1b,
+	0xc7, 0x3e, 0x23, 0xaa, 0x6c, 0x64, 0xa3, 0x05, 0x91, 0xf3, 0x1b, 0x16, 0x93, 0x23, 0x79, 0xc8,
+	0x85, 0xe8, 0xfe, 0x44, 0x50, 0x13, 0x53, 0xe0, 0x3e, 0x54, 0xa2, 0x40, 0x5e, 0x6d, 0xeb, 0x0c,
+	0x8b, 0x29, 0xff, 0x3c, 0x9e, 0x80, 0xb7, 0xce, 0xd9, 0x65, 0x9e, 0x46, 0x71, 0x48, 0x2b, 0x51,
+	0x20, 0x4a, 0xcc, 0x83, 0x20, 0xcd, 0x48, 0x45, 0xab, 0x8a, 0x12, 0x52, 0xe0, 0x8f, 0x00, 0x3e,
+	0x8f, 0x63, 0xe6, 0xe7, 0x11, 0x8f, 0xe5, 0x6d, 0x75, 0xac, 0xde, 0xee, 0xe9, 0x0d, 0x37, 0x0e,
+	0xf9, 0x3e, 0xb6, 0x88, 0x7e, 0x04, 0xca, 0xd6, 0xd3, 0xc1, 0x6d, 0x68, 0x4e, 0xae, 0xa6, 0xb3,
+	0xeb, 0xc1, 0xc5, 0x95, 0xa3, 0xee, 0x09, 0x79, 0xee, 0x94, 0x12, 0x61, 0x15, 0x5a, 0x03, 0xdb,
+	0x9e, 0x4d, 0xe8, 0xf8, 0x7a, 0x64, 0x3b, 0x54, 0xad, 0xe0, 0x23, 0x68, 0x0b, 0x43, 0x99, 0xb9,
+	0x54, 0xab, 0x82, 0xf9, 0x3c, 0x72, 0xed, 0x99, 0x3b, 0xb6, 0x1d, 0xb5, 0x86, 0x1b, 0x50, 0x9b,
+	0x8c, 0xdc, 0x73, 0x75, 0xbf, 0xff, 0x15, 0x3a, 0xaf, 0x1b, 0x11, 0xb4, 0x3b, 0x9e, 0xce, 0x86,
+	0x63, 0xd7, 0x75, 0x86, 0x53, 0xc7, 0x2e, 0x76, 0x7c, 0x91, 0x08, 0x1f, 0x82, 0x32, 0x1c, 0xb8,
+	0xa5, 0x43, 0xad, 0x60, 0x0c, 0x9d, 0xe1, 0xc0, 0xdd, 0xa2, 0xd4, 0xea, 0x59, 0xeb, 0xe1, 0xa9,
+	0x87, 0x7e, 0x3f, 0xf5, 0xd0, 0xdf, 0xa7, 0x1e, 0xf2, 0xea, 0xf2, 0xdf, 0x79, 0xff, 0x6f, 0x00,
+	0x55, 0x37, 0xa5, 0xf6, 0xb3, 0x03, 0x00, 0x00,
 }
 
 func (m *Message) Marshal() (dAtA []byte, err error) {
@@ -321,6 +398,58 @@ func (m *Message) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if len(m.Token) > 0 {
+		i -= len(m.Token)
+		copy(dAtA[i:], m.Token)
+		i = encodeVarintDht(dAtA, i, uint64(len(m.Token)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x8a
+	}
+	if m.Sequence != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.Sequence))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x80
+	}
+	if m.Probe {
+		i--
+		if m.Probe {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x78
+	}
+	if m.BatchSize != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.BatchSize))
+		i--
+		dAtA[i] = 0x70
+	}
+	if m.SlowDown {
+		i--
+		if m.SlowDown {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x68
+	}
+	if m.Checksum != 0 {
+		i -= 4
+		encoding_binary.LittleEndian.PutUint32(dAtA[i:], uint32(m.Checksum))
+		i--
+		dAtA[i] = 0x65
+	}
+	if m.RequestId != 0 {
+		i = encodeVarintDht(dAtA, i, uint64(m.RequestId))
+		i--
+		dAtA[i] = 0x58
+	}
 	if m.ClusterLevelRaw != 0 {
 		i = encodeVarintDht(dAtA, i, uint64(m.ClusterLevelRaw))
 		i--
@@ -475,6 +604,28 @@ func (m *Message) Size() (n int) {
 	if m.ClusterLevelRaw != 0 {
 		n += 1 + sovDht(uint64(m.ClusterLevelRaw))
 	}
+	if m.RequestId != 0 {
+		n += 1 + sovDht(uint64(m.RequestId))
+	}
+	if m.Checksum != 0 {
+		n += 5
+	}
+	if m.SlowDown {
+		n += 2
+	}
+	if m.BatchSize != 0 {
+		n += 1 + sovDht(uint64(m.BatchSize))
+	}
+	if m.Probe {
+		n += 2
+	}
+	if m.Sequence != 0 {
+		n += 2 + sovDht(uint64(m.Sequence))
+	}
+	l = len(m.Token)
+	if l > 0 {
+		n += 2 + l + sovDht(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -715,6 +866,147 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RequestId", wireType)
+			}
+			m.RequestId = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.RequestId |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 5 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Checksum", wireType)
+			}
+			m.Checksum = 0
+			if (iNdEx + 4) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Checksum = uint32(encoding_binary.LittleEndian.Uint32(dAtA[iNdEx:]))
+			iNdEx += 4
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SlowDown", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SlowDown = bool(v != 0)
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BatchSize", wireType)
+			}
+			m.BatchSize = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BatchSize |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Probe", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Probe = bool(v != 0)
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sequence", wireType)
+			}
+			m.Sequence = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Sequence |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 17:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Token", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDht
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDht
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthDht
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Token = append(m.Token[:0], dAtA[iNdEx:postIndex]...)
+			if m.Token == nil {
+				m.Token = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDht(dAtA[iNdEx:])
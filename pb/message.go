@@ -1,6 +1,8 @@
 package dht_pb
 
 import (
+	"hash/crc32"
+
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 
@@ -136,6 +138,65 @@ func (m *Message) SetClusterLevel(level int) {
 	m.ClusterLevelRaw = lvl + 1
 }
 
+// SetChecksum sets the checksum of the message to the CRC32 of its encoding
+// without a checksum. The message must not be modified afterwards.
+func (m *Message) SetChecksum() error {
+	sum, err := m.computeChecksum()
+	if err != nil {
+		return err
+	}
+	m.Checksum = sum
+	return nil
+}
+
+// VerifyChecksum reports whether the checksum of the message matches its
+// content. A message that was never given a checksum only matches if its content
+// happens to have a CRC32 of 0.
+func (m *Message) VerifyChecksum() bool {
+	sum, err := m.computeChecksum()
+	return err == nil && sum == m.GetChecksum()
+}
+
+// TruncatePeers drops closer peers, then provider peers, from the end of the
+// message until it encodes to at most maxSize bytes, and returns how many it
+// dropped. Peers are listed most relevant first, so the least relevant ones go.
+// If the message is too large even without any peers, all of them are dropped
+// and it still doesn't fit.
+func (m *Message) TruncatePeers(maxSize int) int {
+	excess := m.Size() - maxSize
+	dropped := 0
+	for excess > 0 && len(m.CloserPeers) > 0 {
+		last := len(m.CloserPeers) - 1
+		excess -= encodedPeerSize(&m.CloserPeers[last])
+		m.CloserPeers = m.CloserPeers[:last]
+		dropped++
+	}
+	for excess > 0 && len(m.ProviderPeers) > 0 {
+		last := len(m.ProviderPeers) - 1
+		excess -= encodedPeerSize(&m.ProviderPeers[last])
+		m.ProviderPeers = m.ProviderPeers[:last]
+		dropped++
+	}
+	return dropped
+}
+
+// encodedPeerSize returns the number of bytes p takes up in the encoding of a
+// message, tag and length prefix included.
+func encodedPeerSize(p *Message_Peer) int {
+	l := p.Size()
+	return 1 + sovDht(uint64(l)) + l
+}
+
+func (m *Message) computeChecksum() (uint32, error) {
+	c := *m
+	c.Checksum = 0
+	data, err := c.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
 // ConnectionType returns a Message_ConnectionType associated with the
 // network.Connectedness.
 func ConnectionType(c network.Connectedness) Message_ConnectionType {
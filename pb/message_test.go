@@ -1,6 +1,7 @@
 package dht_pb
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -13,3 +14,128 @@ func TestBadAddrsDontReturnNil(t *testing.T) {
 		t.Fatal("shouldnt have any multiaddrs")
 	}
 }
+
+func TestRequestIdRoundTrip(t *testing.T) {
+	for _, id := range []uint64{0, 1, 1 << 40} {
+		m := NewMessage(Message_FIND_NODE, []byte("key"), 0)
+		m.RequestId = id
+		buf, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out Message
+		if err := out.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if out.GetRequestId() != id || out.GetType() != Message_FIND_NODE || string(out.GetKey()) != "key" {
+			t.Fatalf("round trip mismatch: sent id %d, got %+v", id, out)
+		}
+	}
+}
+
+func TestSlowDownRoundTrip(t *testing.T) {
+	for _, slow := range []bool{false, true} {
+		m := NewMessage(Message_PING, nil, 0)
+		m.SlowDown = slow
+		buf, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != m.Size() {
+			t.Fatalf("expected %d bytes, got %d", m.Size(), len(buf))
+		}
+		var out Message
+		if err := out.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if out.GetSlowDown() != slow {
+			t.Fatalf("round trip mismatch: sent slowDown %t, got %+v", slow, out)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	m := NewMessage(Message_GET_VALUE, []byte("key"), 0)
+	m.RequestId = 7
+	if err := m.SetChecksum(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out Message
+	if err := out.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetChecksum() != m.Checksum || !out.VerifyChecksum() {
+		t.Fatalf("expected checksum %d to verify, got %d", m.Checksum, out.GetChecksum())
+	}
+
+	// Corrupt the last byte of the key.
+	i := bytes.Index(buf, []byte("key")) + 2
+	buf[i] ^= 0x01
+	var corrupted Message
+	if err := corrupted.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if corrupted.VerifyChecksum() {
+		t.Fatal("expected the checksum of a corrupted message not to verify")
+	}
+}
+
+func TestTruncatePeers(t *testing.T) {
+	peers := func(n int) []Message_Peer {
+		out := make([]Message_Peer, n)
+		for i := range out {
+			out[i] = Message_Peer{Id: byteString(bytes.Repeat([]byte{byte(i)}, 34))}
+		}
+		return out
+	}
+	m := NewMessage(Message_GET_PROVIDERS, []byte("key"), 0)
+	m.CloserPeers = peers(10)
+	m.ProviderPeers = peers(10)
+
+	if n := m.TruncatePeers(m.Size()); n != 0 {
+		t.Fatalf("expected a message that fits to be left alone, %d peers dropped", n)
+	}
+
+	full := m.Size()
+	max := full - 10*38 - 1
+	if n := m.TruncatePeers(max); n != 11 {
+		t.Fatalf("expected 11 peers to be dropped, got %d", n)
+	}
+	if m.Size() > max || len(m.CloserPeers) != 0 || len(m.ProviderPeers) != 9 {
+		t.Fatalf("expected the closer peers and one provider to be dropped, got %d bytes, %d closer and %d providers",
+			m.Size(), len(m.CloserPeers), len(m.ProviderPeers))
+	}
+	if m.ProviderPeers[8].Id[0] != 8 {
+		t.Fatal("expected the last provider to be dropped")
+	}
+
+	if n := m.TruncatePeers(0); n != 9 || m.Size() == 0 {
+		t.Fatalf("expected all peers to be dropped, leaving the rest of the message, got %d dropped", n)
+	}
+}
+
+func TestSequenceRoundTrip(t *testing.T) {
+	for _, seq := range []uint64{0, 1, 1 << 40} {
+		m := NewMessage(Message_PING, nil, 0)
+		m.Sequence = seq
+		buf, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != m.Size() {
+			t.Fatalf("expected %d bytes, got %d", m.Size(), len(buf))
+		}
+		var out Message
+		if err := out.Unmarshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if out.GetSequence() != seq {
+			t.Fatalf("round trip mismatch: sent sequence %d, got %+v", seq, out)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
@@ -20,6 +21,12 @@ import (
 
 var logger = logging.Logger("dht")
 
+// ErrNoResponse is returned when a MessageSender reports neither a response nor an error for a request.
+var ErrNoResponse = errors.New("peer did not respond")
+
+// ErrMismatchedReply is returned when a peer replies to a request with a message of another type.
+var ErrMismatchedReply = errors.New("reply type does not match request")
+
 // ProtocolMessenger can be used for sending DHT messages to peers and processing their responses.
 // This decouples the wire protocol format from both the DHT protocol implementation and from the implementation of the
 // routing.Routing interface.
@@ -27,8 +34,10 @@ var logger = logging.Logger("dht")
 // Note: the ProtocolMessenger's MessageSender still needs to deal with some wire protocol details such as using
 // varint-delineated protobufs
 type ProtocolMessenger struct {
-	m         MessageSender
-	validator record.Validator
+	m          MessageSender
+	validator  record.Validator
+	onSlowDown func(p peer.ID)
+	onMismatch func(p peer.ID, req, resp *Message)
 }
 
 type ProtocolMessengerOption func(*ProtocolMessenger) error
@@ -40,6 +49,24 @@ func WithValidator(validator record.Validator) ProtocolMessengerOption {
 	}
 }
 
+// WithSlowDownHandler registers a callback invoked on its own goroutine with every peer whose response asks the
+// requester to slow down.
+func WithSlowDownHandler(f func(p peer.ID)) ProtocolMessengerOption {
+	return func(messenger *ProtocolMessenger) error {
+		messenger.onSlowDown = f
+		return nil
+	}
+}
+
+// WithMismatchedReplyHandler registers a callback invoked with every reply whose type doesn't match the type of its
+// request, before the request fails with ErrMismatchedReply.
+func WithMismatchedReplyHandler(f func(p peer.ID, req, resp *Message)) ProtocolMessengerOption {
+	return func(messenger *ProtocolMessenger) error {
+		messenger.onMismatch = f
+		return nil
+	}
+}
+
 // NewProtocolMessenger creates a new ProtocolMessenger that is used for sending DHT messages to peers and processing
 // their responses.
 func NewProtocolMessenger(msgSender MessageSender, opts ...ProtocolMessengerOption) (*ProtocolMessenger, error) {
@@ -64,11 +91,66 @@ type MessageSender interface {
 	SendMessage(ctx context.Context, p peer.ID, pmes *Message) error
 }
 
+// MessageBatchSender is implemented by MessageSenders able to send several one-way messages to a peer at once, over a
+// single stream.
+type MessageBatchSender interface {
+	// SendMessageBatch sends a peer the messages without waiting on a response. Either all of the messages are sent
+	// or none of them is.
+	SendMessageBatch(ctx context.Context, p peer.ID, pmess []*Message) error
+}
+
+// SendMessageBatch sends a peer the messages through m, at once if m is a MessageBatchSender and one after the other
+// otherwise, stopping at the first message that can't be sent.
+func SendMessageBatch(ctx context.Context, m MessageSender, p peer.ID, pmess []*Message) error {
+	if b, ok := m.(MessageBatchSender); ok {
+		return b.SendMessageBatch(ctx, p, pmess)
+	}
+	for _, pmes := range pmess {
+		if err := m.SendMessage(ctx, p, pmes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRequest sends a request through the MessageSender and ensures a non-nil error whenever no response, or a response
+// of another type than the request, was returned. Responses asking to slow down are reported to the slow down handler.
+// Responses withheld until a token is echoed are requested again with the token.
+func (pm *ProtocolMessenger) sendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	resp, err := pm.roundTrip(ctx, p, pmes)
+	// The peer withholds its response until we echo the token it sent back, to
+	// make sure we receive what's sent to us.
+	if err == nil && len(resp.GetToken()) > 0 && len(pmes.GetToken()) == 0 {
+		req := *pmes
+		req.Token = resp.GetToken()
+		resp, err = pm.roundTrip(ctx, p, &req)
+	}
+	return resp, err
+}
+
+// roundTrip sends pmes to p once and checks the response as described in sendRequest.
+func (pm *ProtocolMessenger) roundTrip(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	resp, err := pm.m.SendRequest(ctx, p, pmes)
+	if err == nil && resp == nil {
+		return nil, ErrNoResponse
+	}
+	if err == nil && resp.GetType() != pmes.GetType() {
+		if pm.onMismatch != nil {
+			pm.onMismatch(p, pmes, resp)
+		}
+		return nil, fmt.Errorf("%w: got %s in reply to %s", ErrMismatchedReply, resp.GetType(), pmes.GetType())
+	}
+	if resp.GetSlowDown() && pm.onSlowDown != nil {
+		go pm.onSlowDown(p)
+	}
+	return resp, err
+}
+
 // PutValue asks a peer to store the given key/value pair.
 func (pm *ProtocolMessenger) PutValue(ctx context.Context, p peer.ID, rec *recpb.Record) error {
 	pmes := NewMessage(Message_PUT_VALUE, rec.Key, 0)
 	pmes.Record = rec
-	rpmes, err := pm.m.SendRequest(ctx, p, pmes)
+	rpmes, err := pm.sendRequest(ctx, p, pmes)
 	if err != nil {
 		logger.Debugw("failed to put value to peer", "to", p, "key", internal.LoggableRecordKeyBytes(rec.Key), "error", err)
 		return err
@@ -87,7 +169,7 @@ func (pm *ProtocolMessenger) PutValue(ctx context.Context, p peer.ID, rec *recpb
 // as described in GetClosestPeers.
 func (pm *ProtocolMessenger) GetValue(ctx context.Context, p peer.ID, key string) (*recpb.Record, []*peer.AddrInfo, error) {
 	pmes := NewMessage(Message_GET_VALUE, []byte(key), 0)
-	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	respMsg, err := pm.sendRequest(ctx, p, pmes)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -121,7 +203,7 @@ func (pm *ProtocolMessenger) GetValue(ctx context.Context, p peer.ID, key string
 // even if that peer is not a DHT server node.
 func (pm *ProtocolMessenger) GetClosestPeers(ctx context.Context, p peer.ID, id peer.ID) ([]*peer.AddrInfo, error) {
 	pmes := NewMessage(Message_FIND_NODE, []byte(id), 0)
-	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	respMsg, err := pm.sendRequest(ctx, p, pmes)
 	if err != nil {
 		return nil, err
 	}
@@ -131,6 +213,26 @@ func (pm *ProtocolMessenger) GetClosestPeers(ctx context.Context, p peer.ID, id
 
 // PutProvider asks a peer to store that we are a provider for the given key.
 func (pm *ProtocolMessenger) PutProvider(ctx context.Context, p peer.ID, key multihash.Multihash, host host.Host) error {
+	pmess, err := putProviderMessages([]multihash.Multihash{key}, host)
+	if err != nil {
+		return err
+	}
+	return pm.m.SendMessage(ctx, p, pmess[0])
+}
+
+// PutProviders asks a peer to store that we are a provider for every one of the given keys, sending the provider
+// records at once over a single stream if the MessageSender supports it, see MessageBatchSender. Either all of the
+// records are sent or none of them is.
+func (pm *ProtocolMessenger) PutProviders(ctx context.Context, p peer.ID, keys []multihash.Multihash, host host.Host) error {
+	pmess, err := putProviderMessages(keys, host)
+	if err != nil {
+		return err
+	}
+	return SendMessageBatch(ctx, pm.m, p, pmess)
+}
+
+// putProviderMessages returns the ADD_PROVIDER messages announcing host as a provider of keys.
+func putProviderMessages(keys []multihash.Multihash, host host.Host) ([]*Message, error) {
 	pi := peer.AddrInfo{
 		ID:    host.ID(),
 		Addrs: host.Addrs(),
@@ -139,20 +241,22 @@ func (pm *ProtocolMessenger) PutProvider(ctx context.Context, p peer.ID, key mul
 	// TODO: We may want to limit the type of addresses in our provider records
 	// For example, in a WAN-only DHT prohibit sharing non-WAN addresses (e.g. 192.168.0.100)
 	if len(pi.Addrs) < 1 {
-		return fmt.Errorf("no known addresses for self, cannot put provider")
+		return nil, fmt.Errorf("no known addresses for self, cannot put provider")
 	}
 
-	pmes := NewMessage(Message_ADD_PROVIDER, key, 0)
-	pmes.ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{pi})
-
-	return pm.m.SendMessage(ctx, p, pmes)
+	pmess := make([]*Message, len(keys))
+	for i, key := range keys {
+		pmess[i] = NewMessage(Message_ADD_PROVIDER, key, 0)
+		pmess[i].ProviderPeers = RawPeerInfosToPBPeers([]peer.AddrInfo{pi})
+	}
+	return pmess, nil
 }
 
 // GetProviders asks a peer for the providers it knows of for a given key. Also returns the K closest peers to the key
 // as described in GetClosestPeers.
 func (pm *ProtocolMessenger) GetProviders(ctx context.Context, p peer.ID, key multihash.Multihash) ([]*peer.AddrInfo, []*peer.AddrInfo, error) {
 	pmes := NewMessage(Message_GET_PROVIDERS, key, 0)
-	respMsg, err := pm.m.SendRequest(ctx, p, pmes)
+	respMsg, err := pm.sendRequest(ctx, p, pmes)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -164,7 +268,7 @@ func (pm *ProtocolMessenger) GetProviders(ctx context.Context, p peer.ID, key mu
 // Ping sends a ping message to the passed peer and waits for a response.
 func (pm *ProtocolMessenger) Ping(ctx context.Context, p peer.ID) error {
 	req := NewMessage(Message_PING, nil, 0)
-	resp, err := pm.m.SendRequest(ctx, p, req)
+	resp, err := pm.sendRequest(ctx, p, req)
 	if err != nil {
 		return fmt.Errorf("sending request: %w", err)
 	}
@@ -173,3 +277,21 @@ func (pm *ProtocolMessenger) Ping(ctx context.Context, p peer.ID) error {
 	}
 	return nil
 }
+
+// Probe sends a liveness probe to the passed peer and returns how long it took to respond. Unlike a ping, the peer
+// doesn't count a probe as a query, so it doesn't add the requester to its routing table. The round trip is recorded
+// like that of any other request, in the peer's latency metrics and, if tracked, in the peerstore.
+func (pm *ProtocolMessenger) Probe(ctx context.Context, p peer.ID) (time.Duration, error) {
+	req := NewMessage(Message_PING, nil, 0)
+	req.Probe = true
+	start := time.Now()
+	resp, err := pm.sendRequest(ctx, p, req)
+	if err != nil {
+		return 0, fmt.Errorf("sending request: %w", err)
+	}
+	rtt := time.Since(start)
+	if resp.Type != Message_PING {
+		return 0, fmt.Errorf("got unexpected response type: %v", resp.Type)
+	}
+	return rtt, nil
+}
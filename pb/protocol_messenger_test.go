@@ -0,0 +1,90 @@
+package dht_pb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/test"
+)
+
+// silentSender reports neither a response nor an error for every request.
+type silentSender struct{}
+
+func (silentSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	return nil, nil
+}
+
+func (silentSender) SendMessage(ctx context.Context, p peer.ID, pmes *Message) error {
+	return nil
+}
+
+func TestNoResponse(t *testing.T) {
+	ctx := context.Background()
+
+	pm, err := NewProtocolMessenger(silentSender{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pm.GetClosestPeers(ctx, p, p); err != ErrNoResponse {
+		t.Fatalf("GetClosestPeers: expected ErrNoResponse, got %v", err)
+	}
+	if _, _, err := pm.GetProviders(ctx, p, []byte("key")); err != ErrNoResponse {
+		t.Fatalf("GetProviders: expected ErrNoResponse, got %v", err)
+	}
+	if _, _, err := pm.GetValue(ctx, p, "key"); err != ErrNoResponse {
+		t.Fatalf("GetValue: expected ErrNoResponse, got %v", err)
+	}
+	if err := pm.Ping(ctx, p); !errors.Is(err, ErrNoResponse) {
+		t.Fatalf("Ping: expected ErrNoResponse, got %v", err)
+	}
+}
+
+// pingSender replies to every request with a PING.
+type pingSender struct{}
+
+func (pingSender) SendRequest(ctx context.Context, p peer.ID, pmes *Message) (*Message, error) {
+	return NewMessage(Message_PING, nil, 0), nil
+}
+
+func (pingSender) SendMessage(ctx context.Context, p peer.ID, pmes *Message) error {
+	return nil
+}
+
+func TestMismatchedReply(t *testing.T) {
+	ctx := context.Background()
+
+	var mismatches []Message_MessageType
+	pm, err := NewProtocolMessenger(pingSender{}, WithMismatchedReplyHandler(func(p peer.ID, req, resp *Message) {
+		if resp.GetType() != Message_PING {
+			t.Errorf("expected the PING reply, got %s", resp.GetType())
+		}
+		mismatches = append(mismatches, req.GetType())
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := test.RandPeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pm.GetClosestPeers(ctx, p, p); !errors.Is(err, ErrMismatchedReply) {
+		t.Fatalf("GetClosestPeers: expected ErrMismatchedReply, got %v", err)
+	}
+	if _, _, err := pm.GetValue(ctx, p, "key"); !errors.Is(err, ErrMismatchedReply) {
+		t.Fatalf("GetValue: expected ErrMismatchedReply, got %v", err)
+	}
+	if err := pm.Ping(ctx, p); err != nil {
+		t.Fatalf("Ping: expected the reply to match, got %v", err)
+	}
+	if len(mismatches) != 2 || mismatches[0] != Message_FIND_NODE || mismatches[1] != Message_GET_VALUE {
+		t.Fatalf("expected the FIND_NODE and GET_VALUE requests to be reported, got %v", mismatches)
+	}
+}
@@ -0,0 +1,91 @@
+package dht_pb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// ErrWrongMessageType is returned when a message is viewed as a request of
+// another type.
+var ErrWrongMessageType = errors.New("wrong message type")
+
+// maxProviderKeySize is the size of the largest key provider records are
+// accepted for.
+const maxProviderKeySize = 80
+
+// GetProvidersRequest is the typed view of a GET_PROVIDERS request, see
+// Message.AsGetProviders.
+type GetProvidersRequest struct {
+	msg *Message
+
+	// Key is the key providers are asked for, it is neither empty nor
+	// oversized.
+	Key []byte
+}
+
+// AsGetProviders returns the typed view of a GET_PROVIDERS request, or an
+// error if m isn't one or its fields are invalid.
+func (m *Message) AsGetProviders() (*GetProvidersRequest, error) {
+	if err := m.checkType(Message_GET_PROVIDERS); err != nil {
+		return nil, err
+	}
+	if err := checkProviderKey(m.GetKey()); err != nil {
+		return nil, err
+	}
+	return &GetProvidersRequest{msg: m, Key: m.GetKey()}, nil
+}
+
+// Message returns the message r is a view of.
+func (r *GetProvidersRequest) Message() *Message {
+	return r.msg
+}
+
+// AddProviderRequest is the typed view of an ADD_PROVIDER request, see
+// Message.AsAddProvider.
+type AddProviderRequest struct {
+	msg *Message
+
+	// Key is the key provided, it is neither empty nor oversized.
+	Key []byte
+	// Providers are the provider records announced, as sent by the peer.
+	Providers []*peer.AddrInfo
+}
+
+// AsAddProvider returns the typed view of an ADD_PROVIDER request, or an error
+// if m isn't one or its fields are invalid.
+func (m *Message) AsAddProvider() (*AddProviderRequest, error) {
+	if err := m.checkType(Message_ADD_PROVIDER); err != nil {
+		return nil, err
+	}
+	if err := checkProviderKey(m.GetKey()); err != nil {
+		return nil, err
+	}
+	return &AddProviderRequest{
+		msg:       m,
+		Key:       m.GetKey(),
+		Providers: PBPeersToPeerInfos(m.GetProviderPeers()),
+	}, nil
+}
+
+// Message returns the message r is a view of.
+func (r *AddProviderRequest) Message() *Message {
+	return r.msg
+}
+
+func (m *Message) checkType(typ Message_MessageType) error {
+	if m.GetType() != typ {
+		return fmt.Errorf("%w: %s viewed as %s", ErrWrongMessageType, m.GetType(), typ)
+	}
+	return nil
+}
+
+func checkProviderKey(key []byte) error {
+	if len(key) > maxProviderKeySize {
+		return errors.New("provider key size too large")
+	} else if len(key) == 0 {
+		return errors.New("provider key is empty")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	"go.opencensus.io/stats"
+)
+
+// ListProviders returns the providers of c stored locally, i.e. those announced to us and ourselves if we provide c,
+// without querying the network.
+func (dht *IpfsDHT) ListProviders(c cid.Cid) []peer.ID {
+	provs := dht.ProviderManager.GetProviders(dht.ctx, c.Hash())
+	out := make([]peer.ID, len(provs))
+	copy(out, provs)
+	return out
+}
+
+// PruneExpiredProviders drops the locally stored provider records that are past their validity right away, instead of
+// waiting for the periodic cleanup, and returns how many were dropped.
+func (dht *IpfsDHT) PruneExpiredProviders(ctx context.Context) (int, error) {
+	pruned, err := dht.ProviderManager.PruneExpired(ctx)
+	if pruned > 0 {
+		stats.Record(dht.ctx, metrics.PrunedProviderRecords.M(int64(pruned)))
+	}
+	return pruned, err
+}
@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -40,6 +41,7 @@ type ProviderManager struct {
 
 	newprovs chan *addProv
 	getprovs chan *getProv
+	prunes   chan *pruneProvs
 	proc     goprocess.Process
 
 	cleanupInterval time.Duration
@@ -85,11 +87,18 @@ type getProv struct {
 	resp chan []peer.ID
 }
 
+type pruneProvs struct {
+	pruned int
+	err    error
+	done   chan struct{}
+}
+
 // NewProviderManager constructor
 func NewProviderManager(ctx context.Context, local peer.ID, dstore ds.Batching, opts ...Option) (*ProviderManager, error) {
 	pm := new(ProviderManager)
 	pm.getprovs = make(chan *getProv)
 	pm.newprovs = make(chan *addProv)
+	pm.prunes = make(chan *pruneProvs)
 	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
 	cache, err := lru.NewLRU(lruCacheSize, nil)
 	if err != nil {
@@ -117,6 +126,13 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 		gcSkip     map[string]struct{}
 		gcTime     time.Time
 		gcTimer    = time.NewTimer(pm.cleanupInterval)
+
+		// PruneExpired calls waiting for the GC round under way, with what
+		// it pruned so far, and the calls waiting for the next round.
+		gcPrunes   []*pruneProvs
+		gcPruned   int
+		gcErr      error
+		nextPrunes []*pruneProvs
 	)
 
 	defer func() {
@@ -128,8 +144,48 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 		if err := pm.dstore.Flush(); err != nil {
 			log.Error("failed to flush datastore: ", err)
 		}
+		for _, pp := range append(gcPrunes, nextPrunes...) {
+			pp.err = errors.New("provider manager closed")
+			close(pp.done)
+		}
 	}()
 
+	startGC := func(now time.Time) error {
+		// You know the wonderful thing about caches? You can
+		// drop them.
+		//
+		// Much faster than GCing.
+		pm.cache.Purge()
+
+		// Now, kick off a GC of the datastore.
+		q, err := pm.dstore.Query(dsq.Query{
+			Prefix: ProvidersKeyPrefix,
+		})
+		if err != nil {
+			return err
+		}
+		gcTime = now
+		gcQuery = q
+		gcQueryRes = q.Next()
+		gcSkip = make(map[string]struct{})
+		return nil
+	}
+	// finishPrunes reports the outcome of the GC round to the PruneExpired
+	// calls waiting for it.
+	finishPrunes := func(err error) {
+		if err == nil {
+			err = gcErr
+		}
+		if err == nil && len(gcPrunes) > 0 {
+			err = pm.dstore.Flush()
+		}
+		for _, pp := range gcPrunes {
+			pp.pruned, pp.err = gcPruned, err
+			close(pp.done)
+		}
+		gcPrunes, gcPruned, gcErr = nil, 0, nil
+	}
+
 	for {
 		select {
 		case np := <-pm.newprovs:
@@ -151,21 +207,50 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 
 			// set the cap so the user can't append to this.
 			gp.resp <- provs[0:len(provs):len(provs)]
+		case pp := <-pm.prunes:
+			// Pruning is a GC round started right away. Records may
+			// expire once a round started, so a round under way only
+			// serves the calls made before it started.
+			if gcQuery != nil {
+				nextPrunes = append(nextPrunes, pp)
+				continue
+			}
+			if !gcTimer.Stop() {
+				<-gcTimer.C
+			}
+			gcPrunes = append(gcPrunes, pp)
+			if err := startGC(time.Now()); err != nil {
+				finishPrunes(err)
+				gcTimer.Reset(pm.cleanupInterval)
+			}
 		case res, ok := <-gcQueryRes:
 			if !ok {
 				if err := gcQuery.Close(); err != nil {
 					log.Error("failed to close provider GC query: ", err)
 				}
-				gcTimer.Reset(pm.cleanupInterval)
+				finishPrunes(nil)
 
 				// cleanup GC round
 				gcQueryRes = nil
 				gcSkip = nil
 				gcQuery = nil
+
+				if len(nextPrunes) == 0 {
+					gcTimer.Reset(pm.cleanupInterval)
+					continue
+				}
+				gcPrunes, nextPrunes = nextPrunes, nil
+				if err := startGC(time.Now()); err != nil {
+					finishPrunes(err)
+					gcTimer.Reset(pm.cleanupInterval)
+				}
 				continue
 			}
 			if res.Error != nil {
 				log.Error("got error from GC query: ", res.Error)
+				if gcErr == nil {
+					gcErr = res.Error
+				}
 				continue
 			}
 			if _, ok := gcSkip[res.Key]; ok {
@@ -186,27 +271,19 @@ func (pm *ProviderManager) run(proc goprocess.Process) {
 				err = pm.dstore.Delete(ds.RawKey(res.Key))
 				if err != nil && err != ds.ErrNotFound {
 					log.Error("failed to remove provider record from disk: ", err)
+					if gcErr == nil {
+						gcErr = err
+					}
+					continue
 				}
+				gcPruned++
 			}
 
 		case gcTime = <-gcTimer.C:
-			// You know the wonderful thing about caches? You can
-			// drop them.
-			//
-			// Much faster than GCing.
-			pm.cache.Purge()
-
-			// Now, kick off a GC of the datastore.
-			q, err := pm.dstore.Query(dsq.Query{
-				Prefix: ProvidersKeyPrefix,
-			})
-			if err != nil {
+			if err := startGC(gcTime); err != nil {
 				log.Error("provider record GC query failed: ", err)
-				continue
+				gcTimer.Reset(pm.cleanupInterval)
 			}
-			gcQuery = q
-			gcQueryRes = q.Next()
-			gcSkip = make(map[string]struct{})
 		case <-proc.Closing():
 			return
 		}
@@ -225,6 +302,25 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, val peer.I
 	}
 }
 
+// PruneExpired drops the provider records past ProvideValidity right away,
+// rather than waiting for the next GC run, and returns how many were dropped.
+// It runs a GC round, which goes through the records one at a time in between
+// serving other calls, or waits for the next one if a round is under way.
+func (pm *ProviderManager) PruneExpired(ctx context.Context) (int, error) {
+	pp := &pruneProvs{done: make(chan struct{})}
+	select {
+	case pm.prunes <- pp:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case <-pp.done:
+		return pp.pruned, pp.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 // addProv updates the cache if needed
 func (pm *ProviderManager) addProv(k []byte, p peer.ID) error {
 	now := time.Now()
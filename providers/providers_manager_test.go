@@ -219,6 +219,142 @@ func TestProvidesExpire(t *testing.T) {
 	}
 }
 
+func TestPruneExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	p, err := NewProviderManager(ctx, peer.ID("testing"), dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Process().Close()
+
+	expired := u.Hash([]byte("expired"))
+	live := u.Hash([]byte("live"))
+	past := time.Now().Add(-2 * ProvideValidity)
+	for _, prov := range []peer.ID{"a", "b"} {
+		if err := writeProviderEntry(dstore, expired, prov, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeProviderEntry(dstore, live, "a", past); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeProviderEntry(dstore, live, "b", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	p.AddProvider(ctx, live, "c")
+
+	pruned, err := p.PruneExpired(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Fatalf("expected 3 expired records to be pruned, got %d", pruned)
+	}
+
+	res, err := dstore.Query(dsq.Query{Prefix: ProvidersKeyPrefix, KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	left := make(map[string]bool)
+	for _, e := range rest {
+		left[e.Key] = true
+	}
+	if len(left) != 2 || !left[mkProvKeyFor(live, "b")] || !left[mkProvKeyFor(live, "c")] {
+		t.Fatalf("expected only the live records to be left, got %v", left)
+	}
+
+	if pruned, err := p.PruneExpired(ctx); err != nil || pruned != 0 {
+		t.Fatalf("expected nothing left to prune, got %d (%v)", pruned, err)
+	}
+}
+
+// gatedDatastore holds up every result of the queries for all provider records
+// until its gate is opened.
+type gatedDatastore struct {
+	ds.Batching
+	gate chan struct{}
+}
+
+func (d *gatedDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	res, err := d.Batching.Query(q)
+	if err != nil || q.Prefix != ProvidersKeyPrefix {
+		return res, err
+	}
+	return dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			<-d.gate
+			return res.NextSync()
+		},
+		Close: res.Close,
+	}), nil
+}
+
+func TestPruneExpiredKeepsServing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dstore := &gatedDatastore{Batching: dssync.MutexWrap(ds.NewMapDatastore()), gate: make(chan struct{})}
+	p, err := NewProviderManager(ctx, peer.ID("testing"), dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Process().Close()
+
+	expired := u.Hash([]byte("expired"))
+	if err := writeProviderEntry(dstore, expired, "a", time.Now().Add(-2*ProvideValidity)); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		pruned int
+		err    error
+	}
+	done := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			pruned, err := p.PruneExpired(ctx)
+			done <- result{pruned, err}
+		}()
+	}
+
+	// Providers are still added and served while the records are gone through.
+	live := u.Hash([]byte("live"))
+	p.AddProvider(ctx, live, "b")
+	getCtx, getCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer getCancel()
+	if provs := p.GetProviders(getCtx, live); len(provs) != 1 || provs[0] != "b" {
+		t.Fatalf("expected to be served the live provider during the prune, got %v", provs)
+	}
+	select {
+	case r := <-done:
+		t.Fatalf("expected the prune to wait for the records, got %v", r)
+	default:
+	}
+
+	close(dstore.gate)
+	total := 0
+	for i := 0; i < 2; i++ {
+		r := <-done
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		total += r.pruned
+	}
+	if total != 1 {
+		t.Fatalf("expected the expired record to be pruned once, got %d", total)
+	}
+	if provs := p.GetProviders(ctx, expired); len(provs) != 0 {
+		t.Fatalf("expected the expired record to be gone, got %v", provs)
+	}
+}
+
 var _ = ioutil.NopCloser
 var _ = os.DevNull
 
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
@@ -58,6 +59,9 @@ type query struct {
 
 	// stopFn is used to determine if we should stop the WHOLE disjoint query.
 	stopFn stopFn
+
+	// requests holds the queries to peers in flight, given up on once the query terminates.
+	requests *requestSet
 }
 
 type lookupWithFollowupResult struct {
@@ -106,6 +110,7 @@ func (dht *IpfsDHT) runLookupWithFollowup(ctx context.Context, target string, qu
 
 	doneCh := make(chan struct{}, len(queryPeers))
 	followUpCtx, cancelFollowUp := context.WithCancel(ctx)
+	followUpCtx, followUps := withRequestSet(followUpCtx)
 	defer cancelFollowUp()
 	for _, p := range queryPeers {
 		qp := p
@@ -123,6 +128,7 @@ processFollowUp:
 		case <-doneCh:
 			followupsCompleted++
 			if stopFn() {
+				followUps.cancel()
 				cancelFollowUp()
 				if i < len(queryPeers)-1 {
 					lookupRes.completed = false
@@ -261,6 +267,10 @@ type queryUpdate struct {
 func (q *query) run() {
 	pathCtx, cancelPath := context.WithCancel(q.ctx)
 	defer cancelPath()
+	pathCtx, q.requests = withRequestSet(pathCtx)
+
+	// the seed peers are queried first: get their streams ready while the first requests go out.
+	q.dht.warmStreams(pathCtx, q.seedPeers)
 
 	alpha := q.dht.alpha
 
@@ -340,6 +350,12 @@ func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool
 	// The peers we query next should be ones that we have only Heard about.
 	var peersToQuery []peer.ID
 	peers := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
+	if q.dht.latencyAwareRouting {
+		if len(peers) > 2*nPeersToQuery {
+			peers = peers[:2*nPeersToQuery]
+		}
+		peers = orderByLatency(peers, q.dht.peerstore.LatencyEWMA)
+	}
 	count := 0
 	for _, p := range peers {
 		peersToQuery = append(peersToQuery, p)
@@ -352,6 +368,35 @@ func (q *query) isReadyToTerminate(ctx context.Context, nPeersToQuery int) (bool
 	return false, -1, peersToQuery
 }
 
+// orderByLatency orders peers by increasing latency. The peers whose latency is
+// unknown, i.e. zero, are interleaved with the others, keeping their order.
+func orderByLatency(peers []peer.ID, latency func(peer.ID) time.Duration) []peer.ID {
+	var known, unknown []peer.ID
+	latencies := make(map[peer.ID]time.Duration, len(peers))
+	for _, p := range peers {
+		if l := latency(p); l > 0 {
+			latencies[p] = l
+			known = append(known, p)
+		} else {
+			unknown = append(unknown, p)
+		}
+	}
+	sort.SliceStable(known, func(i, j int) bool { return latencies[known[i]] < latencies[known[j]] })
+
+	ordered := make([]peer.ID, 0, len(peers))
+	for len(known) > 0 || len(unknown) > 0 {
+		if len(known) > 0 {
+			ordered = append(ordered, known[0])
+			known = known[1:]
+		}
+		if len(unknown) > 0 {
+			ordered = append(ordered, unknown[0])
+			unknown = unknown[1:]
+		}
+	}
+	return ordered
+}
+
 // From the set of all nodes that are not unreachable,
 // if the closest beta nodes are all queried, the lookup can terminate.
 func (q *query) isLookupTermination() bool {
@@ -383,6 +428,10 @@ func (q *query) terminate(ctx context.Context, cancel context.CancelFunc, reason
 			NewLookupTerminateEvent(reason),
 		),
 	)
+	if reason != LookupCancelled {
+		// give up on outstanding queries without resetting their streams
+		q.requests.cancel()
+	}
 	cancel() // abort outstanding queries
 	q.terminated = true
 }
@@ -6,8 +6,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/libp2p/go-libp2p-core/test"
 	tu "github.com/libp2p/go-libp2p-testing/etc"
 
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p-kad-dht/qpeerset"
 	"github.com/stretchr/testify/require"
 )
 
@@ -116,3 +122,110 @@ func checkRoutingTable(a, b *IpfsDHT) bool {
 	// under high load, this may not happen as immediately as we would like.
 	return a.routingTable.Find(b.self) != "" && b.routingTable.Find(a.self) != ""
 }
+
+func TestLatencyAwareQueryOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false, LatencyAwareRouting(true))
+	defer d.Close()
+
+	q := &query{
+		ctx:        ctx,
+		dht:        d,
+		queryPeers: qpeerset.NewQueryPeerset("key"),
+		stopFn:     func() bool { return false },
+	}
+	for i := 0; i < 6; i++ {
+		q.queryPeers.TryAdd(test.RandPeerIDFatal(t), d.self)
+	}
+	// The closer the peer, the slower, the second closest one was never heard
+	// from, and the two farthest ones are too far to be considered.
+	closest := q.queryPeers.GetClosestInStates(qpeerset.PeerHeard)
+	unknown := closest[1]
+	for i, p := range []peer.ID{closest[0], closest[2], closest[3]} {
+		d.peerstore.RecordLatency(p, time.Duration(3-i)*10*time.Millisecond)
+	}
+	d.peerstore.RecordLatency(closest[4], time.Millisecond)
+	d.peerstore.RecordLatency(closest[5], time.Millisecond)
+
+	_, _, peers := q.isReadyToTerminate(ctx, 2)
+	require.Equal(t, []peer.ID{closest[3], unknown}, peers)
+
+	// Without latency awareness the closest peers come first.
+	d.latencyAwareRouting = false
+	_, _, peers = q.isReadyToTerminate(ctx, 2)
+	require.Equal(t, closest[:2], peers)
+}
+
+func TestQueryTerminationGivesUpOnRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+
+	for _, tc := range []struct {
+		reason    LookupTerminationReason
+		cancelled bool
+	}{
+		{LookupStopped, true},
+		{LookupCompleted, true},
+		{LookupStarvation, true},
+		// A cancelled context resets the streams of the requests as usual.
+		{LookupCancelled, false},
+	} {
+		t.Run(fmt.Sprint(tc.reason), func(t *testing.T) {
+			q := &query{ctx: ctx, dht: d}
+			_, q.requests = withRequestSet(ctx)
+			q.terminate(ctx, func() {}, tc.reason)
+			require.Equal(t, tc.cancelled, q.requests.cancelled)
+		})
+	}
+}
+
+// warmingMessageSender is a fakeMessageSender that records the peers it is
+// asked to warm streams to.
+type warmingMessageSender struct {
+	fakeMessageSender
+	warmed chan []peer.ID
+}
+
+func (w *warmingMessageSender) WarmStreams(ctx context.Context, peers []peer.ID) map[peer.ID]error {
+	w.warmed <- peers
+	return nil
+}
+
+func TestQueryWarmsSeedStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fake := &warmingMessageSender{
+		fakeMessageSender: fakeMessageSender{
+			respond: func(p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+				return pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel()), nil
+			},
+		},
+		warmed: make(chan []peer.ID, 1),
+	}
+	d := setupDHT(ctx, t, false,
+		CustomMessageSender(func(h host.Host, protos []protocol.ID) pb.MessageSender { return fake }))
+	defer d.Close()
+
+	seeds := setupDHTS(t, ctx, 3)
+	for _, s := range seeds {
+		defer s.Close()
+		connect(t, ctx, d, s)
+	}
+
+	if _, err := d.GetClosestPeers(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case warmed := <-fake.warmed:
+		require.ElementsMatch(t, []peer.ID{seeds[0].self, seeds[1].self, seeds[2].self}, warmed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the query to warm the streams to its seed peers")
+	}
+}
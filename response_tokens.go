@@ -0,0 +1,94 @@
+package dht
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+
+	"github.com/libp2p/go-libp2p-kad-dht/metrics"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+const (
+	// responseTokenEpoch is how often response tokens change. A token stays
+	// valid until the end of the epoch following the one it was issued in.
+	responseTokenEpoch = 2 * time.Minute
+	// responseTokenSize is the size of response tokens, in bytes.
+	responseTokenSize = 16
+)
+
+// responseTokens issues and checks the tokens requesters have to echo to get
+// responses that could be used for amplification, see ResponseTokens.
+type responseTokens struct {
+	key   [32]byte
+	types map[pb.Message_MessageType]struct{}
+}
+
+func newResponseTokens(types map[pb.Message_MessageType]struct{}) (*responseTokens, error) {
+	t := &responseTokens{types: types}
+	if _, err := rand.Read(t.key[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// required reports whether requests of type typ need a token.
+func (t *responseTokens) required(typ pb.Message_MessageType) bool {
+	_, ok := t.types[typ]
+	return ok
+}
+
+// token returns the token of p during epoch, bound to the address its request
+// came from if known.
+func (t *responseTokens) token(ctx context.Context, p peer.ID, epoch int64) []byte {
+	mac := hmac.New(sha256.New, t.key[:])
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(epoch))
+	mac.Write(buf[:])
+	mac.Write([]byte(p))
+	if addr, ok := ObservedAddr(ctx); ok {
+		mac.Write(addr.Bytes())
+	}
+	return mac.Sum(nil)[:responseTokenSize]
+}
+
+// issue returns the token p has to echo.
+func (t *responseTokens) issue(ctx context.Context, p peer.ID, now time.Time) []byte {
+	return t.token(ctx, p, now.Unix()/int64(responseTokenEpoch/time.Second))
+}
+
+// valid reports whether tok is a token we issued to p and that didn't expire.
+func (t *responseTokens) valid(ctx context.Context, p peer.ID, tok []byte, now time.Time) bool {
+	if len(tok) != responseTokenSize {
+		return false
+	}
+	epoch := now.Unix() / int64(responseTokenEpoch/time.Second)
+	return hmac.Equal(tok, t.token(ctx, p, epoch)) || hmac.Equal(tok, t.token(ctx, p, epoch-1))
+}
+
+// withResponseToken wraps h so that it only handles requests carrying a valid
+// token. Other requests get a response carrying nothing but the token to echo.
+func (dht *IpfsDHT) withResponseToken(h dhtHandler) dhtHandler {
+	return func(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+		now := dht.clock.Now()
+		if dht.responseTokens.valid(ctx, p, pmes.GetToken(), now) {
+			return h(ctx, p, pmes)
+		}
+		stats.Record(ctx, metrics.TokenChallenges.M(1))
+		if c := dht.log.Check(zap.DebugLevel, "withholding response until token is echoed"); c != nil {
+			c.Write(zap.String("from", p.String()),
+				zap.Int32("type", int32(pmes.GetType())),
+				zap.Bool("invalid", len(pmes.GetToken()) > 0))
+		}
+		resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
+		resp.Token = dht.responseTokens.issue(ctx, p, now)
+		return resp, nil
+	}
+}
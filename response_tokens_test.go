@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-msgio"
+	"github.com/multiformats/go-multihash"
+
+	dhtcfg "github.com/libp2p/go-libp2p-kad-dht/internal/config"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/net"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+)
+
+func TestResponseTokens(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var cfg dhtcfg.Config
+	if err := cfg.Apply(ResponseTokens()); err == nil {
+		t.Fatal("expected response tokens without message types to be refused")
+	}
+
+	server := setupDHT(ctx, t, false, ResponseTokens(pb.Message_GET_PROVIDERS))
+	client := setupDHT(ctx, t, false)
+	defer server.Close()
+	defer client.Close()
+	connectNoSync(t, ctx, client, server)
+
+	key, err := multihash.Sum([]byte("key"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ProviderManager.AddProvider(ctx, key, client.self)
+
+	s, err := client.host.NewStream(ctx, server.self, server.protocols[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	send := func(token []byte) *pb.Message {
+		t.Helper()
+		req := pb.NewMessage(pb.Message_GET_PROVIDERS, key, 0)
+		req.Token = token
+		if err := net.WriteMsg(s, req); err != nil {
+			t.Fatal(err)
+		}
+		data, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp pb.Message
+		if err := resp.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		return &resp
+	}
+
+	// Without a valid token, only the challenge is returned.
+	challenge := send(nil)
+	if len(challenge.GetToken()) == 0 {
+		t.Fatal("expected a token in response to a request without one")
+	}
+	if len(challenge.GetProviderPeers()) != 0 || len(challenge.GetCloserPeers()) != 0 {
+		t.Fatalf("expected the response to be withheld, got %v", challenge)
+	}
+	forged := append([]byte(nil), challenge.GetToken()...)
+	forged[0]++
+	if resp := send(forged); len(resp.GetProviderPeers()) != 0 || !bytes.Equal(resp.GetToken(), challenge.GetToken()) {
+		t.Fatalf("expected a forged token to be challenged, got %v", resp)
+	}
+
+	// Echoing the token gets the full response.
+	resp := send(challenge.GetToken())
+	if len(resp.GetProviderPeers()) != 1 || string(resp.GetProviderPeers()[0].Id) != string(client.self) {
+		t.Fatalf("expected the provider to be returned, got %v", resp)
+	}
+
+	// Other message types aren't challenged, and the messenger echoes tokens on its own.
+	if _, err := client.protoMessenger.GetClosestPeers(ctx, server.self, client.self); err != nil {
+		t.Fatal(err)
+	}
+	provs, _, err := client.protoMessenger.GetProviders(ctx, server.self, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 1 || provs[0].ID != client.self {
+		t.Fatalf("expected the provider to be returned to the messenger, got %v", provs)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/peerstore"
 	"github.com/libp2p/go-libp2p-core/routing"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/ipfs/go-cid"
 	u "github.com/ipfs/go-ipfs-util"
 	"github.com/libp2p/go-libp2p-kad-dht/internal"
@@ -408,26 +410,11 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 		return nil
 	}
 
-	closerCtx := ctx
-	if deadline, ok := ctx.Deadline(); ok {
-		now := time.Now()
-		timeout := deadline.Sub(now)
-
-		if timeout < 0 {
-			// timed out
-			return context.DeadlineExceeded
-		} else if timeout < 10*time.Second {
-			// Reserve 10% for the final put.
-			deadline = deadline.Add(-timeout / 10)
-		} else {
-			// Otherwise, reserve a second (we'll already be
-			// connected so this should be fast).
-			deadline = deadline.Add(-time.Second)
-		}
-		var cancel context.CancelFunc
-		closerCtx, cancel = context.WithDeadline(ctx, deadline)
-		defer cancel()
+	closerCtx, cancel, err := provideLookupContext(ctx)
+	if err != nil {
+		return err
 	}
+	defer cancel()
 
 	var exceededDeadline bool
 	peers, err := dht.GetClosestPeers(closerCtx, string(keyMH))
@@ -464,6 +451,181 @@ func (dht *IpfsDHT) Provide(ctx context.Context, key cid.Cid, brdcst bool) (err
 	return ctx.Err()
 }
 
+// provideLookupContext returns the context to look up the peers to provide to
+// with, reserving part of ctx's deadline for sending the provider records.
+func provideLookupContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx, func() {}, nil
+	}
+
+	now := time.Now()
+	timeout := deadline.Sub(now)
+
+	if timeout < 0 {
+		// timed out
+		return nil, nil, context.DeadlineExceeded
+	} else if timeout < 10*time.Second {
+		// Reserve 10% for the final put.
+		deadline = deadline.Add(-timeout / 10)
+	} else {
+		// Otherwise, reserve a second (we'll already be
+		// connected so this should be fast).
+		deadline = deadline.Add(-time.Second)
+	}
+	closerCtx, cancel := context.WithDeadline(ctx, deadline)
+	return closerCtx, cancel, nil
+}
+
+// provideManyLookupConcurrency is the number of closest peer lookups ProvideMany runs at once.
+const provideManyLookupConcurrency = 8
+
+// ProvideKeyError is the reason a key given to ProvideMany couldn't be provided.
+type ProvideKeyError struct {
+	// Index is the position of the key in the keys given to ProvideMany. A key given several times is reported at
+	// its first position.
+	Index int
+	Key   cid.Cid
+	Err   error
+}
+
+func (e ProvideKeyError) Error() string {
+	if !e.Key.Defined() {
+		return fmt.Sprintf("key %d: %s", e.Index, e.Err)
+	}
+	return fmt.Sprintf("key %d (%s): %s", e.Index, e.Key, e.Err)
+}
+
+func (e ProvideKeyError) Unwrap() error {
+	return e.Err
+}
+
+// ProvideManyError is returned by ProvideMany when some of the keys couldn't be provided. It lists each of those keys
+// along with the reason, in the order they were given.
+type ProvideManyError []ProvideKeyError
+
+func (e ProvideManyError) Error() string {
+	var merr *multierror.Error
+	for _, ke := range e {
+		merr = multierror.Append(merr, ke)
+	}
+	return merr.Error()
+}
+
+// ProvideMany makes this node announce that it can provide all of the given keys.
+//
+// Unlike calling Provide for every key, the provider records are grouped by the peer they're sent to, and all the
+// records bound for a peer are sent at once, over a single stream. Keys given several times are only provided once.
+// A key is only reported as failed, in a ProvideManyError, if it's undefined, its closest peers couldn't be found or
+// none of them accepted the record.
+func (dht *IpfsDHT) ProvideMany(ctx context.Context, keys []cid.Cid) error {
+	if !dht.enableProviders {
+		return routing.ErrNotSupported
+	}
+
+	var lk sync.Mutex
+	var failed ProvideManyError
+	index := make(map[cid.Cid]int)
+	fail := func(c cid.Cid, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		failed = append(failed, ProvideKeyError{Index: index[c], Key: c, Err: err})
+	}
+
+	var valid []cid.Cid
+	for i, c := range keys {
+		if !c.Defined() {
+			failed = append(failed, ProvideKeyError{Index: i, Key: c, Err: fmt.Errorf("invalid cid: undefined")})
+			continue
+		}
+		if _, ok := index[c]; ok {
+			continue
+		}
+		index[c] = i
+		dht.ProviderManager.AddProvider(ctx, c.Hash(), dht.self)
+		valid = append(valid, c)
+	}
+
+	closerCtx, cancel, err := provideLookupContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	// Find the closest peers of every key and group the keys by peer.
+	keysByPeer := make(map[peer.ID][]cid.Cid)
+	targets := make(map[cid.Cid]int)
+	sem := make(chan struct{}, provideManyLookupConcurrency)
+	var wg sync.WaitGroup
+	for _, c := range valid {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c cid.Cid) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			peers, err := dht.GetClosestPeers(closerCtx, string(c.Hash()))
+			// Like Provide, go on with the peers we found if only the lookup deadline was exceeded.
+			if err != nil && (err != context.DeadlineExceeded || ctx.Err() != nil) {
+				fail(c, err)
+				return
+			}
+			if len(peers) == 0 {
+				fail(c, kb.ErrLookupFailure)
+				return
+			}
+
+			lk.Lock()
+			defer lk.Unlock()
+			for _, p := range peers {
+				keysByPeer[p] = append(keysByPeer[p], c)
+			}
+			targets[c] = len(peers)
+		}(c)
+	}
+	wg.Wait()
+
+	// Send every peer its records at once, over a single stream.
+	rejected := make(map[cid.Cid]int)
+	lastErr := make(map[cid.Cid]error)
+	for p, cs := range keysByPeer {
+		wg.Add(1)
+		go func(p peer.ID, cs []cid.Cid) {
+			defer wg.Done()
+			hashes := make([]multihash.Multihash, len(cs))
+			for i, c := range cs {
+				hashes[i] = c.Hash()
+			}
+			logger.Debugf("putProviders(%d keys, %s)", len(hashes), p)
+			err := dht.protoMessenger.PutProviders(ctx, p, hashes, dht.host)
+			if err == nil {
+				return
+			}
+			logger.Debug(err)
+
+			lk.Lock()
+			defer lk.Unlock()
+			for _, c := range cs {
+				rejected[c]++
+				lastErr[c] = err
+			}
+		}(p, cs)
+	}
+	wg.Wait()
+
+	for c, n := range rejected {
+		if n == targets[c] {
+			fail(c, lastErr[c])
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+		return failed
+	}
+	return ctx.Err()
+}
+
 // FindProviders searches until the context expires.
 func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]peer.AddrInfo, error) {
 	if !dht.enableProviders {
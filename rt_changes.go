@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// rtChange is a change in routing table membership.
+type rtChange struct {
+	added, removed []peer.ID
+}
+
+// rtChangeNotifier reports routing table membership changes to a callback.
+//
+// The routing table announces changes while holding its lock, so the callback
+// is invoked on a separate goroutine. Changes are queued and reported one at a
+// time in the order they happened, so that the callback can mirror the table.
+type rtChangeNotifier struct {
+	onChange func(added, removed []peer.ID)
+
+	mu      sync.Mutex
+	pending []rtChange
+	running bool
+}
+
+// newRTChangeNotifier returns a notifier reporting changes to onChange, or nil
+// if onChange is nil. A nil notifier ignores all changes.
+func newRTChangeNotifier(onChange func(added, removed []peer.ID)) *rtChangeNotifier {
+	if onChange == nil {
+		return nil
+	}
+	return &rtChangeNotifier{onChange: onChange}
+}
+
+func (n *rtChangeNotifier) peerAdded(p peer.ID) {
+	n.notify(rtChange{added: []peer.ID{p}})
+}
+
+func (n *rtChangeNotifier) peerRemoved(p peer.ID) {
+	n.notify(rtChange{removed: []peer.ID{p}})
+}
+
+func (n *rtChangeNotifier) notify(c rtChange) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, c)
+	if !n.running {
+		n.running = true
+		go n.deliver()
+	}
+}
+
+// deliver reports queued changes until there are none left.
+func (n *rtChangeNotifier) deliver() {
+	for {
+		n.mu.Lock()
+		if len(n.pending) == 0 {
+			n.running = false
+			n.mu.Unlock()
+			return
+		}
+		c := n.pending[0]
+		n.pending[0] = rtChange{}
+		n.pending = n.pending[1:]
+		n.mu.Unlock()
+
+		n.onChange(c.added, c.removed)
+	}
+}
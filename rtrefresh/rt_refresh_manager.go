@@ -9,6 +9,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 
+	"github.com/libp2p/go-libp2p-kad-dht/internal"
 	kbucket "github.com/libp2p/go-libp2p-kbucket"
 
 	"github.com/hashicorp/go-multierror"
@@ -47,6 +48,7 @@ type RtRefreshManager struct {
 	// also, a cpl wont be refreshed if the time since it was last refreshed
 	// is below the interval..unless a "forced" refresh is done.
 	refreshInterval                    time.Duration
+	refreshJitter                      float64 // fraction by which the refresh interval is randomly stretched or shrunk
 	successfulOutboundQueryGracePeriod time.Duration
 
 	triggerRefresh chan *triggerRefreshReq // channel to write refresh requests to.
@@ -60,10 +62,11 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 	refreshQueryTimeout time.Duration,
 	refreshInterval time.Duration,
 	successfulOutboundQueryGracePeriod time.Duration,
-	refreshDoneCh chan struct{}) (*RtRefreshManager, error) {
+	refreshDoneCh chan struct{},
+	opts ...Option) (*RtRefreshManager, error) {
 
 	ctx, cancel := context.WithCancel(context.Background())
-	return &RtRefreshManager{
+	r := &RtRefreshManager{
 		ctx:       ctx,
 		cancel:    cancel,
 		h:         h,
@@ -80,7 +83,30 @@ func NewRtRefreshManager(h host.Host, rt *kbucket.RoutingTable, autoRefresh bool
 
 		triggerRefresh: make(chan *triggerRefreshReq),
 		refreshDoneCh:  refreshDoneCh,
-	}, nil
+	}
+	for i, opt := range opts {
+		if err := opt(r); err != nil {
+			cancel()
+			return nil, fmt.Errorf("refresh manager option %d failed: %s", i, err)
+		}
+	}
+	return r, nil
+}
+
+// Option is a function that sets a refresh manager option.
+type Option func(*RtRefreshManager) error
+
+// RefreshJitter randomly stretches or shrinks every interval between two
+// periodic refreshes by up to the given fraction, in [0, 1).
+// Defaults to 0, i.e. no jitter.
+func RefreshJitter(fraction float64) Option {
+	return func(r *RtRefreshManager) error {
+		if fraction < 0 || fraction >= 1 {
+			return fmt.Errorf("refresh jitter must be in [0, 1), got %v", fraction)
+		}
+		r.refreshJitter = fraction
+		return nil
+	}
 }
 
 func (r *RtRefreshManager) Start() error {
@@ -126,15 +152,16 @@ func (r *RtRefreshManager) RefreshNoWait() {
 func (r *RtRefreshManager) loop() {
 	defer r.refcount.Done()
 
+	var refreshTimer *time.Timer
 	var refreshTickrCh <-chan time.Time
 	if r.enableAutoRefresh {
 		err := r.doRefresh(true)
 		if err != nil {
 			logger.Warn("failed when refreshing routing table", err)
 		}
-		t := time.NewTicker(r.refreshInterval)
-		defer t.Stop()
-		refreshTickrCh = t.C
+		refreshTimer = time.NewTimer(internal.Jitter(r.refreshInterval, r.refreshJitter))
+		defer refreshTimer.Stop()
+		refreshTickrCh = refreshTimer.C
 	}
 
 	for {
@@ -142,6 +169,7 @@ func (r *RtRefreshManager) loop() {
 		var forced bool
 		select {
 		case <-refreshTickrCh:
+			refreshTimer.Reset(internal.Jitter(r.refreshInterval, r.refreshJitter))
 		case triggerRefreshReq := <-r.triggerRefresh:
 			if triggerRefreshReq.respCh != nil {
 				waiting = append(waiting, triggerRefreshReq.respCh)
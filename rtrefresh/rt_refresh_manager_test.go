@@ -98,3 +98,13 @@ func TestSkipRefreshOnGapCpls(t *testing.T) {
 	}
 	require.Equal(t, 2, rt.NPeersForCpl(10))
 }
+
+func TestRefreshJitter(t *testing.T) {
+	r := &RtRefreshManager{}
+	require.NoError(t, RefreshJitter(0.5)(r))
+	require.Equal(t, 0.5, r.refreshJitter)
+
+	require.Error(t, RefreshJitter(-0.1)(r))
+	require.Error(t, RefreshJitter(1)(r))
+	require.Equal(t, 0.5, r.refreshJitter)
+}